@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	errorAliasTooDeep = errors.New("error: alias expansion too deep")
+)
+
+func aliasLookup(alias string) ([]string, error) { //查找一个别名指向的地址(别名不区分大小写, 国际化域名的U-label和A-label都算)
+	row, err := authDatabase.Query("SELECT target FROM "+config.Auth.Sqlite.AliasTableName+" WHERE alias=? OR alias=?", strings.ToLower(alias), strings.ToLower(addressToAscii(alias)))
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+	var targetList []string
+	for row.Next() {
+		var target string
+		if err = row.Scan(&target); err != nil {
+			return nil, err
+		}
+		targetList = append(targetList, target)
+	}
+	return targetList, nil
+}
+
+func stripSubaddress(address string) string { //去掉地址中的子地址(user+tag@domain -> user@domain), 没有就原样返回
+	index := strings.LastIndex(address, "@")
+	if index == -1 || config.Alias.SubaddressSeparators == "" {
+		return address
+	}
+	separatorIndex := strings.IndexAny(address[:index], config.Alias.SubaddressSeparators)
+	if separatorIndex <= 0 { //分隔符开头的不算子地址
+		return address
+	}
+	return address[:separatorIndex] + address[index:]
+}
+
+func aliasResolve(address string) ([]string, error) { //把一个本机地址展开成最终的收件人(本机邮箱或外部地址), 不存在就返回空
+	var resultList []string
+	added := make(map[string]bool)
+	err := aliasResolveAddress(address, nil, &resultList, added)
+	return resultList, err
+}
+
+func aliasResolveAddress(address string, pathList []string, resultList *[]string, added map[string]bool) error { //递归展开, pathList为展开到这里经过的地址(检测循环)
+	addResult := func(target string) {
+		if !added[strings.ToLower(target)] {
+			added[strings.ToLower(target)] = true
+			*resultList = append(*resultList, target)
+		}
+	}
+	if !isLocalDomain(getAddressDomain(address)) { //外部地址就是最终收件人
+		addResult(address)
+		return nil
+	}
+	for _, passed := range pathList {
+		if strings.EqualFold(passed, address) { //指回了自己(比如 alice -> alice, bob), 是真实邮箱就投递, 否则是循环
+			if smtpCheckAddressExists(address) {
+				addResult(address)
+			} else {
+				log.Println("Warning: alias loop " + strings.Join(append(pathList, address), " -> ") + ", skipped")
+			}
+			return nil
+		}
+	}
+	if len(pathList) >= config.Alias.MaxDepth {
+		return errorAliasTooDeep
+	}
+	pathList = append(pathList, address)
+	targetList, err := aliasLookup(address) //别名优先于同名的邮箱
+	if err != nil {
+		return err
+	}
+	if len(targetList) == 0 {
+		if _, aliasOf := domainLookup(getAddressDomain(address)); aliasOf != "" { //域名别名: user@example.org -> user@example.com
+			return aliasResolveAddress(address[:strings.LastIndex(address, "@")+1]+aliasOf, pathList, resultList, added)
+		}
+		if list, kind := listLookupAddress(address); list != nil { //邮件列表的地址交给listDeliver处理, 退信地址转给管理员
+			if kind != listAddressBounces {
+				addResult(address)
+				return nil
+			}
+			for _, moderator := range listGetModerators(list.address) {
+				if err = aliasResolveAddress(moderator, pathList, resultList, added); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if smtpCheckAddressExists(address) {
+			addResult(address)
+			return nil
+		}
+		if baseAddress := stripSubaddress(address); baseAddress != address { //user+tag@domain
+			return aliasResolveAddress(baseAddress, pathList, resultList, added)
+		}
+		targetList, err = aliasLookup("*@" + getAddressDomain(address)) //最后才用catch-all
+		if err != nil {
+			return err
+		}
+		if catchAll := getDomainConfig(getAddressDomain(address)).CatchAll; len(targetList) == 0 && catchAll != "" {
+			targetList = []string{catchAll}
+		}
+	}
+	for _, target := range targetList {
+		if err = aliasResolveAddress(target, pathList, resultList, added); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func aliasForward(filePath string, envelope smtpEnvelopeStruct, targetList []string) { //别名指向的外部地址, 复制一份转发出去(保留原来的发件人)
+	cachePath := generateCacheFilePath()
+	if _, err := copyFile(filePath, cachePath); err != nil {
+		log.Println("Error: alias forward error: " + err.Error())
+		os.Remove(cachePath)
+		return
+	}
+	log.Println("Info: alias forward mail to " + strings.Join(targetList, ", "))
+	smtpQueueMail(smtpEnvelopeStruct{fromMail: envelope.fromMail, toMail: targetList, smtpUtf8: envelope.smtpUtf8, dsnRet: envelope.dsnRet, dsnEnvId: envelope.dsnEnvId, arrivalTime: time.Now()}, cachePath)
+}
+
+func addAlias(alias string, target string) error { //添加一个别名(一个别名可以有多个目标)
+	alias = strings.ToLower(alias)
+	if !isLocalDomain(getAddressDomain(alias)) {
+		return errors.New("error: alias must be in a local domain")
+	}
+	if !strings.Contains(target, "@") {
+		return errors.New("error: invalid target address")
+	}
+	targetList, err := aliasLookup(alias)
+	if err != nil {
+		return err
+	}
+	for _, exists := range targetList {
+		if strings.EqualFold(exists, target) {
+			return errors.New("error: alias already exists")
+		}
+	}
+	_, err = authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.AliasTableName+"(alias, target) VALUES(?, ?)", alias, target)
+	return err
+}
+
+func delAlias(alias string, target string) (int64, error) { //删除别名的一个目标, target为空就删除整个别名, 返回删除的数量
+	var err error
+	var result sql.Result
+	if target == "" {
+		result, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.AliasTableName+" WHERE alias=?", strings.ToLower(alias))
+	} else {
+		result, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.AliasTableName+" WHERE alias=? AND target=?", strings.ToLower(alias), target)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAliasResolve(t *testing.T) {
+	testLoadConfig(t, `
+[alias]
+subaddress_separators = "+"
+max_depth = 3
+`)
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		testAddUser(t, username, username+"@example.com", "pw")
+	}
+	for _, alias := range [][2]string{
+		{"team@example.com", "alice@example.com"}, //一个别名指向多个地址
+		{"team@example.com", "bob@example.com"},
+		{"team@example.com", "friend@other.org"},
+		{"team@example.com", "staff@example.com"}, //展开后重复的目标只投递一次
+		{"staff@example.com", "alice@example.com"},
+		{"dave@example.com", "dave@example.com"}, //指回自己的真实邮箱
+		{"dave@example.com", "bob@example.com"},
+		{"loop-a@example.com", "loop-b@example.com"},
+		{"loop-b@example.com", "loop-a@example.com"},
+		{"deep1@example.com", "deep2@example.com"},
+		{"deep2@example.com", "deep3@example.com"},
+		{"deep3@example.com", "alice@example.com"},
+		{"bob+vip@example.com", "carol@example.com"}, //别名优先于去掉子地址
+		{"*@example.com", "carol@example.com"},
+	} {
+		if err := addAlias(alias[0], alias[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := addDomain("example.org", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := listCreate("news@example.com", listPolicyOpen, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := listAddMember("news@example.com", "bob@example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	testList := []struct {
+		address string
+		want    []string
+		err     error
+	}{
+		{"alice@example.com", []string{"alice@example.com"}, nil},
+		{"someone@other.org", []string{"someone@other.org"}, nil}, //外部地址原样返回
+		{"alice+tag@example.com", []string{"alice@example.com"}, nil},
+		{"alice+a+b@example.com", []string{"alice@example.com"}, nil},
+		{"bob+vip@example.com", []string{"carol@example.com"}, nil},
+		{"+tag@example.com", []string{"carol@example.com"}, nil}, //分隔符开头的不算子地址, 交给catch-all
+		{"unknown@example.com", []string{"carol@example.com"}, nil},
+		{"unknown+tag@example.com", []string{"carol@example.com"}, nil},
+		{"team@example.com", []string{"alice@example.com", "bob@example.com", "friend@other.org"}, nil},
+		{"dave@example.com", []string{"dave@example.com", "bob@example.com"}, nil},
+		{"loop-a@example.com", nil, nil},              //循环的地址跳过
+		{"deep1@example.com", nil, errorAliasTooDeep}, //deep1 -> deep2 -> deep3 -> alice 超过3层
+		{"deep2@example.com", []string{"alice@example.com"}, nil},
+		{"bob@example.org", []string{"bob@example.com"}, nil}, //域名别名
+		{"alice+tag@example.org", []string{"alice@example.com"}, nil},
+		{"news@example.com", []string{"news@example.com"}, nil},        //邮件列表交给listDeliver
+		{"news-bounces@example.com", []string{"bob@example.com"}, nil}, //列表的退信转给管理员
+	}
+	for _, test := range testList {
+		resultList, err := aliasResolve(test.address)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.address, err, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(resultList, test.want) {
+			t.Errorf("%s: got %q, want %q", test.address, resultList, test.want)
+		}
+	}
+
+	delAlias("*@example.com", "")
+	if resultList, err := aliasResolve("unknown@example.com"); err != nil || len(resultList) != 0 {
+		t.Errorf("without catch-all: got %q, %v", resultList, err)
+	}
+}
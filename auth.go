@@ -1,9 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
 	"encoding/hex"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func getPasswordHash(password string, salt string) string { //获取加盐后的密码sha256
@@ -11,7 +18,20 @@ func getPasswordHash(password string, salt string) string { //获取加盐后的
 	return hex.EncodeToString(hashBytes[:])
 }
 
-func clientAuth(username string, password string) bool { //验证客户端账号密码
+func generateSalt() string { //生成一个随机盐
+	randBytes := make([]byte, 16)
+	rand.Read(randBytes)
+	saltBytes := sha512.Sum512(append([]byte(strconv.FormatInt(time.Now().UnixNano(), 10)), randBytes...))
+	return base64.StdEncoding.EncodeToString(saltBytes[:])
+}
+
+func generateAppPassword() string { //随机生成一个应用专用密码
+	randBytes := make([]byte, 10)
+	rand.Read(randBytes)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(randBytes))
+}
+
+func clientAuth(username string, password string, service string) bool { //验证客户端账号密码(service为smtp, pop3或sieve)
 	row, err := authDatabase.Query("SELECT * FROM "+config.Auth.Sqlite.TableName+" WHERE username=?", username)
 	if err != nil {
 		log.Println("Error: auth database query failure: " + err.Error())
@@ -32,7 +52,42 @@ func clientAuth(username string, password string) bool { //验证客户端账号
 			return true
 		}
 	}
-	return false
+	return appPasswordAuth(username, password, service)
+}
+
+func appPasswordAuth(username string, password string, service string) bool { //验证应用专用密码
+	row, err := authDatabase.Query("SELECT name, password_sha256_with_salt_hex, salt FROM "+config.Auth.Sqlite.AppPasswordTableName+" WHERE username=? AND (service='' OR service=?)", username, service)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return false
+	}
+	var matched bool
+	var matchedName string
+	for row.Next() {
+		var name string
+		var passwordSha256WithSaltHex string
+		var salt string
+		err = row.Scan(&name, &passwordSha256WithSaltHex, &salt)
+		if err != nil {
+			log.Println("Error: auth database query failure: " + err.Error())
+			row.Close()
+			return false
+		}
+		if getPasswordHash(password, salt) == passwordSha256WithSaltHex {
+			matched = true
+			matchedName = name
+			break
+		}
+	}
+	row.Close() //先关闭查询再更新, 不然sqlite会锁住
+	if !matched {
+		return false
+	}
+	_, err = authDatabase.Exec("UPDATE "+config.Auth.Sqlite.AppPasswordTableName+" SET last_used=? WHERE username=? AND name=?", time.Now().Unix(), username, matchedName)
+	if err != nil {
+		log.Println("Error: auth database update failure: " + err.Error())
+	}
+	return true
 }
 
 func usernameGetAddress(username string) []string { //获取一个账号对应的邮箱列表
@@ -68,8 +123,8 @@ func smtpAddressClientAuth(username string, address string) bool { //验证一
 	return row.Next()
 }
 
-func smtpCheckAddressExists(address string) bool { //检查一个邮箱是否存在
-	row, err := authDatabase.Query("SELECT * FROM "+config.Auth.Sqlite.TableName+" WHERE mail_address=?", address)
+func smtpCheckAddressExists(address string) bool { //检查一个邮箱是否存在(国际化域名的U-label和A-label都算)
+	row, err := authDatabase.Query("SELECT * FROM "+config.Auth.Sqlite.TableName+" WHERE mail_address=? OR mail_address=?", address, addressToAscii(address))
 	if err != nil {
 		log.Println("Error: auth database query failure: " + err.Error())
 		return false
@@ -77,3 +132,17 @@ func smtpCheckAddressExists(address string) bool { //检查一个邮箱是否存
 	defer row.Close()
 	return row.Next()
 }
+
+func addressGetUsername(address string) string { //获取一个邮箱对应的账号, 不存在就返回空
+	row, err := authDatabase.Query("SELECT username FROM "+config.Auth.Sqlite.TableName+" WHERE mail_address=? OR mail_address=?", address, addressToAscii(address))
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return ""
+	}
+	defer row.Close()
+	var username string
+	if !row.Next() || row.Scan(&username) != nil {
+		return ""
+	}
+	return username
+}
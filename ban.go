@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type authFailureRecord struct { //一个ip或用户名的失败记录
+	count     int
+	firstTime time.Time
+}
+
+var (
+	authFailureMap   = make(map[string]*authFailureRecord) //key为 "ip:地址" 或 "user:用户名"
+	authFailureMutex sync.Mutex
+)
+
+func getRemoteIp(addr net.Addr) string { //从连接地址中取出ip
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func ipInNetworkList(ip string, networkList []*net.IPNet) bool { //检查ip是否在列表中
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return false
+	}
+	for _, network := range networkList {
+		if network.Contains(parsedIp) {
+			return true
+		}
+	}
+	return false
+}
+
+func recordAuthFailure(key string) int { //记录一次失败并返回窗口内的失败次数
+	authFailureMutex.Lock()
+	defer authFailureMutex.Unlock()
+	now := time.Now()
+	window := time.Second * time.Duration(config.Auth.BruteForce.FailureWindowS)
+	if len(authFailureMap) > 4096 { //顺手清理过期的记录
+		for k, v := range authFailureMap {
+			if now.Sub(v.firstTime) > window {
+				delete(authFailureMap, k)
+			}
+		}
+	}
+	record, ok := authFailureMap[key]
+	if !ok || now.Sub(record.firstTime) > window {
+		record = &authFailureRecord{count: 0, firstTime: now}
+		authFailureMap[key] = record
+	}
+	record.count++
+	return record.count
+}
+
+func clearAuthFailure(key string) { //登录成功就清除失败记录
+	authFailureMutex.Lock()
+	delete(authFailureMap, key)
+	authFailureMutex.Unlock()
+}
+
+func isBanned(kind string, target string) bool { //检查ip或用户名是否处于封禁中
+	row, err := authDatabase.Query("SELECT expire FROM "+config.Auth.Sqlite.BanTableName+" WHERE kind=? AND target=? AND expire>?", kind, target, time.Now().Unix())
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return false
+	}
+	defer row.Close()
+	return row.Next()
+}
+
+func addBan(kind string, target string, reason string) { //封禁一个ip或用户名
+	now := time.Now().Unix()
+	_, err := authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.BanTableName+" WHERE expire<=? OR (kind=? AND target=?)", now, kind, target)
+	if err != nil {
+		log.Println("Error: auth database update failure: " + err.Error())
+	}
+	_, err = authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.BanTableName+"(kind, target, expire, reason) VALUES(?, ?, ?, ?)", kind, target, now+int64(config.Auth.BruteForce.BanTimeS), reason)
+	if err != nil {
+		log.Println("Error: auth database update failure: " + err.Error())
+		return
+	}
+	log.Println("Warning: ban " + kind + " " + target + " for " + strconv.Itoa(config.Auth.BruteForce.BanTimeS) + "s: " + reason) //fail2ban可以用 "ban ip <HOST>" 匹配
+}
+
+func isIpBanned(ip string) bool { //连接时检查ip是否被封禁
+	if !config.Auth.BruteForce.Enable || ipInNetworkList(ip, bruteForceAllowlist) {
+		return false
+	}
+	return isBanned("ip", ip)
+}
+
+func authAttempt(ip string, username string, password string, service string) bool { //带防爆破的鉴权
+	if !config.Auth.BruteForce.Enable || ipInNetworkList(ip, bruteForceAllowlist) {
+		return clientAuth(username, password, service)
+	}
+	userLocked := isBanned("user", username)
+	if !userLocked && clientAuth(username, password, service) { //被锁定的用户就算密码对了也不放行
+		clearAuthFailure("ip:" + ip)
+		clearAuthFailure("user:" + username)
+		return true
+	}
+	log.Println("Warning: auth failure from " + ip + " user=" + username + " service=" + service) //fail2ban可以用 "auth failure from <HOST>" 匹配
+	ipFailures := recordAuthFailure("ip:" + ip)
+	userFailures := recordAuthFailure("user:" + username)
+	if ipFailures >= config.Auth.BruteForce.IpMaxFailures {
+		addBan("ip", ip, strconv.Itoa(ipFailures)+" auth failures")
+		clearAuthFailure("ip:" + ip)
+	}
+	if !userLocked && userFailures >= config.Auth.BruteForce.UserMaxFailures {
+		addBan("user", username, strconv.Itoa(userFailures)+" auth failures")
+		clearAuthFailure("user:" + username)
+	}
+	failures := ipFailures
+	if userFailures > failures {
+		failures = userFailures
+	}
+	delay := config.Auth.BruteForce.DelayStepMs * failures //渐进式延迟
+	if delay > config.Auth.BruteForce.MaxDelayMs {
+		delay = config.Auth.BruteForce.MaxDelayMs
+	}
+	time.Sleep(time.Millisecond * time.Duration(delay))
+	return false
+}
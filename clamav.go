@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const clamdChunkSize = 32768 //INSTREAM每块的大小
+
+func clamdDial(address string) (net.Conn, error) { //连接clamd, 支持 "unix:/path" 和 "host:port"
+	timeout := time.Millisecond * time.Duration(config.Smtp.Clamav.TimeoutMs)
+	if strings.HasPrefix(address, "unix:") {
+		return net.DialTimeout("unix", strings.TrimPrefix(address, "unix:"), timeout)
+	}
+	if strings.HasPrefix(address, "/") {
+		return net.DialTimeout("unix", address, timeout)
+	}
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func clamdScan(filePath string) (string, error) { //用INSTREAM命令扫描一个文件, 返回病毒名, 没有病毒就返回空
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	conn, err := clamdDial(config.Smtp.Clamav.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(config.Smtp.Clamav.TimeoutMs)))
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buffer := make([]byte, 4+clamdChunkSize) //每块前面是4字节的长度
+	for {
+		n, readErr := io.ReadFull(f, buffer[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buffer, uint32(n))
+			if _, err = conn.Write(buffer[:4+n]); err != nil {
+				break //超过大小限制时clamd会直接回复并关闭连接, 去读回复
+			}
+		}
+		if readErr != nil {
+			if readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+				return "", readErr
+			}
+			_, err = conn.Write([]byte{0, 0, 0, 0}) //长度为0的块表示结束
+			break
+		}
+	}
+	reply, readErr := bufio.NewReader(conn).ReadString(0)
+	if readErr != nil && (readErr != io.EOF || reply == "") {
+		if err != nil {
+			return "", err
+		}
+		return "", readErr
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+	reply = strings.TrimPrefix(reply, "stream: ")
+	if reply == "OK" {
+		return "", nil
+	}
+	if strings.HasSuffix(reply, " FOUND") {
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", errors.New("clamd error: " + reply)
+}
+
+func clamavCheck(filePath string, envelope smtpEnvelopeStruct) filterResultStruct { //扫描一封邮件, 干净的话加上X-Virus-Scanned头部
+	if !config.Smtp.Clamav.Enable {
+		return filterResultStruct{}
+	}
+	virus, scanErr := clamdScan(filePath)
+	if scanErr != nil {
+		log.Println("Error: clamav scan error: " + scanErr.Error())
+		if config.Smtp.Clamav.DefaultAction == "tempfail" {
+			return filterResultStruct{reply: "451 4.7.1 Virus scanner unavailable, please try again later\r\n"}
+		}
+	} else if virus != "" {
+		log.Println("Info: clamav found " + virus + " in mail from " + envelope.fromMail)
+		return filterResultStruct{reply: "554 5.7.1 Message rejected: virus found (" + virus + ")\r\n"}
+	}
+	err := rewriteMailHeader(filePath, func(headerList []string) []string {
+		var newHeaderList []string
+		if scanErr == nil { //fail-open时没有扫描过, 不能加这个头部
+			newHeaderList = append(newHeaderList, "X-Virus-Scanned: ClamAV at "+config.General.ServerAddress+"\r\n")
+		}
+		for _, header := range headerList { //去掉外面带进来的同名头部
+			if getHeaderName(header) != "x-virus-scanned" {
+				newHeaderList = append(newHeaderList, header)
+			}
+		}
+		return newHeaderList
+	})
+	if err != nil {
+		log.Println("Error: add X-Virus-Scanned header error: " + err.Error())
+	}
+	return filterResultStruct{}
+}
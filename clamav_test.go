@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestClamd(t *testing.T, reply func(data []byte) string) string { //假的clamd, 收完INSTREAM之后用reply决定回复, 返回监听地址
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if command, err := reader.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					return
+				}
+				var data []byte
+				for {
+					lengthBytes := make([]byte, 4)
+					if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+						return
+					}
+					length := binary.BigEndian.Uint32(lengthBytes)
+					if length == 0 {
+						break
+					}
+					chunk := make([]byte, length)
+					if _, err := io.ReadFull(reader, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				conn.Write([]byte(reply(data) + "\x00"))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func testClamdReply(data []byte) string {
+	switch {
+	case strings.Contains(string(data), "EICAR-TEST"):
+		return "stream: Eicar FOUND"
+	case strings.Contains(string(data), "too big"):
+		return "INSTREAM size limit exceeded. ERROR"
+	}
+	return "stream: OK"
+}
+
+func testClamavConfig(address string, defaultAction string) string {
+	return `
+[smtp.clamav]
+enable = true
+address = "` + address + `"
+timeout_ms = 2000
+default_action = "` + defaultAction + `"
+`
+}
+
+func TestClamavCheck(t *testing.T) {
+	address := newTestClamd(t, testClamdReply)
+	deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddress := deadListener.Addr().String()
+	deadListener.Close()
+	testList := []struct {
+		name          string
+		address       string
+		defaultAction string
+		body          string
+		wantReply     string
+		wantScanned   bool
+	}{
+		{"clean", address, "tempfail", "hello", "", true},
+		{"virus", address, "accept", "EICAR-TEST", "554 5.7.1 Message rejected: virus found (Eicar)\r\n", false},
+		{"error tempfail", address, "tempfail", "too big", "451 ", false},
+		{"error accept", address, "accept", "too big", "", false},
+		{"unreachable tempfail", deadAddress, "tempfail", "hello", "451 ", false},
+		{"unreachable accept", deadAddress, "accept", "hello", "", false},
+	}
+	for _, test := range testList {
+		testLoadConfig(t, testClamavConfig(test.address, test.defaultAction))
+		filePath := filepath.Join(t.TempDir(), "mail")
+		os.WriteFile(filePath, []byte("X-Virus-Scanned: forged\r\nx-virus-scanned: forged\r\n\tagain\r\nSubject: test\r\n\r\n"+test.body+"\r\n"), 0644) //外面带进来的头部要去掉
+		result := clamavCheck(filePath, smtpEnvelopeStruct{fromMail: "someone@other.net"})
+		if !strings.HasPrefix(result.reply, test.wantReply) || (test.wantReply == "") != (result.reply == "") {
+			t.Errorf("%s: reply = %q, want %q", test.name, result.reply, test.wantReply)
+		}
+		if result.reply != "" {
+			continue
+		}
+		data, _ := os.ReadFile(filePath)
+		if strings.Contains(string(data), "forged") || strings.Contains(string(data), "again") {
+			t.Errorf("%s: client X-Virus-Scanned header kept:\n%s", test.name, data)
+		}
+		if scanned := strings.HasPrefix(string(data), "X-Virus-Scanned: ClamAV at mail.example.com\r\n"); scanned != test.wantScanned {
+			t.Errorf("%s: X-Virus-Scanned added = %v, want %v", test.name, scanned, test.wantScanned)
+		}
+	}
+}
+
+func TestClamavSubmissionNotStored(t *testing.T) { //被拒绝的病毒邮件不能存成发件人副本
+	address := newTestClamd(t, testClamdReply)
+	testLoadConfig(t, testClamavConfig(address, "tempfail")+`
+[smtp.submission]
+save_sent_copy = true
+`)
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMixed})
+	client.command("EHLO client.test", "250")
+	client.command("AUTH LOGIN", "334")
+	client.command(base64.StdEncoding.EncodeToString([]byte("alice")), "334")
+	client.command(base64.StdEncoding.EncodeToString([]byte("pw")), "235")
+	client.command("MAIL FROM:<alice@example.com>", "250")
+	client.command("RCPT TO:<alice@example.com>", "250")
+	client.command("DATA", "354")
+	client.command("From: alice@example.com\r\nTo: alice@example.com\r\nSubject: virus\r\n\r\nEICAR-TEST\r\n.", "554")
+	client.command("QUIT", "221")
+	entryList, _ := os.ReadDir(getMailSubFolder("alice@example.com", config.Smtp.Submission.SentFolder))
+	if len(entryList) != 0 {
+		t.Errorf("infected mail stored in the Sent folder")
+	}
+	entryList, _ = os.ReadDir(config.General.CachePath)
+	if len(entryList) != 0 {
+		t.Errorf("infected mail left in the cache: %v", entryList)
+	}
+}
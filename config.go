@@ -3,13 +3,13 @@ package main
 import (
 	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
 	"database/sql"
-	"encoding/pem"
+	"errors"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	_ "github.com/go-sql-driver/mysql"
@@ -26,6 +26,7 @@ cache_path = "./cache"
 [smtp.inbound]
 enable_plain = true
 plain_enable_STARTTLS = false
+plain_require_tls_for_auth = false #refuse AUTH/USER/PASS on the plain listener until STARTTLS
 enable_tls = false
 plain_listen_address = "0.0.0.0"
 plain_listen_port = 25
@@ -36,17 +37,126 @@ STARTTLS_cert_path = ""
 tls_key_path = ""
 tls_cert_path = ""
 
+[smtp.submission] #when enabled, the plain inbound listener becomes MX only (no AUTH) and the tls inbound listener works as submission
+enable = false
+listen_address = "0.0.0.0"
+listen_port = 587
+enable_STARTTLS = true
+require_tls_for_auth = true
+save_sent_copy = false #save a copy of accepted submitted mail into the sender's own mailbox
+sent_folder = "Sent" #sub folder of the mailbox the sent copy goes to, not shown in pop3
+STARTTLS_key_path = ""
+STARTTLS_cert_path = ""
+
+[smtp.policy]
+trusted_networks = ["127.0.0.0/8", "::1/128"] #clients from these networks may relay without authentication (like postfix mynetworks)
+
+[smtp.greylist] #only applies to mail received from other servers
+enable = false
+delay_s = 300 #a first-seen (client /24, sender, recipient) triplet is accepted after retrying this long later
+retry_window_s = 86400 #the retry must arrive within this time
+expire_s = 3024000 #passed triplets and whitelisted senders are remembered this long
+auto_whitelist_count = 5 #whitelist a client /24 and sender domain after this many triplets passed (0 disables)
+exempt_networks = ["127.0.0.0/8", "::1/128"]
+exempt_addresses = [] #sender or recipient addresses ("user@example.org") or domains ("example.org") that skip greylisting
+
+[smtp.dnsbl] #only applies to unauthenticated clients outside trusted_networks
+enable = false
+resolver_address = "" #"ip:port" of the DNS server used for the lookups, empty uses the system resolver
+timeout_ms = 2000
+cache_s = 3600
+reject_score = 10 #reject when the summed weight of the listing zones reaches this (0 disables)
+[[smtp.dnsbl.zone]]
+zone = "zen.spamhaus.org"
+type = "ip" #"ip" checks the client address when it connects, "domain" checks the sender domain at MAIL FROM (RHSBL)
+weight = 10
+action = "reject" #"reject" refuses the client on any listing, "score" only adds the weight
+responses = {} #optional map from returned address to weight, e.g. {"127.0.0.2" = 10, "127.0.0.10" = 3}
+[[smtp.dnsbl.zone]]
+zone = "dbl.spamhaus.org"
+type = "domain"
+weight = 5
+action = "score"
+
+[smtp.milter] #sendmail milter protocol v6 content filters for received mail, called in order
+enable = false
+servers = [] #e.g. ["inet:11332@127.0.0.1", "unix:/run/opendkim/opendkim.sock"]
+timeout_ms = 10000
+default_action = "accept" #when a milter cannot be reached: "accept" (fail-open) or "tempfail"
+quarantine_path = "./quarantine" #quarantined mail is stored here instead of the mailbox
+
+[smtp.clamav] #virus scanning of received and submitted mail with clamd (INSTREAM)
+enable = false
+address = "127.0.0.1:3310" #or "unix:/run/clamav/clamd.ctl"
+timeout_ms = 30000
+default_action = "tempfail" #when clamd cannot be reached: "accept" (fail-open) or "tempfail"
+
+[smtp.pipe_filter] #external command called for received mail after the milters
+#the message is written to stdin, the envelope is in SENDER, RECIPIENTS (space separated), CLIENT_ADDRESS, CLIENT_HELO and QUEUE_ID
+#exit code: 0 accept (a non-empty stdout replaces the message), 75 tempfail (4xx), 99 discard, others reject (5xx)
+#the first line of stderr is used as the reply text when rejecting
+enable = false
+command = "" #e.g. "/usr/local/bin/mailfilter"
+args = []
+timeout_s = 60
+default_action = "tempfail" #when the command cannot be run or times out: "accept" (fail-open) or "tempfail"
+
+[smtp.timeout] #RFC 5321 4.5.3.2, a negative value means no limit
+idle_timeout_s = 300 #waiting for the next command
+command_timeout_s = 300 #waiting for a command inside a mail transaction, or for a reply from a remote server
+data_timeout_s = 180 #waiting for each line of DATA
+data_end_timeout_s = 600 #waiting for the remote server to accept the message after the final "."
+
 [smtp.outbound]
 remote_connect_retry_times = 5
 remote_connect_timeout_ms = 500
+deferred_retry_times = 5 #retry a temporarily failed delivery this many times before bouncing (0 bounces immediately). Deferred mail is kept in cache_path and resumed after a restart
+deferred_retry_interval_s = 600
 enable_DKIM = false
 dkim_private_key_pem_path = ""
 dkim_domain = ""
 dkim_selector = ""
 
+[spam] #bayesian spam classifier for received mail, trained with "spam train"
+enable = false
+per_user = true #use the recipient's own classifier when it is trained enough, otherwise the global one
+min_trained = 20 #a classifier needs at least this many ham and spam mails before it is used
+max_tokens = 150 #only the most significant tokens of a mail are used
+spam_threshold = 0.9 #X-Spam-Status is Yes at or above this score
+folder_threshold = 0.99 #mail at or above this score goes to the spam folder (0 disables)
+spam_folder = "Spam" #sub folder of the mailbox, not shown in pop3
+
+[sieve] #RFC 5228 filtering scripts run for each local recipient at delivery, managed with "sieve" commands
+enable = false
+max_script_size = 65536
+max_scripts = 10 #scripts a user may store
+max_redirects = 4 #redirect actions allowed in one run
+vacation_default_days = 7 #vacation replies to the same sender are sent at most once in this many days
+
+[alias] #managed with "addalias"/"delalias", an alias may point to several addresses and "*@domain" catches all unknown addresses of the domain
+subaddress_separators = "+" #user+tag@domain is delivered as user@domain, every character is a separator, empty disables
+max_depth = 8 #aliases pointing to aliases are followed this deep
+
+#[domain."example.org"] #settings of one hosted domain (general.mail_domain or one added with "adddomain"), domain aliases use the settings of their target
+#dkim_private_key_pem_path = "" #sign mail from this domain with its own key instead of the [smtp.outbound] one
+#dkim_selector = ""
+#quota_mb = 0 #storage limit of each mailbox in the domain, 0 means unlimited
+#catch_all = "" #gets mail for unknown addresses of the domain when there is no "*@domain" alias
+
+[managesieve] #RFC 5804 server for editing sieve scripts from mail clients, logins use the same accounts and app passwords
+enable = false
+listen_address = "0.0.0.0"
+listen_port = 4190
+enable_STARTTLS = false
+require_tls_for_auth = true #refuse AUTHENTICATE until STARTTLS
+STARTTLS_key_path = ""
+STARTTLS_cert_path = ""
+timeout_s = 1800 #idle timeout, a negative value means no limit
+
 [pop3]
 enable_plain = true
 plain_enable_STARTTLS = false
+plain_require_tls_for_auth = false #refuse AUTH/USER/PASS on the plain listener until STARTTLS
 enable_tls = false
 plain_listen_address = "0.0.0.0"
 plain_listen_port = 110
@@ -56,12 +166,24 @@ STARTTLS_key_path = ""
 STARTTLS_cert_path = ""
 tls_key_path = ""
 tls_cert_path = ""
+autologout_timeout_s = 600 #RFC 1939 autologout timer, a negative value means no limit
 
 [auth]
 auth_database_type = "sqlite" #"sqlite" or "mysql"
 [auth.sqlite]
 file_path = "./accounts.db" #will create automatically
 table_name = "accounts"
+app_password_table_name = "app_passwords"
+ban_table_name = "bans"
+greylist_table_name = "greylist"
+spam_token_table_name = "spam_tokens"
+sieve_table_name = "sieve_scripts"
+sieve_vacation_table_name = "sieve_vacation"
+alias_table_name = "aliases"
+domain_table_name = "domains"
+list_table_name = "mailing_lists"
+list_member_table_name = "mailing_list_members"
+list_pending_table_name = "mailing_list_pending"
 
 [auth.mysql]
 username = ""
@@ -70,22 +192,65 @@ address = ""
 port = 0
 database_name = "simpmailserv"
 table_name = "accounts" #will create automatically
+app_password_table_name = "app_passwords" #will create automatically
+ban_table_name = "bans" #will create automatically
+greylist_table_name = "greylist" #will create automatically
+spam_token_table_name = "spam_tokens" #will create automatically
+sieve_table_name = "sieve_scripts" #will create automatically
+sieve_vacation_table_name = "sieve_vacation" #will create automatically
+alias_table_name = "aliases" #will create automatically
+domain_table_name = "domains" #will create automatically
+list_table_name = "mailing_lists" #will create automatically
+list_member_table_name = "mailing_list_members" #will create automatically
+list_pending_table_name = "mailing_list_pending" #will create automatically
+
+[auth.brute_force]
+enable = true
+failure_window_s = 900 #failures older than this are forgotten
+delay_step_ms = 500 #each failure adds this delay before replying
+max_delay_ms = 5000
+ip_max_failures = 10 #ban the client ip after this many failures
+user_max_failures = 20 #lock the username after this many failures
+ban_time_s = 3600
+allowlist = ["127.0.0.1/8", "::1/128"] #ip or cidr that never gets delayed or banned
+
+[limit] #0 means unlimited
+max_connections = 500 #concurrent smtp and pop3 sessions in total
+max_connections_per_ip = 20 #concurrent sessions from one ip
+max_connection_rate_per_ip = 60 #new connections from one ip per minute
+allowlist = ["127.0.0.1/8", "::1/128"] #ip or cidr that is not limited per ip
+tarpit_invalid_rcpt_threshold = 5 #start delaying RCPT replies after this many invalid recipients in one session
+tarpit_delay_ms = 2000
 `
 
 var (
-	smtpStartTlsCert   tls.Certificate
-	smtpTlsCert        tls.Certificate
-	smtpDkimPrivateKey *rsa.PrivateKey
-	pop3StartTlsCert   tls.Certificate
-	pop3TlsCert        tls.Certificate
-	authDatabase       *sql.DB
+	smtpStartTlsCert           tls.Certificate
+	smtpTlsCert                tls.Certificate
+	smtpSubmissionStartTlsCert tls.Certificate
+	smtpDkimPrivateKey         *rsa.PrivateKey
+	managesieveStartTlsCert    tls.Certificate
+	pop3StartTlsCert           tls.Certificate
+	pop3TlsCert                tls.Certificate
+	authDatabase               *sql.DB
+	bruteForceAllowlist        []*net.IPNet
+	smtpTrustedNetworks        []*net.IPNet
+	limitAllowlist             []*net.IPNet
+	greylistExemptNetworks     []*net.IPNet
+	domainConfigMap            map[string]domainConfig    //A-label域名 -> 单独配置
+	domainDkimPrivateKeyMap    map[string]*rsa.PrivateKey //A-label域名 -> 单独的DKIM私钥
 )
 
 type configStruct struct {
-	General generalConfig `toml:"general"`
-	Smtp    smtpConfig    `toml:"smtp"`
-	Pop3    pop3Config    `toml:"pop3"`
-	Auth    authConfig    `toml:"auth"`
+	General     generalConfig           `toml:"general"`
+	Smtp        smtpConfig              `toml:"smtp"`
+	Spam        spamConfig              `toml:"spam"`
+	Sieve       sieveConfig             `toml:"sieve"`
+	Alias       aliasConfig             `toml:"alias"`
+	Domain      map[string]domainConfig `toml:"domain"`
+	ManageSieve managesieveConfig       `toml:"managesieve"`
+	Pop3        pop3Config              `toml:"pop3"`
+	Auth        authConfig              `toml:"auth"`
+	Limit       limitConfig             `toml:"limit"`
 }
 
 type generalConfig struct {
@@ -96,27 +261,152 @@ type generalConfig struct {
 }
 
 type smtpConfig struct {
-	Inbound  smtpInboundConfig  `toml:"inbound"`
-	Outbound smtpOutboundConfig `toml:"outbound"`
+	Inbound    smtpInboundConfig    `toml:"inbound"`
+	Submission smtpSubmissionConfig `toml:"submission"`
+	Policy     smtpPolicyConfig     `toml:"policy"`
+	Greylist   smtpGreylistConfig   `toml:"greylist"`
+	Dnsbl      smtpDnsblConfig      `toml:"dnsbl"`
+	Milter     smtpMilterConfig     `toml:"milter"`
+	Clamav     smtpClamavConfig     `toml:"clamav"`
+	PipeFilter smtpPipeFilterConfig `toml:"pipe_filter"`
+	Timeout    smtpTimeoutConfig    `toml:"timeout"`
+	Outbound   smtpOutboundConfig   `toml:"outbound"`
 }
 
 type smtpInboundConfig struct {
-	EnablePlain         bool   `toml:"enable_plain"`
-	PlainEnableStartTls bool   `toml:"plain_enable_STARTTLS"`
-	EnableTls           bool   `toml:"enable_tls"`
-	PlainListenAddress  string `toml:"plain_listen_address"`
-	PlainListenPort     int    `toml:"plain_listen_port"`
-	TlsListenAddress    string `toml:"tls_listen_address"`
-	TlsListenPort       int    `toml:"tls_listen_port"`
-	StartTlsKeyPath     string `toml:"STARTTLS_key_path"`
-	StartTlsCertPath    string `toml:"STARTTLS_cert_path"`
-	TlsKeyPath          string `toml:"tls_key_path"`
-	TlsCertPath         string `toml:"tls_cert_path"`
+	EnablePlain            bool   `toml:"enable_plain"`
+	PlainEnableStartTls    bool   `toml:"plain_enable_STARTTLS"`
+	PlainRequireTlsForAuth bool   `toml:"plain_require_tls_for_auth"`
+	EnableTls              bool   `toml:"enable_tls"`
+	PlainListenAddress     string `toml:"plain_listen_address"`
+	PlainListenPort        int    `toml:"plain_listen_port"`
+	TlsListenAddress       string `toml:"tls_listen_address"`
+	TlsListenPort          int    `toml:"tls_listen_port"`
+	StartTlsKeyPath        string `toml:"STARTTLS_key_path"`
+	StartTlsCertPath       string `toml:"STARTTLS_cert_path"`
+	TlsKeyPath             string `toml:"tls_key_path"`
+	TlsCertPath            string `toml:"tls_cert_path"`
+}
+
+type smtpSubmissionConfig struct {
+	Enable            bool   `toml:"enable"`
+	ListenAddress     string `toml:"listen_address"`
+	ListenPort        int    `toml:"listen_port"`
+	EnableStartTls    bool   `toml:"enable_STARTTLS"`
+	RequireTlsForAuth bool   `toml:"require_tls_for_auth"`
+	SaveSentCopy      bool   `toml:"save_sent_copy"`
+	SentFolder        string `toml:"sent_folder"`
+	StartTlsKeyPath   string `toml:"STARTTLS_key_path"`
+	StartTlsCertPath  string `toml:"STARTTLS_cert_path"`
+}
+
+type smtpPolicyConfig struct {
+	TrustedNetworks []string `toml:"trusted_networks"`
+}
+
+type smtpGreylistConfig struct {
+	Enable             bool     `toml:"enable"`
+	DelayS             int      `toml:"delay_s"`
+	RetryWindowS       int      `toml:"retry_window_s"`
+	ExpireS            int      `toml:"expire_s"`
+	AutoWhitelistCount int      `toml:"auto_whitelist_count"`
+	ExemptNetworks     []string `toml:"exempt_networks"`
+	ExemptAddresses    []string `toml:"exempt_addresses"`
+}
+
+type smtpDnsblConfig struct {
+	Enable          bool                  `toml:"enable"`
+	ResolverAddress string                `toml:"resolver_address"`
+	TimeoutMs       int                   `toml:"timeout_ms"`
+	CacheS          int                   `toml:"cache_s"`
+	RejectScore     int                   `toml:"reject_score"`
+	Zones           []smtpDnsblZoneConfig `toml:"zone"`
+}
+
+type smtpDnsblZoneConfig struct {
+	Zone      string         `toml:"zone"`
+	Type      string         `toml:"type"`
+	Weight    int            `toml:"weight"`
+	Action    string         `toml:"action"`
+	Responses map[string]int `toml:"responses"`
+}
+
+type smtpMilterConfig struct {
+	Enable         bool     `toml:"enable"`
+	Servers        []string `toml:"servers"`
+	TimeoutMs      int      `toml:"timeout_ms"`
+	DefaultAction  string   `toml:"default_action"`
+	QuarantinePath string   `toml:"quarantine_path"`
+}
+
+type spamConfig struct {
+	Enable          bool    `toml:"enable"`
+	PerUser         bool    `toml:"per_user"`
+	MinTrained      int     `toml:"min_trained"`
+	MaxTokens       int     `toml:"max_tokens"`
+	SpamThreshold   float64 `toml:"spam_threshold"`
+	FolderThreshold float64 `toml:"folder_threshold"`
+	SpamFolder      string  `toml:"spam_folder"`
+}
+
+type sieveConfig struct {
+	Enable              bool `toml:"enable"`
+	MaxScriptSize       int  `toml:"max_script_size"`
+	MaxScripts          int  `toml:"max_scripts"`
+	MaxRedirects        int  `toml:"max_redirects"`
+	VacationDefaultDays int  `toml:"vacation_default_days"`
+}
+
+type aliasConfig struct {
+	SubaddressSeparators string `toml:"subaddress_separators"`
+	MaxDepth             int    `toml:"max_depth"`
+}
+
+type domainConfig struct {
+	DkimPrivateKeyPemPath string `toml:"dkim_private_key_pem_path"`
+	DkimSelector          string `toml:"dkim_selector"`
+	QuotaMb               int    `toml:"quota_mb"`
+	CatchAll              string `toml:"catch_all"`
+}
+
+type managesieveConfig struct {
+	Enable            bool   `toml:"enable"`
+	ListenAddress     string `toml:"listen_address"`
+	ListenPort        int    `toml:"listen_port"`
+	EnableStartTls    bool   `toml:"enable_STARTTLS"`
+	RequireTlsForAuth bool   `toml:"require_tls_for_auth"`
+	StartTlsKeyPath   string `toml:"STARTTLS_key_path"`
+	StartTlsCertPath  string `toml:"STARTTLS_cert_path"`
+	TimeoutS          int    `toml:"timeout_s"`
+}
+
+type smtpClamavConfig struct {
+	Enable        bool   `toml:"enable"`
+	Address       string `toml:"address"`
+	TimeoutMs     int    `toml:"timeout_ms"`
+	DefaultAction string `toml:"default_action"`
+}
+
+type smtpPipeFilterConfig struct {
+	Enable        bool     `toml:"enable"`
+	Command       string   `toml:"command"`
+	Args          []string `toml:"args"`
+	TimeoutS      int      `toml:"timeout_s"`
+	DefaultAction string   `toml:"default_action"`
+}
+
+type smtpTimeoutConfig struct {
+	IdleTimeoutS    int `toml:"idle_timeout_s"`
+	CommandTimeoutS int `toml:"command_timeout_s"`
+	DataTimeoutS    int `toml:"data_timeout_s"`
+	DataEndTimeoutS int `toml:"data_end_timeout_s"`
 }
 
 type smtpOutboundConfig struct {
 	RemoteConnectRetryTimes int    `toml:"remote_connect_retry_times"`
 	RemoteConnectTimeoutMs  int    `toml:"remote_connect_timeout_ms"`
+	DeferredRetryTimes      int    `toml:"deferred_retry_times"`
+	DeferredRetryIntervalS  int    `toml:"deferred_retry_interval_s"`
 	EnableDkim              bool   `toml:"enable_DKIM"`
 	DkimPrivateKeyPemPath   string `toml:"dkim_private_key_pem_path"`
 	DkimDomain              string `toml:"dkim_domain"`
@@ -124,37 +414,105 @@ type smtpOutboundConfig struct {
 }
 
 type pop3Config struct {
-	EnablePlain         bool   `toml:"enable_plain"`
-	PlainEnableStartTls bool   `toml:"plain_enable_STARTTLS"`
-	EnableTls           bool   `toml:"enable_tls"`
-	PlainListenAddress  string `toml:"plain_listen_address"`
-	PlainListenPort     int    `toml:"plain_listen_port"`
-	TlsListenAddress    string `toml:"tls_listen_address"`
-	TlsListenPort       int    `toml:"tls_listen_port"`
-	StartTlsKeyPath     string `toml:"STARTTLS_key_path"`
-	StartTlsCertPath    string `toml:"STARTTLS_cert_path"`
-	TlsKeyPath          string `toml:"tls_key_path"`
-	TlsCertPath         string `toml:"tls_cert_path"`
+	EnablePlain            bool   `toml:"enable_plain"`
+	PlainEnableStartTls    bool   `toml:"plain_enable_STARTTLS"`
+	PlainRequireTlsForAuth bool   `toml:"plain_require_tls_for_auth"`
+	EnableTls              bool   `toml:"enable_tls"`
+	PlainListenAddress     string `toml:"plain_listen_address"`
+	PlainListenPort        int    `toml:"plain_listen_port"`
+	TlsListenAddress       string `toml:"tls_listen_address"`
+	TlsListenPort          int    `toml:"tls_listen_port"`
+	StartTlsKeyPath        string `toml:"STARTTLS_key_path"`
+	StartTlsCertPath       string `toml:"STARTTLS_cert_path"`
+	TlsKeyPath             string `toml:"tls_key_path"`
+	TlsCertPath            string `toml:"tls_cert_path"`
+	AutologoutTimeoutS     int    `toml:"autologout_timeout_s"`
 }
 
 type authConfig struct {
-	AuthDatabaseType string           `toml:"auth_database_type"`
-	Sqlite           authSqliteConfig `toml:"sqlite"`
-	Mysql            authMysqlConfig  `toml:"mysql"`
+	AuthDatabaseType string               `toml:"auth_database_type"`
+	Sqlite           authSqliteConfig     `toml:"sqlite"`
+	Mysql            authMysqlConfig      `toml:"mysql"`
+	BruteForce       authBruteForceConfig `toml:"brute_force"`
+}
+
+type limitConfig struct {
+	MaxConnections             int      `toml:"max_connections"`
+	MaxConnectionsPerIp        int      `toml:"max_connections_per_ip"`
+	MaxConnectionRatePerIp     int      `toml:"max_connection_rate_per_ip"`
+	Allowlist                  []string `toml:"allowlist"`
+	TarpitInvalidRcptThreshold int      `toml:"tarpit_invalid_rcpt_threshold"`
+	TarpitDelayMs              int      `toml:"tarpit_delay_ms"`
 }
 
 type authSqliteConfig struct {
-	FilePath  string `toml:"file_path"`
-	TableName string `toml:"table_name"`
+	FilePath               string `toml:"file_path"`
+	TableName              string `toml:"table_name"`
+	AppPasswordTableName   string `toml:"app_password_table_name"`
+	BanTableName           string `toml:"ban_table_name"`
+	GreylistTableName      string `toml:"greylist_table_name"`
+	SpamTokenTableName     string `toml:"spam_token_table_name"`
+	SieveTableName         string `toml:"sieve_table_name"`
+	SieveVacationTableName string `toml:"sieve_vacation_table_name"`
+	AliasTableName         string `toml:"alias_table_name"`
+	DomainTableName        string `toml:"domain_table_name"`
+	ListTableName          string `toml:"list_table_name"`
+	ListMemberTableName    string `toml:"list_member_table_name"`
+	ListPendingTableName   string `toml:"list_pending_table_name"`
 }
 
 type authMysqlConfig struct {
-	Username     string `toml:"username"`
-	Password     string `toml:"password"`
-	Address      string `toml:"address"`
-	Port         int    `toml:"port"`
-	DatabaseName string `toml:"database_name"`
-	TableName    string `toml:"table_name"`
+	Username               string `toml:"username"`
+	Password               string `toml:"password"`
+	Address                string `toml:"address"`
+	Port                   int    `toml:"port"`
+	DatabaseName           string `toml:"database_name"`
+	TableName              string `toml:"table_name"`
+	AppPasswordTableName   string `toml:"app_password_table_name"`
+	BanTableName           string `toml:"ban_table_name"`
+	GreylistTableName      string `toml:"greylist_table_name"`
+	SpamTokenTableName     string `toml:"spam_token_table_name"`
+	SieveTableName         string `toml:"sieve_table_name"`
+	SieveVacationTableName string `toml:"sieve_vacation_table_name"`
+	AliasTableName         string `toml:"alias_table_name"`
+	DomainTableName        string `toml:"domain_table_name"`
+	ListTableName          string `toml:"list_table_name"`
+	ListMemberTableName    string `toml:"list_member_table_name"`
+	ListPendingTableName   string `toml:"list_pending_table_name"`
+}
+
+type authBruteForceConfig struct {
+	Enable          bool     `toml:"enable"`
+	FailureWindowS  int      `toml:"failure_window_s"`
+	DelayStepMs     int      `toml:"delay_step_ms"`
+	MaxDelayMs      int      `toml:"max_delay_ms"`
+	IpMaxFailures   int      `toml:"ip_max_failures"`
+	UserMaxFailures int      `toml:"user_max_failures"`
+	BanTimeS        int      `toml:"ban_time_s"`
+	Allowlist       []string `toml:"allowlist"`
+}
+
+func parseNetworkList(list []string) ([]*net.IPNet, error) { //解析ip/cidr列表
+	var networkList []*net.IPNet
+	for _, item := range list {
+		if !strings.Contains(item, "/") { //单个ip就当作/32或/128
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("invalid ip: " + item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networkList = append(networkList, network)
+	}
+	return networkList, nil
 }
 
 func checkAddressValidity(addr string) error { //检查一个监听是否有效
@@ -197,6 +555,7 @@ func verifyConfig() { //验证/预加载配置
 	if _, err = os.Stat(config.General.MailStoragePath); os.IsNotExist(err) { //创建邮件存储目录
 		os.MkdirAll(config.General.MailStoragePath, 0644)
 	}
+	migrateMailFolders() //旧版本的邮箱文件夹名字要改过来
 	if config.General.CachePath == "" {
 		log.Fatal("Error: config general.cache_path is required")
 	}
@@ -217,6 +576,9 @@ func verifyConfig() { //验证/预加载配置
 				config.Smtp.Inbound.PlainEnableStartTls = false
 			}
 		}
+		if config.Smtp.Inbound.PlainRequireTlsForAuth && !config.Smtp.Inbound.PlainEnableStartTls {
+			log.Println("Warning: smtp plain requires TLS for auth but STARTTLS is not enabled. AUTH will be impossible on it")
+		}
 	}
 	if config.Smtp.Inbound.EnableTls { //加载/验证TLS证书
 		smtpTlsCert, err = tls.LoadX509KeyPair(config.Smtp.Inbound.TlsCertPath, config.Smtp.Inbound.TlsKeyPath)
@@ -232,10 +594,35 @@ func verifyConfig() { //验证/预加载配置
 			config.Smtp.Inbound.EnableTls = false
 		}
 	}
-	if !(config.Smtp.Inbound.EnablePlain || config.Smtp.Inbound.EnableTls) {
+	if config.Smtp.Submission.SentFolder == "" { //混用端口鉴权后提交的邮件也会存副本
+		config.Smtp.Submission.SentFolder = "Sent"
+	}
+	if config.Smtp.Submission.Enable { //验证提交端口可用性
+		err = checkAddressValidity(config.Smtp.Submission.ListenAddress + ":" + strconv.Itoa(config.Smtp.Submission.ListenPort))
+		if err != nil {
+			log.Println("Warning: smtp submission address error. It will not start up: " + err.Error())
+			config.Smtp.Submission.Enable = false
+		}
+		if config.Smtp.Submission.EnableStartTls { //加载/验证STARTTLS证书
+			smtpSubmissionStartTlsCert, err = tls.LoadX509KeyPair(config.Smtp.Submission.StartTlsCertPath, config.Smtp.Submission.StartTlsKeyPath)
+			if err != nil {
+				log.Println("Warning: smtp submission STARTTLS enable failure: " + err.Error())
+				config.Smtp.Submission.EnableStartTls = false
+			}
+		}
+		if config.Smtp.Submission.RequireTlsForAuth && !config.Smtp.Submission.EnableStartTls {
+			log.Println("Warning: smtp submission requires TLS for auth but STARTTLS is not enabled. AUTH will be impossible on it")
+		}
+	}
+	if !(config.Smtp.Inbound.EnablePlain || config.Smtp.Inbound.EnableTls || config.Smtp.Submission.Enable) {
 		log.Println("Warning: smtp server will not start up")
 	}
 
+	smtpTrustedNetworks, err = parseNetworkList(config.Smtp.Policy.TrustedNetworks)
+	if err != nil {
+		log.Fatal("Error: config smtp.policy.trusted_networks error: " + err.Error())
+	}
+
 	if config.Smtp.Outbound.RemoteConnectRetryTimes == 0 {
 		log.Println("Warning: smtp.outbound.remoteConnectRetryTimes is 0. Use default 5")
 		config.Smtp.Outbound.RemoteConnectRetryTimes = 5
@@ -244,25 +631,170 @@ func verifyConfig() { //验证/预加载配置
 		log.Println("Warning: smtp.outbound.remoteConnectTimeoutMs is 0. Use default 500")
 		config.Smtp.Outbound.RemoteConnectRetryTimes = 500
 	}
-	if config.Smtp.Outbound.EnableDkim { //验证/加载DKIM私钥
-		dkimPrivateKeyPem, err := os.ReadFile(config.Smtp.Outbound.DkimPrivateKeyPemPath)
-		if err == nil {
-			dkimPrivateKeyData, _ := pem.Decode(dkimPrivateKeyPem)
-			if key, err := x509.ParsePKCS1PrivateKey(dkimPrivateKeyData.Bytes); err == nil {
-				smtpDkimPrivateKey = key
-			} else {
-				if key, err := x509.ParsePKCS8PrivateKey(dkimPrivateKeyData.Bytes); err == nil {
-					smtpDkimPrivateKey = key.(*rsa.PrivateKey)
-				} else {
-					log.Println("Warning: smtp DKIM enable failure: " + err.Error())
-					config.Smtp.Outbound.EnableDkim = false
-				}
+	if config.Smtp.Timeout.IdleTimeoutS == 0 {
+		log.Println("Warning: smtp.timeout.idleTimeoutS is 0. Use default 300")
+		config.Smtp.Timeout.IdleTimeoutS = 300
+	}
+	if config.Smtp.Timeout.CommandTimeoutS == 0 {
+		log.Println("Warning: smtp.timeout.commandTimeoutS is 0. Use default 300")
+		config.Smtp.Timeout.CommandTimeoutS = 300
+	}
+	if config.Smtp.Timeout.DataTimeoutS == 0 {
+		log.Println("Warning: smtp.timeout.dataTimeoutS is 0. Use default 180")
+		config.Smtp.Timeout.DataTimeoutS = 180
+	}
+	if config.Smtp.Timeout.DataEndTimeoutS == 0 {
+		log.Println("Warning: smtp.timeout.dataEndTimeoutS is 0. Use default 600")
+		config.Smtp.Timeout.DataEndTimeoutS = 600
+	}
+	if config.Pop3.AutologoutTimeoutS == 0 {
+		log.Println("Warning: pop3.autologoutTimeoutS is 0. Use default 600")
+		config.Pop3.AutologoutTimeoutS = 600
+	}
+	if config.Smtp.Greylist.Enable { //灰名单的默认值
+		if config.Smtp.Greylist.DelayS == 0 {
+			config.Smtp.Greylist.DelayS = 300
+		}
+		if config.Smtp.Greylist.RetryWindowS == 0 {
+			config.Smtp.Greylist.RetryWindowS = 86400
+		}
+		if config.Smtp.Greylist.ExpireS == 0 {
+			config.Smtp.Greylist.ExpireS = 3024000
+		}
+		greylistExemptNetworks, err = parseNetworkList(config.Smtp.Greylist.ExemptNetworks)
+		if err != nil {
+			log.Fatal("Error: config smtp.greylist.exempt_networks error: " + err.Error())
+		}
+	}
+	if config.Smtp.Dnsbl.Enable { //DNSBL的默认值
+		if config.Smtp.Dnsbl.TimeoutMs == 0 {
+			config.Smtp.Dnsbl.TimeoutMs = 2000
+		}
+		if config.Smtp.Dnsbl.CacheS == 0 {
+			config.Smtp.Dnsbl.CacheS = 3600
+		}
+		for i := range config.Smtp.Dnsbl.Zones {
+			zone := &config.Smtp.Dnsbl.Zones[i]
+			zone.Zone = strings.Trim(zone.Zone, ".")
+			if zone.Type != "ip" && zone.Type != "domain" {
+				log.Fatal("Error: config smtp.dnsbl.zone " + zone.Zone + " type must be \"ip\" or \"domain\"")
 			}
-		} else {
+			if zone.Action == "" {
+				zone.Action = "score"
+			}
+			if zone.Action != "reject" && zone.Action != "score" {
+				log.Fatal("Error: config smtp.dnsbl.zone " + zone.Zone + " action must be \"reject\" or \"score\"")
+			}
+			if zone.Weight == 0 {
+				zone.Weight = 1
+			}
+		}
+		dnsblResolverInstance = newDnsblResolver(config.Smtp.Dnsbl.ResolverAddress)
+	}
+	if config.Smtp.Milter.Enable { //milter的默认值
+		if config.Smtp.Milter.TimeoutMs == 0 {
+			config.Smtp.Milter.TimeoutMs = 10000
+		}
+		if config.Smtp.Milter.DefaultAction == "" {
+			config.Smtp.Milter.DefaultAction = "accept"
+		}
+		if config.Smtp.Milter.DefaultAction != "accept" && config.Smtp.Milter.DefaultAction != "tempfail" {
+			log.Fatal("Error: config smtp.milter.default_action must be \"accept\" or \"tempfail\"")
+		}
+		if config.Smtp.Milter.QuarantinePath == "" {
+			config.Smtp.Milter.QuarantinePath = "./quarantine"
+		}
+	}
+	if config.Spam.Enable { //垃圾邮件分类器的默认值
+		if config.Spam.MinTrained <= 0 {
+			config.Spam.MinTrained = 20
+		}
+		if config.Spam.MaxTokens <= 0 {
+			config.Spam.MaxTokens = 150
+		}
+		if config.Spam.SpamThreshold <= 0 {
+			config.Spam.SpamThreshold = 0.9
+		}
+		if config.Spam.SpamFolder == "" {
+			config.Spam.SpamFolder = "Spam"
+		}
+	}
+	if config.Sieve.MaxScriptSize <= 0 { //sieve的默认值(命令行管理脚本时也要用到)
+		config.Sieve.MaxScriptSize = 65536
+	}
+	if config.Sieve.MaxScripts <= 0 {
+		config.Sieve.MaxScripts = 10
+	}
+	if config.Sieve.MaxRedirects <= 0 {
+		config.Sieve.MaxRedirects = 4
+	}
+	if config.Sieve.VacationDefaultDays <= 0 {
+		config.Sieve.VacationDefaultDays = 7
+	}
+	if config.Alias.MaxDepth <= 0 { //别名的默认值
+		config.Alias.MaxDepth = 8
+	}
+	if config.Smtp.Clamav.Enable { //病毒扫描的默认值
+		if config.Smtp.Clamav.Address == "" {
+			config.Smtp.Clamav.Address = "127.0.0.1:3310"
+		}
+		if config.Smtp.Clamav.TimeoutMs <= 0 {
+			config.Smtp.Clamav.TimeoutMs = 30000
+		}
+		if config.Smtp.Clamav.DefaultAction == "" {
+			config.Smtp.Clamav.DefaultAction = "tempfail"
+		}
+		if config.Smtp.Clamav.DefaultAction != "accept" && config.Smtp.Clamav.DefaultAction != "tempfail" {
+			log.Fatal("Error: config smtp.clamav.default_action must be \"accept\" or \"tempfail\"")
+		}
+	}
+	if config.Smtp.PipeFilter.Enable { //过滤命令的默认值
+		if config.Smtp.PipeFilter.Command == "" {
+			log.Fatal("Error: config smtp.pipe_filter.command is empty")
+		}
+		if config.Smtp.PipeFilter.TimeoutS <= 0 {
+			config.Smtp.PipeFilter.TimeoutS = 60
+		}
+		if config.Smtp.PipeFilter.DefaultAction == "" {
+			config.Smtp.PipeFilter.DefaultAction = "tempfail"
+		}
+		if config.Smtp.PipeFilter.DefaultAction != "accept" && config.Smtp.PipeFilter.DefaultAction != "tempfail" {
+			log.Fatal("Error: config smtp.pipe_filter.default_action must be \"accept\" or \"tempfail\"")
+		}
+	}
+	if config.Smtp.Outbound.DeferredRetryTimes > 0 && config.Smtp.Outbound.DeferredRetryIntervalS <= 0 {
+		log.Println("Warning: smtp.outbound.deferredRetryIntervalS is 0. Use default 600")
+		config.Smtp.Outbound.DeferredRetryIntervalS = 600
+	}
+	if config.Smtp.Outbound.EnableDkim { //验证/加载DKIM私钥
+		smtpDkimPrivateKey, err = loadDkimPrivateKey(config.Smtp.Outbound.DkimPrivateKeyPemPath)
+		if err != nil {
 			log.Println("Warning: smtp DKIM enable failure: " + err.Error())
 			config.Smtp.Outbound.EnableDkim = false
 		}
 	}
+	domainConfigMap = make(map[string]domainConfig)
+	domainDkimPrivateKeyMap = make(map[string]*rsa.PrivateKey)
+	for domain, domainSetting := range config.Domain { //每个域名的单独配置(按A-label保存)
+		asciiDomain, err := domainToAscii(domain)
+		if err != nil {
+			log.Fatal("Error: config domain \"" + domain + "\" error: " + err.Error())
+		}
+		domainConfigMap[asciiDomain] = domainSetting
+		if domainSetting.DkimPrivateKeyPemPath == "" {
+			continue
+		}
+		if domainSetting.DkimSelector == "" {
+			log.Println("Warning: domain " + domain + " DKIM enable failure: dkim_selector is required")
+			continue
+		}
+		key, err := loadDkimPrivateKey(domainSetting.DkimPrivateKeyPemPath)
+		if err != nil {
+			log.Println("Warning: domain " + domain + " DKIM enable failure: " + err.Error())
+			continue
+		}
+		domainDkimPrivateKeyMap[asciiDomain] = key
+	}
 
 	if config.Pop3.EnablePlain { //验证明文可用性
 		err = checkAddressValidity(config.Pop3.PlainListenAddress + ":" + strconv.Itoa(config.Pop3.PlainListenPort))
@@ -277,6 +809,9 @@ func verifyConfig() { //验证/预加载配置
 				config.Pop3.PlainEnableStartTls = false
 			}
 		}
+		if config.Pop3.PlainRequireTlsForAuth && !config.Pop3.PlainEnableStartTls {
+			log.Println("Warning: pop3 plain requires TLS for auth but STARTTLS is not enabled. Login will be impossible on it")
+		}
 	}
 	if config.Pop3.EnableTls { //加载/验证TLS证书
 		pop3TlsCert, err = tls.LoadX509KeyPair(config.Pop3.TlsCertPath, config.Pop3.TlsKeyPath)
@@ -296,6 +831,59 @@ func verifyConfig() { //验证/预加载配置
 		log.Println("Warning: pop3 server will not start up")
 	}
 
+	if config.ManageSieve.Enable { //验证managesieve可用性
+		err = checkAddressValidity(config.ManageSieve.ListenAddress + ":" + strconv.Itoa(config.ManageSieve.ListenPort))
+		if err != nil {
+			log.Println("Warning: managesieve address error. It will not start up: " + err.Error())
+			config.ManageSieve.Enable = false
+		}
+		if config.ManageSieve.EnableStartTls { //加载/验证STARTTLS证书
+			managesieveStartTlsCert, err = tls.LoadX509KeyPair(config.ManageSieve.StartTlsCertPath, config.ManageSieve.StartTlsKeyPath)
+			if err != nil {
+				log.Println("Warning: managesieve STARTTLS enable failure: " + err.Error())
+				config.ManageSieve.EnableStartTls = false
+			}
+		}
+		if config.ManageSieve.RequireTlsForAuth && !config.ManageSieve.EnableStartTls {
+			log.Println("Warning: managesieve requires TLS for auth but STARTTLS is not enabled. Login will be impossible on it")
+		}
+		if config.ManageSieve.TimeoutS == 0 {
+			config.ManageSieve.TimeoutS = 1800
+		}
+		if !config.Sieve.Enable {
+			log.Println("Warning: managesieve is enabled but sieve is not. Scripts can be edited but will not run")
+		}
+	}
+
+	if config.Auth.BruteForce.Enable { //防爆破的默认值
+		if config.Auth.BruteForce.FailureWindowS == 0 {
+			config.Auth.BruteForce.FailureWindowS = 900
+		}
+		if config.Auth.BruteForce.IpMaxFailures == 0 {
+			config.Auth.BruteForce.IpMaxFailures = 10
+		}
+		if config.Auth.BruteForce.UserMaxFailures == 0 {
+			config.Auth.BruteForce.UserMaxFailures = 20
+		}
+		if config.Auth.BruteForce.DelayStepMs == 0 {
+			config.Auth.BruteForce.DelayStepMs = 500
+		}
+		if config.Auth.BruteForce.MaxDelayMs == 0 {
+			config.Auth.BruteForce.MaxDelayMs = 5000
+		}
+		if config.Auth.BruteForce.BanTimeS == 0 {
+			config.Auth.BruteForce.BanTimeS = 3600
+		}
+		bruteForceAllowlist, err = parseNetworkList(config.Auth.BruteForce.Allowlist)
+		if err != nil {
+			log.Fatal("Error: config auth.brute_force.allowlist error: " + err.Error())
+		}
+	}
+	limitAllowlist, err = parseNetworkList(config.Limit.Allowlist)
+	if err != nil {
+		log.Fatal("Error: config limit.allowlist error: " + err.Error())
+	}
+
 	if config.Auth.AuthDatabaseType == "sqlite" { //检测鉴权数据库类型
 		authDatabase, err = sql.Open("sqlite3", config.Auth.Sqlite.FilePath) //加载sqlite
 		if err != nil {
@@ -317,4 +905,85 @@ func verifyConfig() { //验证/预加载配置
 	if err != nil {
 		log.Fatal("Error: auth database create failure: " + err.Error())
 	}
+	if config.Auth.Sqlite.AppPasswordTableName == "" {
+		config.Auth.Sqlite.AppPasswordTableName = "app_passwords"
+	}
+	if config.Auth.Sqlite.BanTableName == "" {
+		config.Auth.Sqlite.BanTableName = "bans"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.BanTableName + "(kind TEXT NOT NULL, target TEXT NOT NULL, expire INTEGER NOT NULL, reason TEXT NOT NULL)") //创建封禁表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.GreylistTableName == "" {
+		config.Auth.Sqlite.GreylistTableName = "greylist"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.GreylistTableName + "(kind TEXT NOT NULL, client TEXT NOT NULL, sender TEXT NOT NULL, recipient TEXT NOT NULL, first_seen INTEGER NOT NULL, last_seen INTEGER NOT NULL, pass_count INTEGER NOT NULL)") //创建灰名单表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.SpamTokenTableName == "" {
+		config.Auth.Sqlite.SpamTokenTableName = "spam_tokens"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.SpamTokenTableName + "(owner TEXT NOT NULL, token TEXT NOT NULL, spam_count INTEGER NOT NULL, ham_count INTEGER NOT NULL)") //创建垃圾邮件分类器的token表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	_, err = authDatabase.Exec("CREATE INDEX IF NOT EXISTS " + config.Auth.Sqlite.SpamTokenTableName + "_owner_token ON " + config.Auth.Sqlite.SpamTokenTableName + "(owner, token)")
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.SieveTableName == "" {
+		config.Auth.Sqlite.SieveTableName = "sieve_scripts"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.SieveTableName + "(username TEXT NOT NULL, name TEXT NOT NULL, script TEXT NOT NULL, active INTEGER NOT NULL)") //创建sieve脚本表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.SieveVacationTableName == "" {
+		config.Auth.Sqlite.SieveVacationTableName = "sieve_vacation"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.SieveVacationTableName + "(username TEXT NOT NULL, handle TEXT NOT NULL, sender TEXT NOT NULL, expire INTEGER NOT NULL)") //创建vacation回复记录表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.AliasTableName == "" {
+		config.Auth.Sqlite.AliasTableName = "aliases"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.AliasTableName + "(alias TEXT NOT NULL, target TEXT NOT NULL)") //创建别名表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.DomainTableName == "" {
+		config.Auth.Sqlite.DomainTableName = "domains"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.DomainTableName + "(domain TEXT NOT NULL, alias_of TEXT NOT NULL)") //创建托管域名表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.ListTableName == "" {
+		config.Auth.Sqlite.ListTableName = "mailing_lists"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.ListTableName + "(address TEXT NOT NULL, policy TEXT NOT NULL, subject_tag TEXT NOT NULL)") //创建邮件列表表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.ListMemberTableName == "" {
+		config.Auth.Sqlite.ListMemberTableName = "mailing_list_members"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.ListMemberTableName + "(list TEXT NOT NULL, member TEXT NOT NULL, moderator INTEGER NOT NULL)") //创建邮件列表成员表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	if config.Auth.Sqlite.ListPendingTableName == "" {
+		config.Auth.Sqlite.ListPendingTableName = "mailing_list_pending"
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.ListPendingTableName + "(token TEXT NOT NULL, list TEXT NOT NULL, kind TEXT NOT NULL, address TEXT NOT NULL, file_path TEXT NOT NULL, smtputf8 INTEGER NOT NULL, expire INTEGER NOT NULL)") //创建邮件列表等待确认的操作表(待批准的投稿和退订)
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
+	_, err = authDatabase.Exec("CREATE TABLE IF NOT EXISTS " + config.Auth.Sqlite.AppPasswordTableName + "(username TEXT NOT NULL, name TEXT NOT NULL, service TEXT NOT NULL, password_sha256_with_salt_hex TEXT NOT NULL, salt TEXT NOT NULL, last_used INTEGER NOT NULL)") //创建应用专用密码表
+	if err != nil {
+		log.Fatal("Error: auth database create failure: " + err.Error())
+	}
 }
@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestVerifyConfigBruteForceDefaults(t *testing.T) {
+	testLoadConfig(t, `
+[auth.brute_force]
+enable = true
+`)
+	bruteForce := config.Auth.BruteForce
+	if bruteForce.DelayStepMs != 500 || bruteForce.MaxDelayMs != 5000 || bruteForce.FailureWindowS != 900 || bruteForce.IpMaxFailures != 10 || bruteForce.UserMaxFailures != 20 || bruteForce.BanTimeS != 3600 {
+		t.Errorf("brute force defaults = %+v", bruteForce)
+	}
+}
@@ -1,17 +1,47 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
+	"errors"
 	"net"
+	"os"
+	"time"
 )
 
 type connStruct struct { //为了兼容STARTTLS做的一个通用结构体
-	tlsConn   *tls.Conn
-	plainConn net.Conn
-	connType  byte //0x00 plain  0x01 tls
+	tlsConn      *tls.Conn
+	plainConn    net.Conn
+	connType     byte          //0x00 plain  0x01 tls
+	reader       *bufio.Reader //读行用的缓冲(为了支持PIPELINING)
+	readTimeout  time.Duration //读一行的超时, 0为不限制
+	writeTimeout time.Duration //每次写的超时, 0为不限制
+}
+
+const ( //smtp监听的工作模式
+	smtpModeMixed      byte = iota //MX和客户端提交混用(没有启用提交端口时)
+	smtpModeMx                     //只接收投递到本机的邮件, 不允许AUTH
+	smtpModeSubmission             //客户端提交(RFC 6409), 所有事务都必须鉴权
+)
+
+type listenerOptionStruct struct { //每个监听的选项
+	enableStartTls    bool
+	startTlsConfig    *tls.Config
+	requireTlsForAuth bool //未加密时不允许鉴权
+	smtpMode          byte
+}
+
+func newServerConn(plainConn net.Conn) *connStruct { //包装服务端收到的连接(TLS监听收到的连接直接视为TLS)
+	if tlsConn, ok := plainConn.(*tls.Conn); ok {
+		return &connStruct{tlsConn: tlsConn, plainConn: plainConn, connType: 0x01}
+	}
+	return &connStruct{tlsConn: nil, plainConn: plainConn, connType: 0x00}
 }
 
 func (conn *connStruct) Write(b []byte) (int, error) { //写
+	if conn.writeTimeout > 0 {
+		conn.plainConn.SetWriteDeadline(time.Now().Add(conn.writeTimeout)) //TLS连接的超时也是设置在底层连接上
+	}
 	if conn.connType == 0x00 {
 		return conn.plainConn.Write(b)
 	}
@@ -32,3 +62,47 @@ func (conn *connStruct) Close() { //关闭连接
 		conn.tlsConn.Close()
 	}
 }
+
+func (conn *connStruct) getReader() *bufio.Reader { //获取读缓冲
+	if conn.reader == nil {
+		conn.reader = bufio.NewReaderSize(conn, MaxReadLineSize)
+	}
+	return conn.reader
+}
+
+func (conn *connStruct) discardBuffered() int { //丢弃已经缓冲但还没处理的数据(STARTTLS之后明文阶段的数据不能再用, 防止命令注入), 返回丢弃的字节数
+	if conn.reader == nil {
+		return 0
+	}
+	n := conn.reader.Buffered()
+	conn.reader.Reset(conn)
+	return n
+}
+
+func (conn *connStruct) setTimeout(readTimeout time.Duration, writeTimeout time.Duration) { //设置读写超时
+	conn.readTimeout = readTimeout
+	conn.writeTimeout = writeTimeout
+}
+
+func (conn *connStruct) setReadTimeout(readTimeout time.Duration) { //只修改读超时
+	conn.readTimeout = readTimeout
+}
+
+func (conn *connStruct) startRead() { //开始读一行之前设置读超时(整行都要在超时之内读完, 防止慢速攻击)
+	if conn.readTimeout > 0 {
+		conn.plainConn.SetReadDeadline(time.Now().Add(conn.readTimeout))
+	} else {
+		conn.plainConn.SetReadDeadline(time.Time{})
+	}
+}
+
+func timeoutSeconds(seconds int) time.Duration { //配置中的秒数转成超时, 负数为不限制
+	if seconds < 0 {
+		return 0
+	}
+	return time.Second * time.Duration(seconds)
+}
+
+func isTimeoutError(err error) bool { //是否是读写超时
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+type localDeliveryStruct struct { //投递给一个本地收件人的准备结果, commit之后才真正生效
+	envelope        smtpEnvelopeStruct
+	address         string
+	username        string
+	sourcePath      string   //这个收件人的邮件副本(转发/拒绝/自动回复时要用)
+	tempPathList    []string //要存进邮箱的临时文件
+	storagePathList []string //对应的储存位置
+	result          sieveResultStruct
+}
+
+func localDeliveryPrepare(filePath string, envelope smtpEnvelopeStruct, address string, spamTokenList []string) (*localDeliveryStruct, error) { //复制一份邮件, 经过垃圾邮件分类和sieve脚本, 算出要存放的位置
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkMailboxQuota(address, info.Size()); err != nil {
+		return nil, err
+	}
+	delivery := &localDeliveryStruct{envelope: envelope, address: address, sourcePath: generateCacheFilePath(), result: sieveResultStruct{keep: true}}
+	if _, err := copyFile(filePath, delivery.sourcePath); err != nil {
+		os.Remove(delivery.sourcePath)
+		return nil, err
+	}
+	defaultFolder := ""
+	if spamTokenList != nil {
+		defaultFolder = spamCheck(delivery.sourcePath, address, spamTokenList)
+	}
+	if config.Sieve.Enable {
+		delivery.username = addressGetUsername(address)
+		if script := sieveLoadActiveScript(delivery.username); script != nil {
+			headerList, size, err := readMailFileHeaderList(delivery.sourcePath)
+			if err != nil {
+				delivery.abort()
+				return nil, err
+			}
+			delivery.result, err = sieveExecute(script, envelope, address, headerList, size)
+			if err != nil {
+				log.Println("Warning: sieve script of " + delivery.username + " error: " + err.Error())
+			}
+		}
+	}
+	var folderList []string
+	if delivery.result.keep {
+		folderList = append(folderList, defaultFolder)
+	}
+	for _, folder := range delivery.result.fileintoList {
+		if strings.EqualFold(folder, "INBOX") {
+			folder = ""
+		}
+		exists := false
+		for _, added := range folderList {
+			exists = exists || added == folder
+		}
+		if !exists {
+			folderList = append(folderList, folder)
+		}
+	}
+	for i, folder := range folderList { //第一个位置直接用副本, 其他的再复制
+		tempPath := delivery.sourcePath
+		if i > 0 {
+			tempPath = generateCacheFilePath()
+			if _, err := copyFile(delivery.sourcePath, tempPath); err != nil {
+				os.Remove(tempPath)
+				delivery.abort()
+				return nil, err
+			}
+		}
+		delivery.tempPathList = append(delivery.tempPathList, tempPath)
+		delivery.storagePathList = append(delivery.storagePathList, getMailStoragePathInFolder(address, folder))
+	}
+	return delivery, nil
+}
+
+func (delivery *localDeliveryStruct) abort() { //放弃投递, 删掉临时文件
+	os.Remove(delivery.sourcePath)
+	for _, tempPath := range delivery.tempPathList {
+		os.Remove(tempPath)
+	}
+}
+
+func (delivery *localDeliveryStruct) commit() { //执行转发/拒绝/自动回复, 然后存进邮箱
+	for _, target := range delivery.result.redirectList {
+		sieveRedirect(delivery.sourcePath, delivery.envelope, delivery.address, target)
+	}
+	if delivery.result.reject != "" {
+		log.Println("Info: sieve of " + delivery.address + " rejected mail from " + delivery.envelope.fromMail)
+		smtpSendDsn(delivery.envelope, []dsnResultStruct{{address: delivery.address, action: "failed", status: "5.7.1", diagnostic: "550 5.7.1 Rejected by recipient: " + strings.ReplaceAll(strings.TrimSpace(delivery.result.reject), "\r\n", " ")}}, delivery.sourcePath)
+	}
+	if delivery.result.vacation != nil {
+		sieveSendVacation(delivery.sourcePath, delivery.envelope, delivery.address, delivery.username, delivery.result.vacation)
+	}
+	for i := range delivery.tempPathList {
+		if err := os.Rename(delivery.tempPathList[i], delivery.storagePathList[i]); err != nil {
+			log.Println("Error: local delivery to " + delivery.address + " error: " + err.Error())
+			os.Remove(delivery.tempPathList[i])
+		}
+	}
+	if len(delivery.tempPathList) == 0 { //没有存进邮箱(discard/redirect/reject)
+		os.Remove(delivery.sourcePath)
+	}
+}
+
+func localDeliver(filePath string, envelope smtpEnvelopeStruct, address string) error { //直接投递给一个本地收件人
+	delivery, err := localDeliveryPrepare(filePath, envelope, address, nil)
+	if err != nil {
+		return err
+	}
+	delivery.commit()
+	return nil
+}
+
+func readMailFileHeaderList(filePath string) ([]string, int64, error) { //读取邮件文件的头部和大小
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	headerList, err := readMailHeaderList(bufio.NewReader(f))
+	return headerList, info.Size(), err
+}
+
+func isDeliveredTo(headerList []string, address string) bool { //邮件是否已经经过这个地址(用Delivered-To头部防止转发循环)
+	for _, header := range headerList {
+		if getHeaderName(header) == "delivered-to" && strings.EqualFold(strings.Trim(getHeaderValue(header), "<>"), address) {
+			return true
+		}
+	}
+	return false
+}
+
+func sieveRedirect(filePath string, envelope smtpEnvelopeStruct, recipient string, target string) { //转发一份邮件(保留原来的发件人)
+	headerList, _, err := readMailFileHeaderList(filePath)
+	if err != nil {
+		log.Println("Error: sieve redirect error: " + err.Error())
+		return
+	}
+	if strings.EqualFold(target, recipient) || isDeliveredTo(headerList, target) {
+		log.Println("Warning: sieve redirect loop " + recipient + " -> " + target + ", skipped")
+		return
+	}
+	cachePath := generateCacheFilePath()
+	if _, err = copyFile(filePath, cachePath); err == nil {
+		err = rewriteMailHeader(cachePath, func(headerList []string) []string {
+			return append([]string{"Delivered-To: " + recipient + "\r\n"}, headerList...)
+		})
+	}
+	if err != nil {
+		log.Println("Error: sieve redirect error: " + err.Error())
+		os.Remove(cachePath)
+		return
+	}
+	log.Println("Info: sieve redirect mail to " + recipient + " -> " + target)
+	smtpQueueMail(smtpEnvelopeStruct{fromMail: envelope.fromMail, toMail: []string{target}, smtpUtf8: envelope.smtpUtf8, arrivalTime: time.Now()}, cachePath)
+}
+
+func sieveVacationAllowed(headerList []string, sender string, recipient string, addresses []string) bool { //检查是不是应该自动回复(RFC 5230 4.5/4.6)
+	if sender == "" {
+		return false
+	}
+	localPart := strings.ToLower(sender[:strings.LastIndex(sender+"@", "@")])
+	if localPart == "mailer-daemon" || localPart == "listserv" || localPart == "majordomo" || strings.HasPrefix(localPart, "owner-") || strings.HasSuffix(localPart, "-request") || strings.HasSuffix(localPart, "-bounces") {
+		return false
+	}
+	ownAddressList := append([]string{recipient}, addresses...)
+	mentioned := false
+	for _, header := range headerList {
+		name := getHeaderName(header)
+		value := getHeaderValue(header)
+		switch name {
+		case "auto-submitted":
+			if !strings.EqualFold(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]), "no") {
+				return false
+			}
+		case "precedence":
+			if strings.EqualFold(value, "bulk") || strings.EqualFold(value, "list") || strings.EqualFold(value, "junk") {
+				return false
+			}
+		case "list-id", "list-unsubscribe":
+			return false
+		case "to", "cc", "bcc", "resent-to", "resent-cc", "resent-bcc":
+			addressList, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, address := range addressList {
+				for _, own := range ownAddressList {
+					mentioned = mentioned || strings.EqualFold(address.Address, own)
+				}
+			}
+		}
+	}
+	return mentioned
+}
+
+func sieveSendVacation(filePath string, envelope smtpEnvelopeStruct, recipient string, username string, vacation *sieveVacationStruct) { //发送自动回复
+	headerList, _, err := readMailFileHeaderList(filePath)
+	if err != nil {
+		log.Println("Error: sieve vacation error: " + err.Error())
+		return
+	}
+	if !sieveVacationAllowed(headerList, envelope.fromMail, recipient, vacation.addresses) || !sieveVacationShouldReply(username, vacation, envelope.fromMail) {
+		return
+	}
+	subject := vacation.subject
+	if subject == "" {
+		originalSubject := ""
+		if index := findHeader(headerList, "subject"); index != -1 {
+			originalSubject = getHeaderValue(headerList[index])
+			if decoded, err := (&mime.WordDecoder{}).DecodeHeader(originalSubject); err == nil {
+				originalSubject = decoded
+			}
+		}
+		subject = "Auto: " + originalSubject
+	}
+	from := "<" + recipient + ">"
+	if vacation.from != "" { //:from是脚本作者写的, 不能直接放进头部(可能带换行插入其他头部)
+		if address, err := mail.ParseAddress(vacation.from); err == nil {
+			from = address.String()
+		} else {
+			log.Println("Warning: sieve vacation of " + recipient + " has invalid :from, using the recipient address")
+		}
+	}
+	cachePath := generateCacheFilePath()
+	f, err := os.OpenFile(cachePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error: sieve vacation error: " + err.Error())
+		return
+	}
+	writer := bufio.NewWriter(f)
+	writer.WriteString("From: " + from + "\r\n")
+	writer.WriteString("To: <" + envelope.fromMail + ">\r\n")
+	writer.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	writer.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	writer.WriteString("Message-ID: " + generateMessageId() + "\r\n")
+	if index := findHeader(headerList, "message-id"); index != -1 { //回复原邮件
+		messageId := getHeaderValue(headerList[index])
+		writer.WriteString("In-Reply-To: " + messageId + "\r\n")
+		references := messageId
+		if index = findHeader(headerList, "references"); index != -1 {
+			references = getHeaderValue(headerList[index]) + " " + messageId
+		}
+		writer.WriteString("References: " + references + "\r\n")
+	}
+	writer.WriteString("Auto-Submitted: auto-replied\r\n")
+	writer.WriteString("MIME-Version: 1.0\r\n")
+	if vacation.mime { //:mime的理由本身就是一个MIME实体(带头部)
+		writer.WriteString(strings.ReplaceAll(strings.ReplaceAll(vacation.reason, "\r\n", "\n"), "\n", "\r\n"))
+	} else {
+		writer.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+		writer.WriteString(strings.ReplaceAll(strings.ReplaceAll(vacation.reason, "\r\n", "\n"), "\n", "\r\n"))
+	}
+	err = writer.Flush()
+	f.Close()
+	if err != nil {
+		log.Println("Error: sieve vacation error: " + err.Error())
+		os.Remove(cachePath)
+		return
+	}
+	log.Println("Info: sieve vacation reply from " + recipient + " to " + envelope.fromMail)
+	smtpQueueMail(smtpEnvelopeStruct{fromMail: "", toMail: []string{envelope.fromMail}, arrivalTime: time.Now()}, cachePath) //自动回复用空的发件人, 避免对方再自动回复
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/mail"
+	"os"
 	"regexp"
 	"strings"
 )
@@ -103,3 +110,97 @@ func generateDkimFullHeaderWithSign(canonicalizedHeaderList []string, dkimBaseHe
 	dkimBaseHeader += subHeader + "\r\n"
 	return dkimBaseHeader
 }
+
+func getDkimIdentity(headerList []string) (string, string, *rsa.PrivateKey) { //按From的域名选择DKIM签名用的域名/选择器/私钥, 没有单独配置就用全局的, 都没有就返回nil
+	if index := findHeader(headerList, "from"); index != -1 {
+		if fromAddress, err := mail.ParseAddress(getHeaderValue(headerList[index])); err == nil {
+			if fromDomain, err := domainToAscii(getAddressDomain(fromAddress.Address)); err == nil && domainDkimPrivateKeyMap[fromDomain] != nil {
+				return fromDomain, domainConfigMap[fromDomain].DkimSelector, domainDkimPrivateKeyMap[fromDomain]
+			}
+		}
+	}
+	if config.Smtp.Outbound.EnableDkim {
+		return config.Smtp.Outbound.DkimDomain, config.Smtp.Outbound.DkimSelector, smtpDkimPrivateKey
+	}
+	return "", "", nil
+}
+
+func generateDkimHeaderForFile(filePath string) (string, error) { //给一个缓存的邮件文件生成带签名的DKIM头部, 不需要签名就返回空
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	headerList, err := readMailHeaderList(reader)
+	if err != nil {
+		return "", err
+	}
+	dkimDomain, dkimSelector, privateKey := getDkimIdentity(headerList)
+	if privateKey == nil {
+		return "", nil
+	}
+	var toKeepHeaders []string
+	var keepedHeaderList []string
+	for _, header := range headerList { //只签名格式正确的头部
+		headerName := getHeaderName(header)
+		if headerName == "" {
+			continue
+		}
+		toKeepHeaders = append(toKeepHeaders, headerName)
+		keepedHeaderList = append(keepedHeaderList, strings.TrimRight(header, "\r\n"))
+	}
+	keepedHeaderList = canonicalizeHeaderList(keepedHeaderList)
+
+	dkimBodyHash := sha256.New()
+	rxReduceWS := regexp.MustCompile(`[ \t]+`)
+	var hashBuffer string
+	for { //relaxed正文规范化: 压缩空白, 去掉行尾空白, 忽略结尾的空行
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		line = strings.TrimRight(rxReduceWS.ReplaceAllString(line, " "), " ")
+		if line == "" {
+			hashBuffer += "\r\n"
+		} else {
+			dkimBodyHash.Write([]byte(hashBuffer + line + "\r\n"))
+			hashBuffer = ""
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(toKeepHeaders) == 0 {
+		return "", errors.New("no header to sign")
+	}
+	dkimBaseHeader := generateDkimBaseHeader(base64.StdEncoding.EncodeToString(dkimBodyHash.Sum(nil)), dkimDomain, dkimSelector, toKeepHeaders, privateKey)
+	return generateDkimFullHeaderWithSign(keepedHeaderList, dkimBaseHeader, privateKey), nil
+}
+
+func loadDkimPrivateKey(pemPath string) (*rsa.PrivateKey, error) { //读取DKIM私钥(PKCS1或PKCS8)
+	privateKeyPem, err := os.ReadFile(pemPath)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyData, _ := pem.Decode(privateKeyPem)
+	if privateKeyData == nil {
+		return nil, errors.New("error: invalid pem file")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(privateKeyData.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(privateKeyData.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("error: not a rsa private key")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dnsResolver interface { //DNS查询接口(net.Resolver实现了它, 测试时可以换成假的)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type dnsblCacheEntry struct {
+	addrs  []string
+	expire time.Time
+}
+
+type dnsblResultStruct struct { //一次检查的结果
+	score  int
+	reject bool     //命中了动作为reject的列表
+	hits   []string //命中的列表(用于日志和头部)
+}
+
+var (
+	dnsblResolverInstance dnsResolver = net.DefaultResolver
+	dnsblCache                        = make(map[string]dnsblCacheEntry)
+	dnsblCacheMutex       sync.Mutex
+)
+
+func newDnsblResolver(address string) dnsResolver { //指定了DNS服务器的话就用它查询
+	if address == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: time.Second * 5}
+		return dialer.DialContext(ctx, network, address)
+	}}
+}
+
+func dnsblLookup(query string) []string { //查询一个名字(带缓存), 查不到就返回空
+	dnsblCacheMutex.Lock()
+	entry, ok := dnsblCache[query]
+	dnsblCacheMutex.Unlock()
+	if ok && time.Now().Before(entry.expire) {
+		return entry.addrs
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(config.Smtp.Dnsbl.TimeoutMs))
+	defer cancel()
+	addrs, err := dnsblResolverInstance.LookupHost(ctx, query)
+	if err != nil {
+		if dnsError, ok := err.(*net.DNSError); !ok || !dnsError.IsNotFound { //查询失败(不是不存在)的话不缓存
+			log.Println("Warning: dnsbl lookup " + query + " error: " + err.Error())
+			return nil
+		}
+		addrs = nil
+	}
+	dnsblCacheMutex.Lock()
+	if len(dnsblCache) > 4096 { //顺手清理过期的缓存
+		now := time.Now()
+		for k, v := range dnsblCache {
+			if now.After(v.expire) {
+				delete(dnsblCache, k)
+			}
+		}
+	}
+	dnsblCache[query] = dnsblCacheEntry{addrs: addrs, expire: time.Now().Add(time.Second * time.Duration(config.Smtp.Dnsbl.CacheS))}
+	dnsblCacheMutex.Unlock()
+	return addrs
+}
+
+func dnsblReverseIp(ip string) string { //把ip转换成DNSBL查询用的反转形式
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return ""
+	}
+	if ipv4 := parsedIp.To4(); ipv4 != nil {
+		return strconv.Itoa(int(ipv4[3])) + "." + strconv.Itoa(int(ipv4[2])) + "." + strconv.Itoa(int(ipv4[1])) + "." + strconv.Itoa(int(ipv4[0]))
+	}
+	const hexDigits = "0123456789abcdef" //IPv6按半字节反转(RFC 5782 2.4)
+	nibbles := make([]string, 0, 32)
+	for i := len(parsedIp) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hexDigits[parsedIp[i]&0x0f]), string(hexDigits[parsedIp[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+func dnsblZoneWeight(zone smtpDnsblZoneConfig, addrs []string) int { //根据返回的地址计算这个列表的权重, 0为没有命中
+	weight := 0
+	for _, addr := range addrs {
+		if len(zone.Responses) > 0 { //配置了返回码映射就按映射来
+			if w, ok := zone.Responses[addr]; ok && w > weight {
+				weight = w
+			}
+			continue
+		}
+		if strings.HasPrefix(addr, "127.") && !strings.HasPrefix(addr, "127.255.255.") { //127.255.255.x是查询出错的返回码(比如通过公共DNS查询)
+			weight = zone.Weight
+		}
+	}
+	return weight
+}
+
+func dnsblCheck(kind string, name string) dnsblResultStruct { //对所有对应类型的列表做检查, kind为ip或domain
+	var result dnsblResultStruct
+	if !config.Smtp.Dnsbl.Enable || name == "" {
+		return result
+	}
+	for _, zone := range config.Smtp.Dnsbl.Zones {
+		if zone.Type != kind {
+			continue
+		}
+		weight := dnsblZoneWeight(zone, dnsblLookup(name+"."+zone.Zone))
+		if weight == 0 {
+			continue
+		}
+		result.hits = append(result.hits, zone.Zone)
+		result.score += weight
+		if zone.Action == "reject" {
+			result.reject = true
+		}
+	}
+	if config.Smtp.Dnsbl.RejectScore > 0 && result.score >= config.Smtp.Dnsbl.RejectScore {
+		result.reject = true
+	}
+	if len(result.hits) > 0 {
+		log.Println("Info: dnsbl " + kind + " " + name + " listed in " + strings.Join(result.hits, ", ") + " score=" + strconv.Itoa(result.score))
+	}
+	return result
+}
+
+func dnsblCheckIp(ip string) dnsblResultStruct { //连接时检查客户端ip
+	if smtpIsTrustedClient(ip) {
+		return dnsblResultStruct{}
+	}
+	return dnsblCheck("ip", dnsblReverseIp(ip))
+}
+
+func dnsblCheckSender(fromMail string) dnsblResultStruct { //MAIL FROM时检查发件人域名(RHSBL)
+	domain, err := domainToAscii(getAddressDomain(fromMail))
+	if err != nil {
+		return dnsblResultStruct{}
+	}
+	return dnsblCheck("domain", domain)
+}
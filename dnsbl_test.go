@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDnsResolver struct { //假的DNS, 没有记录的名字返回不存在, timeoutNames里的名字一直等到超时
+	records      map[string][]string
+	timeoutNames map[string]bool
+}
+
+func (resolver *testDnsResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if resolver.timeoutNames[host] {
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+	}
+	if addrs, ok := resolver.records[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+const testDnsblConfig = `
+[smtp.dnsbl]
+enable = true
+timeout_ms = 100
+cache_s = 60
+reject_score = 8
+[[smtp.dnsbl.zone]]
+zone = "block.test"
+type = "ip"
+weight = 10
+action = "reject"
+[[smtp.dnsbl.zone]]
+zone = "score.test"
+type = "ip"
+weight = 3
+action = "score"
+[[smtp.dnsbl.zone]]
+zone = "codes.test"
+type = "ip"
+action = "score"
+responses = {"127.0.0.2" = 5, "127.0.0.4" = 1}
+[[smtp.dnsbl.zone]]
+zone = "rhs.test"
+type = "domain"
+weight = 4
+action = "score"
+`
+
+func testSetDnsResolver(t *testing.T, resolver dnsResolver) {
+	t.Helper()
+	oldResolver := dnsblResolverInstance
+	dnsblResolverInstance = resolver
+	dnsblCache = make(map[string]dnsblCacheEntry)
+	t.Cleanup(func() {
+		dnsblResolverInstance = oldResolver
+		dnsblCache = make(map[string]dnsblCacheEntry)
+	})
+}
+
+func TestDnsblCheck(t *testing.T) {
+	testLoadConfig(t, testDnsblConfig)
+	testSetDnsResolver(t, &testDnsResolver{
+		records: map[string][]string{
+			"2.0.0.192.block.test":  {"127.0.0.2"},
+			"3.0.0.192.score.test":  {"127.0.0.2"},
+			"3.0.0.192.codes.test":  {"127.0.0.2"},
+			"4.0.0.192.score.test":  {"127.0.0.2"},
+			"4.0.0.192.codes.test":  {"127.0.0.4"},
+			"5.0.0.192.block.test":  {"127.255.255.254"}, //查询出错的返回码不算命中
+			"spam.example.rhs.test": {"127.0.0.2"},
+		},
+		timeoutNames: map[string]bool{"6.0.0.192.block.test": true},
+	})
+	testList := []struct {
+		name   string
+		result dnsblResultStruct
+	}{
+		{"192.0.0.1", dnsblResultStruct{}}, //没有被列出
+		{"192.0.0.2", dnsblResultStruct{score: 10, reject: true, hits: []string{"block.test"}}},              //命中reject的列表
+		{"192.0.0.3", dnsblResultStruct{score: 8, reject: true, hits: []string{"score.test", "codes.test"}}}, //分数达到reject_score
+		{"192.0.0.4", dnsblResultStruct{score: 4, hits: []string{"score.test", "codes.test"}}},               //分数不够
+		{"192.0.0.5", dnsblResultStruct{}},
+		{"127.0.0.1", dnsblResultStruct{}}, //可信网络不检查
+	}
+	for _, test := range testList {
+		if result := dnsblCheckIp(test.name); !reflect.DeepEqual(result, test.result) {
+			t.Errorf("dnsblCheckIp(%s) = %+v, want %+v", test.name, result, test.result)
+		}
+	}
+
+	start := time.Now() //超时的查询不算命中, 也不缓存
+	if result := dnsblCheckIp("192.0.0.6"); !reflect.DeepEqual(result, dnsblResultStruct{}) {
+		t.Errorf("timeout result = %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout lookup took %v", elapsed)
+	}
+	if _, ok := dnsblCache["6.0.0.192.block.test"]; ok {
+		t.Error("timeout lookup was cached")
+	}
+
+	if result := dnsblCheckSender("someone@Spam.Example"); !reflect.DeepEqual(result, dnsblResultStruct{score: 4, hits: []string{"rhs.test"}}) { //RHSBL
+		t.Errorf("dnsblCheckSender = %+v", result)
+	}
+	if result := dnsblCheckSender("someone@clean.example"); !reflect.DeepEqual(result, dnsblResultStruct{}) {
+		t.Errorf("dnsblCheckSender clean = %+v", result)
+	}
+}
+
+func TestDnsblReverseIp(t *testing.T) {
+	if got := dnsblReverseIp("192.0.2.99"); got != "99.2.0.192" {
+		t.Errorf("ipv4: %s", got)
+	}
+	if got := dnsblReverseIp("2001:db8::1"); got != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2" {
+		t.Errorf("ipv6: %s", got)
+	}
+	if got := dnsblReverseIp("pipe"); got != "" {
+		t.Errorf("invalid: %s", got)
+	}
+}
+
+func TestDnsblHeaderNotForgeable(t *testing.T) { //客户端自己带的X-DNSBL头部要被去掉, 只留下服务器加的
+	testLoadConfig(t, testDnsblConfig)
+	testSetDnsResolver(t, &testDnsResolver{records: map[string][]string{"spam.example.rhs.test": {"127.0.0.2"}}})
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMx})
+	client.command("EHLO client.test", "250")
+	client.command("MAIL FROM:<someone@spam.example>", "250")
+	client.command("RCPT TO:<alice@example.com>", "250")
+	client.command("DATA", "354")
+	client.command("Subject: hi\r\nX-DNSBL: score=0;\r\n listed=nothing\r\nx-dnsbl: clean\r\nX-Other: kept\r\n\r\nbody\r\n.", "250")
+	mailInfoList, err := getMailAllInfo("alice@example.com")
+	if err != nil || len(mailInfoList) != 1 {
+		t.Fatalf("mailbox has %d mails, %v", len(mailInfoList), err)
+	}
+	data, err := os.ReadFile(mailInfoList[0].filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := string(data)
+	if strings.Count(strings.ToLower(mail), "x-dnsbl:") != 1 || !strings.Contains(mail, "X-DNSBL: score=4; listed=rhs.test\r\n") {
+		t.Errorf("X-DNSBL headers wrong:\n%s", mail)
+	}
+	if strings.Contains(mail, "listed=nothing") || !strings.Contains(mail, "X-Other: kept\r\n") || !strings.Contains(mail, "\r\n\r\nbody\r\n") {
+		t.Errorf("mail content wrong:\n%s", mail)
+	}
+}
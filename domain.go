@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+var (
+	errorMailboxFull = errors.New("error: mailbox full")
+)
+
+type domainInfoStruct struct {
+	domain  string
+	aliasOf string //域名别名指向的域名, 空为独立的域名
+}
+
+func domainLookup(domain string) (bool, string) { //查找一个托管的域名, 返回是否存在和它指向的域名(不是域名别名就为空)
+	asciiDomain, err := domainToAscii(domain)
+	if err != nil {
+		return false, ""
+	}
+	if mainDomain, err := domainToAscii(config.General.MailDomain); err == nil && asciiDomain == mainDomain { //配置里的域名总是托管的
+		return true, ""
+	}
+	row, err := authDatabase.Query("SELECT alias_of FROM "+config.Auth.Sqlite.DomainTableName+" WHERE domain=?", asciiDomain)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return false, ""
+	}
+	defer row.Close()
+	var aliasOf string
+	if !row.Next() || row.Scan(&aliasOf) != nil {
+		return false, ""
+	}
+	return true, aliasOf
+}
+
+func getDomainConfig(domain string) domainConfig { //获取一个域名的单独配置(域名别名用指向的域名的配置), 没有就返回空的
+	asciiDomain, err := domainToAscii(domain)
+	if err != nil {
+		return domainConfig{}
+	}
+	if _, aliasOf := domainLookup(asciiDomain); aliasOf != "" {
+		asciiDomain = aliasOf
+	}
+	return domainConfigMap[asciiDomain]
+}
+
+func listDomains() ([]domainInfoStruct, error) { //列出所有托管的域名(不包括配置里的)
+	row, err := authDatabase.Query("SELECT domain, alias_of FROM " + config.Auth.Sqlite.DomainTableName)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+	var domainList []domainInfoStruct
+	for row.Next() {
+		var info domainInfoStruct
+		if err = row.Scan(&info.domain, &info.aliasOf); err != nil {
+			return nil, err
+		}
+		domainList = append(domainList, info)
+	}
+	return domainList, nil
+}
+
+func addDomain(domain string, aliasOf string) error { //添加一个托管的域名, aliasOf不为空就是这个域名的别名
+	asciiDomain, err := domainToAscii(domain)
+	if err != nil || asciiDomain == "" || strings.ContainsAny(asciiDomain, "@/ ") {
+		return errors.New("error: invalid domain")
+	}
+	if exists, _ := domainLookup(asciiDomain); exists {
+		return errors.New("error: domain already exists")
+	}
+	if aliasOf != "" {
+		aliasOf, err = domainToAscii(aliasOf)
+		if err != nil {
+			return errors.New("error: invalid domain")
+		}
+		exists, targetAliasOf := domainLookup(aliasOf)
+		if !exists {
+			return errors.New("error: target domain does not exist")
+		}
+		if targetAliasOf != "" { //不允许别名的别名
+			return errors.New("error: target domain is an alias of " + targetAliasOf)
+		}
+	}
+	_, err = authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.DomainTableName+"(domain, alias_of) VALUES(?, ?)", asciiDomain, aliasOf)
+	return err
+}
+
+func delDomain(domain string) error { //删除一个托管的域名(邮箱和别名要另外删除)
+	asciiDomain, err := domainToAscii(domain)
+	if err != nil {
+		return errors.New("error: invalid domain")
+	}
+	if mainDomain, err := domainToAscii(config.General.MailDomain); err == nil && asciiDomain == mainDomain {
+		return errors.New("error: cannot delete general.mail_domain")
+	}
+	row, err := authDatabase.Query("SELECT domain FROM "+config.Auth.Sqlite.DomainTableName+" WHERE alias_of=?", asciiDomain)
+	if err != nil {
+		return err
+	}
+	hasAlias := row.Next()
+	row.Close()
+	if hasAlias {
+		return errors.New("error: domain has alias domains, delete them first")
+	}
+	result, err := authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.DomainTableName+" WHERE domain=?", asciiDomain)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.New("error: domain does not exist")
+	}
+	return nil
+}
+
+func checkMailboxQuota(address string, size int64) error { //检查邮箱放下这么大的邮件会不会超过域名的容量限制
+	quotaMb := getDomainConfig(getAddressDomain(address)).QuotaMb
+	if quotaMb <= 0 {
+		return nil
+	}
+	usage, err := getMailUsage(address)
+	if err != nil {
+		return err
+	}
+	if usage+size > int64(quotaMb)*1024*1024 {
+		return errorMailboxFull
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+)
+
+func DotReadLine(conn *connStruct) ([]byte, bool, error) { //读取一行DATA/多行回复的数据并去掉透明点(RFC 5321 4.5.2), 读到结束行时返回true
+	line, err := ConnReadLine(conn)
+	if err != nil {
+		return nil, false, err
+	}
+	if string(line) == ".\r\n" {
+		return nil, true, nil
+	}
+	if line[0] == '.' {
+		line = line[1:]
+	}
+	return line, false, nil
+}
+
+type dotWriterStruct struct { //写入时给以'.'开头的行加上透明点, Close时写入结束行
+	writer    io.Writer
+	lineStart bool //下一个字节是不是在行首
+	lastCr    bool //上一个字节是不是'\r'
+}
+
+func newDotWriter(writer io.Writer) *dotWriterStruct {
+	return &dotWriterStruct{writer: writer, lineStart: true}
+}
+
+func (dotWriter *dotWriterStruct) Write(data []byte) (int, error) {
+	start := 0
+	for i := 0; i < len(data); i++ {
+		if dotWriter.lineStart && data[i] == '.' { //行首的'.'要再加一个
+			if _, err := dotWriter.writer.Write(data[start:i]); err != nil {
+				return start, err
+			}
+			if _, err := dotWriter.writer.Write([]byte{'.'}); err != nil {
+				return i, err
+			}
+			start = i
+		}
+		dotWriter.lineStart = data[i] == '\n' && dotWriter.lastCr
+		dotWriter.lastCr = data[i] == '\r'
+	}
+	if _, err := dotWriter.writer.Write(data[start:]); err != nil {
+		return start, err
+	}
+	return len(data), nil
+}
+
+func (dotWriter *dotWriterStruct) Close() error { //写入结束行(数据最后没有换行的话先补上)
+	end := ".\r\n"
+	if !dotWriter.lineStart {
+		end = "\r\n" + end
+	}
+	_, err := dotWriter.writer.Write([]byte(end))
+	return err
+}
+
+func dotDiscardData(conn *connStruct) error { //丢弃剩下的数据直到结束行
+	for {
+		_, end, err := DotReadLine(conn)
+		if err != nil {
+			return err
+		}
+		if end {
+			return nil
+		}
+	}
+}
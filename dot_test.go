@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func testDotRoundTrip(t *testing.T, body string) string { //用dotWriter写出, 再用DotReadLine读回来
+	t.Helper()
+	var buffer bytes.Buffer
+	dotWriter := newDotWriter(&buffer)
+	for i := 0; i < len(body); i += 3 { //分成几次写, 检查跨越多次Write的行首判断
+		end := i + 3
+		if end > len(body) {
+			end = len(body)
+		}
+		if _, err := dotWriter.Write([]byte(body[i:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dotWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		clientConn.Write(buffer.Bytes())
+		clientConn.Close()
+	}()
+	conn := newServerConn(serverConn)
+	var result []byte
+	for {
+		line, end, err := DotReadLine(conn)
+		if err != nil {
+			t.Fatalf("read %q error: %v", buffer.String(), err)
+		}
+		if end {
+			return string(result)
+		}
+		result = append(result, line...)
+	}
+}
+
+func TestDotRoundTrip(t *testing.T) {
+	testList := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"plain", "hello\r\nworld\r\n", "hello\r\nworld\r\n"},
+		{"leading dot", ".hidden\r\n..two\r\nmid.dle\r\n", ".hidden\r\n..two\r\nmid.dle\r\n"},
+		{"lone dot", "a\r\n.\r\nb\r\n", "a\r\n.\r\nb\r\n"},
+		{"lone dot first", ".\r\n", ".\r\n"},
+		{"crlf only", "\r\n", "\r\n"},
+		{"crlf lines", "\r\n\r\n\r\n", "\r\n\r\n\r\n"},
+		{"no final crlf", "a\r\nlast", "a\r\nlast\r\n"}, //结束行之前要补上换行
+		{"no final crlf dot", "a\r\n.", "a\r\n.\r\n"},
+		{"bare lf is not a line end", "a\n.b\r\n", "a\n.b\r\n"},
+		{"empty", "", ""},
+	}
+	for _, test := range testList {
+		if got := testDotRoundTrip(t, test.body); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type dsnResultStruct struct { //一个收件人的投递结果
+	address    string
+	action     string //delivered relayed expanded failed delayed
+	status     string //增强状态码
+	diagnostic string //对方服务器的回复或者错误信息
+}
+
+func xtextDecode(text string) string { //解码xtext(RFC 3461 4)
+	var decoded strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '+' && i+2 < len(text) {
+			if b, err := hex.DecodeString(text[i+1 : i+3]); err == nil {
+				decoded.Write(b)
+				i += 2
+				continue
+			}
+		}
+		decoded.WriteByte(text[i])
+	}
+	return decoded.String()
+}
+
+func xtextEncode(text string) string { //编码成xtext
+	var encoded strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			encoded.WriteString("+" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		} else {
+			encoded.WriteByte(c)
+		}
+	}
+	return encoded.String()
+}
+
+func isValidXtext(text string) bool { //检查xtext格式
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c < 33 || c > 126 || c == '=' {
+			return false
+		}
+		if c == '+' {
+			if i+2 >= len(text) {
+				return false
+			}
+			if _, err := hex.DecodeString(text[i+1 : i+3]); err != nil {
+				return false
+			}
+			i += 2
+		}
+	}
+	return true
+}
+
+func dsnCheckMailParams(params map[string]string) string { //检查MAIL的RET/ENVID参数, 不正确就返回要回复的内容
+	if ret, ok := params["RET"]; ok {
+		ret = strings.ToUpper(ret)
+		if ret != "FULL" && ret != "HDRS" {
+			return "501 5.5.4 Invalid RET parameter\r\n"
+		}
+	}
+	if envId, ok := params["ENVID"]; ok {
+		if envId == "" || len(envId) > 100 || !isValidXtext(envId) {
+			return "501 5.5.4 Invalid ENVID parameter\r\n"
+		}
+	}
+	return ""
+}
+
+func dsnCheckRcptParams(params map[string]string) string { //检查RCPT的NOTIFY/ORCPT参数, 不正确就返回要回复的内容
+	if notify, ok := params["NOTIFY"]; ok {
+		notifyList := strings.Split(strings.ToUpper(notify), ",")
+		for _, item := range notifyList {
+			if item == "NEVER" && len(notifyList) != 1 {
+				return "501 5.5.4 NOTIFY=NEVER cannot be combined with other values\r\n"
+			}
+			if item != "NEVER" && item != "SUCCESS" && item != "FAILURE" && item != "DELAY" {
+				return "501 5.5.4 Invalid NOTIFY parameter\r\n"
+			}
+		}
+	}
+	if orcpt, ok := params["ORCPT"]; ok {
+		orcptSplit := strings.SplitN(orcpt, ";", 2)
+		if len(orcptSplit) != 2 || orcptSplit[0] == "" || !isValidXtext(orcptSplit[1]) {
+			return "501 5.5.4 Invalid ORCPT parameter\r\n"
+		}
+	}
+	return ""
+}
+
+func dsnShouldNotify(notify string, action string) bool { //根据NOTIFY参数判断这个结果要不要通知发件人
+	notify = strings.ToUpper(notify)
+	switch action {
+	case "failed":
+		return notify == "" || strings.Contains(notify, "FAILURE") //没指定的话默认只通知失败
+	case "delayed":
+		return strings.Contains(notify, "DELAY")
+	default:
+		return strings.Contains(notify, "SUCCESS")
+	}
+}
+
+func smtpSendDsn(envelope smtpEnvelopeStruct, resultList []dsnResultStruct, originalFilePath string) { //生成并投递投递状态通知(RFC 3464)
+	if envelope.fromMail == "" { //空发件人(退信本身)不再产生通知
+		return
+	}
+	var notifyList []dsnResultStruct
+	var subject = "Successful Mail Delivery Report"
+	var hasFailure bool
+	for _, result := range resultList {
+		if !dsnShouldNotify(envelope.dsnNotify[result.address], result.action) {
+			continue
+		}
+		notifyList = append(notifyList, result)
+		if result.action == "failed" {
+			subject = "Undelivered Mail Returned to Sender"
+			hasFailure = true
+		} else if result.action == "delayed" && !hasFailure {
+			subject = "Delayed Mail (still being retried)"
+		}
+	}
+	if len(notifyList) == 0 {
+		return
+	}
+	boundaryBytes := make([]byte, 12)
+	rand.Read(boundaryBytes)
+	boundary := "dsn-" + hex.EncodeToString(boundaryBytes)
+	cacheFilePath := generateCacheFilePath()
+	f, err := os.OpenFile(cacheFilePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error: smtp create DSN error: " + err.Error())
+		return
+	}
+	writer := bufio.NewWriter(f)
+	writer.WriteString("From: Mail Delivery System <MAILER-DAEMON@" + config.General.MailDomain + ">\r\n")
+	writer.WriteString("To: <" + envelope.fromMail + ">\r\n")
+	writer.WriteString("Subject: " + subject + "\r\n")
+	writer.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	writer.WriteString("Message-ID: " + generateMessageId() + "\r\n")
+	writer.WriteString("Auto-Submitted: auto-replied\r\n")
+	writer.WriteString("MIME-Version: 1.0\r\n")
+	writer.WriteString("Content-Type: multipart/report; report-type=delivery-status; boundary=\"" + boundary + "\"\r\n\r\n")
+
+	writer.WriteString("--" + boundary + "\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n") //给人看的部分
+	writer.WriteString("This is the mail system at host " + config.General.ServerAddress + ".\r\n\r\n")
+	for _, result := range notifyList {
+		writer.WriteString("<" + result.address + ">: " + result.action)
+		if result.diagnostic != "" {
+			writer.WriteString(": " + result.diagnostic)
+		}
+		writer.WriteString("\r\n")
+	}
+
+	writer.WriteString("\r\n--" + boundary + "\r\nContent-Type: message/delivery-status\r\n\r\n") //给机器看的部分
+	writer.WriteString("Reporting-MTA: dns; " + config.General.ServerAddress + "\r\n")
+	if envelope.dsnEnvId != "" {
+		writer.WriteString("Original-Envelope-Id: " + xtextDecode(envelope.dsnEnvId) + "\r\n")
+	}
+	writer.WriteString("Arrival-Date: " + envelope.arrivalTime.Format(time.RFC1123Z) + "\r\n")
+	for _, result := range notifyList {
+		writer.WriteString("\r\n")
+		if orcpt, ok := envelope.dsnOrcpt[result.address]; ok {
+			orcptSplit := strings.SplitN(orcpt, ";", 2)
+			writer.WriteString("Original-Recipient: " + orcptSplit[0] + ";" + xtextDecode(orcptSplit[1]) + "\r\n")
+		}
+		writer.WriteString("Final-Recipient: rfc822; " + result.address + "\r\n")
+		writer.WriteString("Action: " + result.action + "\r\n")
+		writer.WriteString("Status: " + result.status + "\r\n")
+		if result.diagnostic != "" {
+			writer.WriteString("Diagnostic-Code: smtp; " + strings.ReplaceAll(result.diagnostic, "\r\n", " ") + "\r\n")
+		}
+		if result.action == "delayed" {
+			writer.WriteString("Will-Retry-Until: " + time.Now().Add(time.Second*time.Duration(config.Smtp.Outbound.DeferredRetryIntervalS*(config.Smtp.Outbound.DeferredRetryTimes-envelope.retryTimes))).Format(time.RFC1123Z) + "\r\n")
+		}
+	}
+
+	originalFile, err := os.Open(originalFilePath) //附上原邮件(RET=FULL或者失败时没有指定RET就附上全文, 否则只附上头部)
+	if err == nil {
+		fullMessage := strings.ToUpper(envelope.dsnRet) == "FULL" || (envelope.dsnRet == "" && hasFailure)
+		if fullMessage {
+			writer.WriteString("\r\n--" + boundary + "\r\nContent-Type: message/rfc822\r\n\r\n")
+			io.Copy(writer, originalFile)
+		} else {
+			writer.WriteString("\r\n--" + boundary + "\r\nContent-Type: text/rfc822-headers\r\n\r\n")
+			headerList, _ := readMailHeaderList(bufio.NewReader(originalFile))
+			writer.WriteString(strings.Join(headerList, ""))
+		}
+		originalFile.Close()
+	}
+	writer.WriteString("\r\n--" + boundary + "--\r\n")
+	err = writer.Flush()
+	f.Close()
+	if err != nil {
+		log.Println("Error: smtp create DSN error: " + err.Error())
+		os.Remove(cacheFilePath)
+		return
+	}
+
+	if isLocalDomain(getAddressDomain(envelope.fromMail)) { //发件人在本机就直接投递
+		err = os.Rename(cacheFilePath, getMailStoragePath(envelope.fromMail))
+		if err != nil {
+			log.Println("Error: smtp deliver DSN error: " + err.Error())
+			os.Remove(cacheFilePath)
+		}
+		return
+	}
+	smtpQueueMail(smtpEnvelopeStruct{fromMail: "", toMail: []string{envelope.fromMail}, arrivalTime: time.Now()}, cacheFilePath)
+}
+
+func dsnStatusFromError(err error) string { //从发送错误中取出增强状态码
+	message := err.Error()
+	index := strings.Index(message, ": ")
+	if index != -1 {
+		fields := strings.Fields(message[index+2:])
+		if len(fields) >= 2 && len(fields[0]) == 3 && (fields[0][0] == '4' || fields[0][0] == '5') {
+			if strings.Count(fields[1], ".") == 2 { //对方回复里带了增强状态码
+				return fields[1]
+			}
+			return string(fields[0][0]) + ".0.0"
+		}
+	}
+	if isTemporarySendError(err) {
+		return "4.4.1"
+	}
+	return "5.0.0"
+}
+
+func isTemporarySendError(err error) bool { //是否是临时错误(网络错误或4xx回复)
+	if sendError, ok := err.(*smtpSendError); ok {
+		return !sendError.permanent
+	}
+	return true
+}
+
+type smtpSendError struct { //发送时对方回复的错误
+	message   string
+	permanent bool
+}
+
+func (err *smtpSendError) Error() string {
+	return err.message
+}
+
+func newSmtpReplyError(stage string, ret []byte) error { //根据对方的回复生成错误, 5xx是永久错误
+	return &smtpSendError{message: stage + " failed: " + strings.TrimRight(string(ret), "\r\n"), permanent: len(ret) > 0 && ret[0] == '5'}
+}
+
+func newSmtpPermanentError(message string) error { //生成一个永久错误
+	return &smtpSendError{message: message, permanent: true}
+}
+
+func dsnFormatRetryTimes(times int) string { //日志用
+	return strconv.Itoa(times) + "/" + strconv.Itoa(config.Smtp.Outbound.DeferredRetryTimes)
+}
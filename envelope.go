@@ -0,0 +1,196 @@
+package main
+
+import (
+	"strings"
+)
+
+func isAtext(c byte) bool { //RFC 5322 atext(非ASCII字符在SMTPUTF8里也算)
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80 {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) != -1
+}
+
+func isDotString(s string) bool { //RFC 5321 Dot-string
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '.' && !isAtext(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isValidEnvelopeDomain(domain string) bool { //RFC 5321 Domain或者address-literal
+	if strings.HasPrefix(domain, "[") {
+		return strings.HasSuffix(domain, "]") && len(domain) > 2 && !strings.ContainsAny(domain[1:len(domain)-1], "[]\\ ")
+	}
+	if domain == "" || len(domain) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c >= 0x80) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func smtpParseMailbox(mailbox string) (string, bool) { //解析Mailbox(Local-part "@" Domain), 返回规范化后的地址
+	var localPart string
+	var rest string
+	if strings.HasPrefix(mailbox, "\"") { //Quoted-string形式的本地部分
+		var unquoted strings.Builder
+		i := 1
+		for ; i < len(mailbox); i++ {
+			c := mailbox[i]
+			if c == '\\' {
+				if i+1 >= len(mailbox) || mailbox[i+1] < 32 || mailbox[i+1] > 126 {
+					return "", false
+				}
+				i++
+				unquoted.WriteByte(mailbox[i])
+				continue
+			}
+			if c == '"' {
+				break
+			}
+			if c < 32 || c == 127 {
+				return "", false
+			}
+			unquoted.WriteByte(c)
+		}
+		if i >= len(mailbox) {
+			return "", false
+		}
+		rest = mailbox[i+1:]
+		localPart = unquoted.String()
+		if !isDotString(localPart) { //不能写成Dot-string的才保留引号
+			localPart = "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(localPart) + "\""
+		}
+	} else {
+		index := strings.LastIndex(mailbox, "@")
+		if index == -1 {
+			return "", false
+		}
+		localPart = mailbox[:index]
+		rest = mailbox[index:]
+		if !isDotString(localPart) {
+			return "", false
+		}
+	}
+	if !strings.HasPrefix(rest, "@") || !isValidEnvelopeDomain(rest[1:]) {
+		return "", false
+	}
+	if len(localPart) > 64 {
+		return "", false
+	}
+	return localPart + rest, true
+}
+
+var smtpKnownParams = map[string][]string{ //MAIL FROM/RCPT TO支持的ESMTP参数(SIZE和AUTH没有宣告, 但是有些客户端总会带上, 接受了不用)
+	"from": {"BODY", "SMTPUTF8", "RET", "ENVID", "SIZE", "AUTH"},
+	"to":   {"NOTIFY", "ORCPT"},
+}
+
+func smtpParseEnvelope(line string, keyword string) (string, map[string]string, string) { //解析MAIL FROM/RCPT TO的参数(RFC 5321 4.1.2), 返回地址, ESMTP参数(key为大写)和出错时要回复的内容
+	params := make(map[string]string)
+	index := strings.IndexByte(line, ' ')
+	if index == -1 {
+		return "", nil, "501 5.5.4 Error: bad syntax\r\n"
+	}
+	argument := strings.TrimLeft(line[index+1:], " ")
+	if len(argument) < len(keyword)+1 || !strings.EqualFold(argument[:len(keyword)+1], keyword+":") {
+		return "", nil, "501 5.5.4 Error: bad syntax\r\n"
+	}
+	argument = strings.TrimLeft(argument[len(keyword)+1:], " ") //有些客户端会在冒号后面加空格
+	if !strings.HasPrefix(argument, "<") {
+		return "", nil, "501 5.5.4 Error: bad syntax\r\n"
+	}
+	end := -1 //找到路径结尾的'>'(要跳过引号里的内容)
+	inQuote := false
+	for i := 1; i < len(argument); i++ {
+		if inQuote && argument[i] == '\\' {
+			i++
+			continue
+		}
+		if argument[i] == '"' {
+			inQuote = !inQuote
+		} else if argument[i] == '>' && !inQuote {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return "", nil, "501 5.5.4 Error: bad syntax\r\n"
+	}
+	path := argument[1:end]
+	if strings.HasPrefix(path, "@") { //源路由(A-d-l)已经废弃, 跳过不用
+		colon := strings.IndexByte(path, ':')
+		if colon == -1 {
+			return "", nil, "501 5.5.4 Error: bad syntax\r\n"
+		}
+		for _, hop := range strings.Split(path[:colon], ",") {
+			if !strings.HasPrefix(hop, "@") || !isValidEnvelopeDomain(hop[1:]) {
+				return "", nil, "501 5.5.4 Error: bad syntax\r\n"
+			}
+		}
+		path = path[colon+1:]
+	}
+	address := ""
+	if path != "" {
+		var ok bool
+		address, ok = smtpParseMailbox(path)
+		if !ok {
+			if keyword == "to" && strings.EqualFold(path, "postmaster") { //RCPT TO:<Postmaster>不需要域名
+				address = "postmaster@" + config.General.MailDomain
+			} else {
+				return "", nil, "553 5.1.3 Invalid address syntax\r\n"
+			}
+		}
+	} else if keyword != "from" { //只有MAIL FROM可以用空路径(退信)
+		return "", nil, "553 5.1.3 Invalid address syntax\r\n"
+	}
+	for _, param := range strings.Fields(argument[end+1:]) {
+		paramSplit := strings.SplitN(param, "=", 2)
+		key := strings.ToUpper(paramSplit[0])
+		if key == "" || (key[0] < 'A' || key[0] > 'Z') && (key[0] < '0' || key[0] > '9') {
+			return "", nil, "501 5.5.4 Invalid parameter: " + param + "\r\n"
+		}
+		for i := 1; i < len(key); i++ {
+			if !(key[i] >= 'A' && key[i] <= 'Z' || key[i] >= '0' && key[i] <= '9' || key[i] == '-') {
+				return "", nil, "501 5.5.4 Invalid parameter: " + param + "\r\n"
+			}
+		}
+		if _, ok := params[key]; ok { //同一个参数不能出现两次
+			return "", nil, "501 5.5.4 Duplicate parameter: " + param + "\r\n"
+		}
+		known := false
+		for _, name := range smtpKnownParams[keyword] {
+			known = known || name == key
+		}
+		if !known {
+			return "", nil, "555 5.5.4 Unsupported parameter: " + param + "\r\n"
+		}
+		if len(paramSplit) == 2 {
+			if paramSplit[1] == "" || strings.ContainsAny(paramSplit[1], "=") {
+				return "", nil, "501 5.5.4 Invalid parameter: " + param + "\r\n"
+			}
+			params[key] = paramSplit[1]
+		} else {
+			params[key] = ""
+		}
+	}
+	if body, ok := params["BODY"]; ok && !strings.EqualFold(body, "7BIT") && !strings.EqualFold(body, "8BITMIME") {
+		return "", nil, "501 5.5.4 Invalid BODY parameter\r\n"
+	}
+	return address, params, ""
+}
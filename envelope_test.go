@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSmtpParseEnvelope(t *testing.T) {
+	testLoadConfig(t, "")
+	testList := []struct {
+		line      string
+		keyword   string
+		address   string
+		params    map[string]string
+		replyCode string //空为解析成功
+	}{
+		{"MAIL FROM:<>", "from", "", map[string]string{}, ""}, //退信的空路径
+		{"RCPT TO:<>", "to", "", nil, "553"},
+		{"MAIL FROM:<alice@example.com>", "from", "alice@example.com", map[string]string{}, ""},
+		{"mail from: <alice@example.com>", "from", "alice@example.com", map[string]string{}, ""}, //冒号后面有空格
+		{"MAIL FROM:<\"john smith\"@example.com>", "from", "\"john smith\"@example.com", map[string]string{}, ""},
+		{"MAIL FROM:<\"a\\\"b\"@example.com>", "from", "\"a\\\"b\"@example.com", map[string]string{}, ""},
+		{"MAIL FROM:<\"a>b\"@example.com>", "from", "\"a>b\"@example.com", map[string]string{}, ""}, //引号里的>不是结尾
+		{"MAIL FROM:<\"abc\"@example.com>", "from", "abc@example.com", map[string]string{}, ""},     //不需要引号的去掉引号
+		{"MAIL FROM:<\"a\rb\"@example.com>", "from", "", nil, "553"},
+		{"RCPT TO:<@a.example,@b.example:user@host.example>", "to", "user@host.example", map[string]string{}, ""}, //源路由
+		{"RCPT TO:<@a..example:user@host.example>", "to", "", nil, "501"},
+		{"RCPT TO:<@a.example,b.example:user@host.example>", "to", "", nil, "501"},
+		{"RCPT TO:<@a.example user@host.example>", "to", "", nil, "501"},
+		{"MAIL FROM:alice@example.com", "from", "", nil, "501"}, //缺少尖括号
+		{"MAIL FROM:<alice@example.com", "from", "", nil, "501"},
+		{"MAIL FROM:", "from", "", nil, "501"},
+		{"MAIL TO:<alice@example.com>", "from", "", nil, "501"},
+		{"MAIL FROM:<alice@@example.com>", "from", "", nil, "553"},
+		{"MAIL FROM:<.alice@example.com>", "from", "", nil, "553"},
+		{"MAIL FROM:<alice@-example.com>", "from", "", nil, "553"},
+		{"MAIL FROM:<alice@[192.0.2.1]>", "from", "alice@[192.0.2.1]", map[string]string{}, ""},
+		{"MAIL FROM:<" + strings.Repeat("a", 65) + "@example.com>", "from", "", nil, "553"},
+		{"MAIL FROM:<alice@example.com> body=8bitmime SMTPUTF8 ret=HDRS ENVID=abc", "from", "alice@example.com", map[string]string{"BODY": "8bitmime", "SMTPUTF8": "", "RET": "HDRS", "ENVID": "abc"}, ""},
+		{"MAIL FROM:<alice@example.com> BODY=8BITMIME BODY=7BIT", "from", "", nil, "501"}, //重复的参数
+		{"MAIL FROM:<alice@example.com> SMTPUTF8 smtputf8", "from", "", nil, "501"},
+		{"MAIL FROM:<alice@example.com> BODY=BINARYMIME", "from", "", nil, "501"},
+		{"MAIL FROM:<alice@example.com> FOO=bar", "from", "", nil, "555"}, //不认识的参数
+		{"MAIL FROM:<alice@example.com> NOTIFY=NEVER", "from", "", nil, "555"},
+		{"RCPT TO:<alice@example.com> RET=FULL", "to", "", nil, "555"},
+		{"MAIL FROM:<alice@example.com> SIZE=", "from", "", nil, "501"},
+		{"MAIL FROM:<alice@example.com> -X", "from", "", nil, "501"},
+		{"RCPT TO:<alice@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;alice@example.com", "to", "alice@example.com", map[string]string{"NOTIFY": "SUCCESS,FAILURE", "ORCPT": "rfc822;alice@example.com"}, ""},
+		{"RCPT TO:<Postmaster>", "to", "postmaster@example.com", map[string]string{}, ""}, //不带域名的postmaster
+		{"RCPT TO:<postmaster>", "to", "postmaster@example.com", map[string]string{}, ""},
+		{"MAIL FROM:<Postmaster>", "from", "", nil, "553"},
+		{"RCPT TO:<alice>", "to", "", nil, "553"},
+	}
+	for _, test := range testList {
+		address, params, reply := smtpParseEnvelope(test.line, test.keyword)
+		if test.replyCode != "" {
+			if !strings.HasPrefix(reply, test.replyCode+" ") {
+				t.Errorf("%q: reply = %q, want %s", test.line, reply, test.replyCode)
+			}
+			continue
+		}
+		if reply != "" || address != test.address || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%q: got %q %v %q, want %q %v", test.line, address, params, reply, test.address, test.params)
+		}
+	}
+}
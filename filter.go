@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ( //过滤命令的退出码
+	pipeFilterExitAccept   = 0
+	pipeFilterExitTempfail = 75 //EX_TEMPFAIL
+	pipeFilterExitDiscard  = 99
+)
+
+type filterResultStruct struct { //一次内容过滤的结果
+	reply      string //要回复给客户端的内容, 空为接受
+	discard    bool   //接受但是丢弃
+	quarantine string //隔离原因, 空为不隔离
+}
+
+func filterReplyText(code string, text string, defaultText string) string { //把过滤命令给的文字转换成smtp回复, 没有给出同类的回复码就加上默认的
+	text = strings.TrimSpace(text)
+	if text == "" {
+		text = defaultText
+	}
+	if len(text) > 4 && text[0] == code[0] && text[1] >= '0' && text[1] <= '9' && text[2] >= '0' && text[2] <= '9' && text[3] == ' ' {
+		return text + "\r\n"
+	}
+	return code + " " + text + "\r\n"
+}
+
+func pipeFilterWriteMessage(src io.Reader, dstPath string) (int64, error) { //把过滤命令输出的邮件写入文件, 换行统一为CRLF
+	dstFile, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer dstFile.Close()
+	reader := bufio.NewReader(src)
+	writer := bufio.NewWriter(dstFile)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			writer.Write(line)
+			writer.WriteString("\r\n")
+			size += int64(len(line)) + 2
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+	return size, writer.Flush()
+}
+
+func pipeFilterRun(filePath string, envelope smtpEnvelopeStruct) (filterResultStruct, error) { //调用一次过滤命令
+	var result filterResultStruct
+	f, err := os.Open(filePath)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	outputPath := generateCacheFilePath()
+	outputFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return result, err
+	}
+	defer os.Remove(outputPath)
+	defer outputFile.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(config.Smtp.PipeFilter.TimeoutS))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.Smtp.PipeFilter.Command, config.Smtp.PipeFilter.Args...)
+	cmd.Env = append(os.Environ(),
+		"SENDER="+envelope.fromMail,
+		"RECIPIENTS="+strings.Join(envelope.toMail, " "),
+		"CLIENT_ADDRESS="+envelope.clientIp,
+		"CLIENT_HELO="+envelope.heloName,
+		"QUEUE_ID="+path.Base(filePath),
+	)
+	var stderr bytes.Buffer
+	cmd.Stdin = f
+	cmd.Stdout = outputFile
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return result, errors.New("error: filter command timed out")
+	}
+	exitCode := 0
+	if err != nil {
+		exitError, ok := err.(*exec.ExitError)
+		if !ok || exitError.ExitCode() < 0 { //没能运行或者被信号杀掉了
+			return result, err
+		}
+		exitCode = exitError.ExitCode()
+	}
+	message, _, _ := strings.Cut(stderr.String(), "\n")
+	switch exitCode {
+	case pipeFilterExitAccept:
+		outputFile.Close()
+		info, err := os.Stat(outputPath)
+		if err != nil {
+			return result, err
+		}
+		if info.Size() == 0 { //没有输出就保持原来的邮件
+			return result, nil
+		}
+		output, err := os.Open(outputPath)
+		if err != nil {
+			return result, err
+		}
+		defer output.Close()
+		rewritePath := generateCacheFilePath()
+		if _, err = pipeFilterWriteMessage(output, rewritePath); err != nil {
+			os.Remove(rewritePath)
+			return result, err
+		}
+		if err = os.Rename(rewritePath, filePath); err != nil {
+			os.Remove(rewritePath)
+			return result, err
+		}
+	case pipeFilterExitTempfail:
+		result.reply = filterReplyText("451 4.7.1", message, "Message temporarily rejected by content filter")
+	case pipeFilterExitDiscard:
+		result.discard = true
+	default:
+		result.reply = filterReplyText("554 5.7.1", message, "Message rejected by content filter")
+	}
+	return result, nil
+}
+
+func pipeFilterCheck(filePath string, envelope smtpEnvelopeStruct) filterResultStruct { //调用配置的过滤命令
+	if !config.Smtp.PipeFilter.Enable {
+		return filterResultStruct{}
+	}
+	result, err := pipeFilterRun(filePath, envelope)
+	if err != nil {
+		log.Println("Error: filter command " + config.Smtp.PipeFilter.Command + " error: " + err.Error())
+		if config.Smtp.PipeFilter.DefaultAction == "tempfail" {
+			return filterResultStruct{reply: "451 4.7.1 Content filter unavailable, please try again later\r\n"}
+		}
+		return filterResultStruct{} //fail-open
+	}
+	if result.reply != "" || result.discard {
+		log.Println("Info: filter command rejected mail from " + envelope.fromMail + " reply=" + strconv.Quote(strings.TrimSpace(result.reply)) + " discard=" + strconv.FormatBool(result.discard))
+	}
+	return result
+}
+
+func smtpContentFilter(filePath string, envelope smtpEnvelopeStruct, milterSession *milterSessionStruct) filterResultStruct { //收到的邮件投递之前依次经过所有内容过滤
+	if result := clamavCheck(filePath, envelope); result.reply != "" {
+		return result
+	}
+	result := milterSession.message(filePath)
+	if result.reply != "" || result.discard {
+		return result
+	}
+	pipeResult := pipeFilterCheck(filePath, envelope)
+	if pipeResult.reply != "" || pipeResult.discard {
+		return pipeResult
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+func greylistClientKey(ip string) string { //灰名单按网段记录客户端(IPv4取/24, IPv6取/64), 因为大的发信方会从同一个网段的不同地址重试
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return ip
+	}
+	if ipv4 := parsedIp.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsedIp.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func greylistIsExempt(clientIp string, fromMail string, toMail string) bool { //检查是否在豁免列表中
+	if ipInNetworkList(clientIp, greylistExemptNetworks) {
+		return true
+	}
+	for _, exempt := range config.Smtp.Greylist.ExemptAddresses {
+		exempt = strings.ToLower(exempt)
+		for _, address := range []string{strings.ToLower(fromMail), strings.ToLower(toMail)} {
+			if address == exempt || getAddressDomain(address) == exempt {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func greylistCheck(clientIp string, fromMail string, toMail string) string { //RCPT TO时检查灰名单, 需要稍后重试就返回要回复的内容
+	if !config.Smtp.Greylist.Enable || greylistIsExempt(clientIp, fromMail, toMail) {
+		return ""
+	}
+	now := time.Now().Unix()
+	client := greylistClientKey(clientIp)
+	sender := strings.ToLower(fromMail)
+	if sender == "" {
+		sender = "<>"
+	}
+	senderDomain := getAddressDomain(sender)
+	recipient := strings.ToLower(toMail)
+	expire := now - int64(config.Smtp.Greylist.ExpireS)
+	tableName := config.Auth.Sqlite.GreylistTableName
+
+	if config.Smtp.Greylist.AutoWhitelistCount > 0 && senderDomain != "" { //重试成功过足够多次的发件人直接放行
+		row, err := authDatabase.Query("SELECT pass_count FROM "+tableName+" WHERE kind='awl' AND client=? AND sender=? AND last_seen>?", client, senderDomain, expire)
+		if err != nil {
+			log.Println("Error: auth database query failure: " + err.Error())
+			return ""
+		}
+		var passCount int
+		whitelisted := row.Next() && row.Scan(&passCount) == nil && passCount >= config.Smtp.Greylist.AutoWhitelistCount
+		row.Close()
+		if whitelisted {
+			authDatabase.Exec("UPDATE "+tableName+" SET last_seen=? WHERE kind='awl' AND client=? AND sender=?", now, client, senderDomain)
+			return ""
+		}
+	}
+
+	row, err := authDatabase.Query("SELECT first_seen, last_seen, pass_count FROM "+tableName+" WHERE kind='triplet' AND client=? AND sender=? AND recipient=?", client, sender, recipient)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return "" //数据库出问题的时候不能把邮件都拦住
+	}
+	var firstSeen, lastSeen int64
+	var passCount int
+	found := row.Next() && row.Scan(&firstSeen, &lastSeen, &passCount) == nil
+	row.Close()
+
+	if !found || (passCount == 0 && now-firstSeen > int64(config.Smtp.Greylist.RetryWindowS)) || (passCount > 0 && lastSeen <= expire) { //第一次见到(或者太久没有重试/已经过期)就重新开始计时
+		_, err = authDatabase.Exec("DELETE FROM "+tableName+" WHERE last_seen<=? OR (kind='triplet' AND client=? AND sender=? AND recipient=?)", expire, client, sender, recipient)
+		if err != nil {
+			log.Println("Error: auth database update failure: " + err.Error())
+		}
+		_, err = authDatabase.Exec("INSERT INTO "+tableName+"(kind, client, sender, recipient, first_seen, last_seen, pass_count) VALUES('triplet', ?, ?, ?, ?, ?, 0)", client, sender, recipient, now, now)
+		if err != nil {
+			log.Println("Error: auth database update failure: " + err.Error())
+			return ""
+		}
+		log.Println("Info: greylist " + clientIp + " from=" + sender + " to=" + recipient)
+		return "451 4.7.1 Greylisted, please try again later\r\n"
+	}
+	if passCount == 0 && now-firstSeen < int64(config.Smtp.Greylist.DelayS) { //重试得太快
+		return "451 4.7.1 Greylisted, please try again later\r\n"
+	}
+
+	_, err = authDatabase.Exec("UPDATE "+tableName+" SET last_seen=?, pass_count=pass_count+1 WHERE kind='triplet' AND client=? AND sender=? AND recipient=?", now, client, sender, recipient)
+	if err != nil {
+		log.Println("Error: auth database update failure: " + err.Error())
+	}
+	if passCount == 0 && config.Smtp.Greylist.AutoWhitelistCount > 0 && senderDomain != "" { //第一次通过就给这个发件人的自动白名单计数
+		result, err := authDatabase.Exec("UPDATE "+tableName+" SET last_seen=?, pass_count=pass_count+1 WHERE kind='awl' AND client=? AND sender=?", now, client, senderDomain)
+		if err != nil {
+			log.Println("Error: auth database update failure: " + err.Error())
+		} else if affected, _ := result.RowsAffected(); affected == 0 {
+			_, err = authDatabase.Exec("INSERT INTO "+tableName+"(kind, client, sender, recipient, first_seen, last_seen, pass_count) VALUES('awl', ?, ?, '', ?, ?, 1)", client, senderDomain, now, now)
+			if err != nil {
+				log.Println("Error: auth database update failure: " + err.Error())
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const ( //punycode参数(RFC 3492)
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+var (
+	errorPunycodeOverflow = errors.New("error: punycode overflow")
+	errorInvalidDomain    = errors.New("error: invalid domain")
+)
+
+func punycodeAdapt(delta int, numPoints int, firstTime bool) int { //调整bias
+	if firstTime {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+func punycodeDigit(d int) byte { //数字转成punycode字符
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punycodeEncode(input string) (string, error) { //把一个标签编码成punycode(不带xn--前缀)
+	runes := []rune(input)
+	var output []byte
+	for _, r := range runes { //基本字符原样输出
+		if r < 0x80 {
+			output = append(output, byte(r))
+		}
+	}
+	basicCount := len(output)
+	handled := basicCount
+	if basicCount > 0 {
+		output = append(output, '-')
+	}
+	n := punycodeInitialN
+	delta := 0
+	bias := punycodeInitialBias
+	for handled < len(runes) {
+		m := int(^uint(0) >> 1)
+		for _, r := range runes { //找到下一个最小的非基本字符
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m - n) > (int(^uint(0)>>1)-delta)/(handled+1) {
+			return "", errorPunycodeOverflow
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) == n {
+				q := delta
+				for k := punycodeBase; ; k += punycodeBase {
+					t := k - bias
+					if t < punycodeTMin {
+						t = punycodeTMin
+					} else if t > punycodeTMax {
+						t = punycodeTMax
+					}
+					if q < t {
+						break
+					}
+					output = append(output, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+					q = (q - t) / (punycodeBase - t)
+				}
+				output = append(output, punycodeDigit(q))
+				bias = punycodeAdapt(delta, handled+1, handled == basicCount)
+				delta = 0
+				handled++
+			}
+		}
+		delta++
+		n++
+	}
+	return string(output), nil
+}
+
+func isAscii(s string) bool { //是否全是ASCII字符
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func domainToAscii(domain string) (string, error) { //把域名转换成A-label形式(小写), 只做小写映射(没有NFC规范化), 检查标签和域名的长度(RFC 5890)
+	if !utf8.ValidString(domain) {
+		return "", errorInvalidDomain
+	}
+	labels := strings.Split(strings.ToLower(domain), ".")
+	for i, label := range labels {
+		if isAscii(label) {
+			if len(label) > 63 {
+				return "", errorInvalidDomain
+			}
+			continue
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") || (len(label) >= 4 && label[2:4] == "--") { //U-label不能以连字符开头结尾, 第3-4位也不能是"--"(RFC 5891 4.2.3.1)
+			return "", errorInvalidDomain
+		}
+		for _, r := range label {
+			if r <= 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) || r == 0xfffd { //控制字符, 空白和解码失败的字符
+				return "", errorInvalidDomain
+			}
+		}
+		encoded, err := punycodeEncode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = "xn--" + encoded
+		if len(labels[i]) > 63 {
+			return "", errorInvalidDomain
+		}
+	}
+	asciiDomain := strings.Join(labels, ".")
+	if len(strings.TrimSuffix(asciiDomain, ".")) > 253 {
+		return "", errorInvalidDomain
+	}
+	return asciiDomain, nil
+}
+
+func addressToAscii(address string) string { //把邮箱地址的域名部分转换成A-label, 本地部分不变
+	index := strings.LastIndex(address, "@")
+	if index == -1 {
+		return address
+	}
+	domain, err := domainToAscii(address[index+1:])
+	if err != nil {
+		return address
+	}
+	return address[:index+1] + domain
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPunycodeEncode(t *testing.T) { //RFC 3492 7.1的例子
+	testList := []struct {
+		input  string
+		output string
+	}{
+		{"ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"他們爲什麽不說中文", "ihqwctvzc91f659drss3x8bo0yb"},
+		{"Pročprostěnemluvíčesky", "Proprostnemluvesky-uyb24dma41a"},
+		{"למההםפשוטלאמדבריםעברית", "4dbcagdahymbxekheh6e0a7fei0b"},
+		{"なぜみんな日本語を話してくれないのか", "n8jok5ay5dzabd5bym9f0cm5685rrjetr6pdxa"},
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+		{"安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+		{"MajiでKoiする5秒前", "MajiKoi5-783gue6qz075azm5e"},
+		{"パフィーdeルンバ", "de-jg4avhby1noc0d"},
+		{"そのスピードで", "d9juau41awczczp"},
+		{"bücher", "bcher-kva"},
+	}
+	for _, test := range testList {
+		output, err := punycodeEncode(test.input)
+		if err != nil || output != test.output {
+			t.Errorf("punycodeEncode(%q) = %q, %v, want %q", test.input, output, err, test.output)
+		}
+	}
+}
+
+func TestDomainToAscii(t *testing.T) {
+	testList := []struct {
+		input  string
+		output string
+		ok     bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM", "example.com", true},
+		{"münchen.de", "xn--mnchen-3ya.de", true},
+		{"MÜNCHEN.de", "xn--mnchen-3ya.de", true},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", true},
+		{"xn--mnchen-3ya.de", "xn--mnchen-3ya.de", true},
+		{"", "", true},
+		{"-ü.de", "", false},
+		{"ü-.de", "", false},
+		{"\xff.de", "", false},
+		{"a bé.de", "", false},
+		{strings.Repeat("a", 64) + ".de", "", false},
+		{strings.Repeat("ü", 60) + ".de", "", false},
+		{strings.Repeat("abcdefghi.", 26) + "de", "", false},
+	}
+	for _, test := range testList {
+		output, err := domainToAscii(test.input)
+		if (err == nil) != test.ok || output != test.output {
+			t.Errorf("domainToAscii(%q) = %q, %v, want %q ok=%v", test.input, output, err, test.output, test.ok)
+		}
+	}
+}
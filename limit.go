@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type connRateRecord struct { //一个ip在当前一分钟内的连接次数
+	count     int
+	firstTime time.Time
+}
+
+var (
+	connTotal      int
+	connCountMap   = make(map[string]int) //ip -> 当前连接数
+	connRateMap    = make(map[string]*connRateRecord)
+	connLimitMutex sync.Mutex
+)
+
+func acquireConnection(ip string) bool { //新连接进来时检查是否超过限制, 没超过就计数
+	connLimitMutex.Lock()
+	defer connLimitMutex.Unlock()
+	if config.Limit.MaxConnections > 0 && connTotal >= config.Limit.MaxConnections {
+		log.Println("Warning: connection limit reached, reject " + ip)
+		return false
+	}
+	if !ipInNetworkList(ip, limitAllowlist) {
+		if config.Limit.MaxConnectionRatePerIp > 0 {
+			now := time.Now()
+			if len(connRateMap) > 4096 { //顺手清理过期的记录
+				for k, v := range connRateMap {
+					if now.Sub(v.firstTime) > time.Minute {
+						delete(connRateMap, k)
+					}
+				}
+			}
+			record, ok := connRateMap[ip]
+			if !ok || now.Sub(record.firstTime) > time.Minute {
+				record = &connRateRecord{count: 0, firstTime: now}
+				connRateMap[ip] = record
+			}
+			record.count++ //被拒绝的连接也算在频率里
+			if record.count > config.Limit.MaxConnectionRatePerIp {
+				log.Println("Warning: connection rate limit reached, reject " + ip)
+				return false
+			}
+		}
+		if config.Limit.MaxConnectionsPerIp > 0 && connCountMap[ip] >= config.Limit.MaxConnectionsPerIp {
+			log.Println("Warning: per ip connection limit reached, reject " + ip)
+			return false
+		}
+	}
+	connTotal++
+	connCountMap[ip]++
+	return true
+}
+
+func releaseConnection(ip string) { //连接结束时减少计数
+	connLimitMutex.Lock()
+	defer connLimitMutex.Unlock()
+	connTotal--
+	connCountMap[ip]--
+	if connCountMap[ip] <= 0 {
+		delete(connCountMap, ip)
+	}
+}
+
+func rejectConnection(conn net.Conn, reply string) { //回复超过限制的客户端并断开
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	conn.Write([]byte(reply))
+	conn.Close()
+}
+
+func smtpTarpit(invalidRcptCount int) { //无效收件人太多的话拖慢回复
+	if config.Limit.TarpitDelayMs <= 0 || config.Limit.TarpitInvalidRcptThreshold <= 0 || invalidRcptCount < config.Limit.TarpitInvalidRcptThreshold {
+		return
+	}
+	time.Sleep(time.Millisecond * time.Duration(config.Limit.TarpitDelayMs))
+}
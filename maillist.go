@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ( //邮件列表的投稿方式
+	listPolicyOpen        = "open"         //任何人都可以投稿
+	listPolicyMembersOnly = "members_only" //只有成员可以投稿
+	listPolicyModerated   = "moderated"    //管理员直接发出, 其他人的投稿要管理员批准
+)
+
+const ( //邮件列表的几种地址
+	listAddressPost    byte = iota //list@domain 投稿
+	listAddressBounces             //list-bounces@domain 退信(转给管理员)
+	listAddressRequest             //list-request@domain 退订
+)
+
+const ( //等待确认的操作
+	listPendingPost        = "post"        //等待管理员批准的投稿
+	listPendingUnsubscribe = "unsubscribe" //等待成员确认的退订
+)
+
+const listPendingExpireTime = time.Hour * 24 * 7 //等待确认的操作过期时间
+
+var (
+	errorListNotExists     = errors.New("error: list does not exist")
+	errorListTokenNotFound = errors.New("error: token not found or expired")
+)
+
+type mailListStruct struct {
+	address    string
+	policy     string
+	subjectTag string //加在标题前面, 空为不加
+}
+
+type mailListMemberStruct struct {
+	address   string
+	moderator bool
+}
+
+type listPendingStruct struct { //一个等待确认的操作
+	list     string
+	kind     string
+	address  string //投稿的发件人或者要退订的成员
+	filePath string //待批准的投稿保存的位置
+	smtpUtf8 bool
+}
+
+func listSpecialAddress(listAddress string, suffix string) string { //list@domain -> list-suffix@domain
+	index := strings.LastIndex(listAddress, "@")
+	return listAddress[:index] + "-" + suffix + listAddress[index:]
+}
+
+func listGet(address string) (*mailListStruct, error) { //读取一个邮件列表, 不存在就返回nil
+	row, err := authDatabase.Query("SELECT address, policy, subject_tag FROM "+config.Auth.Sqlite.ListTableName+" WHERE address=? OR address=?", strings.ToLower(address), strings.ToLower(addressToAscii(address)))
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+	if !row.Next() {
+		return nil, nil
+	}
+	list := &mailListStruct{}
+	err = row.Scan(&list.address, &list.policy, &list.subjectTag)
+	return list, err
+}
+
+func listLookupAddress(address string) (*mailListStruct, byte) { //查找一个地址是不是邮件列表的地址, 不是就返回nil
+	list, err := listGet(address)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return nil, listAddressPost
+	}
+	if list != nil {
+		return list, listAddressPost
+	}
+	index := strings.LastIndex(address, "@")
+	if index == -1 {
+		return nil, listAddressPost
+	}
+	for suffix, kind := range map[string]byte{"-bounces": listAddressBounces, "-request": listAddressRequest} {
+		if strings.HasSuffix(strings.ToLower(address[:index]), suffix) {
+			if list, err = listGet(address[:index-len(suffix)] + address[index:]); err == nil && list != nil {
+				return list, kind
+			}
+		}
+	}
+	return nil, listAddressPost
+}
+
+func listGetMembers(listAddress string) ([]mailListMemberStruct, error) { //读取邮件列表的成员
+	row, err := authDatabase.Query("SELECT member, moderator FROM "+config.Auth.Sqlite.ListMemberTableName+" WHERE list=?", listAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+	var memberList []mailListMemberStruct
+	for row.Next() {
+		var member mailListMemberStruct
+		if err = row.Scan(&member.address, &member.moderator); err != nil {
+			return nil, err
+		}
+		memberList = append(memberList, member)
+	}
+	return memberList, nil
+}
+
+func listGetModerators(listAddress string) []string { //获取邮件列表的管理员地址
+	memberList, err := listGetMembers(listAddress)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return nil
+	}
+	var moderatorList []string
+	for _, member := range memberList {
+		if member.moderator {
+			moderatorList = append(moderatorList, member.address)
+		}
+	}
+	return moderatorList
+}
+
+func listFindMember(memberList []mailListMemberStruct, address string) *mailListMemberStruct { //在成员中找一个地址, 没有就返回nil
+	for i := range memberList {
+		if strings.EqualFold(memberList[i].address, address) || strings.EqualFold(addressToAscii(memberList[i].address), addressToAscii(address)) {
+			return &memberList[i]
+		}
+	}
+	return nil
+}
+
+func listAll() ([]mailListStruct, error) { //列出所有邮件列表
+	row, err := authDatabase.Query("SELECT address, policy, subject_tag FROM " + config.Auth.Sqlite.ListTableName)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+	var listList []mailListStruct
+	for row.Next() {
+		var list mailListStruct
+		if err = row.Scan(&list.address, &list.policy, &list.subjectTag); err != nil {
+			return nil, err
+		}
+		listList = append(listList, list)
+	}
+	return listList, nil
+}
+
+func listCreate(address string, policy string, subjectTag string) error { //创建一个邮件列表
+	address = strings.ToLower(address)
+	if policy != listPolicyOpen && policy != listPolicyMembersOnly && policy != listPolicyModerated {
+		return errors.New("error: policy must be open, members_only or moderated")
+	}
+	if !isLocalDomain(getAddressDomain(address)) {
+		return errors.New("error: list must be in a local domain")
+	}
+	if smtpCheckAddressExists(address) {
+		return errors.New("error: address is a mailbox")
+	}
+	if targetList, err := aliasLookup(address); err != nil || len(targetList) != 0 {
+		return errors.New("error: address is an alias")
+	}
+	if list, _ := listLookupAddress(address); list != nil {
+		return errors.New("error: list already exists")
+	}
+	_, err := authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.ListTableName+"(address, policy, subject_tag) VALUES(?, ?, ?)", address, policy, subjectTag)
+	return err
+}
+
+func listDelete(address string) error { //删除一个邮件列表和它的成员
+	list, err := listGet(address)
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		return errorListNotExists
+	}
+	if _, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.ListMemberTableName+" WHERE list=?", list.address); err != nil {
+		return err
+	}
+	_, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.ListTableName+" WHERE address=?", list.address)
+	return err
+}
+
+func listAddMember(listAddress string, member string, moderator bool) error { //添加成员(已经是成员的话只修改是否为管理员)
+	list, err := listGet(listAddress)
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		return errorListNotExists
+	}
+	if !strings.Contains(member, "@") {
+		return errors.New("error: invalid member address")
+	}
+	memberList, err := listGetMembers(list.address)
+	if err != nil {
+		return err
+	}
+	if exists := listFindMember(memberList, member); exists != nil {
+		_, err = authDatabase.Exec("UPDATE "+config.Auth.Sqlite.ListMemberTableName+" SET moderator=? WHERE list=? AND member=?", moderator, list.address, exists.address)
+		return err
+	}
+	_, err = authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.ListMemberTableName+"(list, member, moderator) VALUES(?, ?, ?)", list.address, member, moderator)
+	return err
+}
+
+func listRemoveMember(listAddress string, member string) error { //删除成员
+	list, err := listGet(listAddress)
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		return errorListNotExists
+	}
+	memberList, err := listGetMembers(list.address)
+	if err != nil {
+		return err
+	}
+	exists := listFindMember(memberList, member)
+	if exists == nil {
+		return errors.New("error: not a member")
+	}
+	_, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.ListMemberTableName+" WHERE list=? AND member=?", list.address, exists.address)
+	return err
+}
+
+func listCheckSender(list *mailListStruct, sender string) string { //检查发件人能不能给只允许成员投稿的列表发信, 不能就返回要回复的内容
+	if list.policy != listPolicyMembersOnly {
+		return ""
+	}
+	memberList, err := listGetMembers(list.address)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return "451 4.3.0 Requested action aborted: local error in processing\r\n"
+	}
+	if listFindMember(memberList, sender) == nil {
+		return "550 5.7.1 Only members can post to " + list.address + "\r\n"
+	}
+	return ""
+}
+
+func listDeliver(filePath string, envelope smtpEnvelopeStruct, address string) { //投递给邮件列表的地址(投稿或者退订)
+	list, kind := listLookupAddress(address)
+	if list == nil {
+		return
+	}
+	headerList, _, err := readMailFileHeaderList(filePath)
+	if err != nil {
+		log.Println("Error: list " + list.address + " read mail error: " + err.Error())
+		return
+	}
+	if kind == listAddressRequest {
+		listRequest(list, envelope, headerList)
+		return
+	}
+	listPost(filePath, envelope, list, headerList, false)
+}
+
+func listPendingAdd(pending listPendingStruct) (string, error) { //保存一个等待确认的操作, 返回随机的确认码
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	_, err := authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.ListPendingTableName+"(token, list, kind, address, file_path, smtputf8, expire) VALUES(?, ?, ?, ?, ?, ?, ?)", token, pending.list, pending.kind, pending.address, pending.filePath, pending.smtpUtf8, time.Now().Add(listPendingExpireTime).Unix())
+	return token, err
+}
+
+func listPendingCleanup() { //删掉过期的操作和它们保存的投稿
+	row, err := authDatabase.Query("SELECT file_path FROM "+config.Auth.Sqlite.ListPendingTableName+" WHERE expire<?", time.Now().Unix())
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return
+	}
+	var filePathList []string
+	for row.Next() {
+		var filePath string
+		if err = row.Scan(&filePath); err == nil && filePath != "" {
+			filePathList = append(filePathList, filePath)
+		}
+	}
+	row.Close()
+	for _, filePath := range filePathList {
+		os.Remove(filePath)
+	}
+	if _, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.ListPendingTableName+" WHERE expire<?", time.Now().Unix()); err != nil {
+		log.Println("Error: auth database delete failure: " + err.Error())
+	}
+}
+
+func listPendingTake(listAddress string, kind string, token string) (*listPendingStruct, error) { //取出(并删除)一个等待确认的操作, 没有或者已经过期就返回nil
+	listPendingCleanup()
+	token = strings.ToLower(token)
+	row, err := authDatabase.Query("SELECT list, kind, address, file_path, smtputf8 FROM "+config.Auth.Sqlite.ListPendingTableName+" WHERE token=? AND list=? AND kind=?", token, listAddress, kind)
+	if err != nil {
+		return nil, err
+	}
+	if !row.Next() {
+		row.Close()
+		return nil, nil
+	}
+	pending := &listPendingStruct{}
+	err = row.Scan(&pending.list, &pending.kind, &pending.address, &pending.filePath, &pending.smtpUtf8)
+	row.Close()
+	if err != nil {
+		return nil, err
+	}
+	result, err := authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.ListPendingTableName+" WHERE token=?", token)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 { //同时有两个请求用了这个确认码
+		return nil, nil
+	}
+	return pending, nil
+}
+
+func listApprove(listAddress string, token string) error { //批准一封待批准的投稿, 发给所有成员
+	list, err := listGet(listAddress)
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		return errorListNotExists
+	}
+	pending, err := listPendingTake(list.address, listPendingPost, token)
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		return errorListTokenNotFound
+	}
+	defer os.Remove(pending.filePath)
+	headerList, _, err := readMailFileHeaderList(pending.filePath)
+	if err != nil {
+		return err
+	}
+	log.Println("Info: list " + list.address + " post from " + pending.address + " approved")
+	listPost(pending.filePath, smtpEnvelopeStruct{fromMail: pending.address, smtpUtf8: pending.smtpUtf8, arrivalTime: time.Now()}, list, headerList, true)
+	return nil
+}
+
+func listReject(listAddress string, token string) error { //拒绝一封待批准的投稿(直接删掉)
+	list, err := listGet(listAddress)
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		return errorListNotExists
+	}
+	pending, err := listPendingTake(list.address, listPendingPost, token)
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		return errorListTokenNotFound
+	}
+	os.Remove(pending.filePath)
+	log.Println("Info: list " + list.address + " post from " + pending.address + " rejected")
+	return nil
+}
+
+func isListToken(token string) bool { //确认码是32位十六进制
+	if len(token) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+func listRequest(list *mailListStruct, envelope smtpEnvelopeStruct, headerList []string) { //处理发到list-request的请求(标题里带unsubscribe, confirm/approve/reject加确认码)
+	subject := ""
+	if index := findHeader(headerList, "subject"); index != -1 {
+		subject = getHeaderValue(headerList[index])
+		if decoded, err := (&mime.WordDecoder{}).DecodeHeader(subject); err == nil {
+			subject = decoded
+		}
+	}
+	wordList := strings.Fields(strings.ToLower(subject))
+	for i := 0; i+1 < len(wordList); i++ { //回复时标题前面会加上Re:之类的, 所以在整个标题里找
+		token := strings.Trim(wordList[i+1], "()[]<>.,:")
+		if !isListToken(token) {
+			continue
+		}
+		switch strings.Trim(wordList[i], "()[]<>.,:") {
+		case "confirm": //确认码只发给了成员自己, 所以伪造发件人也没法退订别人
+			pending, err := listPendingTake(list.address, listPendingUnsubscribe, token)
+			if err != nil {
+				log.Println("Error: auth database query failure: " + err.Error())
+				return
+			}
+			if pending == nil {
+				log.Println("Warning: list " + list.address + " unsubscribe confirmation with unknown token from " + envelope.fromMail)
+				return
+			}
+			if err = listRemoveMember(list.address, pending.address); err != nil {
+				log.Println("Warning: list " + list.address + " unsubscribe " + pending.address + " error: " + err.Error())
+				return
+			}
+			log.Println("Info: list " + list.address + " member " + pending.address + " unsubscribed")
+			return
+		case "approve": //确认码只发给了管理员
+			if err := listApprove(list.address, token); err != nil {
+				log.Println("Warning: list " + list.address + " approve from " + envelope.fromMail + " error: " + err.Error())
+			}
+			return
+		case "reject":
+			if err := listReject(list.address, token); err != nil {
+				log.Println("Warning: list " + list.address + " reject from " + envelope.fromMail + " error: " + err.Error())
+			}
+			return
+		}
+	}
+	if envelope.fromMail == "" || !strings.Contains(strings.ToLower(subject), "unsubscribe") {
+		return
+	}
+	listUnsubscribeRequest(list, envelope.fromMail)
+}
+
+func listUnsubscribeRequest(list *mailListStruct, address string) { //给要退订的成员发一封带确认码的邮件, 成员回复之后才真正退订
+	memberList, err := listGetMembers(list.address)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return
+	}
+	member := listFindMember(memberList, address)
+	if member == nil {
+		log.Println("Warning: list " + list.address + " unsubscribe request from non-member " + address + ", ignored")
+		return
+	}
+	token, err := listPendingAdd(listPendingStruct{list: list.address, kind: listPendingUnsubscribe, address: member.address})
+	if err != nil {
+		log.Println("Error: list " + list.address + " save unsubscribe request error: " + err.Error())
+		return
+	}
+	requestAddress := listSpecialAddress(list.address, "request")
+	content := "From: <" + requestAddress + ">\r\n" +
+		"To: <" + member.address + ">\r\n" +
+		"Subject: confirm " + token + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: " + generateMessageId() + "\r\n" +
+		"Auto-Submitted: auto-replied\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"Someone asked to remove " + member.address + " from " + list.address + ".\r\n" +
+		"To confirm, reply to this mail without changing the subject.\r\n" +
+		"If you did not ask for this, just ignore this mail.\r\n"
+	cachePath := generateCacheFilePath()
+	if err = os.WriteFile(cachePath, []byte(content), 0644); err != nil {
+		log.Println("Error: list " + list.address + " unsubscribe confirmation error: " + err.Error())
+		os.Remove(cachePath)
+		return
+	}
+	log.Println("Info: list " + list.address + " unsubscribe confirmation sent to " + member.address)
+	smtpQueueMail(smtpEnvelopeStruct{fromMail: "", toMail: []string{member.address}, arrivalTime: time.Now()}, cachePath)
+}
+
+func listPost(filePath string, envelope smtpEnvelopeStruct, list *mailListStruct, headerList []string, approved bool) { //把一封投稿发给所有成员, approved为管理员已经批准过
+	listId := strings.Replace(addressToAscii(list.address), "@", ".", 1)
+	if envelope.fromMail == "" { //退信不发给成员
+		log.Println("Warning: list " + list.address + " got mail with empty sender, dropped")
+		return
+	}
+	for _, header := range headerList {
+		if getHeaderName(header) == "list-id" && strings.Contains(getHeaderValue(header), "<"+listId+">") {
+			log.Println("Warning: list " + list.address + " mail loop detected, dropped")
+			return
+		}
+	}
+	memberList, err := listGetMembers(list.address)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return
+	}
+	sender := listFindMember(memberList, envelope.fromMail)
+	if !approved && list.policy == listPolicyMembersOnly && sender == nil {
+		smtpSendDsn(envelope, []dsnResultStruct{{address: list.address, action: "failed", status: "5.7.1", diagnostic: "550 5.7.1 Only members can post to " + list.address}}, filePath)
+		return
+	}
+	if !approved && list.policy == listPolicyModerated && (sender == nil || !sender.moderator) {
+		listHold(filePath, envelope, list, headerList)
+		return
+	}
+	var toMail []string
+	for _, member := range memberList {
+		toMail = append(toMail, member.address)
+	}
+	if len(toMail) == 0 {
+		return
+	}
+	cachePath := generateCacheFilePath()
+	if _, err = copyFile(filePath, cachePath); err == nil {
+		err = rewriteMailHeader(cachePath, func(headerList []string) []string {
+			var newHeaderList []string
+			for _, header := range headerList { //去掉原来的列表头部(比如从别的列表转过来的)
+				switch getHeaderName(header) {
+				case "list-id", "list-unsubscribe", "list-post", "list-help", "list-subscribe", "list-owner", "list-archive", "precedence":
+					continue
+				case "subject":
+					if list.subjectTag != "" && !strings.Contains(getHeaderValue(header), list.subjectTag) {
+						header = header[:strings.Index(header, ":")+1] + " " + list.subjectTag + " " + strings.TrimLeft(header[strings.Index(header, ":")+1:], " \t")
+					}
+				}
+				newHeaderList = append(newHeaderList, header)
+			}
+			if list.subjectTag != "" && findHeader(newHeaderList, "subject") == -1 {
+				newHeaderList = append(newHeaderList, "Subject: "+list.subjectTag+"\r\n")
+			}
+			return append(newHeaderList,
+				"List-Id: <"+listId+">\r\n",
+				"List-Post: <mailto:"+list.address+">\r\n",
+				"List-Unsubscribe: <mailto:"+listSpecialAddress(list.address, "request")+"?subject=unsubscribe>\r\n",
+				"Precedence: list\r\n")
+		})
+	}
+	if err != nil {
+		log.Println("Error: list " + list.address + " prepare mail error: " + err.Error())
+		os.Remove(cachePath)
+		return
+	}
+	log.Println("Info: list " + list.address + " post from " + envelope.fromMail + " sent to " + strings.Join(toMail, ", "))
+	smtpQueueMail(smtpEnvelopeStruct{fromMail: listSpecialAddress(list.address, "bounces"), toMail: toMail, smtpUtf8: envelope.smtpUtf8, arrivalTime: time.Now()}, cachePath) //退信回到列表(转给管理员)
+}
+
+func listHold(filePath string, envelope smtpEnvelopeStruct, list *mailListStruct, headerList []string) { //需要批准的投稿保存在服务器上, 把确认码发给管理员, 用命令行或者回复确认码来批准
+	moderatorList := listGetModerators(list.address)
+	if len(moderatorList) == 0 {
+		smtpSendDsn(envelope, []dsnResultStruct{{address: list.address, action: "failed", status: "5.7.1", diagnostic: "550 5.7.1 List " + list.address + " has no moderator"}}, filePath)
+		return
+	}
+	heldPath := generateCacheFilePath()
+	if _, err := copyFile(filePath, heldPath); err != nil {
+		log.Println("Error: list " + list.address + " hold mail error: " + err.Error())
+		os.Remove(heldPath)
+		return
+	}
+	token, err := listPendingAdd(listPendingStruct{list: list.address, kind: listPendingPost, address: envelope.fromMail, filePath: heldPath, smtpUtf8: envelope.smtpUtf8})
+	if err != nil {
+		log.Println("Error: list " + list.address + " hold mail error: " + err.Error())
+		os.Remove(heldPath)
+		return
+	}
+	subject := ""
+	if index := findHeader(headerList, "subject"); index != -1 {
+		subject = getHeaderValue(headerList[index])
+		if decoded, err := (&mime.WordDecoder{}).DecodeHeader(subject); err == nil {
+			subject = decoded
+		}
+	}
+	boundaryBytes := make([]byte, 12)
+	rand.Read(boundaryBytes)
+	boundary := "=_" + hex.EncodeToString(boundaryBytes)
+	cachePath := generateCacheFilePath()
+	f, err := os.OpenFile(cachePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error: list " + list.address + " hold mail error: " + err.Error())
+		listPendingTake(list.address, listPendingPost, token)
+		os.Remove(heldPath)
+		return
+	}
+	writer := bufio.NewWriter(f)
+	writer.WriteString("From: <" + listSpecialAddress(list.address, "bounces") + ">\r\n")
+	writer.WriteString("To: " + strings.Join(moderatorList, ", ") + "\r\n")
+	writer.WriteString("Reply-To: <" + listSpecialAddress(list.address, "request") + ">\r\n")
+	writer.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", "Moderation required for "+list.address+": "+subject+" (approve "+token+")") + "\r\n")
+	writer.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	writer.WriteString("Message-ID: " + generateMessageId() + "\r\n")
+	writer.WriteString("Auto-Submitted: auto-generated\r\n")
+	writer.WriteString("MIME-Version: 1.0\r\n")
+	writer.WriteString("Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n")
+	writer.WriteString("--" + boundary + "\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	writer.WriteString("A post from " + envelope.fromMail + " to " + list.address + " is waiting for approval.\r\n")
+	writer.WriteString("To approve it, reply to this mail without changing the subject, or run on the server:\r\n")
+	writer.WriteString("    simpmailserv list approve " + list.address + " " + token + "\r\n")
+	writer.WriteString("To reject it, reply with the subject \"reject " + token + "\", run \"simpmailserv list reject " + list.address + " " + token + "\", or just ignore this mail.\r\n")
+	writer.WriteString("Posts that are not approved are dropped after " + strconv.Itoa(int(listPendingExpireTime/(time.Hour*24))) + " days.\r\n")
+	writer.WriteString("\r\n--" + boundary + "\r\nContent-Type: message/rfc822\r\n\r\n")
+	originalFile, err := os.Open(filePath)
+	if err == nil {
+		_, err = io.Copy(writer, originalFile)
+		originalFile.Close()
+	}
+	writer.WriteString("\r\n--" + boundary + "--\r\n")
+	if err == nil {
+		err = writer.Flush()
+	}
+	f.Close()
+	if err != nil {
+		log.Println("Error: list " + list.address + " hold mail error: " + err.Error())
+		os.Remove(cachePath)
+		listPendingTake(list.address, listPendingPost, token)
+		os.Remove(heldPath)
+		return
+	}
+	log.Println("Info: list " + list.address + " post from " + envelope.fromMail + " held for moderation, token " + token)
+	smtpQueueMail(smtpEnvelopeStruct{fromMail: "", toMail: moderatorList, arrivalTime: time.Now()}, cachePath)
+}
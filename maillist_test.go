@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func testListSetup(t *testing.T) { //一个需要批准的列表, alice是管理员, bob是成员
+	t.Helper()
+	testLoadConfig(t, "")
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	testAddUser(t, "bob", "bob@example.com", "pw")
+	if err := listCreate("team@example.com", listPolicyModerated, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := listAddMember("team@example.com", "alice@example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := listAddMember("team@example.com", "bob@example.com", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testListDeliver(t *testing.T, fromMail string, address string, content string) { //把一封邮件交给列表处理, 等列表发出的邮件都投递完
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), "mail")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	listDeliver(filePath, smtpEnvelopeStruct{fromMail: fromMail, toMail: []string{address}}, address)
+	smtpQueueWaitGroup.Wait()
+}
+
+func testReadMailbox(t *testing.T, address string) []string { //读取一个邮箱里的所有邮件
+	t.Helper()
+	mailInfoList, err := getMailAllInfo(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mailList []string
+	for _, info := range mailInfoList {
+		data, err := os.ReadFile(info.filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mailList = append(mailList, string(data))
+	}
+	return mailList
+}
+
+func testFindToken(t *testing.T, mail string, command string) string {
+	t.Helper()
+	match := regexp.MustCompile(command + ` ([0-9a-f]{32})`).FindStringSubmatch(mail)
+	if match == nil {
+		t.Fatalf("no %s token in:\n%s", command, mail)
+	}
+	return match[1]
+}
+
+func TestListModeration(t *testing.T) {
+	testListSetup(t)
+	testListDeliver(t, "someone@other.net", "team@example.com", "From: someone@other.net\r\nSubject: hello\r\n\r\nfirst post\r\n")
+	if mailList := testReadMailbox(t, "bob@example.com"); len(mailList) != 0 {
+		t.Fatalf("held post delivered to members")
+	}
+	mailList := testReadMailbox(t, "alice@example.com")
+	if len(mailList) != 1 {
+		t.Fatalf("moderator got %d mails", len(mailList))
+	}
+	token := testFindToken(t, mailList[0], "approve")
+	if !strings.Contains(mailList[0], "Reply-To: <team-request@example.com>\r\n") {
+		t.Errorf("notice does not ask for replies to team-request")
+	}
+
+	if err := listApprove("team@example.com", strings.Repeat("0", 32)); err != errorListTokenNotFound {
+		t.Errorf("approve with a wrong token: %v", err)
+	}
+	testListDeliver(t, "alice@example.com", "team-request@example.com", "From: alice@example.com\r\nSubject: Re: Moderation required for team@example.com: hello (approve "+token+")\r\n\r\nok\r\n") //管理员回复通知邮件
+	mailList = testReadMailbox(t, "bob@example.com")
+	if len(mailList) != 1 || !strings.Contains(mailList[0], "first post") || !strings.Contains(mailList[0], "List-Id: <team.example.com>\r\n") {
+		t.Fatalf("approved post not delivered: %q", mailList)
+	}
+	if err := listApprove("team@example.com", token); err != errorListTokenNotFound {
+		t.Errorf("token used twice: %v", err)
+	}
+
+	testListDeliver(t, "someone@other.net", "team@example.com", "From: someone@other.net\r\nSubject: second\r\n\r\nsecond post\r\n")
+	mailList = testReadMailbox(t, "alice@example.com")
+	var secondToken string
+	for _, mail := range mailList {
+		if strings.Contains(mail, "second") && strings.Contains(mail, "Moderation required") {
+			secondToken = testFindToken(t, mail, "approve")
+		}
+	}
+	if secondToken == "" {
+		t.Fatalf("no notice for the second post")
+	}
+	if err := listReject("team@example.com", secondToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := listApprove("team@example.com", secondToken); err != errorListTokenNotFound {
+		t.Errorf("approve after reject: %v", err)
+	}
+	if mailList = testReadMailbox(t, "bob@example.com"); len(mailList) != 1 {
+		t.Errorf("rejected post delivered")
+	}
+}
+
+func TestListUnsubscribeConfirm(t *testing.T) {
+	testListSetup(t)
+	testListDeliver(t, "bob@example.com", "team-request@example.com", "From: bob@example.com\r\nSubject: unsubscribe\r\n\r\n") //发件人可以伪造, 所以只发确认邮件
+	memberList, _ := listGetMembers("team@example.com")
+	if listFindMember(memberList, "bob@example.com") == nil {
+		t.Fatalf("member removed without confirmation")
+	}
+	mailList := testReadMailbox(t, "bob@example.com")
+	if len(mailList) != 1 {
+		t.Fatalf("member got %d mails", len(mailList))
+	}
+	token := testFindToken(t, mailList[0], "confirm")
+
+	testListDeliver(t, "bob@example.com", "team-request@example.com", "From: bob@example.com\r\nSubject: Re: confirm "+strings.Repeat("0", 32)+"\r\n\r\n")
+	memberList, _ = listGetMembers("team@example.com")
+	if listFindMember(memberList, "bob@example.com") == nil {
+		t.Fatalf("member removed with a wrong token")
+	}
+	testListDeliver(t, "bob@example.com", "team-request@example.com", "From: bob@example.com\r\nSubject: Re: confirm "+token+"\r\n\r\n")
+	memberList, _ = listGetMembers("team@example.com")
+	if listFindMember(memberList, "bob@example.com") != nil {
+		t.Errorf("member not removed after confirmation")
+	}
+
+	testListDeliver(t, "nobody@other.net", "team-request@example.com", "From: nobody@other.net\r\nSubject: unsubscribe\r\n\r\n") //不是成员就不发确认邮件
+	if mailList = testReadMailbox(t, "alice@example.com"); len(mailList) != 0 {
+		t.Errorf("unexpected mail to alice")
+	}
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"crypto/sha512"
-	"encoding/base64"
 	"fmt"
 	"log"
 	"os"
@@ -19,6 +17,31 @@ deluser <username>: Delete a user
 addmail <username> <mail_address>: Add a mail address for a exists user
 delmail <username> <mail_address>: Delete a mail address for a exists (Note that if a account does not have any mail address it will be removed)
 delmailfile <mail_address>: Delete mail address all file
+addapppass <username> <name> [smtp|pop3|sieve]: Add an app password for a exists user (Limited to one service if given)
+delapppass <username> <name>: Revoke an app password
+listapppass <username>: List app passwords of a user
+addalias <alias> <target>: Add a target address for an alias (Use *@domain for a catch-all, an alias can have several targets)
+delalias <alias> [target]: Delete a target of an alias (All targets if not given)
+adddomain <domain> [target_domain]: Host a domain (As an alias of target_domain if given, mail to user@domain is delivered to user@target_domain)
+deldomain <domain>: Stop hosting a domain (Users and aliases in it are not removed)
+listdomain: List hosted domains
+list create <list_address> [open|members_only|moderated] [subject_tag]: Create a mailing list (members_only by default, posts to a moderated list are sent to its moderators for approval)
+list add <list_address> <member_address> [moderator]: Add a member to a mailing list (Or change whether it is a moderator)
+list remove <list_address> <member_address>: Remove a member from a mailing list
+list delete <list_address>: Delete a mailing list
+list approve <list_address> <token>: Approve a post held for moderation (The token is in the mail sent to the moderators)
+list reject <list_address> <token>: Reject a post held for moderation
+list show [list_address]: Show all mailing lists, or the settings and members of one
+ban list: List active ip/user bans
+ban unban <ip|username>: Lift a ban
+sieve list <username>: List sieve scripts of a user
+sieve put <username> <name> <file>: Check and save a sieve script
+sieve get <username> <name>: Output a sieve script
+sieve activate <username> <name>: Make a sieve script the active one
+sieve deactivate <username>: Stop running sieve scripts for a user
+sieve delete <username> <name>: Delete a sieve script (active scripts must be deactivated first)
+sieve check <file>: Check the syntax of a sieve script
+spam train <ham|spam> <file|mailbox>: Train the spam classifier with a mail file or folder (global), or a mail address with an optional /folder (that mailbox only)
 `
 
 var (
@@ -34,8 +57,10 @@ func main() {
 			fmt.Print(helpOutput)
 		case "start": //运行服务器
 			smtpServer()
+			queueRestore() //继续上次没有完成的重试
 			pop3Server()
-			if config.Smtp.Inbound.EnablePlain || config.Smtp.Inbound.EnableTls || config.Pop3.EnablePlain || config.Pop3.EnableTls {
+			managesieveServer()
+			if config.Smtp.Inbound.EnablePlain || config.Smtp.Inbound.EnableTls || config.Smtp.Submission.Enable || config.Pop3.EnablePlain || config.Pop3.EnableTls || config.ManageSieve.Enable {
 				ch := make(chan int)
 				<-ch
 			}
@@ -43,8 +68,7 @@ func main() {
 			if len(os.Args) < 5 {
 				fmt.Println("Wrong syntax. Use help to get command list")
 			}
-			saltBytes := sha512.Sum512([]byte(strconv.FormatInt(time.Now().UnixNano(), 10)))
-			salt := base64.StdEncoding.EncodeToString(saltBytes[:])
+			salt := generateSalt()
 			passwordSha256WithSaltHex := getPasswordHash(os.Args[4], salt)
 			_, err := authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.TableName+"(username, mail_address, password_sha256_with_salt_hex, salt) VALUES(?, ?, ?, ?)", os.Args[2], os.Args[3], passwordSha256WithSaltHex, salt)
 			if err != nil {
@@ -59,6 +83,11 @@ func main() {
 			_, err := authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.TableName+" WHERE username=?", os.Args[2])
 			if err != nil {
 				fmt.Println("Error: delete user error: " + err.Error())
+				return
+			}
+			_, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.AppPasswordTableName+" WHERE username=?", os.Args[2]) //顺便删掉应用专用密码
+			if err != nil {
+				fmt.Println("Error: delete user app password error: " + err.Error())
 			} else {
 				fmt.Println("Delete user successful")
 			}
@@ -110,6 +139,419 @@ func main() {
 			} else {
 				fmt.Println("Delete mail file successful")
 			}
+		case "addapppass": //添加应用专用密码
+			if len(os.Args) < 4 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			var service string
+			if len(os.Args) >= 5 {
+				service = os.Args[4]
+				if service != "smtp" && service != "pop3" && service != "sieve" {
+					fmt.Println("Error: service must be smtp, pop3 or sieve")
+					return
+				}
+			}
+			if len(usernameGetAddress(os.Args[2])) == 0 {
+				fmt.Println("Error: user does not exists")
+				return
+			}
+			row, err := authDatabase.Query("SELECT name FROM "+config.Auth.Sqlite.AppPasswordTableName+" WHERE username=? AND name=?", os.Args[2], os.Args[3])
+			if err != nil {
+				fmt.Println("Error: database query failure: " + err.Error())
+				return
+			}
+			exists := row.Next()
+			row.Close()
+			if exists {
+				fmt.Println("Error: app password " + os.Args[3] + " already exists")
+				return
+			}
+			password := generateAppPassword()
+			salt := generateSalt()
+			_, err = authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.AppPasswordTableName+"(username, name, service, password_sha256_with_salt_hex, salt, last_used) VALUES(?, ?, ?, ?, ?, 0)", os.Args[2], os.Args[3], service, getPasswordHash(password, salt), salt)
+			if err != nil {
+				fmt.Println("Error: add app password error: " + err.Error())
+			} else {
+				fmt.Println("Add app password successful. Password (only shown once): " + password)
+			}
+		case "delapppass": //吊销应用专用密码
+			if len(os.Args) < 4 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			result, err := authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.AppPasswordTableName+" WHERE username=? AND name=?", os.Args[2], os.Args[3])
+			if err != nil {
+				fmt.Println("Error: delete app password error: " + err.Error())
+				return
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				fmt.Println("Error: app password does not exists")
+			} else {
+				fmt.Println("Delete app password successful")
+			}
+		case "listapppass": //列出应用专用密码
+			if len(os.Args) < 3 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			row, err := authDatabase.Query("SELECT name, service, last_used FROM "+config.Auth.Sqlite.AppPasswordTableName+" WHERE username=?", os.Args[2])
+			if err != nil {
+				fmt.Println("Error: database query failure: " + err.Error())
+				return
+			}
+			defer row.Close()
+			for row.Next() {
+				var name string
+				var service string
+				var lastUsed int64
+				err = row.Scan(&name, &service, &lastUsed)
+				if err != nil {
+					fmt.Println("Error: database query failure: " + err.Error())
+					return
+				}
+				if service == "" {
+					service = "all"
+				}
+				lastUsedString := "never"
+				if lastUsed != 0 {
+					lastUsedString = time.Unix(lastUsed, 0).Format(time.RFC3339)
+				}
+				fmt.Println(name + " service: " + service + " last used: " + lastUsedString)
+			}
+		case "addalias": //添加别名
+			if len(os.Args) < 4 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			err := addAlias(os.Args[2], os.Args[3])
+			if err != nil {
+				fmt.Println("Error: add alias error: " + err.Error())
+			} else {
+				fmt.Println("Add alias successful")
+			}
+		case "delalias": //删除别名
+			if len(os.Args) < 3 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			var target string
+			if len(os.Args) >= 4 {
+				target = os.Args[3]
+			}
+			deleted, err := delAlias(os.Args[2], target)
+			if err != nil {
+				fmt.Println("Error: delete alias error: " + err.Error())
+			} else if deleted == 0 {
+				fmt.Println("Error: alias does not exists")
+			} else {
+				fmt.Println("Delete alias successful")
+			}
+		case "adddomain": //添加托管的域名
+			if len(os.Args) < 3 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			var aliasOf string
+			if len(os.Args) >= 4 {
+				aliasOf = os.Args[3]
+			}
+			err := addDomain(os.Args[2], aliasOf)
+			if err != nil {
+				fmt.Println("Error: add domain error: " + err.Error())
+			} else {
+				fmt.Println("Add domain successful")
+			}
+		case "deldomain": //删除托管的域名
+			if len(os.Args) < 3 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			err := delDomain(os.Args[2])
+			if err != nil {
+				fmt.Println("Error: delete domain error: " + err.Error())
+			} else {
+				fmt.Println("Delete domain successful")
+			}
+		case "listdomain": //列出托管的域名
+			domainList, err := listDomains()
+			if err != nil {
+				fmt.Println("Error: database query failure: " + err.Error())
+				return
+			}
+			fmt.Println(config.General.MailDomain + " (general.mail_domain)")
+			for _, info := range domainList {
+				if info.aliasOf != "" {
+					fmt.Println(info.domain + " -> " + info.aliasOf)
+				} else {
+					fmt.Println(info.domain)
+				}
+			}
+		case "list": //管理邮件列表
+			if len(os.Args) < 3 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			switch os.Args[2] {
+			case "create":
+				if len(os.Args) < 4 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				policy := listPolicyMembersOnly
+				if len(os.Args) >= 5 {
+					policy = os.Args[4]
+				}
+				var subjectTag string
+				if len(os.Args) >= 6 {
+					subjectTag = os.Args[5]
+				}
+				err := listCreate(os.Args[3], policy, subjectTag)
+				if err != nil {
+					fmt.Println("Error: create list error: " + err.Error())
+				} else {
+					fmt.Println("Create list successful")
+				}
+			case "add":
+				if len(os.Args) < 5 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				err := listAddMember(os.Args[3], os.Args[4], len(os.Args) >= 6 && os.Args[5] == "moderator")
+				if err != nil {
+					fmt.Println("Error: add list member error: " + err.Error())
+				} else {
+					fmt.Println("Add list member successful")
+				}
+			case "remove":
+				if len(os.Args) < 5 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				err := listRemoveMember(os.Args[3], os.Args[4])
+				if err != nil {
+					fmt.Println("Error: remove list member error: " + err.Error())
+				} else {
+					fmt.Println("Remove list member successful")
+				}
+			case "delete":
+				if len(os.Args) < 4 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				err := listDelete(os.Args[3])
+				if err != nil {
+					fmt.Println("Error: delete list error: " + err.Error())
+				} else {
+					fmt.Println("Delete list successful")
+				}
+			case "approve":
+				if len(os.Args) < 5 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				err := listApprove(os.Args[3], os.Args[4])
+				if err != nil {
+					fmt.Println("Error: approve post error: " + err.Error())
+				} else {
+					smtpQueueWaitGroup.Wait() //等发送完再退出
+					fmt.Println("Approve post successful")
+				}
+			case "reject":
+				if len(os.Args) < 5 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				err := listReject(os.Args[3], os.Args[4])
+				if err != nil {
+					fmt.Println("Error: reject post error: " + err.Error())
+				} else {
+					fmt.Println("Reject post successful")
+				}
+			case "show":
+				if len(os.Args) < 4 {
+					listList, err := listAll()
+					if err != nil {
+						fmt.Println("Error: database query failure: " + err.Error())
+						return
+					}
+					for _, list := range listList {
+						fmt.Println(list.address + " policy: " + list.policy)
+					}
+					return
+				}
+				list, err := listGet(os.Args[3])
+				if err != nil {
+					fmt.Println("Error: database query failure: " + err.Error())
+					return
+				}
+				if list == nil {
+					fmt.Println("Error: list does not exists")
+					return
+				}
+				memberList, err := listGetMembers(list.address)
+				if err != nil {
+					fmt.Println("Error: database query failure: " + err.Error())
+					return
+				}
+				fmt.Println("address: " + list.address)
+				fmt.Println("policy: " + list.policy)
+				fmt.Println("subject tag: " + list.subjectTag)
+				fmt.Println("members:")
+				for _, member := range memberList {
+					if member.moderator {
+						fmt.Println("  " + member.address + " (moderator)")
+					} else {
+						fmt.Println("  " + member.address)
+					}
+				}
+			default:
+				fmt.Println("Unknown command. Use help to get command list")
+			}
+		case "ban": //管理封禁
+			if len(os.Args) < 3 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			switch os.Args[2] {
+			case "list":
+				row, err := authDatabase.Query("SELECT kind, target, expire, reason FROM "+config.Auth.Sqlite.BanTableName+" WHERE expire>?", time.Now().Unix())
+				if err != nil {
+					fmt.Println("Error: database query failure: " + err.Error())
+					return
+				}
+				defer row.Close()
+				for row.Next() {
+					var kind string
+					var target string
+					var expire int64
+					var reason string
+					err = row.Scan(&kind, &target, &expire, &reason)
+					if err != nil {
+						fmt.Println("Error: database query failure: " + err.Error())
+						return
+					}
+					fmt.Println(kind + " " + target + " until " + time.Unix(expire, 0).Format(time.RFC3339) + " (" + reason + ")")
+				}
+			case "unban":
+				if len(os.Args) < 4 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				result, err := authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.BanTableName+" WHERE target=?", os.Args[3])
+				if err != nil {
+					fmt.Println("Error: unban error: " + err.Error())
+					return
+				}
+				if n, _ := result.RowsAffected(); n == 0 {
+					fmt.Println("Error: ban does not exists")
+				} else {
+					fmt.Println("Unban successful")
+				}
+			default:
+				fmt.Println("Unknown command. Use help to get command list")
+			}
+		case "sieve": //管理sieve脚本
+			if len(os.Args) < 4 {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			if os.Args[2] != "check" && len(usernameGetAddress(os.Args[3])) == 0 {
+				fmt.Println("Error: user does not exists")
+				return
+			}
+			switch os.Args[2] {
+			case "list":
+				scriptList, err := sieveListScripts(os.Args[3])
+				if err != nil {
+					fmt.Println("Error: database query failure: " + err.Error())
+					return
+				}
+				for _, info := range scriptList {
+					if info.active {
+						fmt.Println(info.name + " (active)")
+					} else {
+						fmt.Println(info.name)
+					}
+				}
+			case "put":
+				if len(os.Args) < 6 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				script, err := os.ReadFile(os.Args[5])
+				if err != nil {
+					fmt.Println("Error: read script error: " + err.Error())
+					return
+				}
+				err = sievePutScript(os.Args[3], os.Args[4], string(script))
+				if err != nil {
+					fmt.Println("Error: put script error: " + err.Error())
+				} else {
+					fmt.Println("Put script successful")
+				}
+			case "get":
+				if len(os.Args) < 5 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				script, err := sieveGetScript(os.Args[3], os.Args[4])
+				if err != nil {
+					fmt.Println("Error: get script error: " + err.Error())
+					return
+				}
+				fmt.Print(script)
+			case "activate", "deactivate":
+				name := ""
+				if os.Args[2] == "activate" {
+					if len(os.Args) < 5 {
+						fmt.Println("Wrong syntax. Use help to get command list")
+						return
+					}
+					name = os.Args[4]
+				}
+				err := sieveSetActive(os.Args[3], name)
+				if err != nil {
+					fmt.Println("Error: " + os.Args[2] + " script error: " + err.Error())
+				} else {
+					fmt.Println("Set active script successful")
+				}
+			case "delete":
+				if len(os.Args) < 5 {
+					fmt.Println("Wrong syntax. Use help to get command list")
+					return
+				}
+				err := sieveDeleteScript(os.Args[3], os.Args[4])
+				if err != nil {
+					fmt.Println("Error: delete script error: " + err.Error())
+				} else {
+					fmt.Println("Delete script successful")
+				}
+			case "check":
+				script, err := os.ReadFile(os.Args[3])
+				if err != nil {
+					fmt.Println("Error: read script error: " + err.Error())
+					return
+				}
+				if _, err = sieveCompile(string(script)); err != nil {
+					fmt.Println("Error: " + err.Error())
+				} else {
+					fmt.Println("Script OK")
+				}
+			default:
+				fmt.Println("Unknown command. Use help to get command list")
+			}
+		case "spam": //训练垃圾邮件分类器
+			if len(os.Args) < 5 || os.Args[2] != "train" {
+				fmt.Println("Wrong syntax. Use help to get command list")
+				return
+			}
+			trained, err := spamTrainCommand(os.Args[3], os.Args[4])
+			if err != nil {
+				fmt.Println("Error: spam train error: " + err.Error())
+				return
+			}
+			fmt.Println("Trained " + strconv.Itoa(trained) + " " + os.Args[3] + " mail")
 		default:
 			fmt.Println("Unknown command. Use help to get command list")
 		}
@@ -117,7 +559,8 @@ func main() {
 		log.Println("Info: Command not detected. Start the server by default")
 		smtpServer()
 		pop3Server()
-		if config.Smtp.Inbound.EnablePlain || config.Smtp.Inbound.EnableTls || config.Pop3.EnablePlain || config.Pop3.EnableTls {
+		managesieveServer()
+		if config.Smtp.Inbound.EnablePlain || config.Smtp.Inbound.EnableTls || config.Smtp.Submission.Enable || config.Pop3.EnablePlain || config.Pop3.EnableTls || config.ManageSieve.Enable {
 			ch := make(chan int)
 			<-ch
 		}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard) //测试时不输出日志
+	os.Exit(m.Run())
+}
+
+func testLoadConfig(t *testing.T, extraConfig string) { //加载一份测试用的配置(邮件, 缓存和数据库都放在临时目录), extraConfig追加在后面
+	t.Helper()
+	dir := t.TempDir()
+	config = configStruct{}
+	_, err := toml.Decode(`[general]
+server_address = "mail.example.com"
+mail_domain = "example.com"
+mail_storage_path = "`+filepath.ToSlash(filepath.Join(dir, "mail"))+`"
+cache_path = "`+filepath.ToSlash(filepath.Join(dir, "cache"))+`"
+
+[smtp.policy]
+trusted_networks = ["127.0.0.0/8", "::1/128"]
+
+[auth]
+auth_database_type = "sqlite"
+[auth.sqlite]
+file_path = "`+filepath.ToSlash(filepath.Join(dir, "accounts.db"))+`"
+table_name = "accounts"
+`+extraConfig, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyConfig()
+	t.Cleanup(func() {
+		authDatabase.Close()
+	})
+}
+
+func testAddUser(t *testing.T, username string, mailAddress string, password string) { //添加一个测试用的账号
+	t.Helper()
+	salt := generateSalt()
+	_, err := authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.TableName+"(username, mail_address, password_sha256_with_salt_hex, salt) VALUES(?, ?, ?, ?)", username, mailAddress, getPasswordHash(password, salt), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
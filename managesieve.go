@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errorManagesieveSyntax          = errors.New("error: syntax error")
+	errorManagesieveLiteralTooLarge = errors.New("error: literal too large")
+)
+
+func managesieveQuote(s string) string { //把字符串编码成quoted string, 有换行或者太长的用literal(RFC 5804 4)
+	if len(s) > 1024 || strings.ContainsAny(s, "\r\n\x00") {
+		return "{" + strconv.Itoa(len(s)) + "}\r\n" + s
+	}
+	return "\"" + strings.ReplaceAll(strings.ReplaceAll(s, "\\", "\\\\"), "\"", "\\\"") + "\""
+}
+
+func managesieveResponse(kind string, code string, text string) []byte { //生成OK/NO/BYE回复, code可以为空
+	response := kind
+	if code != "" {
+		response += " (" + code + ")"
+	}
+	if text != "" {
+		response += " " + managesieveQuote(text)
+	}
+	return []byte(response + "\r\n")
+}
+
+func managesieveCapability(conn *connStruct, option listenerOptionStruct, verified bool) string { //生成能力列表
+	saslMechanisms := "PLAIN LOGIN"
+	if option.requireTlsForAuth && conn.connType == 0x00 { //要求TLS的话未加密时不提供鉴权方式
+		saslMechanisms = ""
+	}
+	var extensionList []string
+	for extension := range sieveExtensions {
+		extensionList = append(extensionList, extension)
+	}
+	sort.Strings(extensionList)
+	capability := "\"IMPLEMENTATION\" " + managesieveQuote(serverName) + "\r\n"
+	if !verified {
+		capability += "\"SASL\" " + managesieveQuote(saslMechanisms) + "\r\n"
+	}
+	capability += "\"SIEVE\" " + managesieveQuote(strings.Join(extensionList, " ")) + "\r\n"
+	if option.enableStartTls && conn.connType == 0x00 && !verified {
+		capability += "\"STARTTLS\"\r\n"
+	}
+	capability += "\"MAXREDIRECTS\" \"" + strconv.Itoa(config.Sieve.MaxRedirects) + "\"\r\n"
+	capability += "\"VERSION\" \"1.0\"\r\n"
+	return capability + "OK\r\n"
+}
+
+func managesieveReadCommand(conn *connStruct) ([]string, error) { //读一条命令, 拆成atom/quoted string/literal参数
+	var argList []string
+	for {
+		line, err := ConnReadLine(conn)
+		if err != nil {
+			return nil, err
+		}
+		line = line[:len(line)-2]
+		literalSize := -1
+		for i := 0; i < len(line); {
+			switch line[i] {
+			case ' ':
+				i++
+			case '"': //quoted string, 只允许转义\和"
+				var arg []byte
+				i++
+				for i < len(line) && line[i] != '"' {
+					if line[i] == '\\' && i+1 < len(line) && (line[i+1] == '\\' || line[i+1] == '"') {
+						i++
+					}
+					arg = append(arg, line[i])
+					i++
+				}
+				if i >= len(line) {
+					return nil, errorManagesieveSyntax
+				}
+				i++
+				argList = append(argList, string(arg))
+			case '{': //literal, 必须在行尾: {n} 或 {n+}
+				end := len(line) - 1
+				if line[end] != '}' {
+					return nil, errorManagesieveSyntax
+				}
+				size, err := strconv.Atoi(strings.TrimSuffix(string(line[i+1:end]), "+"))
+				if err != nil || size < 0 {
+					return nil, errorManagesieveSyntax
+				}
+				literalSize = size
+				i = len(line)
+			default: //atom
+				start := i
+				for i < len(line) && line[i] != ' ' {
+					i++
+				}
+				argList = append(argList, string(line[start:i]))
+			}
+		}
+		if literalSize < 0 {
+			return argList, nil
+		}
+		conn.startRead()
+		if literalSize > config.Sieve.MaxScriptSize { //丢掉太大的literal和这条命令剩下的部分
+			if _, err = io.CopyN(io.Discard, conn.getReader(), int64(literalSize)); err != nil {
+				return nil, err
+			}
+			if _, err = ConnReadLine(conn); err != nil {
+				return nil, err
+			}
+			return nil, errorManagesieveLiteralTooLarge
+		}
+		literal := make([]byte, literalSize)
+		if _, err = io.ReadFull(conn.getReader(), literal); err != nil {
+			return nil, err
+		}
+		argList = append(argList, string(literal))
+	}
+}
+
+func managesieveReadSaslResponse(conn *connStruct, challenge string) (string, bool, error) { //发送一个SASL challenge并读取客户端的回应(base64解码), 第二个返回值为客户端是否取消
+	conn.Write([]byte(managesieveQuote(base64.StdEncoding.EncodeToString([]byte(challenge))) + "\r\n"))
+	argList, err := managesieveReadCommand(conn)
+	if err != nil {
+		return "", false, err
+	}
+	if len(argList) != 1 {
+		return "", false, errorManagesieveSyntax
+	}
+	if argList[0] == "*" {
+		return "", true, nil
+	}
+	response, err := base64.StdEncoding.DecodeString(argList[0])
+	if err != nil {
+		return "", false, errorManagesieveSyntax
+	}
+	return string(response), false, nil
+}
+
+func managesieveScriptError(err error) []byte { //把脚本存储的错误转成回复
+	switch {
+	case errors.Is(err, errorSieveScriptNotExists):
+		return managesieveResponse("NO", "NONEXISTENT", "Script does not exist")
+	case errors.Is(err, errorSieveScriptActive):
+		return managesieveResponse("NO", "ACTIVE", "Cannot delete the active script")
+	case errors.Is(err, errorSieveScriptExists):
+		return managesieveResponse("NO", "ALREADYEXISTS", "Script already exists")
+	case errors.Is(err, errorSieveTooManyScripts):
+		return managesieveResponse("NO", "QUOTA/MAXSCRIPTS", "Too many scripts")
+	case errors.Is(err, errorSieveInvalidName):
+		return managesieveResponse("NO", "", "Invalid script name")
+	}
+	log.Println("Error: managesieve script storage error: " + err.Error())
+	return managesieveResponse("NO", "TRYLATER", "Internal error")
+}
+
+func managesieveClientHandler(plainConn net.Conn, option listenerOptionStruct) { //处理客户端连接
+	conn := newServerConn(plainConn)
+	timeout := timeoutSeconds(config.ManageSieve.TimeoutS)
+	conn.setTimeout(timeout, timeout)
+	remoteIp := getRemoteIp(plainConn.RemoteAddr())
+	if isIpBanned(remoteIp) { //被封禁的ip直接拒绝
+		conn.Write(managesieveResponse("BYE", "", "Your address is temporarily banned"))
+		conn.Close()
+		return
+	}
+	var username string
+	var verified bool = false
+	conn.Write([]byte(managesieveCapability(conn, option, verified)))
+	for {
+		argList, err := managesieveReadCommand(conn)
+		if err == errorManagesieveSyntax {
+			conn.Write(managesieveResponse("NO", "", "Syntax error"))
+			continue
+		}
+		if err == errorManagesieveLiteralTooLarge {
+			conn.Write(managesieveResponse("NO", "QUOTA/MAXSIZE", "Script too large"))
+			continue
+		}
+		if err != nil {
+			if isTimeoutError(err) {
+				conn.Write(managesieveResponse("BYE", "", "Disconnected for inactivity"))
+			} else if err == errorLineTooLong {
+				conn.Write(managesieveResponse("BYE", "", "Line too long"))
+			}
+			conn.Close()
+			return
+		}
+		if len(argList) == 0 {
+			conn.Write(managesieveResponse("NO", "", "Syntax error"))
+			continue
+		}
+		command := strings.ToLower(argList[0])
+		switch command {
+		case "havespace", "putscript", "listscripts", "setactive", "getscript", "deletescript", "renamescript", "checkscript":
+			if !verified { //这些命令只能在鉴权后使用
+				conn.Write(managesieveResponse("NO", "", "Not authenticated"))
+				continue
+			}
+		}
+		switch command {
+		case "capability": //返回能力列表
+			conn.Write([]byte(managesieveCapability(conn, option, verified)))
+		case "starttls": //升级到TLS
+			if !option.enableStartTls || conn.connType == 0x01 || verified {
+				conn.Write(managesieveResponse("NO", "", "STARTTLS not available"))
+				continue
+			}
+			conn.discardBuffered() //STARTTLS后面不能跟着明文命令
+			conn.Write(managesieveResponse("OK", "", "Begin TLS negotiation"))
+			tlsConn := tls.Server(conn.plainConn, option.startTlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return
+			}
+			conn.tlsConn = tlsConn
+			conn.connType = 0x01
+			conn.Write([]byte(managesieveCapability(conn, option, verified))) //TLS之后要重新发送能力列表
+		case "authenticate": //SASL鉴权
+			if verified {
+				conn.Write(managesieveResponse("NO", "", "Already authenticated"))
+				continue
+			}
+			if option.requireTlsForAuth && conn.connType == 0x00 {
+				conn.Write(managesieveResponse("NO", "ENCRYPT-NEEDED", "TLS required for authentication, use STARTTLS first"))
+				continue
+			}
+			if len(argList) < 2 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			var authUsername string
+			var password string
+			var cancelled bool
+			switch strings.ToUpper(argList[1]) {
+			case "PLAIN": //authzid\0authcid\0password
+				var response string
+				if len(argList) >= 3 {
+					var decoded []byte
+					if decoded, err = base64.StdEncoding.DecodeString(argList[2]); err != nil {
+						err = errorManagesieveSyntax
+					}
+					response = string(decoded)
+				} else {
+					response, cancelled, err = managesieveReadSaslResponse(conn, "")
+				}
+				if err == nil && !cancelled {
+					responseSplit := strings.Split(response, "\x00")
+					if len(responseSplit) != 3 || (responseSplit[0] != "" && responseSplit[0] != responseSplit[1]) {
+						err = errorManagesieveSyntax
+					} else {
+						authUsername = responseSplit[1]
+						password = responseSplit[2]
+					}
+				}
+			case "LOGIN":
+				authUsername, cancelled, err = managesieveReadSaslResponse(conn, "Username:")
+				if err == nil && !cancelled {
+					password, cancelled, err = managesieveReadSaslResponse(conn, "Password:")
+				}
+			default:
+				conn.Write(managesieveResponse("NO", "", "Unsupported authentication mechanism"))
+				continue
+			}
+			if err != nil && err != errorManagesieveSyntax && err != errorManagesieveLiteralTooLarge {
+				conn.Close()
+				return
+			}
+			if err != nil {
+				conn.Write(managesieveResponse("NO", "", "Cannot decode response"))
+				continue
+			}
+			if cancelled {
+				conn.Write(managesieveResponse("NO", "", "Authentication cancelled"))
+				continue
+			}
+			if !authAttempt(remoteIp, authUsername, password, "sieve") {
+				conn.Write(managesieveResponse("NO", "", "Authentication failed"))
+				continue
+			}
+			username = authUsername
+			verified = true
+			conn.Write(managesieveResponse("OK", "", "Logged in"))
+		case "noop": //什么也不做, 有参数的话原样返回
+			if len(argList) >= 2 {
+				conn.Write(managesieveResponse("OK", "TAG "+managesieveQuote(argList[1]), "Done"))
+			} else {
+				conn.Write(managesieveResponse("OK", "", "Done"))
+			}
+		case "logout": //结束会话
+			conn.Write(managesieveResponse("OK", "", "Logout"))
+			conn.Close()
+			return
+		case "havespace": //检查能不能保存一个这样大小的脚本
+			if len(argList) < 3 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			size, err := strconv.Atoi(argList[2])
+			if err != nil || size < 0 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			if size > config.Sieve.MaxScriptSize {
+				conn.Write(managesieveResponse("NO", "QUOTA/MAXSIZE", "Script too large"))
+				continue
+			}
+			scriptList, err := sieveListScripts(username)
+			if err != nil {
+				conn.Write(managesieveScriptError(err))
+				continue
+			}
+			exists := false
+			for _, info := range scriptList {
+				exists = exists || info.name == argList[1]
+			}
+			if !exists && len(scriptList) >= config.Sieve.MaxScripts {
+				conn.Write(managesieveResponse("NO", "QUOTA/MAXSCRIPTS", "Too many scripts"))
+				continue
+			}
+			conn.Write(managesieveResponse("OK", "", ""))
+		case "putscript": //保存脚本
+			if len(argList) < 3 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			if len(argList[2]) > config.Sieve.MaxScriptSize {
+				conn.Write(managesieveResponse("NO", "QUOTA/MAXSIZE", "Script too large"))
+				continue
+			}
+			if _, err = sieveCompile(argList[2]); err != nil {
+				conn.Write(managesieveResponse("NO", "", err.Error()))
+				continue
+			}
+			if err = sievePutScript(username, argList[1], argList[2]); err != nil {
+				conn.Write(managesieveScriptError(err))
+				continue
+			}
+			conn.Write(managesieveResponse("OK", "", ""))
+		case "checkscript": //只检查语法
+			if len(argList) < 2 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			if _, err = sieveCompile(argList[1]); err != nil {
+				conn.Write(managesieveResponse("NO", "", err.Error()))
+				continue
+			}
+			conn.Write(managesieveResponse("OK", "", ""))
+		case "listscripts": //列出脚本
+			scriptList, err := sieveListScripts(username)
+			if err != nil {
+				conn.Write(managesieveScriptError(err))
+				continue
+			}
+			reply := ""
+			for _, info := range scriptList {
+				reply += managesieveQuote(info.name)
+				if info.active {
+					reply += " ACTIVE"
+				}
+				reply += "\r\n"
+			}
+			conn.Write([]byte(reply + "OK\r\n"))
+		case "setactive": //设置生效的脚本, 空名字为全部停用
+			if len(argList) < 2 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			if err = sieveSetActive(username, argList[1]); err != nil {
+				conn.Write(managesieveScriptError(err))
+				continue
+			}
+			conn.Write(managesieveResponse("OK", "", ""))
+		case "getscript": //读取脚本
+			if len(argList) < 2 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			script, err := sieveGetScript(username, argList[1])
+			if err != nil {
+				conn.Write(managesieveScriptError(err))
+				continue
+			}
+			conn.Write([]byte("{" + strconv.Itoa(len(script)) + "}\r\n" + script + "\r\nOK\r\n"))
+		case "deletescript": //删除脚本
+			if len(argList) < 2 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			if err = sieveDeleteScript(username, argList[1]); err != nil {
+				conn.Write(managesieveScriptError(err))
+				continue
+			}
+			conn.Write(managesieveResponse("OK", "", ""))
+		case "renamescript": //重命名脚本
+			if len(argList) < 3 {
+				conn.Write(managesieveResponse("NO", "", "Syntax error"))
+				continue
+			}
+			if err = sieveRenameScript(username, argList[1], argList[2]); err != nil {
+				conn.Write(managesieveScriptError(err))
+				continue
+			}
+			conn.Write(managesieveResponse("OK", "", ""))
+		default:
+			conn.Write(managesieveResponse("NO", "", "Unknown command"))
+		}
+	}
+}
+
+func managesieveClientListenHandler(listener net.Listener, option listenerOptionStruct) { //监听
+	for !serverStop {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error: managesieve listen error: " + err.Error())
+			continue
+		}
+		remoteIp := getRemoteIp(conn.RemoteAddr())
+		if !acquireConnection(remoteIp) { //超过连接数限制
+			go rejectConnection(conn, "BYE (TRYLATER) \"Too many connections\"\r\n")
+			continue
+		}
+		go func() {
+			managesieveClientHandler(conn, option)
+			releaseConnection(remoteIp)
+		}()
+	}
+}
+
+func managesieveServer() { //启动managesieve服务
+	if !config.ManageSieve.Enable {
+		return
+	}
+	listener, err := net.Listen("tcp", config.ManageSieve.ListenAddress+":"+strconv.Itoa(config.ManageSieve.ListenPort))
+	if err != nil {
+		log.Println("Error: start managesieve server error: " + err.Error())
+		return
+	}
+	log.Println("Info: start managesieve server at: " + listener.Addr().String())
+	option := listenerOptionStruct{requireTlsForAuth: config.ManageSieve.RequireTlsForAuth}
+	if config.ManageSieve.EnableStartTls {
+		log.Println("Info: managesieve STARTTLS enabled")
+		option.enableStartTls = true
+		option.startTlsConfig = &tls.Config{Certificates: []tls.Certificate{managesieveStartTlsCert}}
+	}
+	go managesieveClientListenHandler(listener, option)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testManagesieveClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestManagesieveClient(t *testing.T, option listenerOptionStruct) *testManagesieveClient {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	handlerDone := make(chan struct{})
+	go func() {
+		managesieveClientHandler(serverConn, option)
+		close(handlerDone)
+	}()
+	client := &testManagesieveClient{t: t, conn: clientConn, reader: bufio.NewReader(clientConn)}
+	t.Cleanup(func() { //等会话结束, 下一个测试才能换配置
+		clientConn.Close()
+		<-handlerDone
+	})
+	if _, response := client.readResponse(); response != "OK" {
+		t.Fatalf("greeting = %q", response)
+	}
+	return client
+}
+
+var testManagesieveLiteral = regexp.MustCompile(`\{([0-9]+)\}\r\n$`)
+
+func (client *testManagesieveClient) readResponse() (string, string) { //读取一个回复, 返回前面的数据(literal已经展开)和最后的OK/NO/BYE行
+	client.t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var data strings.Builder
+	for {
+		line, err := client.reader.ReadString('\n')
+		if err != nil {
+			client.t.Fatalf("read response error: %v", err)
+		}
+		if match := testManagesieveLiteral.FindStringSubmatch(line); match != nil {
+			size, _ := strconv.Atoi(match[1])
+			literal := make([]byte, size)
+			if _, err = io.ReadFull(client.reader, literal); err != nil {
+				client.t.Fatalf("read literal error: %v", err)
+			}
+			data.WriteString(line[:len(line)-len(match[0])] + string(literal))
+			continue
+		}
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			return data.String(), strings.TrimRight(line, "\r\n")
+		}
+		data.WriteString(line)
+	}
+}
+
+func (client *testManagesieveClient) write(data string) {
+	client.t.Helper()
+	client.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err := client.conn.Write([]byte(data)); err != nil {
+		client.t.Fatalf("write %q error: %v", data, err)
+	}
+}
+
+func (client *testManagesieveClient) command(line string, want string) (string, string) { //发送一条命令, 检查回复以want开头
+	client.t.Helper()
+	client.write(line + "\r\n")
+	data, response := client.readResponse()
+	if !strings.HasPrefix(response, want) {
+		client.t.Fatalf("%q: got %q, want %s", line, response, want)
+	}
+	return data, response
+}
+
+func testManagesieveLogin(client *testManagesieveClient) {
+	client.t.Helper()
+	client.command("AUTHENTICATE \"PLAIN\" \""+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00pw"))+"\"", "OK")
+}
+
+func TestManagesieveNotAuthenticated(t *testing.T) {
+	testLoadConfig(t, "")
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	client := newTestManagesieveClient(t, listenerOptionStruct{})
+	for _, line := range []string{"LISTSCRIPTS", "PUTSCRIPT \"a\" \"keep;\"", "GETSCRIPT \"a\"", "SETACTIVE \"a\"", "DELETESCRIPT \"a\"", "RENAMESCRIPT \"a\" \"b\"", "HAVESPACE \"a\" 10", "CHECKSCRIPT \"keep;\""} {
+		if _, response := client.command(line, "NO"); !strings.Contains(response, "Not authenticated") {
+			t.Errorf("%s: %q", line, response)
+		}
+	}
+	client.command("NOOP", "OK")
+	if data, _ := client.command("CAPABILITY", "OK"); !strings.Contains(data, "\"SASL\" \"PLAIN LOGIN\"") {
+		t.Errorf("capability = %q", data)
+	}
+	client.command("FOO", "NO")
+	client.command("\"unterminated", "NO")
+	client.command("AUTHENTICATE \"CRAM-MD5\"", "NO")
+	if scriptList, _ := sieveListScripts("alice"); len(scriptList) != 0 {
+		t.Errorf("scripts stored before authentication: %v", scriptList)
+	}
+
+	tlsClient := newTestManagesieveClient(t, listenerOptionStruct{requireTlsForAuth: true})
+	if data, _ := tlsClient.command("CAPABILITY", "OK"); !strings.Contains(data, "\"SASL\" \"\"") {
+		t.Errorf("capability without TLS = %q", data)
+	}
+	if _, response := tlsClient.command("AUTHENTICATE \"PLAIN\" \""+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00pw"))+"\"", "NO"); !strings.Contains(response, "ENCRYPT-NEEDED") {
+		t.Errorf("auth without TLS = %q", response)
+	}
+}
+
+func TestManagesieveAuthenticate(t *testing.T) {
+	testLoadConfig(t, "\n[auth.brute_force]\nenable = false\n")
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	encode := func(s string) string {
+		return "\"" + base64.StdEncoding.EncodeToString([]byte(s)) + "\""
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		client := newTestManagesieveClient(t, listenerOptionStruct{})
+		client.command("AUTHENTICATE \"PLAIN\" "+encode("\x00alice\x00wrong"), "NO")
+		client.command("AUTHENTICATE \"PLAIN\" "+encode("bob\x00alice\x00pw"), "NO") //不能代替别人登录
+		client.command("AUTHENTICATE \"PLAIN\" \"not base64\"", "NO")
+		client.command("AUTHENTICATE \"PLAIN\" "+encode("alice\x00alice\x00pw"), "OK")
+		if data, _ := client.command("CAPABILITY", "OK"); strings.Contains(data, "SASL") {
+			t.Errorf("SASL listed after authentication: %q", data)
+		}
+		client.command("AUTHENTICATE \"PLAIN\" "+encode("\x00alice\x00pw"), "NO")
+		client.command("LISTSCRIPTS", "OK")
+	})
+
+	t.Run("plain without initial response", func(t *testing.T) {
+		client := newTestManagesieveClient(t, listenerOptionStruct{})
+		client.write("AUTHENTICATE \"PLAIN\"\r\n")
+		if line, _ := client.reader.ReadString('\n'); line != "\"\"\r\n" {
+			t.Fatalf("challenge = %q", line)
+		}
+		client.command(encode("\x00alice\x00pw"), "OK")
+	})
+
+	t.Run("login", func(t *testing.T) {
+		client := newTestManagesieveClient(t, listenerOptionStruct{})
+		client.write("AUTHENTICATE \"LOGIN\"\r\n")
+		if line, _ := client.reader.ReadString('\n'); line != encode("Username:")+"\r\n" {
+			t.Fatalf("username challenge = %q", line)
+		}
+		client.write(encode("alice") + "\r\n")
+		if line, _ := client.reader.ReadString('\n'); line != encode("Password:")+"\r\n" {
+			t.Fatalf("password challenge = %q", line)
+		}
+		client.command("{4+}\r\n"+base64.StdEncoding.EncodeToString([]byte("pw")), "OK") //回应也可以是literal
+		client.command("LISTSCRIPTS", "OK")
+	})
+
+	t.Run("login cancelled", func(t *testing.T) {
+		client := newTestManagesieveClient(t, listenerOptionStruct{})
+		client.write("AUTHENTICATE \"LOGIN\"\r\n")
+		client.reader.ReadString('\n')
+		if _, response := client.command("\"*\"", "NO"); !strings.Contains(response, "cancelled") {
+			t.Errorf("cancel = %q", response)
+		}
+		client.command("LISTSCRIPTS", "NO")
+	})
+}
+
+func TestManagesieveScripts(t *testing.T) {
+	testLoadConfig(t, "\n[sieve]\nmax_script_size = 100\n")
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	client := newTestManagesieveClient(t, listenerOptionStruct{})
+	testManagesieveLogin(client)
+
+	script := "require \"fileinto\";\r\nif header :contains \"subject\" \"\\\"x\\\"\" {\r\n  fileinto \"X\";\r\n}\r\n"
+	client.command("PUTSCRIPT \"filter\" {"+strconv.Itoa(len(script))+"+}\r\n"+script, "OK")
+	client.command("PUTSCRIPT \"small\" \"keep;\"", "OK")
+	if data, _ := client.command("GETSCRIPT \"filter\"", "OK"); data != script+"\r\n" {
+		t.Errorf("getscript = %q", data)
+	}
+	if data, _ := client.command("GETSCRIPT \"small\"", "OK"); data != "keep;\r\n" {
+		t.Errorf("getscript = %q", data)
+	}
+	client.command("GETSCRIPT \"none\"", "NO (NONEXISTENT)")
+	client.command("SETACTIVE \"filter\"", "OK")
+	if data, _ := client.command("LISTSCRIPTS", "OK"); data != "\"filter\" ACTIVE\r\n\"small\"\r\n" {
+		t.Errorf("listscripts = %q", data)
+	}
+	client.command("DELETESCRIPT \"filter\"", "NO (ACTIVE)")
+
+	client.command("CHECKSCRIPT \"keep;\"", "OK")
+	if _, response := client.command("CHECKSCRIPT {13+}\r\nfileinto \"x\";", "NO"); !strings.Contains(response, "requires extension") {
+		t.Errorf("checkscript = %q", response)
+	}
+	if _, response := client.command("PUTSCRIPT \"bad\" \"foo;\"", "NO"); !strings.Contains(response, "unknown command foo") {
+		t.Errorf("putscript = %q", response)
+	}
+	if _, err := sieveGetScript("alice", "bad"); err == nil {
+		t.Errorf("bad script stored")
+	}
+
+	big := strings.Repeat("#", 101)
+	client.command("PUTSCRIPT \"big\" {101+}\r\n"+big, "NO (QUOTA/MAXSIZE)") //太大的literal直接丢掉, 会话继续
+	client.command("CHECKSCRIPT {101+}\r\n"+big, "NO (QUOTA/MAXSIZE)")
+	client.command("HAVESPACE \"big\" 101", "NO (QUOTA/MAXSIZE)")
+	client.command("HAVESPACE \"big\" 100", "OK")
+	if _, err := sieveGetScript("alice", "big"); err == nil {
+		t.Errorf("oversized script stored")
+	}
+	client.command("NOOP \"after\"", "OK (TAG \"after\")")
+	client.command("LOGOUT", "OK")
+}
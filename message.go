@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+func readMailHeaderList(reader *bufio.Reader) ([]string, error) { //读取邮件头部(每一项包含折叠行和结尾的\r\n), 读到空行为止
+	var headerList []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "\r\n" || line == "\n" || line == "" { //头部结束
+			return headerList, nil
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headerList) > 0 { //折叠行
+			headerList[len(headerList)-1] += line
+		} else {
+			headerList = append(headerList, line)
+		}
+		if err == io.EOF {
+			return headerList, nil
+		}
+	}
+}
+
+func getHeaderName(header string) string { //获取头部名称(小写)
+	headerSplit := strings.SplitN(header, ":", 2)
+	if len(headerSplit) < 2 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(headerSplit[0]))
+}
+
+func getHeaderValue(header string) string { //获取展开后的头部值
+	headerSplit := strings.SplitN(header, ":", 2)
+	if len(headerSplit) < 2 {
+		return ""
+	}
+	value := strings.ReplaceAll(headerSplit[1], "\r\n", "")
+	value = strings.ReplaceAll(value, "\n", "")
+	return strings.TrimSpace(value)
+}
+
+func findHeader(headerList []string, name string) int { //找到第一个对应名称的头部, 没有就返回-1
+	for i, header := range headerList {
+		if getHeaderName(header) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func rewriteMailHeader(filePath string, edit func([]string) []string) error { //修改邮件文件的头部, 正文保持不变
+	srcFile, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	reader := bufio.NewReader(srcFile)
+	headerList, err := readMailHeaderList(reader)
+	if err != nil {
+		return err
+	}
+	headerList = edit(headerList)
+	tempFilePath := generateCacheFilePath()
+	dstFile, err := os.OpenFile(tempFilePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = dstFile.Write([]byte(strings.Join(headerList, "") + "\r\n"))
+	if err == nil {
+		_, err = io.Copy(dstFile, reader)
+	}
+	dstFile.Close()
+	if err != nil {
+		os.Remove(tempFilePath)
+		return err
+	}
+	return os.Rename(tempFilePath, filePath)
+}
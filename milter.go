@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ( //milter协议(sendmail libmilter v6)
+	milterVersion = 6
+
+	milterActAddHeader  uint32 = 0x01 //SMFIF_ADDHDRS
+	milterActChgHeader  uint32 = 0x10 //SMFIF_CHGHDRS
+	milterActQuarantine uint32 = 0x20 //SMFIF_QUARANTINE
+
+	milterProtoNoConnect uint32 = 0x01 //SMFIP_NOCONNECT
+	milterProtoNoHelo    uint32 = 0x02
+	milterProtoNoMail    uint32 = 0x04
+	milterProtoNoRcpt    uint32 = 0x08
+	milterProtoNoBody    uint32 = 0x10
+	milterProtoNoHdrs    uint32 = 0x20
+	milterProtoNoEoh     uint32 = 0x40
+	milterProtoNrHdr     uint32 = 0x80
+	milterProtoNoUnknown uint32 = 0x100
+	milterProtoNoData    uint32 = 0x200
+	milterProtoSkip      uint32 = 0x400
+	milterProtoNrConn    uint32 = 0x1000
+	milterProtoNrHelo    uint32 = 0x2000
+	milterProtoNrMail    uint32 = 0x4000
+	milterProtoNrRcpt    uint32 = 0x8000
+	milterProtoNrData    uint32 = 0x10000
+	milterProtoNrEoh     uint32 = 0x40000
+	milterProtoNrBody    uint32 = 0x80000
+
+	milterMaxPacketSize = 1 << 20
+	milterMaxBodyChunk  = 65535
+)
+
+var (
+	errorMilterProtocol = errors.New("error: milter protocol error")
+)
+
+type milterConnStruct struct {
+	address     string
+	conn        net.Conn
+	reader      *bufio.Reader
+	protocol    uint32 //协商后milter要求的协议选项
+	closed      bool   //这次连接不再使用它(出错了或者接受了整个连接)
+	messageDone bool   //这封邮件已经有结论了, 后面的阶段不用再问
+	inMessage   bool   //已经发送了MAIL FROM, 邮件还没有结束
+}
+
+type milterSessionStruct struct { //一次smtp连接对应的milter会话, 每个阶段发生时就发给milter(这样连接/收件人阶段的拒绝不用等到收完正文)
+	milterList  []*milterConnStruct
+	clientIp    string
+	queueId     string //这封邮件的队列ID(给milter的宏)
+	discard     bool   //有milter要求丢弃这封邮件
+	unavailable bool   //有milter不可用并且default_action为tempfail
+	heloReply   string //HELO/EHLO被milter拒绝时的回复, 重新HELO被接受之前MAIL也用这个回复拒绝
+}
+
+func milterDial(address string) (net.Conn, error) { //连接milter, 支持 "unix:/path", "inet:port@host", "inet6:port@host" 和 "host:port"
+	timeout := time.Millisecond * time.Duration(config.Smtp.Milter.TimeoutMs)
+	switch {
+	case strings.HasPrefix(address, "unix:"), strings.HasPrefix(address, "local:"):
+		return net.DialTimeout("unix", address[strings.IndexByte(address, ':')+1:], timeout)
+	case strings.HasPrefix(address, "inet:"), strings.HasPrefix(address, "inet6:"):
+		portHost := strings.SplitN(address[strings.IndexByte(address, ':')+1:], "@", 2)
+		if len(portHost) != 2 {
+			return nil, errors.New("invalid milter address: " + address)
+		}
+		return net.DialTimeout("tcp", net.JoinHostPort(portHost[1], portHost[0]), timeout)
+	}
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func (milter *milterConnStruct) writePacket(command byte, data []byte) error { //发送一个包(4字节长度+命令+数据)
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = command
+	copy(packet[5:], data)
+	milter.conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(config.Smtp.Milter.TimeoutMs)))
+	_, err := milter.conn.Write(packet)
+	return err
+}
+
+func (milter *milterConnStruct) readPacket() (byte, []byte, error) { //读取一个包
+	milter.conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(config.Smtp.Milter.TimeoutMs)))
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(milter.reader, lengthBytes); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBytes)
+	if length == 0 || length > milterMaxPacketSize {
+		return 0, nil, errorMilterProtocol
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(milter.reader, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+func milterJoin(fields ...string) []byte { //把字段用\0分隔(每个字段后面都有\0)
+	var data []byte
+	for _, field := range fields {
+		data = append(data, field...)
+		data = append(data, 0)
+	}
+	return data
+}
+
+func milterSplit(data []byte) []string { //把\0分隔的数据拆开
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+}
+
+func (milter *milterConnStruct) sendMacros(command byte, macros ...string) error { //发送宏(name value成对)
+	if len(macros) == 0 {
+		return nil
+	}
+	return milter.writePacket('D', append([]byte{command}, milterJoin(macros...)...))
+}
+
+func (milter *milterConnStruct) readResponse() (byte, []byte, error) { //读取回复(跳过progress)
+	for {
+		command, data, err := milter.readPacket()
+		if err != nil {
+			return 0, nil, err
+		}
+		if command != 'p' {
+			return command, data, nil
+		}
+	}
+}
+
+func (milter *milterConnStruct) step(command byte, data []byte, noReplyFlag uint32) (byte, []byte, error) { //发送一个阶段的命令并读取回复(milter要求不回复的话就当作continue)
+	if err := milter.writePacket(command, data); err != nil {
+		return 0, nil, err
+	}
+	if milter.protocol&noReplyFlag != 0 {
+		return 'c', nil, nil
+	}
+	return milter.readResponse()
+}
+
+func milterReplyText(command byte, data []byte, subject string) string { //把milter的回复转换成smtp回复, subject为被拒绝的对象(Message/Recipient address等)
+	switch command {
+	case 'r':
+		return "550 5.7.1 " + subject + " rejected by content filter\r\n"
+	case 't':
+		return "451 4.7.1 " + subject + " temporarily rejected by content filter, please try again later\r\n"
+	case 'y': //milter自定义的回复码
+		text := strings.TrimRight(string(data), "\x00")
+		if len(text) >= 3 && (text[0] == '4' || text[0] == '5') {
+			return strings.ReplaceAll(strings.TrimRight(text, "\r\n"), "\r\n", " ") + "\r\n"
+		}
+		return "550 5.7.1 " + subject + " rejected by content filter\r\n"
+	}
+	return ""
+}
+
+func milterHeaderValue(header string) string { //取出头部的值给milter(去掉冒号后的一个空格和结尾的换行)
+	value := header[strings.IndexByte(header, ':')+1:]
+	value = strings.TrimPrefix(strings.TrimPrefix(value, " "), "\t")
+	value = strings.TrimRight(value, "\r\n")
+	return strings.ReplaceAll(value, "\r\n", "\n")
+}
+
+func milterFormatHeader(name string, value string) string { //把milter给的头部转换成邮件中的格式
+	return name + ": " + strings.ReplaceAll(strings.ReplaceAll(value, "\r\n", "\n"), "\n", "\r\n") + "\r\n"
+}
+
+func milterApplyHeaderChange(headerList []string, command byte, data []byte) []string { //应用一个头部修改
+	var index uint32
+	if command == 'i' || command == 'm' { //insheader和chgheader前面有4字节的序号
+		if len(data) < 4 {
+			return headerList
+		}
+		index = binary.BigEndian.Uint32(data)
+		data = data[4:]
+	}
+	fields := milterSplit(data)
+	if len(fields) < 1 || fields[0] == "" {
+		return headerList
+	}
+	name := fields[0]
+	value := ""
+	if len(fields) > 1 {
+		value = fields[1]
+	}
+	switch command {
+	case 'h': //在最后添加
+		return append(headerList, milterFormatHeader(name, value))
+	case 'i': //插入到指定位置
+		if int(index) > len(headerList) {
+			index = uint32(len(headerList))
+		}
+		headerList = append(headerList[:index], append([]string{milterFormatHeader(name, value)}, headerList[index:]...)...)
+	case 'm': //修改第index个同名头部, 值为空就删除
+		count := uint32(0)
+		for i, header := range headerList {
+			if getHeaderName(header) != strings.ToLower(name) {
+				continue
+			}
+			count++
+			if count != index {
+				continue
+			}
+			if value == "" {
+				return append(headerList[:i], headerList[i+1:]...)
+			}
+			headerList[i] = milterFormatHeader(name, value)
+			return headerList
+		}
+		if value != "" { //没有找到的话就添加
+			headerList = append(headerList, milterFormatHeader(name, value))
+		}
+	}
+	return headerList
+}
+
+func milterOpen(address string) (*milterConnStruct, error) { //连接一个milter并协商版本/动作/协议
+	conn, err := milterDial(address)
+	if err != nil {
+		return nil, err
+	}
+	milter := &milterConnStruct{address: address, conn: conn, reader: bufio.NewReader(conn)}
+	optneg := make([]byte, 12)
+	binary.BigEndian.PutUint32(optneg[0:], milterVersion)
+	binary.BigEndian.PutUint32(optneg[4:], milterActAddHeader|milterActChgHeader|milterActQuarantine)
+	binary.BigEndian.PutUint32(optneg[8:], milterProtoNoConnect|milterProtoNoHelo|milterProtoNoMail|milterProtoNoRcpt|milterProtoNoBody|milterProtoNoHdrs|milterProtoNoEoh|milterProtoNrHdr|milterProtoNoUnknown|milterProtoNoData|milterProtoSkip|milterProtoNrConn|milterProtoNrHelo|milterProtoNrMail|milterProtoNrRcpt|milterProtoNrData|milterProtoNrEoh|milterProtoNrBody)
+	if err = milter.writePacket('O', optneg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	command, data, err := milter.readPacket()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if command != 'O' || len(data) < 12 {
+		conn.Close()
+		return nil, errorMilterProtocol
+	}
+	milter.protocol = binary.BigEndian.Uint32(data[8:])
+	return milter, nil
+}
+
+func milterSessionOpen(clientIp string) (*milterSessionStruct, string) { //客户端连接时打开所有配置的milter并发送connect阶段, 返回非空字符串表示要拒绝连接
+	session := &milterSessionStruct{clientIp: clientIp}
+	for _, address := range config.Smtp.Milter.Servers {
+		milter, err := milterOpen(address)
+		if err != nil {
+			log.Println("Error: milter " + address + " error: " + err.Error())
+			session.unavailable = config.Smtp.Milter.DefaultAction == "tempfail"
+			continue
+		}
+		session.milterList = append(session.milterList, milter)
+	}
+	family := "4"
+	if strings.Contains(clientIp, ":") {
+		family = "6"
+	}
+	port := make([]byte, 2)
+	data := append(append(milterJoin("["+clientIp+"]"), append([]byte(family), port...)...), milterJoin(clientIp)...)
+	return session, session.stage('C', data, []string{"j", config.General.ServerAddress, "{daemon_name}", serverName, "{client_addr}", clientIp}, milterProtoNoConnect, milterProtoNrConn, "Connection")
+}
+
+func (session *milterSessionStruct) fail(milter *milterConnStruct, err error) string { //一个milter出错了, 这次连接不再使用它, 按default_action返回要回复的内容
+	log.Println("Error: milter " + milter.address + " error: " + err.Error())
+	milter.conn.Close()
+	milter.closed = true
+	if config.Smtp.Milter.DefaultAction == "tempfail" {
+		session.unavailable = true
+		return "451 4.7.1 Content filter unavailable, please try again later\r\n"
+	}
+	return "" //fail-open
+}
+
+func (session *milterSessionStruct) stage(command byte, data []byte, macros []string, skip uint32, noReply uint32, subject string) string { //把一个阶段依次发给每个milter, 返回非空字符串表示要拒绝并回复的内容
+	for _, milter := range session.milterList {
+		if milter.closed || milter.messageDone || milter.protocol&skip != 0 {
+			continue
+		}
+		if err := milter.sendMacros(command, macros...); err != nil {
+			return session.fail(milter, err)
+		}
+		replyCommand, replyData, err := milter.step(command, data, noReply)
+		if err != nil {
+			return session.fail(milter, err)
+		}
+		switch replyCommand {
+		case 'c':
+			continue
+		case 'a': //接受, 连接阶段接受的话整个连接都不用再问了, 否则只是这封邮件
+			if command == 'C' || command == 'H' {
+				milter.writePacket('Q', nil)
+				milter.conn.Close()
+				milter.closed = true
+			} else {
+				milter.messageDone = true
+			}
+		case 'd': //丢弃整封邮件(还是要假装收下)
+			session.discard = true
+			milter.messageDone = true
+		case 'r', 't', 'y':
+			if command == 'M' || command == 'T' { //拒绝收件人的话只是这个收件人, 拒绝HELO的话再次HELO还要问它
+				milter.messageDone = true
+			}
+			return milterReplyText(replyCommand, replyData, subject)
+		default:
+			return session.fail(milter, errorMilterProtocol)
+		}
+	}
+	return ""
+}
+
+func (session *milterSessionStruct) helo(heloName string) string { //HELO/EHLO阶段
+	if session == nil {
+		return ""
+	}
+	session.heloReply = session.stage('H', milterJoin(heloName), nil, milterProtoNoHelo, milterProtoNrHelo, "Helo command")
+	return session.heloReply
+}
+
+func (session *milterSessionStruct) mail(fromMail string) string { //MAIL FROM阶段, 开始一封新的邮件
+	if session == nil {
+		return ""
+	}
+	if session.unavailable { //有milter连不上又要求tempfail
+		return "451 4.7.1 Content filter unavailable, please try again later\r\n"
+	}
+	if session.heloReply != "" { //之前HELO成功过的话状态允许MAIL, 但是milter拒绝了最后一次HELO
+		return session.heloReply
+	}
+	session.queueId = path.Base(generateCacheFilePath())
+	for _, milter := range session.milterList { //跳过了MAIL阶段的milter也要收到这封邮件
+		milter.inMessage = !milter.closed
+	}
+	reply := session.stage('M', milterJoin("<"+fromMail+">"), []string{"i", session.queueId, "{mail_addr}", fromMail}, milterProtoNoMail, milterProtoNrMail, "Sender address")
+	if reply != "" {
+		session.abort()
+	}
+	return reply
+}
+
+func (session *milterSessionStruct) rcpt(toMail string) string { //RCPT TO阶段, 拒绝的话只影响这个收件人
+	if session == nil {
+		return ""
+	}
+	return session.stage('R', milterJoin("<"+toMail+">"), []string{"{rcpt_addr}", toMail}, milterProtoNoRcpt, milterProtoNrRcpt, "Recipient address")
+}
+
+func (session *milterSessionStruct) data() string { //DATA命令阶段(正文还没有收到)
+	if session == nil {
+		return ""
+	}
+	reply := session.stage('T', nil, nil, milterProtoNoData, milterProtoNrData, "Message")
+	if reply != "" {
+		session.abort()
+	}
+	return reply
+}
+
+func (session *milterSessionStruct) message(filePath string) filterResultStruct { //收完正文之后发送头部, 正文和结束, 应用milter的修改
+	var result filterResultStruct
+	if session == nil {
+		return result
+	}
+	for _, milter := range session.milterList {
+		if session.discard {
+			break
+		}
+		if milter.closed || milter.messageDone || !milter.inMessage {
+			continue
+		}
+		milterResult, err := milter.message(filePath, session)
+		if err != nil {
+			if reply := session.fail(milter, err); reply != "" {
+				result.reply = reply
+				break
+			}
+			continue
+		}
+		milter.inMessage = false
+		if milterResult.quarantine != "" {
+			result.quarantine = milterResult.quarantine
+		}
+		if milterResult.reply != "" || milterResult.discard {
+			result.reply = milterResult.reply
+			result.discard = milterResult.discard
+			break
+		}
+	}
+	if session.discard {
+		result.discard = true
+	}
+	session.abort() //没有问完的milter(拒绝/丢弃之后)要结束这封邮件
+	return result
+}
+
+func (session *milterSessionStruct) abort() { //邮件事务结束(RSET/HELO/出错/收完), 让还在处理这封邮件的milter准备下一封
+	if session == nil {
+		return
+	}
+	for _, milter := range session.milterList {
+		if !milter.closed && milter.inMessage {
+			if err := milter.writePacket('A', nil); err != nil {
+				session.fail(milter, err)
+			}
+		}
+		milter.inMessage = false
+		milter.messageDone = false
+	}
+	session.discard = false
+}
+
+func (session *milterSessionStruct) close() { //客户端断开时关闭所有milter
+	if session == nil {
+		return
+	}
+	for _, milter := range session.milterList {
+		if !milter.closed {
+			milter.writePacket('Q', nil)
+			milter.conn.Close()
+			milter.closed = true
+		}
+	}
+}
+
+func (milter *milterConnStruct) message(filePath string, session *milterSessionStruct) (filterResultStruct, error) { //发送一封邮件的头部和正文, 读取最终结果和修改操作
+	var result filterResultStruct
+	f, err := os.Open(filePath)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	headerList, err := readMailHeaderList(reader)
+	if err != nil {
+		return result, err
+	}
+	handleResponse := func(command byte, data []byte) (bool, error) { //处理头部和正文阶段的回复, 返回true表示这个milter已经有结论了
+		switch command {
+		case 'c':
+			return false, nil
+		case 'a':
+			return true, nil
+		case 'd':
+			result.discard = true
+			return true, nil
+		case 'r', 't', 'y':
+			result.reply = milterReplyText(command, data, "Message")
+			return true, nil
+		}
+		return true, errorMilterProtocol
+	}
+	if milter.protocol&milterProtoNoHdrs == 0 {
+		for _, header := range headerList {
+			name := strings.TrimSpace(header[:strings.IndexByte(header+":", ':')])
+			command, data, err := milter.step('L', milterJoin(name, milterHeaderValue(header)), milterProtoNrHdr)
+			if err != nil {
+				return result, err
+			}
+			if done, err := handleResponse(command, data); done || err != nil {
+				return result, err
+			}
+		}
+	}
+	if milter.protocol&milterProtoNoEoh == 0 {
+		command, data, err := milter.step('N', nil, milterProtoNrEoh)
+		if err != nil {
+			return result, err
+		}
+		if done, err := handleResponse(command, data); done || err != nil {
+			return result, err
+		}
+	}
+	if milter.protocol&milterProtoNoBody == 0 {
+		buffer := make([]byte, milterMaxBodyChunk)
+		for {
+			n, readErr := io.ReadFull(reader, buffer)
+			if n > 0 {
+				command, data, err := milter.step('B', buffer[:n], milterProtoNrBody)
+				if err != nil {
+					return result, err
+				}
+				if command == 's' { //milter不需要剩下的正文了
+					break
+				}
+				if done, err := handleResponse(command, data); done || err != nil {
+					return result, err
+				}
+			}
+			if readErr != nil {
+				if readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+					return result, readErr
+				}
+				break
+			}
+		}
+	}
+
+	if err = milter.writePacket('E', nil); err != nil { //结束, 读取修改操作直到最终回复
+		return result, err
+	}
+	var changeList [][]byte
+	var command byte
+	var data []byte
+	for {
+		command, data, err = milter.readResponse()
+		if err != nil {
+			return result, err
+		}
+		switch command {
+		case 'h', 'i', 'm':
+			changeList = append(changeList, append([]byte{command}, data...))
+			continue
+		case 'q':
+			result.quarantine = strings.TrimRight(string(data), "\x00")
+			if result.quarantine == "" {
+				result.quarantine = "quarantined by milter " + milter.address
+			}
+			continue
+		case '+', '-', 'b', 'e', '2': //没有申请的修改操作
+			log.Println("Warning: milter " + milter.address + " sent unsupported modification " + strconv.Quote(string(command)))
+			continue
+		}
+		break
+	}
+	if command == 'c' || command == 'a' { //接受了才应用修改
+		if len(changeList) > 0 {
+			err = rewriteMailHeader(filePath, func(headerList []string) []string {
+				for _, change := range changeList {
+					headerList = milterApplyHeaderChange(headerList, change[0], change[1:])
+				}
+				return headerList
+			})
+		}
+		return result, err
+	}
+	_, err = handleResponse(command, data)
+	return result, err
+}
+
+func getQuarantinePath() string { //获取一个隔离邮件应该储存的位置
+	quarantinePath := config.Smtp.Milter.QuarantinePath
+	if _, err := os.Stat(quarantinePath); os.IsNotExist(err) {
+		os.MkdirAll(quarantinePath, 0755)
+	}
+	return path.Join(quarantinePath, path.Base(generateCacheFilePath()))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMilterPacket struct {
+	command byte
+	data    []byte
+}
+
+type testMilter struct { //假的milter, 记录收到的命令, 用handler决定回复
+	listener    net.Listener
+	mutex       sync.Mutex
+	commandList []byte
+	handler     func(command byte, data []byte) []testMilterPacket
+}
+
+func newTestMilter(t *testing.T, handler func(command byte, data []byte) []testMilterPacket) *testMilter {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	milter := &testMilter{listener: listener, handler: handler}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go milter.serve(conn)
+		}
+	}()
+	return milter
+}
+
+func (milter *testMilter) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		lengthBytes := make([]byte, 4)
+		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint32(lengthBytes))
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			return
+		}
+		command, data := packet[0], packet[1:]
+		if command == 'D' { //宏不用回复, 也不记录
+			continue
+		}
+		milter.mutex.Lock()
+		milter.commandList = append(milter.commandList, command)
+		milter.mutex.Unlock()
+		var replyList []testMilterPacket
+		switch command {
+		case 'O':
+			optneg := make([]byte, 12)
+			binary.BigEndian.PutUint32(optneg[0:], 6)
+			binary.BigEndian.PutUint32(optneg[4:], milterActAddHeader)
+			replyList = []testMilterPacket{{'O', optneg}}
+		case 'A':
+		case 'Q':
+			return
+		default:
+			replyList = milter.handler(command, data)
+			if replyList == nil {
+				replyList = []testMilterPacket{{'c', nil}}
+			}
+		}
+		for _, reply := range replyList {
+			out := make([]byte, 5+len(reply.data))
+			binary.BigEndian.PutUint32(out, uint32(len(reply.data)+1))
+			out[4] = reply.command
+			copy(out[5:], reply.data)
+			conn.Write(out)
+		}
+	}
+}
+
+func (milter *testMilter) commands() string { //收到的命令(去掉重复的头部和正文)
+	milter.mutex.Lock()
+	defer milter.mutex.Unlock()
+	var result []byte
+	for _, command := range milter.commandList {
+		if len(result) > 0 && result[len(result)-1] == command && (command == 'L' || command == 'B') {
+			continue
+		}
+		result = append(result, command)
+	}
+	return string(result)
+}
+
+func testMilterConfig(address string, defaultAction string) string {
+	return `
+[smtp.milter]
+enable = true
+servers = ["` + address + `"]
+timeout_ms = 2000
+default_action = "` + defaultAction + `"
+`
+}
+
+func TestMilterConnectReject(t *testing.T) { //连接阶段的拒绝在问候的时候就生效
+	milter := newTestMilter(t, func(command byte, data []byte) []testMilterPacket {
+		if command == 'C' {
+			return []testMilterPacket{{'y', []byte("554 5.7.1 Go away\x00")}}
+		}
+		return nil
+	})
+	testLoadConfig(t, testMilterConfig(milter.listener.Addr().String(), "accept"))
+	clientConn, serverConn := net.Pipe()
+	handlerDone := make(chan struct{})
+	go func() {
+		smtpClientHandler(serverConn, listenerOptionStruct{smtpMode: smtpModeMx})
+		close(handlerDone)
+	}()
+	defer func() {
+		clientConn.Close()
+		<-handlerDone
+	}()
+	clientConn.SetDeadline(time.Now().Add(time.Second * 5))
+	reply, err := bufio.NewReader(clientConn).ReadString('\n')
+	if err != nil || reply != "554 5.7.1 Go away\r\n" {
+		t.Errorf("greeting = %q, %v", reply, err)
+	}
+}
+
+func TestMilterStages(t *testing.T) {
+	milter := newTestMilter(t, func(command byte, data []byte) []testMilterPacket {
+		switch command {
+		case 'R':
+			if strings.Contains(string(data), "bad@example.com") {
+				return []testMilterPacket{{'r', nil}}
+			}
+		case 'E':
+			return []testMilterPacket{{'h', []byte("X-Milter\x00checked\x00")}, {'c', nil}}
+		}
+		return nil
+	})
+	testLoadConfig(t, testMilterConfig(milter.listener.Addr().String(), "accept"))
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	testAddUser(t, "bad", "bad@example.com", "pw")
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMx})
+	client.command("EHLO client.test", "250")
+	client.command("MAIL FROM:<someone@other.net>", "250")
+	client.command("RSET", "250") //RSET要让milter结束这封邮件
+	client.command("MAIL FROM:<someone@other.net>", "250")
+	if reply := client.command("RCPT TO:<bad@example.com>", "550"); !strings.Contains(reply, "Recipient address rejected") { //收件人阶段就拒绝, 不用等正文
+		t.Errorf("rcpt reply = %q", reply)
+	}
+	if commands := milter.commands(); commands != "OCHMAMR" {
+		t.Errorf("commands before DATA = %q", commands)
+	}
+	client.command("RCPT TO:<alice@example.com>", "250")
+	client.command("DATA", "354")
+	client.command("Subject: hi\r\n\r\nbody\r\n.", "250")
+	client.command("QUIT", "221")
+	if commands := milter.commands(); !strings.HasPrefix(commands, "OCHMAMRRTLNBE") {
+		t.Errorf("commands = %q", commands)
+	}
+	mailInfoList, err := getMailAllInfo("alice@example.com")
+	if err != nil || len(mailInfoList) != 1 {
+		t.Fatalf("mailbox has %d mails, %v", len(mailInfoList), err)
+	}
+	data, _ := os.ReadFile(mailInfoList[0].filePath)
+	if !strings.Contains(string(data), "X-Milter: checked\r\n") {
+		t.Errorf("milter header not added:\n%s", data)
+	}
+}
+
+func TestMilterUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close() //没有人监听了
+	for defaultAction, wantCode := range map[string]string{"tempfail": "451", "accept": "250"} {
+		t.Run(defaultAction, func(t *testing.T) {
+			testLoadConfig(t, testMilterConfig(address, defaultAction))
+			client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMx})
+			client.command("EHLO client.test", "250")
+			client.command("MAIL FROM:<someone@other.net>", wantCode)
+		})
+	}
+}
+
+func TestMilterHeloReject(t *testing.T) { //HELO被拒绝之后再次HELO还要问milter, 不能绕过
+	milter := newTestMilter(t, func(command byte, data []byte) []testMilterPacket {
+		if command == 'H' && strings.HasPrefix(string(data), "bad.test") {
+			return []testMilterPacket{{'y', []byte("550 5.7.1 Bad helo\x00")}}
+		}
+		return nil
+	})
+	testLoadConfig(t, testMilterConfig(milter.listener.Addr().String(), "accept"))
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMx})
+	client.command("EHLO bad.test", "550")
+	client.command("EHLO bad.test", "550")
+	client.command("MAIL FROM:<someone@other.net>", "503")
+	client.command("EHLO good.test", "250")
+	client.command("HELO bad.test", "550")
+	client.command("MAIL FROM:<someone@other.net>", "550") //之前的EHLO成功过, 但是最后一次HELO被拒绝了
+	client.command("EHLO good.test", "250")
+	client.command("MAIL FROM:<someone@other.net>", "250")
+	client.command("QUIT", "221")
+}
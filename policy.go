@@ -0,0 +1,73 @@
+package main
+
+import "strings"
+
+func getAddressDomain(address string) string { //获取邮箱地址的域名部分(小写)
+	index := strings.LastIndex(address, "@")
+	if index == -1 {
+		return ""
+	}
+	return strings.ToLower(address[index+1:])
+}
+
+func isLocalDomain(domain string) bool { //是否为本机托管的邮箱域名(包括域名别名, 国际化域名按A-label比较)
+	exists, _ := domainLookup(domain)
+	return exists
+}
+
+func smtpIsTrustedClient(clientIp string) bool { //客户端是否来自可信网络(类似postfix的mynetworks)
+	return ipInNetworkList(clientIp, smtpTrustedNetworks)
+}
+
+func smtpIsRelayClient(smtpMode byte, authenticatedUsername string, clientIp string) bool { //这个客户端的事务是否可以往外转发
+	if smtpMode == smtpModeSubmission {
+		return authenticatedUsername != ""
+	}
+	if authenticatedUsername != "" && smtpMode != smtpModeMx {
+		return true
+	}
+	return smtpIsTrustedClient(clientIp)
+}
+
+func smtpCheckSender(smtpMode byte, authenticatedUsername string, clientIp string, fromMail string) string { //MAIL FROM时检查发件人, 不允许就返回要回复的内容
+	switch smtpMode {
+	case smtpModeSubmission: //提交端口所有事务都必须鉴权
+		if authenticatedUsername == "" {
+			return "530 5.7.0 Authentication required\r\n"
+		}
+		if !smtpAddressClientAuth(authenticatedUsername, fromMail) {
+			return "553 5.7.1 Mail from must equal authorized user\r\n"
+		}
+	case smtpModeMx: //MX端口不接受冒充本机的发件人(可信网络除外)
+		if smtpIsTrustedClient(clientIp) {
+			return ""
+		}
+		if isLocalDomain(getAddressDomain(fromMail)) {
+			return "553 5.7.1 Local senders must use the submission port\r\n"
+		}
+	default:
+		if authenticatedUsername != "" {
+			if !smtpAddressClientAuth(authenticatedUsername, fromMail) {
+				return "553 5.7.1 Mail from must equal authorized user\r\n"
+			}
+			return ""
+		}
+		if smtpIsTrustedClient(clientIp) {
+			return ""
+		}
+		if isLocalDomain(getAddressDomain(fromMail)) {
+			return "530 5.7.0 Authentication required\r\n"
+		}
+	}
+	return ""
+}
+
+func smtpCheckRelay(smtpMode byte, authenticatedUsername string, clientIp string, toMail string) string { //RCPT TO时检查是否允许投递/转发, 不允许就返回要回复的内容
+	if isLocalDomain(getAddressDomain(toMail)) { //投递到本机不算转发
+		return ""
+	}
+	if smtpIsRelayClient(smtpMode, authenticatedUsername, clientIp) {
+		return ""
+	}
+	return "554 5.7.1 <" + toMail + ">: Relay access denied\r\n"
+}
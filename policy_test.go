@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSmtpCheckRelay(t *testing.T) {
+	testLoadConfig(t, "")
+	modeNameMap := map[byte]string{smtpModeMixed: "mixed", smtpModeMx: "mx", smtpModeSubmission: "submission"}
+	for _, mode := range []byte{smtpModeMixed, smtpModeMx, smtpModeSubmission} {
+		for _, username := range []string{"", "alice"} {
+			for _, clientIp := range []string{"127.0.0.1", "203.0.113.5"} {
+				for _, toMail := range []string{"bob@example.com", "bob@EXAMPLE.com", "someone@other.org"} {
+					trusted := clientIp == "127.0.0.1"
+					local := toMail != "someone@other.org"
+					var want bool
+					switch {
+					case local: //投递到本机总是允许
+						want = true
+					case mode == smtpModeSubmission:
+						want = username != ""
+					case mode == smtpModeMx: //MX端口不能鉴权, 只有可信网络可以转发
+						want = trusted
+					default:
+						want = username != "" || trusted
+					}
+					reply := smtpCheckRelay(mode, username, clientIp, toMail)
+					if (reply == "") != want {
+						t.Errorf("mode=%s auth=%q ip=%s to=%s: reply %q, want allowed=%v", modeNameMap[mode], username, clientIp, toMail, reply, want)
+					}
+					if reply != "" && !strings.HasPrefix(reply, "554 5.7.1 ") {
+						t.Errorf("mode=%s auth=%q ip=%s to=%s: unexpected reply %q", modeNameMap[mode], username, clientIp, toMail, reply)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSmtpNoOpenRelay(t *testing.T) { //没有鉴权又不在可信网络的客户端(net.Pipe的地址不是ip)不能把外部邮件转发到外部
+	testLoadConfig(t, "")
+	for _, mode := range []byte{smtpModeMixed, smtpModeMx} {
+		client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: mode})
+		client.command("EHLO client.test", "250")
+		client.command("MAIL FROM:<spammer@other.net>", "250")
+		client.command("RCPT TO:<victim@other.org>", "554")
+		client.command("QUIT", "221")
+	}
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeSubmission})
+	client.command("EHLO client.test", "250")
+	client.command("MAIL FROM:<spammer@other.net>", "530")
+	client.command("RCPT TO:<victim@other.org>", "503")
+	client.command("QUIT", "221")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
 	"io"
 	"log"
@@ -10,8 +11,16 @@ import (
 	"strings"
 )
 
-func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *tls.Config) { //处理客户端连接
-	conn := &connStruct{tlsConn: nil, plainConn: plainConn, connType: 0x00}
+func pop3ClientHandler(plainConn net.Conn, option listenerOptionStruct) { //处理客户端连接
+	conn := newServerConn(plainConn)
+	autologoutTimeout := timeoutSeconds(config.Pop3.AutologoutTimeoutS)
+	conn.setTimeout(autologoutTimeout, autologoutTimeout)
+	remoteIp := getRemoteIp(plainConn.RemoteAddr())
+	if isIpBanned(remoteIp) { //被封禁的ip直接拒绝
+		conn.Write([]byte("-ERR Your address is temporarily banned\r\n"))
+		conn.Close()
+		return
+	}
 	conn.Write([]byte("+OK Welcome to " + serverName + " pop3 server (" + config.General.ServerAddress + ")\r\n"))
 	var username string
 	var mailAddereeList []string
@@ -20,6 +29,9 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 	for {
 		data, err := ConnReadLine(conn)
 		if err != nil {
+			if isTimeoutError(err) { //RFC 1939的自动登出
+				conn.Write([]byte("-ERR Autologout; idle for too long\r\n"))
+			}
 			conn.Close()
 			return
 		}
@@ -27,14 +39,26 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 		dataSplit := strings.Split(string(data), " ")
 		command := strings.ToLower(dataSplit[0])
 		switch command {
+		case "stat", "list", "uidl", "retr", "top", "dele", "rset":
+			if !verified { //这些命令只能在鉴权后使用
+				conn.Write([]byte("-ERR Not authenticated\r\n"))
+				continue
+			}
+		}
+		switch command {
 		case "capa": //返回可用命令
-			if enableStartTls {
-				conn.Write([]byte("+OK Capability list follows\r\nUSER\r\nPASS\r\nSTAT\r\nLIST\r\nUIDL\r\nRETR\r\nDELE\r\nRSET\r\nSTLS\r\n.\r\n"))
-			} else {
-				conn.Write([]byte("+OK Capability list follows\r\nUSER\r\nPASS\r\nSTAT\r\nLIST\r\nUIDL\r\nRETR\r\nDELE\r\nRSET\r\n.\r\n"))
+			capaReply := "+OK Capability list follows\r\n"
+			if !option.requireTlsForAuth || conn.connType == 0x01 { //要求TLS的话未加密时不显示USER
+				capaReply += "USER\r\nPASS\r\n"
+			}
+			capaReply += "STAT\r\nLIST\r\nUIDL\r\nRETR\r\nTOP\r\nDELE\r\nRSET\r\nRESP-CODES\r\n"
+			if option.enableStartTls && conn.connType == 0x00 {
+				capaReply += "STLS\r\n"
 			}
+			capaReply += ".\r\n"
+			conn.Write([]byte(capaReply))
 		case "stls": //升级到TLS
-			if !enableStartTls {
+			if !option.enableStartTls {
 				conn.Write([]byte("-ERR Unknown command\r\n"))
 				continue
 			}
@@ -44,9 +68,11 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 			}
 			if conn.connType == 0x01 {
 				conn.Write([]byte("-ERR Command not permitted when TLS active\r\n"))
+				continue
 			}
+			conn.discardBuffered() //STLS后面不能跟着明文命令
 			conn.Write([]byte("+OK Begin TLS negotiation\r\n"))
-			tlsConn := tls.Server(conn.plainConn, startTlsConfig)
+			tlsConn := tls.Server(conn.plainConn, option.startTlsConfig)
 			conn.tlsConn = tlsConn
 			conn.connType = 0x01
 		case "user": //设置用户
@@ -54,6 +80,10 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 				conn.Write([]byte("-ERR Have authenticated\r\n"))
 				continue
 			}
+			if option.requireTlsForAuth && conn.connType == 0x00 {
+				conn.Write([]byte("-ERR [SYS/PERM] TLS required for authentication, use STLS first\r\n"))
+				continue
+			}
 			if len(dataSplit) < 2 {
 				conn.Write([]byte("-ERR Wrong syntax\r\n"))
 				continue
@@ -65,6 +95,10 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 				conn.Write([]byte("-ERR Have authenticated\r\n"))
 				continue
 			}
+			if option.requireTlsForAuth && conn.connType == 0x00 {
+				conn.Write([]byte("-ERR [SYS/PERM] TLS required for authentication, use STLS first\r\n"))
+				continue
+			}
 			if len(dataSplit) < 2 {
 				conn.Write([]byte("-ERR Wrong syntax\r\n"))
 				continue
@@ -74,7 +108,7 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 				continue
 			}
 			password := strings.Join(dataSplit[1:], " ")
-			if clientAuth(username, password) {
+			if authAttempt(remoteIp, username, password, "pop3") {
 				mailAddereeList = usernameGetAddress(username)
 				verified = true
 				mailNum, mailTotalSize, err := getMailBasicInfoList(mailAddereeList)
@@ -116,7 +150,7 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 					conn.Write([]byte("-ERR Unknown message\r\n"))
 					continue
 				}
-				if num > int64(len(mailInfoList)) {
+				if num < 1 || num > int64(len(mailInfoList)) {
 					conn.Write([]byte("-ERR Unknown message\r\n"))
 					continue
 				}
@@ -144,7 +178,7 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 					conn.Write([]byte("-ERR Unknown message\r\n"))
 					continue
 				}
-				if num > int64(len(mailInfoList)) {
+				if num < 1 || num > int64(len(mailInfoList)) {
 					conn.Write([]byte("-ERR Unknown message\r\n"))
 					continue
 				}
@@ -165,7 +199,7 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 				conn.Write([]byte("-ERR Unknown message\r\n"))
 				continue
 			}
-			if num > int64(len(mailInfoList)) {
+			if num < 1 || num > int64(len(mailInfoList)) {
 				conn.Write([]byte("-ERR Unknown message\r\n"))
 				continue
 			}
@@ -175,21 +209,59 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 				continue
 			}
 			conn.Write([]byte("+OK " + strconv.FormatInt(mailInfoList[num-1].size, 10) + " octets\r\n"))
-			for {
-				fileData, err := FileReadLine(f)
+			dotWriter := newDotWriter(conn)
+			_, err = io.Copy(dotWriter, f)
+			f.Close()
+			if err != nil { //已经回复了+OK, 只能断开连接
+				log.Println("Error: pop3 read mail error: " + err.Error())
+				conn.Close()
+				return
+			}
+			dotWriter.Close()
+		case "top": //返回一封邮件的头部和正文的前n行
+			if len(dataSplit) < 3 {
+				conn.Write([]byte("-ERR Syntax error\r\n"))
+				continue
+			}
+			mailInfoList, err := getMailAllInfoList(usernameGetAddress(username))
+			if err != nil {
+				conn.Write([]byte("-ERR " + err.Error() + "\r\n"))
+				continue
+			}
+			num, err := strconv.ParseInt(dataSplit[1], 10, 64)
+			if err != nil || num < 1 || num > int64(len(mailInfoList)) {
+				conn.Write([]byte("-ERR Unknown message\r\n"))
+				continue
+			}
+			lineCount, err := strconv.Atoi(dataSplit[2])
+			if err != nil || lineCount < 0 {
+				conn.Write([]byte("-ERR Syntax error\r\n"))
+				continue
+			}
+			f, err := os.Open(mailInfoList[num-1].filePath)
+			if err != nil {
+				conn.Write([]byte("-ERR Unknown message\r\n"))
+				continue
+			}
+			reader := bufio.NewReader(f)
+			headerList, err := readMailHeaderList(reader)
+			if err != nil {
+				f.Close()
+				conn.Write([]byte("-ERR Unknown message\r\n"))
+				continue
+			}
+			conn.Write([]byte("+OK Top of message follows\r\n"))
+			dotWriter := newDotWriter(conn)
+			dotWriter.Write([]byte(strings.Join(headerList, "") + "\r\n"))
+			for i := 0; i < lineCount; i++ {
+				line, err := reader.ReadBytes('\n')
+				dotWriter.Write(line)
 				if err != nil {
-					if err != io.EOF {
-						conn.Write([]byte("-ERR Unknown message\r\n"))
-						f.Close()
-						goto nextCycle
-					} else {
-						conn.Write([]byte(".\r\n"))
-						break
-					}
+					break
 				}
-				conn.Write(fileData)
 			}
 			f.Close()
+			dotWriter.Close()
 		case "dele": //删除一封邮件
 			if len(dataSplit) < 2 {
 				conn.Write([]byte("-ERR Unknown message\r\n"))
@@ -205,7 +277,7 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 				conn.Write([]byte("-ERR Unknown message\r\n"))
 				continue
 			}
-			if num > int64(len(mailInfoList)) {
+			if num < 1 || num > int64(len(mailInfoList)) {
 				conn.Write([]byte("-ERR Unknown message\r\n"))
 				continue
 			}
@@ -223,17 +295,25 @@ func pop3ClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 		default:
 			conn.Write([]byte("-ERR Unknown command\r\n"))
 		}
-	nextCycle:
 	}
 }
 
-func pop3ClientListenHandler(listener net.Listener, enableStartTls bool, startTlsConfig *tls.Config) { //监听
+func pop3ClientListenHandler(listener net.Listener, option listenerOptionStruct) { //监听
 	for !serverStop {
 		conn, err := listener.Accept()
 		if err != nil {
 			log.Println("Error: pop3 listen error: " + err.Error())
+			continue
+		}
+		remoteIp := getRemoteIp(conn.RemoteAddr())
+		if !acquireConnection(remoteIp) { //超过连接数限制
+			go rejectConnection(conn, "-ERR [IN-USE] Too many connections\r\n")
+			continue
 		}
-		go pop3ClientHandler(conn, enableStartTls, startTlsConfig)
+		go func() {
+			pop3ClientHandler(conn, option)
+			releaseConnection(remoteIp)
+		}()
 	}
 }
 
@@ -245,12 +325,13 @@ func pop3Server() { //启动pop3服务
 			goto next
 		}
 		log.Println("Info: start pop3 server at: " + listener.Addr().String())
+		option := listenerOptionStruct{requireTlsForAuth: config.Pop3.PlainRequireTlsForAuth}
 		if config.Pop3.PlainEnableStartTls {
 			log.Println("Info: pop3 STARTTLS enabled")
-			go pop3ClientListenHandler(listener, true, &tls.Config{Certificates: []tls.Certificate{pop3StartTlsCert}})
-		} else {
-			go pop3ClientListenHandler(listener, false, nil)
+			option.enableStartTls = true
+			option.startTlsConfig = &tls.Config{Certificates: []tls.Certificate{pop3StartTlsCert}}
 		}
+		go pop3ClientListenHandler(listener, option)
 	}
 next:
 	if config.Pop3.EnableTls {
@@ -260,6 +341,6 @@ next:
 			return
 		}
 		log.Println("Info: start pop3 tls server at: " + listener.Addr().String())
-		go pop3ClientListenHandler(listener, false, nil)
+		go pop3ClientListenHandler(listener, listenerOptionStruct{})
 	}
 }
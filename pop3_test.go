@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPop3TopDotStuffing(t *testing.T) {
+	testLoadConfig(t, "")
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	mail := "Subject: dots\r\n\r\n.first\r\n.\r\n..\r\nfourth\r\n"
+	if err := os.WriteFile(getMailStoragePath("alice@example.com"), []byte(mail), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go pop3ClientHandler(serverConn, listenerOptionStruct{})
+	clientConn.SetDeadline(time.Now().Add(time.Second * 5))
+	reader := bufio.NewReader(clientConn)
+	command := func(line string) string {
+		t.Helper()
+		if line != "" {
+			clientConn.Write([]byte(line + "\r\n"))
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil || !strings.HasPrefix(reply, "+OK") {
+			t.Fatalf("%s: got %q, %v", line, reply, err)
+		}
+		return reply
+	}
+	command("")
+	command("USER alice")
+	command("PASS pw")
+	for _, test := range []struct {
+		lines string
+		want  string
+	}{
+		{"3", "Subject: dots\r\n\r\n.first\r\n.\r\n..\r\n"},
+		{"10", "Subject: dots\r\n\r\n.first\r\n.\r\n..\r\nfourth\r\n"},
+		{"0", "Subject: dots\r\n\r\n"},
+	} {
+		command("TOP 1 " + test.lines)
+		var got strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == ".\r\n" {
+				break
+			}
+			got.WriteString(strings.TrimPrefix(line, ".")) //去掉透明点
+		}
+		if got.String() != test.want {
+			t.Errorf("TOP 1 %s: got %q, want %q", test.lines, got.String(), test.want)
+		}
+	}
+	command("QUIT")
+}
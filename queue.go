@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const queueFileSuffix = ".queue" //推迟重试的邮件在缓存文件旁边放一个同名加后缀的信封文件
+
+type queueRecordStruct struct { //信封文件的内容(重启后用来继续重试)
+	FromMail    string            `toml:"from_mail"`
+	ToMail      []string          `toml:"to_mail"`
+	SmtpUtf8    bool              `toml:"smtputf8"`
+	DsnRet      string            `toml:"dsn_ret"`
+	DsnEnvId    string            `toml:"dsn_envid"`
+	DsnNotify   map[string]string `toml:"dsn_notify"`
+	DsnOrcpt    map[string]string `toml:"dsn_orcpt"`
+	ArrivalTime time.Time         `toml:"arrival_time"`
+	RetryTimes  int               `toml:"retry_times"`
+	NextRetry   time.Time         `toml:"next_retry"`
+	DkimHeader  string            `toml:"dkim_header"`
+}
+
+func queueSave(cacheFilePath string, envelope smtpEnvelopeStruct, dkimHeader string, nextRetry time.Time) error { //把推迟重试的邮件的信封写到缓存文件旁边
+	record := queueRecordStruct{FromMail: envelope.fromMail, ToMail: envelope.toMail, SmtpUtf8: envelope.smtpUtf8, DsnRet: envelope.dsnRet, DsnEnvId: envelope.dsnEnvId, DsnNotify: envelope.dsnNotify, DsnOrcpt: envelope.dsnOrcpt, ArrivalTime: envelope.arrivalTime, RetryTimes: envelope.retryTimes, NextRetry: nextRetry, DkimHeader: dkimHeader}
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(record); err != nil {
+		return err
+	}
+	tempPath := cacheFilePath + queueFileSuffix + ".tmp" //先写临时文件再改名, 重启时不会读到写了一半的信封
+	if err := os.WriteFile(tempPath, buffer.Bytes(), 0644); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, cacheFilePath+queueFileSuffix)
+}
+
+func queueLoad(cacheFilePath string) (smtpEnvelopeStruct, string, time.Time, error) { //读取缓存文件旁边的信封, 返回信封, DKIM头部和下次重试的时间
+	var record queueRecordStruct
+	if _, err := toml.DecodeFile(cacheFilePath+queueFileSuffix, &record); err != nil {
+		return smtpEnvelopeStruct{}, "", time.Time{}, err
+	}
+	envelope := smtpEnvelopeStruct{fromMail: record.FromMail, toMail: record.ToMail, smtpUtf8: record.SmtpUtf8, dsnRet: record.DsnRet, dsnEnvId: record.DsnEnvId, dsnNotify: record.DsnNotify, dsnOrcpt: record.DsnOrcpt, arrivalTime: record.ArrivalTime, retryTimes: record.RetryTimes}
+	return envelope, record.DkimHeader, record.NextRetry, nil
+}
+
+func queueRemove(cacheFilePath string) { //邮件处理完之后删掉信封文件(不存在也没关系)
+	os.Remove(cacheFilePath + queueFileSuffix)
+}
+
+func queueSchedule(envelope smtpEnvelopeStruct, cacheFilePath string, dkimHeader string, nextRetry time.Time) { //到时间后重试发送
+	time.AfterFunc(time.Until(nextRetry), func() {
+		smtpMailSendHandler(envelope, cacheFilePath, dkimHeader)
+	})
+}
+
+func queueRestore() { //启动时扫描缓存目录, 重新安排上次没有完成的重试
+	entryList, err := os.ReadDir(config.General.CachePath)
+	if err != nil {
+		log.Println("Error: read queue error: " + err.Error())
+		return
+	}
+	for _, entry := range entryList {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), queueFileSuffix) {
+			continue
+		}
+		queuePath := path.Join(config.General.CachePath, entry.Name())
+		cacheFilePath := strings.TrimSuffix(queuePath, queueFileSuffix)
+		envelope, dkimHeader, nextRetry, err := queueLoad(cacheFilePath)
+		if err != nil {
+			log.Println("Error: read queue file " + entry.Name() + " error: " + err.Error())
+			continue
+		}
+		if _, err = os.Stat(cacheFilePath); err != nil { //邮件本身已经没有了
+			log.Println("Warning: queued mail " + entry.Name() + " lost its cache file, dropped")
+			os.Remove(queuePath)
+			continue
+		}
+		log.Println("Info: restore queued mail to " + strings.Join(envelope.toMail, ", ") + ", retry " + dsnFormatRetryTimes(envelope.retryTimes))
+		queueSchedule(envelope, cacheFilePath, dkimHeader, nextRetry)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueueSaveLoad(t *testing.T) {
+	testLoadConfig(t, "")
+	cacheFilePath := generateCacheFilePath()
+	envelope := smtpEnvelopeStruct{
+		fromMail:    "alice@example.com",
+		toMail:      []string{"bob@other.org", "carol@other.org"},
+		smtpUtf8:    true,
+		dsnRet:      "HDRS",
+		dsnEnvId:    "QQ314159",
+		dsnNotify:   map[string]string{"bob@other.org": "SUCCESS,FAILURE"},
+		dsnOrcpt:    map[string]string{"bob@other.org": "rfc822;bob@other.org"},
+		arrivalTime: time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC),
+		retryTimes:  2,
+	}
+	nextRetry := time.Date(2022, 8, 1, 10, 20, 0, 0, time.UTC)
+	dkimHeader := "DKIM-Signature: v=1; a=rsa-sha256; d=example.com;\r\n\tb=abc\r\n"
+	if err := queueSave(cacheFilePath, envelope, dkimHeader, nextRetry); err != nil {
+		t.Fatal(err)
+	}
+	loadedEnvelope, loadedDkimHeader, loadedNextRetry, err := queueLoad(cacheFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loadedEnvelope.toMail, envelope.toMail) || loadedEnvelope.fromMail != envelope.fromMail || loadedEnvelope.smtpUtf8 != envelope.smtpUtf8 || loadedEnvelope.dsnRet != envelope.dsnRet || loadedEnvelope.dsnEnvId != envelope.dsnEnvId || loadedEnvelope.retryTimes != envelope.retryTimes {
+		t.Errorf("envelope = %+v, want %+v", loadedEnvelope, envelope)
+	}
+	if !reflect.DeepEqual(loadedEnvelope.dsnNotify, envelope.dsnNotify) || !reflect.DeepEqual(loadedEnvelope.dsnOrcpt, envelope.dsnOrcpt) {
+		t.Errorf("dsn parameters = %v %v", loadedEnvelope.dsnNotify, loadedEnvelope.dsnOrcpt)
+	}
+	if !loadedEnvelope.arrivalTime.Equal(envelope.arrivalTime) || !loadedNextRetry.Equal(nextRetry) {
+		t.Errorf("times = %v %v", loadedEnvelope.arrivalTime, loadedNextRetry)
+	}
+	if loadedDkimHeader != dkimHeader {
+		t.Errorf("dkim header = %q", loadedDkimHeader)
+	}
+	queueRemove(cacheFilePath)
+	if _, err = os.Stat(cacheFilePath + queueFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("queue file not removed: %v", err)
+	}
+}
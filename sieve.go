@@ -0,0 +1,565 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const ( //词法单元类型
+	sieveTokenIdentifier = iota
+	sieveTokenTag
+	sieveTokenNumber
+	sieveTokenString
+	sieveTokenPunct
+	sieveTokenEnd
+)
+
+type sieveTokenStruct struct {
+	kind  int
+	value string
+	line  int
+}
+
+type sieveArgumentStruct struct { //命令/测试的一个参数
+	kind    int //sieveTokenTag, sieveTokenNumber或sieveTokenString(字符串列表)
+	tag     string
+	number  int64
+	strList []string
+	isList  bool //是不是用[]写的列表
+}
+
+type sieveTestStruct struct {
+	name      string
+	arguments []sieveArgumentStruct
+	tests     []*sieveTestStruct //not/anyof/allof的子测试
+	line      int
+}
+
+type sieveCommandStruct struct {
+	name      string
+	arguments []sieveArgumentStruct
+	test      *sieveTestStruct //if/elsif的测试
+	block     []*sieveCommandStruct
+	line      int
+}
+
+type sieveScriptStruct struct { //编译好的脚本
+	commands []*sieveCommandStruct
+	requires map[string]bool
+}
+
+var sieveExtensions = map[string]bool{ //支持的扩展
+	"fileinto":                   true,
+	"reject":                     true,
+	"envelope":                   true,
+	"vacation":                   true,
+	"variables":                  true,
+	"copy":                       true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+func sieveError(line int, message string) error {
+	return errors.New("line " + strconv.Itoa(line) + ": " + message)
+}
+
+func sieveLex(script string) ([]sieveTokenStruct, error) { //把脚本拆成词法单元(RFC 5228 8.1)
+	var tokenList []sieveTokenStruct
+	line := 1
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#': //单行注释
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(script[i:], "/*"): //多行注释
+			end := strings.Index(script[i+2:], "*/")
+			if end == -1 {
+				return nil, sieveError(line, "unterminated comment")
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"': //带引号的字符串
+			var value strings.Builder
+			startLine := line
+			i++
+			for {
+				if i >= len(script) {
+					return nil, sieveError(startLine, "unterminated string")
+				}
+				if script[i] == '\\' && i+1 < len(script) {
+					value.WriteByte(script[i+1])
+					i += 2
+					continue
+				}
+				if script[i] == '"' {
+					i++
+					break
+				}
+				if script[i] == '\n' {
+					line++
+				}
+				value.WriteByte(script[i])
+				i++
+			}
+			tokenList = append(tokenList, sieveTokenStruct{kind: sieveTokenString, value: value.String(), line: startLine})
+		case strings.HasPrefix(strings.ToLower(script[i:]), "text:"): //多行字符串, 以单独一行的"."结束, 行首的".."表示"."
+			startLine := line
+			end := strings.Index(script[i:], "\n")
+			if end == -1 {
+				return nil, sieveError(line, "unterminated multi-line string")
+			}
+			i += end + 1
+			line++
+			var value strings.Builder
+			for {
+				end = strings.Index(script[i:], "\n")
+				if end == -1 {
+					return nil, sieveError(startLine, "unterminated multi-line string")
+				}
+				textLine := script[i : i+end+1]
+				i += end + 1
+				line++
+				if strings.TrimRight(textLine, "\r\n") == "." {
+					break
+				}
+				if strings.HasPrefix(textLine, "..") {
+					textLine = textLine[1:]
+				}
+				value.WriteString(strings.TrimRight(textLine, "\r\n") + "\r\n")
+			}
+			tokenList = append(tokenList, sieveTokenStruct{kind: sieveTokenString, value: value.String(), line: startLine})
+		case c >= '0' && c <= '9': //数字, 可以带K/M/G
+			start := i
+			for i < len(script) && script[i] >= '0' && script[i] <= '9' {
+				i++
+			}
+			value := script[start:i]
+			if i < len(script) && strings.IndexByte("KkMmGg", script[i]) != -1 {
+				value += strings.ToUpper(script[i : i+1])
+				i++
+			}
+			tokenList = append(tokenList, sieveTokenStruct{kind: sieveTokenNumber, value: value, line: line})
+		case c == ':' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z': //标识符和标签
+			start := i
+			i++
+			for i < len(script) && (script[i] == '_' || script[i] >= 'a' && script[i] <= 'z' || script[i] >= 'A' && script[i] <= 'Z' || script[i] >= '0' && script[i] <= '9') {
+				i++
+			}
+			kind := sieveTokenIdentifier
+			if c == ':' {
+				kind = sieveTokenTag
+				if i == start+1 {
+					return nil, sieveError(line, "empty tag")
+				}
+			}
+			tokenList = append(tokenList, sieveTokenStruct{kind: kind, value: strings.ToLower(script[start:i]), line: line})
+		case strings.IndexByte(";,(){}[]", c) != -1:
+			tokenList = append(tokenList, sieveTokenStruct{kind: sieveTokenPunct, value: string(c), line: line})
+			i++
+		default:
+			return nil, sieveError(line, "unexpected character "+strconv.Quote(string(c)))
+		}
+	}
+	tokenList = append(tokenList, sieveTokenStruct{kind: sieveTokenEnd, line: line})
+	return tokenList, nil
+}
+
+type sieveParserStruct struct {
+	tokenList []sieveTokenStruct
+	pos       int
+}
+
+func (parser *sieveParserStruct) peek() sieveTokenStruct {
+	return parser.tokenList[parser.pos]
+}
+
+func (parser *sieveParserStruct) next() sieveTokenStruct {
+	token := parser.tokenList[parser.pos]
+	if token.kind != sieveTokenEnd {
+		parser.pos++
+	}
+	return token
+}
+
+func (parser *sieveParserStruct) isPunct(value string) bool {
+	token := parser.peek()
+	return token.kind == sieveTokenPunct && token.value == value
+}
+
+func (parser *sieveParserStruct) expectPunct(value string) error {
+	token := parser.next()
+	if token.kind != sieveTokenPunct || token.value != value {
+		return sieveError(token.line, "expected \""+value+"\"")
+	}
+	return nil
+}
+
+func (parser *sieveParserStruct) parseArguments() ([]sieveArgumentStruct, error) { //读取参数(字符串列表/数字/标签)
+	var argumentList []sieveArgumentStruct
+	for {
+		token := parser.peek()
+		switch {
+		case token.kind == sieveTokenTag:
+			parser.next()
+			argumentList = append(argumentList, sieveArgumentStruct{kind: sieveTokenTag, tag: token.value})
+		case token.kind == sieveTokenNumber:
+			parser.next()
+			value := token.value
+			multiplier := int64(1)
+			switch value[len(value)-1] {
+			case 'K':
+				multiplier = 1 << 10
+			case 'M':
+				multiplier = 1 << 20
+			case 'G':
+				multiplier = 1 << 30
+			}
+			value = strings.TrimRight(value, "KMG")
+			number, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, sieveError(token.line, "invalid number")
+			}
+			argumentList = append(argumentList, sieveArgumentStruct{kind: sieveTokenNumber, number: number * multiplier})
+		case token.kind == sieveTokenString:
+			parser.next()
+			argumentList = append(argumentList, sieveArgumentStruct{kind: sieveTokenString, strList: []string{token.value}})
+		case token.kind == sieveTokenPunct && token.value == "[":
+			parser.next()
+			argument := sieveArgumentStruct{kind: sieveTokenString, isList: true}
+			for {
+				token = parser.next()
+				if token.kind != sieveTokenString {
+					return nil, sieveError(token.line, "expected string in string list")
+				}
+				argument.strList = append(argument.strList, token.value)
+				if parser.isPunct("]") {
+					parser.next()
+					break
+				}
+				if err := parser.expectPunct(","); err != nil {
+					return nil, err
+				}
+			}
+			argumentList = append(argumentList, argument)
+		default:
+			return argumentList, nil
+		}
+	}
+}
+
+func (parser *sieveParserStruct) parseTest() (*sieveTestStruct, error) {
+	token := parser.next()
+	if token.kind != sieveTokenIdentifier {
+		return nil, sieveError(token.line, "expected test")
+	}
+	test := &sieveTestStruct{name: token.value, line: token.line}
+	var err error
+	test.arguments, err = parser.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	if parser.isPunct("(") { //测试列表
+		parser.next()
+		for {
+			subTest, err := parser.parseTest()
+			if err != nil {
+				return nil, err
+			}
+			test.tests = append(test.tests, subTest)
+			if parser.isPunct(")") {
+				parser.next()
+				break
+			}
+			if err = parser.expectPunct(","); err != nil {
+				return nil, err
+			}
+		}
+	} else if parser.peek().kind == sieveTokenIdentifier { //单个子测试(not)
+		subTest, err := parser.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		test.tests = append(test.tests, subTest)
+	}
+	return test, nil
+}
+
+func (parser *sieveParserStruct) parseCommands(inBlock bool) ([]*sieveCommandStruct, error) {
+	commandList := []*sieveCommandStruct{} //空的块{}也不是nil, 检查时nil表示没有块
+	for {
+		token := parser.peek()
+		if token.kind == sieveTokenEnd {
+			if inBlock {
+				return nil, sieveError(token.line, "missing \"}\"")
+			}
+			return commandList, nil
+		}
+		if inBlock && parser.isPunct("}") {
+			parser.next()
+			return commandList, nil
+		}
+		parser.next()
+		if token.kind != sieveTokenIdentifier {
+			return nil, sieveError(token.line, "expected command")
+		}
+		command := &sieveCommandStruct{name: token.value, line: token.line}
+		var err error
+		command.arguments, err = parser.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek().kind == sieveTokenIdentifier {
+			command.test, err = parser.parseTest()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if parser.isPunct("{") {
+			parser.next()
+			command.block, err = parser.parseCommands(true)
+			if err != nil {
+				return nil, err
+			}
+		} else if err = parser.expectPunct(";"); err != nil {
+			return nil, err
+		}
+		commandList = append(commandList, command)
+	}
+}
+
+type sieveArgumentSpecStruct struct { //一个命令/测试可以接受的参数
+	tags         map[string]int    //标签 -> 后面跟着的参数类型(0为没有)
+	positional   []int             //位置参数的类型
+	extension    string            //需要require的扩展
+	tagExtension map[string]string //需要require扩展的标签
+}
+
+var sieveCommandSpecs = map[string]sieveArgumentSpecStruct{
+	"keep":     {},
+	"discard":  {},
+	"stop":     {},
+	"fileinto": {tags: map[string]int{":copy": 0}, positional: []int{sieveTokenString}, extension: "fileinto", tagExtension: map[string]string{":copy": "copy"}},
+	"redirect": {tags: map[string]int{":copy": 0}, positional: []int{sieveTokenString}, tagExtension: map[string]string{":copy": "copy"}},
+	"reject":   {positional: []int{sieveTokenString}, extension: "reject"},
+	"vacation": {tags: map[string]int{":days": sieveTokenNumber, ":subject": sieveTokenString, ":from": sieveTokenString, ":addresses": sieveTokenString, ":mime": 0, ":handle": sieveTokenString}, positional: []int{sieveTokenString}, extension: "vacation"},
+	"set":      {tags: map[string]int{":lower": 0, ":upper": 0, ":lowerfirst": 0, ":upperfirst": 0, ":quotewildcard": 0, ":length": 0}, positional: []int{sieveTokenString, sieveTokenString}, extension: "variables"},
+}
+
+var sieveMatchTags = map[string]int{":is": 0, ":contains": 0, ":matches": 0, ":comparator": sieveTokenString}
+
+var sieveTestSpecs = map[string]sieveArgumentSpecStruct{
+	"true":     {},
+	"false":    {},
+	"not":      {},
+	"anyof":    {},
+	"allof":    {},
+	"exists":   {positional: []int{sieveTokenString}},
+	"size":     {tags: map[string]int{":over": 0, ":under": 0}, positional: []int{sieveTokenNumber}},
+	"header":   {tags: sieveMatchTags, positional: []int{sieveTokenString, sieveTokenString}},
+	"address":  {tags: sieveAddressTags(), positional: []int{sieveTokenString, sieveTokenString}},
+	"envelope": {tags: sieveAddressTags(), positional: []int{sieveTokenString, sieveTokenString}, extension: "envelope"},
+	"string":   {tags: sieveMatchTags, positional: []int{sieveTokenString, sieveTokenString}, extension: "variables"},
+}
+
+func sieveAddressTags() map[string]int {
+	tags := map[string]int{":all": 0, ":localpart": 0, ":domain": 0}
+	for tag, kind := range sieveMatchTags {
+		tags[tag] = kind
+	}
+	return tags
+}
+
+func sieveSplitArguments(argumentList []sieveArgumentStruct, spec sieveArgumentSpecStruct, requires map[string]bool, line int) (map[string]sieveArgumentStruct, []sieveArgumentStruct, error) { //把参数分成标签和位置参数, 并检查类型
+	tags := make(map[string]sieveArgumentStruct)
+	var positional []sieveArgumentStruct
+	for i := 0; i < len(argumentList); i++ {
+		argument := argumentList[i]
+		if argument.kind != sieveTokenTag {
+			positional = append(positional, argument)
+			continue
+		}
+		if len(positional) > 0 {
+			return nil, nil, sieveError(line, "tag "+argument.tag+" after positional arguments")
+		}
+		valueKind, ok := spec.tags[argument.tag]
+		if !ok {
+			return nil, nil, sieveError(line, "unknown tag "+argument.tag)
+		}
+		if extension, ok := spec.tagExtension[argument.tag]; ok && !requires[extension] {
+			return nil, nil, sieveError(line, "tag "+argument.tag+" requires extension \""+extension+"\"")
+		}
+		if _, ok := tags[argument.tag]; ok {
+			return nil, nil, sieveError(line, "duplicate tag "+argument.tag)
+		}
+		if valueKind != 0 { //带值的标签记录后面的值
+			if i+1 >= len(argumentList) || argumentList[i+1].kind != valueKind {
+				return nil, nil, sieveError(line, "tag "+argument.tag+" needs a value")
+			}
+			i++
+			tags[argument.tag] = argumentList[i]
+		} else {
+			tags[argument.tag] = argument
+		}
+	}
+	if len(positional) != len(spec.positional) {
+		return nil, nil, sieveError(line, "wrong number of arguments")
+	}
+	for i, kind := range spec.positional {
+		if positional[i].kind != kind {
+			return nil, nil, sieveError(line, "wrong argument type")
+		}
+	}
+	return tags, positional, nil
+}
+
+func sieveCheckTest(test *sieveTestStruct, requires map[string]bool) error { //检查测试的语法
+	spec, ok := sieveTestSpecs[test.name]
+	if !ok {
+		return sieveError(test.line, "unknown test "+test.name)
+	}
+	if spec.extension != "" && !requires[spec.extension] {
+		return sieveError(test.line, "test "+test.name+" requires extension \""+spec.extension+"\"")
+	}
+	tags, _, err := sieveSplitArguments(test.arguments, spec, requires, test.line)
+	if err != nil {
+		return err
+	}
+	if comparator, ok := tags[":comparator"]; ok {
+		name := strings.ToLower(comparator.strList[0])
+		if len(comparator.strList) != 1 || (name != "i;octet" && name != "i;ascii-casemap") { //这两个比较器不需要require
+			return sieveError(test.line, "unsupported comparator")
+		}
+	}
+	count := 0
+	for _, tag := range []string{":is", ":contains", ":matches"} {
+		if _, ok := tags[tag]; ok {
+			count++
+		}
+	}
+	if count > 1 {
+		return sieveError(test.line, "more than one match type")
+	}
+	count = 0
+	for _, tag := range []string{":all", ":localpart", ":domain"} {
+		if _, ok := tags[tag]; ok {
+			count++
+		}
+	}
+	if count > 1 {
+		return sieveError(test.line, "more than one address part")
+	}
+	if _, over := tags[":over"]; test.name == "size" {
+		if _, under := tags[":under"]; over == under {
+			return sieveError(test.line, "size needs :over or :under")
+		}
+	}
+	switch test.name {
+	case "not":
+		if len(test.tests) != 1 {
+			return sieveError(test.line, "not needs one test")
+		}
+	case "anyof", "allof":
+		if len(test.tests) == 0 {
+			return sieveError(test.line, test.name+" needs a test list")
+		}
+	default:
+		if len(test.tests) != 0 {
+			return sieveError(test.line, test.name+" does not take tests")
+		}
+	}
+	for _, subTest := range test.tests {
+		if err = sieveCheckTest(subTest, requires); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sieveCheckCommands(commandList []*sieveCommandStruct, requires map[string]bool, topLevel bool) error { //检查命令的语法
+	allowRequire := topLevel
+	for i, command := range commandList {
+		if command.name != "require" {
+			allowRequire = false
+		}
+		switch command.name {
+		case "require":
+			if !allowRequire {
+				return sieveError(command.line, "require must come before other commands")
+			}
+			if len(command.arguments) != 1 || command.arguments[0].kind != sieveTokenString || command.test != nil || command.block != nil {
+				return sieveError(command.line, "require needs a string list")
+			}
+			for _, extension := range command.arguments[0].strList {
+				if !sieveExtensions[strings.ToLower(extension)] {
+					return sieveError(command.line, "unsupported extension \""+extension+"\"")
+				}
+				requires[strings.ToLower(extension)] = true
+			}
+			continue
+		case "if", "elsif", "else":
+			if command.name != "if" && (i == 0 || (commandList[i-1].name != "if" && commandList[i-1].name != "elsif")) {
+				return sieveError(command.line, command.name+" without if")
+			}
+			if len(command.arguments) != 0 || command.block == nil || (command.name == "else") != (command.test == nil) {
+				return sieveError(command.line, "invalid "+command.name)
+			}
+			if command.test != nil {
+				if err := sieveCheckTest(command.test, requires); err != nil {
+					return err
+				}
+			}
+			if err := sieveCheckCommands(command.block, requires, false); err != nil {
+				return err
+			}
+			continue
+		}
+		spec, ok := sieveCommandSpecs[command.name]
+		if !ok {
+			return sieveError(command.line, "unknown command "+command.name)
+		}
+		if spec.extension != "" && !requires[spec.extension] {
+			return sieveError(command.line, "command "+command.name+" requires extension \""+spec.extension+"\"")
+		}
+		if command.test != nil || command.block != nil {
+			return sieveError(command.line, command.name+" does not take a test or block")
+		}
+		_, positional, err := sieveSplitArguments(command.arguments, spec, requires, command.line)
+		if err != nil {
+			return err
+		}
+		for _, argument := range positional {
+			if argument.kind == sieveTokenString && argument.isList {
+				return sieveError(command.line, command.name+" expects a single string")
+			}
+		}
+	}
+	return nil
+}
+
+func sieveCompile(script string) (*sieveScriptStruct, error) { //解析并检查一个脚本
+	if len(script) > config.Sieve.MaxScriptSize {
+		return nil, errors.New("script too large")
+	}
+	tokenList, err := sieveLex(script)
+	if err != nil {
+		return nil, err
+	}
+	parser := &sieveParserStruct{tokenList: tokenList}
+	commandList, err := parser.parseCommands(false)
+	if err != nil {
+		return nil, err
+	}
+	requires := make(map[string]bool)
+	if err = sieveCheckCommands(commandList, requires, true); err != nil {
+		return nil, err
+	}
+	return &sieveScriptStruct{commands: commandList, requires: requires}, nil
+}
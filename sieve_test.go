@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSieveWildcardMatch(t *testing.T) {
+	testList := []struct {
+		pattern  string
+		text     string
+		fold     bool
+		match    bool
+		captures []string
+	}{
+		{"*", "", false, true, []string{""}},
+		{"", "", false, true, nil},
+		{"", "a", false, false, nil},
+		{"a?c", "abc", false, true, []string{"b"}},
+		{"a?c", "ac", false, false, nil},
+		{"*@*", "alice@example.com", false, true, []string{"alice", "example.com"}},
+		{"* *", "a b c", false, true, []string{"a b", "c"}}, //*尽量多匹配
+		{"*%*", "a%b%c", false, true, []string{"a%b", "c"}},
+		{"[*] *", "[list] hello", false, true, []string{"list", "hello"}},
+		{"\\*x", "*x", false, true, nil},
+		{"\\*x", "ax", false, false, nil},
+		{"a\\?", "a?", false, true, nil},
+		{"a\\", "a\\", false, true, nil},
+		{"HELLO*", "hello world", true, true, []string{" world"}},
+		{"HELLO*", "hello world", false, false, nil},
+		{"*?*", "ab", false, true, []string{"a", "b", ""}},
+		{"ä*", "Ärger", true, true, []string{"rger"}},
+	}
+	for _, test := range testList {
+		var captures []string
+		match := sieveWildcardMatch([]rune(test.pattern), []rune(test.text), test.fold, &captures)
+		if match != test.match {
+			t.Errorf("%q against %q: match = %v", test.pattern, test.text, match)
+			continue
+		}
+		if match && !reflect.DeepEqual(captures, test.captures) {
+			t.Errorf("%q against %q: captures = %q, want %q", test.pattern, test.text, captures, test.captures)
+		}
+		if !match && len(captures) != 0 {
+			t.Errorf("%q against %q: captures %q left after failed match", test.pattern, test.text, captures)
+		}
+	}
+}
+
+func TestSieveWildcardMatchNotExponential(t *testing.T) { //脚本作者可以写出很多*的模式, 不能让一封邮件卡住投递
+	pattern := []rune(strings.Repeat("*a", 30) + "b")
+	text := []rune(strings.Repeat("a", 2000))
+	start := time.Now()
+	var captures []string
+	if sieveWildcardMatch(pattern, text, true, &captures) {
+		t.Errorf("pattern should not match")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("match took %v", elapsed)
+	}
+}
+
+func TestSieveCompile(t *testing.T) {
+	testLoadConfig(t, "")
+	testList := []struct {
+		script string
+		err    string //空为编译成功
+	}{
+		{"", ""},
+		{"keep;", ""},
+		{"# comment\r\n/* multi\r\nline */ keep;", ""},
+		{"fileinto \"x\";", "requires extension \"fileinto\""},
+		{"require \"fileinto\"; fileinto \"x\";", ""},
+		{"require [\"fileinto\", \"copy\"]; fileinto :copy \"x\";", ""},
+		{"require \"fileinto\"; fileinto :copy \"x\";", "requires extension \"copy\""},
+		{"redirect :copy \"bob@example.com\";", "requires extension \"copy\""},
+		{"require \"foo\";", "unsupported extension \"foo\""},
+		{"keep; require \"fileinto\";", "require must come before other commands"},
+		{"if true { require \"fileinto\"; }", "require must come before other commands"},
+		{"if true { keep; } elsif false { discard; } else { stop; }", ""},
+		{"if true { keep; } elsif exists \"x\" { discard; } elsif size :over 1K { stop; }", ""},
+		{"else { keep; }", "else without if"},
+		{"if true { keep; } keep; elsif true { keep; }", "elsif without if"},
+		{"if true keep;", "invalid if"},
+		{"if true { keep; } else {}", ""},
+		{"if { keep; }", "invalid if"},
+		{"else true { keep; }", "else without if"},
+		{"if true { keep; } else true { keep; }", "invalid else"},
+		{"if true { keep;", "missing \"}\""},
+		{"keep", "expected \";\""},
+		{"keep \"x\";", "wrong number of arguments"},
+		{"discard :copy;", "unknown tag :copy"},
+		{"require \"fileinto\"; fileinto [\"a\", \"b\"];", "expects a single string"},
+		{"require \"fileinto\"; fileinto 1;", "wrong argument type"},
+		{"keep; \"x\"", "expected command"},
+		{"keep; \"unterminated", "unterminated string"},
+		{"/* unterminated", "unterminated comment"},
+		{"keep; @", "unexpected character"},
+		{"require \"reject\";\r\nreject text:\r\nline one\r\n..dot\r\n.\r\n;", ""},
+		{"require \"reject\";\r\nreject text:\r\nline one\r\n", "unterminated multi-line string"},
+		{"if size 100 { keep; }", "size needs :over or :under"},
+		{"if size :over :under 100 { keep; }", "size needs :over or :under"},
+		{"if header :is :contains \"a\" \"b\" { keep; }", "more than one match type"},
+		{"if address :all :domain \"from\" \"b\" { keep; }", "more than one address part"},
+		{"if header :comparator \"i;octet\" \"a\" \"b\" { keep; }", ""},
+		{"if header :comparator \"i;foo\" \"a\" \"b\" { keep; }", "unsupported comparator"},
+		{"if header :comparator \"a\" \"b\" { keep; }", "wrong number of arguments"},
+		{"if header :is :is \"a\" \"b\" { keep; }", "duplicate tag :is"},
+		{"if header \"a\" :is \"b\" { keep; }", "after positional arguments"},
+		{"if envelope \"from\" \"a\" { keep; }", "requires extension \"envelope\""},
+		{"if string \"a\" \"b\" { keep; }", "requires extension \"variables\""},
+		{"if foo { keep; }", "unknown test foo"},
+		{"foo;", "unknown command foo"},
+		{"if not { keep; }", "not needs one test"},
+		{"if anyof { keep; }", "anyof needs a test list"},
+		{"if anyof(true, not false) { keep; }", ""},
+		{"if allof(true,) { keep; }", "expected test"},
+		{"keep { stop; }", "does not take a test or block"},
+		{"require \"vacation\"; vacation :days 3 :subject \"s\" :from \"a@example.com\" :addresses [\"b@example.com\"] :mime :handle \"h\" \"reason\";", ""},
+		{"require \"vacation\"; vacation :days \"3\" \"reason\";", "tag :days needs a value"},
+		{"require \"variables\"; set :lower :upperfirst \"a\" \"b\";", ""},
+		{"require \"variables\"; set \"a\";", "wrong number of arguments"},
+		{"\r\nkeep;\r\nfoo;", "line 3: unknown command foo"},
+		{strings.Repeat("#", 70000), "script too large"},
+	}
+	for _, test := range testList {
+		_, err := sieveCompile(test.script)
+		if test.err == "" && err != nil {
+			t.Errorf("%q: %v", test.script, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: err = %v, want %q", test.script, err, test.err)
+		}
+	}
+}
+
+func TestSieveExecute(t *testing.T) {
+	testLoadConfig(t, "")
+	headerList, err := readMailHeaderList(bufio.NewReader(strings.NewReader("From: \"Some One\" <Someone@Other.net>\r\n" +
+		"To: alice@example.com, carol@example.com\r\n" +
+		"Subject: [team] Weekly\r\n Report\r\n" +
+		"X-Encoded: =?utf-8?q?caf=C3=A9?=\r\n" +
+		"X-Multi: one\r\nX-Multi: two\r\n\r\nbody\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := smtpEnvelopeStruct{fromMail: "bounce@other.net", toMail: []string{"alice+tag@example.com"}}
+	testList := []struct {
+		script string
+		want   sieveResultStruct
+		err    bool //执行出错, 只做隐式keep
+	}{
+		{"", sieveResultStruct{keep: true}, false}, //隐式keep
+		{"keep;", sieveResultStruct{keep: true}, false},
+		{"discard;", sieveResultStruct{}, false},
+		{"discard; keep;", sieveResultStruct{keep: true}, false}, //显式keep不受discard影响
+		{"require \"fileinto\"; fileinto \"Work\";", sieveResultStruct{fileintoList: []string{"Work"}}, false},
+		{"require \"fileinto\"; fileinto \"Work\"; fileinto \"Work\"; keep;", sieveResultStruct{keep: true, fileintoList: []string{"Work"}}, false},
+		{"require [\"fileinto\", \"copy\"]; fileinto :copy \"Work\";", sieveResultStruct{keep: true, fileintoList: []string{"Work"}}, false},
+		{"redirect \"Bob <bob@other.org>\";", sieveResultStruct{redirectList: []string{"bob@other.org"}}, false},
+		{"require \"copy\"; redirect :copy \"bob@other.org\";", sieveResultStruct{keep: true, redirectList: []string{"bob@other.org"}}, false},
+		{"redirect \"not an address\";", sieveResultStruct{keep: true}, true},
+		{strings.Repeat("redirect \"bob@other.org\";", 5), sieveResultStruct{keep: true}, true}, //超过max_redirects
+		{"require \"reject\"; reject \"go away\";", sieveResultStruct{reject: "go away"}, false},
+		{"require \"fileinto\"; fileinto \"A\"; stop; fileinto \"B\";", sieveResultStruct{fileintoList: []string{"A"}}, false},
+		{"if header :is \"subject\" \"[TEAM] Weekly Report\" { discard; }", sieveResultStruct{}, false}, //折叠行展开, 默认不区分大小写
+		{"if header :comparator \"i;octet\" :is \"subject\" \"[TEAM] Weekly Report\" { discard; }", sieveResultStruct{keep: true}, false},
+		{"if header :contains [\"x-none\", \"subject\"] [\"monthly\", \"WEEKLY\"] { discard; }", sieveResultStruct{}, false},
+		{"if header :is \"x-encoded\" \"café\" { discard; }", sieveResultStruct{}, false}, //解码MIME编码
+		{"if header :is \"x-multi\" \"two\" { discard; }", sieveResultStruct{}, false},
+		{"if header :matches \"subject\" \"*weekly\" { discard; }", sieveResultStruct{keep: true}, false},
+		{"if exists [\"from\", \"x-multi\"] { discard; }", sieveResultStruct{}, false},
+		{"if exists [\"from\", \"x-none\"] { discard; }", sieveResultStruct{keep: true}, false},
+		{"if address :is \"from\" \"someone@other.net\" { discard; }", sieveResultStruct{}, false},
+		{"if address :domain :is \"to\" \"example.com\" { discard; }", sieveResultStruct{}, false},
+		{"if address :localpart :is \"to\" \"carol\" { discard; }", sieveResultStruct{}, false},
+		{"if address :localpart :is \"from\" \"Some One\" { discard; }", sieveResultStruct{keep: true}, false},
+		{"require \"envelope\"; if envelope :is \"from\" \"bounce@other.net\" { discard; }", sieveResultStruct{}, false},
+		{"require \"envelope\"; if envelope :localpart :is \"to\" \"alice+tag\" { discard; }", sieveResultStruct{}, false},
+		{"require \"envelope\"; if envelope :domain :is \"from\" \"example.com\" { discard; }", sieveResultStruct{keep: true}, false},
+		{"if size :over 1000 { discard; }", sieveResultStruct{}, false},
+		{"if size :over 1K { discard; }", sieveResultStruct{keep: true}, false}, //1024不大于1K
+		{"if size :under 2K { discard; }", sieveResultStruct{}, false},
+		{"if size :under 1K { discard; }", sieveResultStruct{keep: true}, false},
+		{"require \"fileinto\"; if false { fileinto \"A\"; } elsif true { fileinto \"B\"; } elsif true { fileinto \"C\"; } else { fileinto \"D\"; }", sieveResultStruct{fileintoList: []string{"B"}}, false},
+		{"require \"fileinto\"; if false { fileinto \"A\"; } elsif false { fileinto \"B\"; } else { fileinto \"D\"; }", sieveResultStruct{fileintoList: []string{"D"}}, false},
+		{"require \"fileinto\"; if true { fileinto \"A\"; } else { fileinto \"D\"; } if true { fileinto \"E\"; }", sieveResultStruct{fileintoList: []string{"A", "E"}}, false},
+		{"if anyof(false, not true) { discard; }", sieveResultStruct{keep: true}, false},
+		{"if allof(true, not false) { discard; }", sieveResultStruct{}, false},
+		{"require [\"fileinto\", \"variables\"]; if header :matches \"subject\" \"[*] *\" { fileinto \"lists/${1}/${2}\"; }", sieveResultStruct{fileintoList: []string{"lists/team/Weekly Report"}}, false},
+		{"require [\"fileinto\", \"variables\"]; if address :matches \"from\" \"*@?ther.*\" { fileinto \"${0}|${1}|${2}|${3}|${4}\"; }", sieveResultStruct{fileintoList: []string{"Someone@Other.net|Someone|O|net|"}}, false},
+		{"require [\"fileinto\", \"variables\"]; if header :matches \"subject\" \"*\" {} if header :matches \"x-none\" \"*\" {} fileinto \"${1}\";", sieveResultStruct{fileintoList: []string{"[team] Weekly Report"}}, false}, //匹配失败不改变之前的${N}
+		{"require \"fileinto\"; if header :matches \"subject\" \"[*] *\" { fileinto \"${1}\"; }", sieveResultStruct{fileintoList: []string{"${1}"}}, false},                                                                    //没有require variables不展开
+		{"require [\"fileinto\", \"variables\"]; set \"a\" \"x\"; set \"A\" \"${a}y\"; fileinto \"${A}-${b}-${}-${a.b}\";", sieveResultStruct{fileintoList: []string{"xy--${}-${a.b}"}}, false},
+		{"require [\"fileinto\", \"variables\"]; set :lower \"a\" \"MiXeD\"; set :upper \"b\" \"MiXeD\"; set :upperfirst \"c\" \"mixed\"; set :lowerfirst \"d\" \"MIXED\"; fileinto \"${a},${b},${c},${d}\";", sieveResultStruct{fileintoList: []string{"mixed,MIXED,Mixed,mIXED"}}, false},
+		{"require [\"fileinto\", \"variables\"]; set :length \"a\" \"café\"; set :quotewildcard \"b\" \"a*b?c\\\\\"; fileinto \"${a} ${b}\";", sieveResultStruct{fileintoList: []string{"4 a\\*b\\?c\\\\"}}, false},
+		{"require [\"variables\"]; set \"a\" \"Weekly\"; if string :is \"${a}\" \"weekly\" { discard; }", sieveResultStruct{}, false},
+		{"require [\"variables\"]; set \"a\" \"*\"; if header :matches \"subject\" \"${a}team${a}\" { discard; }", sieveResultStruct{}, false},
+		{"require [\"variables\"]; set \"1a\" \"x\";", sieveResultStruct{keep: true}, true},
+		{"require [\"vacation\", \"variables\"]; set \"s\" \"Away\"; vacation :subject \"${s}\" :from \"alice@example.com\" :addresses [\"al@example.com\"] :handle \"h\" \"reason\";", sieveResultStruct{keep: true, vacation: &sieveVacationStruct{days: 7, subject: "Away", from: "alice@example.com", addresses: []string{"al@example.com"}, handle: "h", reason: "reason"}}, false},
+		{"require \"vacation\"; vacation :days 2 :mime \"Content-Type: text/plain\r\n\r\nreason\";", sieveResultStruct{keep: true, vacation: &sieveVacationStruct{days: 2, mime: true, reason: "Content-Type: text/plain\r\n\r\nreason"}}, false},
+	}
+	for _, test := range testList {
+		script, err := sieveCompile(test.script)
+		if err != nil {
+			t.Errorf("%q: %v", test.script, err)
+			continue
+		}
+		result, err := sieveExecute(script, envelope, "alice+tag@example.com", headerList, 1024)
+		if (err != nil) != test.err {
+			t.Errorf("%q: err = %v", test.script, err)
+		}
+		if !reflect.DeepEqual(result, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.script, result, test.want)
+		}
+	}
+}
+
+func TestSieveVacationShouldReply(t *testing.T) {
+	testLoadConfig(t, "")
+	vacation := &sieveVacationStruct{days: 3, subject: "Away", reason: "on holiday"}
+	if !sieveVacationShouldReply("alice", vacation, "bob@other.net") {
+		t.Fatalf("first mail not replied")
+	}
+	if sieveVacationShouldReply("alice", vacation, "Bob@Other.net") { //同一个发件人(不区分大小写)只回复一次
+		t.Errorf("replied twice within :days")
+	}
+	if !sieveVacationShouldReply("alice", vacation, "carol@other.net") {
+		t.Errorf("other sender not replied")
+	}
+	if !sieveVacationShouldReply("dave", vacation, "bob@other.net") {
+		t.Errorf("other user not replied")
+	}
+	if !sieveVacationShouldReply("alice", &sieveVacationStruct{days: 3, subject: "Away", reason: "changed"}, "bob@other.net") { //没有:handle的时候内容不同就算不同的vacation
+		t.Errorf("changed reason not replied")
+	}
+
+	vacation = &sieveVacationStruct{days: 1, reason: "first", handle: "trip"}
+	if !sieveVacationShouldReply("alice", vacation, "erin@other.net") {
+		t.Fatalf("first mail with a handle not replied")
+	}
+	if sieveVacationShouldReply("alice", &sieveVacationStruct{days: 1, reason: "second", handle: "trip"}, "erin@other.net") { //:handle相同, 内容不同也算同一个
+		t.Errorf("replied twice for the same handle")
+	}
+	if _, err := authDatabase.Exec("UPDATE "+config.Auth.Sqlite.SieveVacationTableName+" SET expire=? WHERE handle=?", time.Now().Unix()-1, "trip"); err != nil {
+		t.Fatal(err)
+	}
+	if !sieveVacationShouldReply("alice", vacation, "erin@other.net") {
+		t.Errorf("not replied after :days expired")
+	}
+}
+
+func TestSieveVacationFrom(t *testing.T) { //:from不能往自动回复里插入头部
+	testLoadConfig(t, "")
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	testAddUser(t, "bob", "bob@example.com", "pw")
+	testList := []struct {
+		from string
+		want string
+	}{
+		{"", "From: <alice@example.com>\r\n"},
+		{"Alice Away <alice@example.com>", "From: \"Alice Away\" <alice@example.com>\r\n"},
+		{"alice@example.com\r\nBcc: victim@other.org", "From: <alice@example.com>\r\n"},
+		{"\"Alice\r\nBcc: victim@other.org\" <alice@example.com>", "From: <alice@example.com>\r\n"},
+	}
+	for i, test := range testList {
+		filePath := filepath.Join(t.TempDir(), "mail")
+		if err := os.WriteFile(filePath, []byte("From: bob@example.com\r\nTo: alice@example.com\r\nSubject: hi\r\n\r\nbody\r\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sieveSendVacation(filePath, smtpEnvelopeStruct{fromMail: "bob@example.com"}, "alice@example.com", "alice", &sieveVacationStruct{days: 1, from: test.from, reason: "away", handle: strconv.Itoa(i)})
+		smtpQueueWaitGroup.Wait()
+		mailInfoList, err := getMailAllInfo("bob@example.com")
+		if err != nil || len(mailInfoList) != 1 {
+			t.Fatalf("%q: bob has %d mails, %v", test.from, len(mailInfoList), err)
+		}
+		data, _ := os.ReadFile(mailInfoList[0].filePath)
+		os.Remove(mailInfoList[0].filePath)
+		header := string(data[:strings.Index(string(data), "\r\n\r\n")+2])
+		if !strings.HasPrefix(header, test.want) || strings.Contains(header, "Bcc:") {
+			t.Errorf("%q: header of the reply:\n%s", test.from, header)
+		}
+	}
+}
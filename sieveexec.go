@@ -0,0 +1,445 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type sieveVacationStruct struct { //vacation动作(RFC 5230)
+	days      int
+	subject   string
+	from      string
+	addresses []string
+	mime      bool
+	handle    string
+	reason    string
+}
+
+type sieveResultStruct struct { //脚本执行的结果
+	keep         bool     //是否保存到默认的文件夹(隐式或显式的keep)
+	fileintoList []string //要保存到的文件夹
+	redirectList []string //要转发到的地址
+	reject       string   //拒绝的理由, 空为不拒绝
+	vacation     *sieveVacationStruct
+}
+
+type sieveContextStruct struct { //脚本执行时的状态
+	script     *sieveScriptStruct
+	envelope   smtpEnvelopeStruct
+	recipient  string
+	headerList []string
+	size       int64
+	variables  map[string]string
+	matchList  []string //最近一次:matches匹配到的内容(${0}...${9})
+	result     sieveResultStruct
+	implicit   bool //隐式keep还有没有效
+	stopped    bool
+}
+
+var errorSieveTooManyRedirects = errors.New("error: too many redirects")
+
+func (context *sieveContextStruct) expand(value string) string { //展开变量(RFC 5229 3), 没有require variables就不展开
+	if !context.script.requires["variables"] || !strings.Contains(value, "${") {
+		return value
+	}
+	var result strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end == -1 {
+			break
+		}
+		name := strings.ToLower(value[start+2 : start+end])
+		replacement, ok := "", false
+		if index, err := strconv.Atoi(name); err == nil && index >= 0 && len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+			ok = true
+			if index < len(context.matchList) {
+				replacement = context.matchList[index]
+			}
+		} else if isSieveVariableName(name) {
+			replacement, ok = context.variables[name], true
+		}
+		if !ok { //不是变量的写法就原样保留
+			result.WriteString(value[:start+2])
+			value = value[start+2:]
+			continue
+		}
+		result.WriteString(value[:start] + replacement)
+		value = value[start+end+1:]
+	}
+	result.WriteString(value)
+	return result.String()
+}
+
+func isSieveVariableName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (context *sieveContextStruct) expandList(valueList []string) []string {
+	expanded := make([]string, len(valueList))
+	for i, value := range valueList {
+		expanded[i] = context.expand(value)
+	}
+	return expanded
+}
+
+func sieveRuneEqual(a rune, b rune, fold bool) bool {
+	if fold {
+		return unicode.ToLower(a) == unicode.ToLower(b)
+	}
+	return a == b
+}
+
+type sieveWildcardTokenStruct struct { //:matches模式中的一个元素
+	kind byte //'*', '?' 或者 0(普通字符)
+	char rune
+}
+
+func sieveWildcardMatch(pattern []rune, text []rune, fold bool, captures *[]string) bool { //:matches的通配符匹配(*和?, \转义), 记录每个通配符匹配到的内容
+	var tokenList []sieveWildcardTokenStruct
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '*' || pattern[i] == '?':
+			tokenList = append(tokenList, sieveWildcardTokenStruct{kind: byte(pattern[i])})
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			tokenList = append(tokenList, sieveWildcardTokenStruct{char: pattern[i]})
+		default:
+			tokenList = append(tokenList, sieveWildcardTokenStruct{char: pattern[i]})
+		}
+	}
+	width := len(text) + 1
+	possible := make([]bool, (len(tokenList)+1)*width) //possible[i*width+j]: 模式从第i个元素开始能否匹配文本从第j个字符开始的部分
+	possible[len(tokenList)*width+len(text)] = true
+	for i := len(tokenList) - 1; i >= 0; i-- {
+		for j := len(text); j >= 0; j-- {
+			switch token := tokenList[i]; token.kind {
+			case '*':
+				possible[i*width+j] = possible[(i+1)*width+j] || (j < len(text) && possible[i*width+j+1])
+			case '?':
+				possible[i*width+j] = j < len(text) && possible[(i+1)*width+j+1]
+			default:
+				possible[i*width+j] = j < len(text) && sieveRuneEqual(token.char, text[j], fold) && possible[(i+1)*width+j+1]
+			}
+		}
+	}
+	if !possible[0] {
+		return false
+	}
+	j := 0
+	for i, token := range tokenList { //按表走一遍记录匹配内容, *尽量多匹配(RFC 5229 3.2的例子)
+		switch token.kind {
+		case '*':
+			end := len(text)
+			for !possible[(i+1)*width+end] {
+				end--
+			}
+			*captures = append(*captures, string(text[j:end]))
+			j = end
+		case '?':
+			*captures = append(*captures, string(text[j:j+1]))
+			j++
+		default:
+			j++
+		}
+	}
+	return true
+}
+
+func (context *sieveContextStruct) match(tags map[string]sieveArgumentStruct, valueList []string, keyList []string) bool { //用测试指定的比较器和匹配方式比较
+	caseInsensitive := true
+	if comparator, ok := tags[":comparator"]; ok && strings.ToLower(comparator.strList[0]) == "i;octet" {
+		caseInsensitive = false
+	}
+	for _, value := range valueList {
+		for _, key := range keyList {
+			key = context.expand(key)
+			if _, ok := tags[":matches"]; ok {
+				var captures []string
+				if sieveWildcardMatch([]rune(key), []rune(value), caseInsensitive, &captures) {
+					if context.script.requires["variables"] {
+						context.matchList = append([]string{value}, captures...)
+					}
+					return true
+				}
+				continue
+			}
+			foldValue := value
+			if caseInsensitive {
+				foldValue = strings.Map(unicode.ToLower, value)
+				key = strings.Map(unicode.ToLower, key)
+			}
+			if _, ok := tags[":contains"]; ok {
+				if strings.Contains(foldValue, key) {
+					return true
+				}
+			} else if foldValue == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (context *sieveContextStruct) headerValues(name string) []string { //取出某个头部的所有值(解码MIME编码)
+	var valueList []string
+	decoder := mime.WordDecoder{}
+	name = strings.ToLower(name)
+	for _, header := range context.headerList {
+		if getHeaderName(header) != name {
+			continue
+		}
+		value := getHeaderValue(header)
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		valueList = append(valueList, value)
+	}
+	return valueList
+}
+
+func sieveAddressPart(tags map[string]sieveArgumentStruct, address string) string { //取出地址的一部分
+	index := strings.LastIndex(address, "@")
+	if _, ok := tags[":localpart"]; ok {
+		if index == -1 {
+			return address
+		}
+		return address[:index]
+	}
+	if _, ok := tags[":domain"]; ok {
+		if index == -1 {
+			return ""
+		}
+		return address[index+1:]
+	}
+	return address
+}
+
+func (context *sieveContextStruct) evalTest(test *sieveTestStruct) (bool, error) {
+	spec := sieveTestSpecs[test.name]
+	tags, positional, err := sieveSplitArguments(test.arguments, spec, context.script.requires, test.line)
+	if err != nil {
+		return false, err
+	}
+	switch test.name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		result, err := context.evalTest(test.tests[0])
+		return !result, err
+	case "anyof", "allof":
+		for _, subTest := range test.tests {
+			result, err := context.evalTest(subTest)
+			if err != nil {
+				return false, err
+			}
+			if result == (test.name == "anyof") {
+				return result, nil
+			}
+		}
+		return test.name == "allof", nil
+	case "exists":
+		for _, name := range context.expandList(positional[0].strList) {
+			if findHeader(context.headerList, strings.ToLower(name)) == -1 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		if _, ok := tags[":over"]; ok {
+			return context.size > positional[0].number, nil
+		}
+		return context.size < positional[0].number, nil
+	case "header":
+		var valueList []string
+		for _, name := range context.expandList(positional[0].strList) {
+			valueList = append(valueList, context.headerValues(name)...)
+		}
+		return context.match(tags, valueList, positional[1].strList), nil
+	case "address":
+		var valueList []string
+		for _, name := range context.expandList(positional[0].strList) {
+			for _, value := range context.headerValues(name) {
+				addressList, err := mail.ParseAddressList(value)
+				if err != nil { //解析不了的话按原样比较
+					valueList = append(valueList, sieveAddressPart(tags, value))
+					continue
+				}
+				for _, address := range addressList {
+					valueList = append(valueList, sieveAddressPart(tags, address.Address))
+				}
+			}
+		}
+		return context.match(tags, valueList, positional[1].strList), nil
+	case "envelope":
+		var valueList []string
+		for _, name := range context.expandList(positional[0].strList) {
+			switch strings.ToLower(name) {
+			case "from":
+				valueList = append(valueList, sieveAddressPart(tags, context.envelope.fromMail))
+			case "to":
+				valueList = append(valueList, sieveAddressPart(tags, context.recipient))
+			}
+		}
+		return context.match(tags, valueList, positional[1].strList), nil
+	case "string":
+		return context.match(tags, context.expandList(positional[0].strList), positional[1].strList), nil
+	}
+	return false, sieveError(test.line, "unknown test "+test.name)
+}
+
+func sieveSetModifier(tags map[string]sieveArgumentStruct, value string) string { //set命令的修饰(RFC 5229 4.1)
+	if _, ok := tags[":lower"]; ok {
+		value = strings.ToLower(value)
+	}
+	if _, ok := tags[":upper"]; ok {
+		value = strings.ToUpper(value)
+	}
+	if _, ok := tags[":lowerfirst"]; ok && value != "" {
+		runeList := []rune(value)
+		value = string(unicode.ToLower(runeList[0])) + string(runeList[1:])
+	}
+	if _, ok := tags[":upperfirst"]; ok && value != "" {
+		runeList := []rune(value)
+		value = string(unicode.ToUpper(runeList[0])) + string(runeList[1:])
+	}
+	if _, ok := tags[":quotewildcard"]; ok {
+		value = strings.NewReplacer("\\", "\\\\", "*", "\\*", "?", "\\?").Replace(value)
+	}
+	if _, ok := tags[":length"]; ok {
+		value = strconv.Itoa(len([]rune(value)))
+	}
+	return value
+}
+
+func (context *sieveContextStruct) execCommands(commandList []*sieveCommandStruct) error {
+	skipElse := false //前面的if/elsif已经成立了
+	for _, command := range commandList {
+		if context.stopped {
+			return nil
+		}
+		switch command.name {
+		case "require":
+			continue
+		case "if", "elsif", "else":
+			if command.name == "if" {
+				skipElse = false
+			} else if skipElse {
+				continue
+			}
+			result := true
+			if command.test != nil {
+				var err error
+				result, err = context.evalTest(command.test)
+				if err != nil {
+					return err
+				}
+			}
+			if result {
+				skipElse = true
+				if err := context.execCommands(command.block); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		tags, positional, err := sieveSplitArguments(command.arguments, sieveCommandSpecs[command.name], context.script.requires, command.line)
+		if err != nil {
+			return err
+		}
+		_, copyAction := tags[":copy"]
+		switch command.name {
+		case "stop":
+			context.stopped = true
+		case "keep":
+			context.result.keep = true
+		case "discard":
+			context.implicit = false
+		case "fileinto":
+			folder := context.expand(positional[0].strList[0])
+			if !copyAction {
+				context.implicit = false
+			}
+			for _, exists := range context.result.fileintoList {
+				if exists == folder {
+					folder = ""
+				}
+			}
+			if folder != "" {
+				context.result.fileintoList = append(context.result.fileintoList, folder)
+			}
+		case "redirect":
+			address := context.expand(positional[0].strList[0])
+			parsedAddress, err := mail.ParseAddress(address)
+			if err != nil {
+				return sieveError(command.line, "invalid redirect address "+address)
+			}
+			if len(context.result.redirectList) >= config.Sieve.MaxRedirects {
+				return errorSieveTooManyRedirects
+			}
+			if !copyAction {
+				context.implicit = false
+			}
+			context.result.redirectList = append(context.result.redirectList, parsedAddress.Address)
+		case "reject":
+			context.implicit = false
+			context.result.reject = context.expand(positional[0].strList[0])
+		case "vacation":
+			vacation := &sieveVacationStruct{days: config.Sieve.VacationDefaultDays, reason: context.expand(positional[0].strList[0])}
+			if days, ok := tags[":days"]; ok {
+				vacation.days = int(days.number)
+			}
+			if subject, ok := tags[":subject"]; ok {
+				vacation.subject = context.expand(subject.strList[0])
+			}
+			if from, ok := tags[":from"]; ok {
+				vacation.from = context.expand(from.strList[0])
+			}
+			if addresses, ok := tags[":addresses"]; ok {
+				vacation.addresses = context.expandList(addresses.strList)
+			}
+			if handle, ok := tags[":handle"]; ok {
+				vacation.handle = context.expand(handle.strList[0])
+			}
+			_, vacation.mime = tags[":mime"]
+			context.result.vacation = vacation
+		case "set":
+			name := strings.ToLower(context.expand(positional[0].strList[0]))
+			if !isSieveVariableName(name) {
+				return sieveError(command.line, "invalid variable name "+name)
+			}
+			context.variables[name] = sieveSetModifier(tags, context.expand(positional[1].strList[0]))
+		}
+	}
+	return nil
+}
+
+func sieveExecute(script *sieveScriptStruct, envelope smtpEnvelopeStruct, recipient string, headerList []string, size int64) (sieveResultStruct, error) { //对一封邮件执行脚本, 出错时按RFC 5228 2.10.6只做隐式keep
+	context := &sieveContextStruct{script: script, envelope: envelope, recipient: recipient, headerList: headerList, size: size, variables: make(map[string]string), implicit: true}
+	err := context.execCommands(script.commands)
+	if err != nil {
+		return sieveResultStruct{keep: true}, err
+	}
+	if context.implicit {
+		context.result.keep = true
+	}
+	return context.result, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errorSieveScriptNotExists = errors.New("error: script does not exist")
+	errorSieveScriptActive    = errors.New("error: script is active")
+	errorSieveTooManyScripts  = errors.New("error: too many scripts")
+	errorSieveInvalidName     = errors.New("error: invalid script name")
+	errorSieveScriptExists    = errors.New("error: script already exists")
+)
+
+type sieveScriptInfoStruct struct {
+	name   string
+	active bool
+}
+
+func isValidSieveScriptName(name string) bool { //脚本名(RFC 5804 1.6): 非空的UTF-8, 不含控制字符
+	if name == "" || utf8.RuneCountInString(name) > 128 || !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || r >= 0x80 && r <= 0x9f || r == 0x2028 || r == 0x2029 {
+			return false
+		}
+	}
+	return true
+}
+
+func sieveListScripts(username string) ([]sieveScriptInfoStruct, error) { //列出一个账号的所有脚本
+	row, err := authDatabase.Query("SELECT name, active FROM "+config.Auth.Sqlite.SieveTableName+" WHERE username=?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+	var scriptList []sieveScriptInfoStruct
+	for row.Next() {
+		var info sieveScriptInfoStruct
+		if err = row.Scan(&info.name, &info.active); err != nil {
+			return nil, err
+		}
+		scriptList = append(scriptList, info)
+	}
+	return scriptList, nil
+}
+
+func sieveGetScript(username string, name string) (string, error) { //读取一个脚本的内容
+	row, err := authDatabase.Query("SELECT script FROM "+config.Auth.Sqlite.SieveTableName+" WHERE username=? AND name=?", username, name)
+	if err != nil {
+		return "", err
+	}
+	defer row.Close()
+	if !row.Next() {
+		return "", errorSieveScriptNotExists
+	}
+	var script string
+	err = row.Scan(&script)
+	return script, err
+}
+
+func sievePutScript(username string, name string, script string) error { //保存一个脚本(检查语法), 同名的会被替换
+	if !isValidSieveScriptName(name) {
+		return errorSieveInvalidName
+	}
+	if _, err := sieveCompile(script); err != nil {
+		return err
+	}
+	result, err := authDatabase.Exec("UPDATE "+config.Auth.Sqlite.SieveTableName+" SET script=? WHERE username=? AND name=?", script, username, name)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return nil
+	}
+	scriptList, err := sieveListScripts(username)
+	if err != nil {
+		return err
+	}
+	if len(scriptList) >= config.Sieve.MaxScripts {
+		return errorSieveTooManyScripts
+	}
+	_, err = authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.SieveTableName+"(username, name, script, active) VALUES(?, ?, ?, 0)", username, name, script)
+	return err
+}
+
+func sieveSetActive(username string, name string) error { //设置生效的脚本(同时只有一个), 名字为空就全部停用
+	if name != "" {
+		if _, err := sieveGetScript(username, name); err != nil {
+			return err
+		}
+	}
+	_, err := authDatabase.Exec("UPDATE "+config.Auth.Sqlite.SieveTableName+" SET active=0 WHERE username=?", username)
+	if err != nil || name == "" {
+		return err
+	}
+	_, err = authDatabase.Exec("UPDATE "+config.Auth.Sqlite.SieveTableName+" SET active=1 WHERE username=? AND name=?", username, name)
+	return err
+}
+
+func sieveDeleteScript(username string, name string) error { //删除一个脚本(生效中的不能删除)
+	scriptList, err := sieveListScripts(username)
+	if err != nil {
+		return err
+	}
+	for _, info := range scriptList {
+		if info.name != name {
+			continue
+		}
+		if info.active {
+			return errorSieveScriptActive
+		}
+		_, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.SieveTableName+" WHERE username=? AND name=?", username, name)
+		return err
+	}
+	return errorSieveScriptNotExists
+}
+
+func sieveRenameScript(username string, oldName string, newName string) error { //重命名一个脚本
+	if !isValidSieveScriptName(newName) {
+		return errorSieveInvalidName
+	}
+	if _, err := sieveGetScript(username, newName); err == nil {
+		return errorSieveScriptExists
+	}
+	result, err := authDatabase.Exec("UPDATE "+config.Auth.Sqlite.SieveTableName+" SET name=? WHERE username=? AND name=?", newName, username, oldName)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errorSieveScriptNotExists
+	}
+	return nil
+}
+
+func sieveLoadActiveScript(username string) *sieveScriptStruct { //读取并编译一个账号生效中的脚本, 没有就返回nil
+	row, err := authDatabase.Query("SELECT name, script FROM "+config.Auth.Sqlite.SieveTableName+" WHERE username=? AND active=1", username)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return nil
+	}
+	defer row.Close()
+	var name string
+	var script string
+	if !row.Next() || row.Scan(&name, &script) != nil {
+		return nil
+	}
+	compiled, err := sieveCompile(script)
+	if err != nil {
+		log.Println("Warning: sieve script " + name + " of " + username + " error: " + err.Error())
+		return nil
+	}
+	return compiled
+}
+
+func sieveVacationShouldReply(username string, vacation *sieveVacationStruct, sender string) bool { //同一个发件人在:days天内只回复一次(RFC 5230 4.2), 要回复的话记录下来
+	handle := vacation.handle
+	if handle == "" { //没有指定:handle就用内容区分
+		hash := sha1.Sum([]byte(vacation.subject + "\x00" + vacation.from + "\x00" + vacation.reason))
+		handle = hex.EncodeToString(hash[:])
+	}
+	sender = strings.ToLower(sender)
+	now := time.Now().Unix()
+	row, err := authDatabase.Query("SELECT expire FROM "+config.Auth.Sqlite.SieveVacationTableName+" WHERE username=? AND handle=? AND sender=? AND expire>?", username, handle, sender, now)
+	if err != nil {
+		log.Println("Error: auth database query failure: " + err.Error())
+		return false
+	}
+	replied := row.Next()
+	row.Close()
+	if replied {
+		return false
+	}
+	days := vacation.days
+	if days < 1 {
+		days = 1
+	}
+	_, err = authDatabase.Exec("DELETE FROM "+config.Auth.Sqlite.SieveVacationTableName+" WHERE expire<=? OR (username=? AND handle=? AND sender=?)", now, username, handle, sender)
+	if err != nil {
+		log.Println("Error: auth database update failure: " + err.Error())
+	}
+	_, err = authDatabase.Exec("INSERT INTO "+config.Auth.Sqlite.SieveVacationTableName+"(username, handle, sender, expire) VALUES(?, ?, ?, ?)", username, handle, sender, now+int64(days)*86400)
+	if err != nil {
+		log.Println("Error: auth database update failure: " + err.Error())
+		return false
+	}
+	return true
+}
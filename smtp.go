@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -9,23 +8,140 @@ import (
 	"log"
 	"net"
 	"os"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
-func stmpSendHandshake(targetAddress []string, targetDomain string, internalAddress string) (*connStruct, error) { //连接邮件服务器
-	mxRecords, err := net.LookupMX(targetDomain) //查询mx记录
+const ( //smtp会话状态 greeting -> ehlo -> auth -> mail -> rcpt -> data
+	smtpStateGreeting byte = iota //刚连接(或刚STARTTLS), 还没有HELO/EHLO
+	smtpStateEhlo                 //已经HELO/EHLO
+	smtpStateAuth                 //已经HELO/EHLO并且鉴权成功
+	smtpStateMail                 //已经MAIL FROM
+	smtpStateRcpt                 //已经有至少一个RCPT TO
+	smtpStateData                 //正在接收DATA
+)
+
+type smtpEnvelopeStruct struct { //一封待投递邮件的信封
+	fromMail    string
+	toMail      []string
+	smtpUtf8    bool
+	dsnRet      string            //RET参数(FULL/HDRS)
+	dsnEnvId    string            //ENVID参数(xtext)
+	dsnNotify   map[string]string //收件人 -> NOTIFY参数
+	dsnOrcpt    map[string]string //收件人 -> ORCPT参数(xtext)
+	arrivalTime time.Time
+	retryTimes  int    //已经推迟重试的次数
+	clientIp    string //收到邮件时客户端的ip(给内容过滤用)
+	heloName    string //客户端HELO/EHLO时给的名字
+}
+
+func smtpCheckTransition(state byte, command string) string { //检查命令在当前状态下是否允许, 不允许就返回要回复的错误
+	switch command {
+	case "noop", "rset", "quit", "helo", "ehlo":
+		return ""
+	case "starttls":
+		if state == smtpStateAuth {
+			return "503 5.5.1 Error: already authenticated\r\n"
+		}
+		if state != smtpStateGreeting && state != smtpStateEhlo {
+			return "503 5.5.1 Error: mail transaction in progress\r\n"
+		}
+		return ""
+	case "auth":
+		switch state {
+		case smtpStateGreeting:
+			return "503 5.5.1 Error: send HELO/EHLO first\r\n"
+		case smtpStateAuth:
+			return "503 5.5.1 Error: already authenticated\r\n"
+		case smtpStateMail, smtpStateRcpt:
+			return "503 5.5.1 Error: AUTH not permitted during a mail transaction\r\n"
+		}
+		return ""
+	case "mail":
+		switch state {
+		case smtpStateGreeting:
+			return "503 5.5.1 Error: send HELO/EHLO first\r\n"
+		case smtpStateMail, smtpStateRcpt:
+			return "503 5.5.1 Error: nested MAIL command\r\n"
+		}
+		return ""
+	case "rcpt":
+		switch state {
+		case smtpStateGreeting:
+			return "503 5.5.1 Error: send HELO/EHLO first\r\n"
+		case smtpStateEhlo, smtpStateAuth:
+			return "503 5.5.1 Error: need MAIL command\r\n"
+		}
+		return ""
+	case "data":
+		switch state {
+		case smtpStateGreeting:
+			return "503 5.5.1 Error: send HELO/EHLO first\r\n"
+		case smtpStateEhlo, smtpStateAuth:
+			return "503 5.5.1 Error: need MAIL command\r\n"
+		case smtpStateMail:
+			return "503 5.5.1 Error: need RCPT command\r\n"
+		}
+		return ""
+	}
+	return "" //未知命令交给后面处理
+}
+
+func smtpCheckAddressEncoding(address string, smtpUtf8 bool) string { //检查地址编码, 非ASCII地址必须在SMTPUTF8事务中使用, 不允许就返回要回复的内容
+	if isAscii(address) {
+		return ""
+	}
+	if !utf8.ValidString(address) {
+		return "553 5.6.7 Address is not valid UTF-8\r\n"
+	}
+	if !smtpUtf8 {
+		return "553 5.6.7 Non-ASCII address requires SMTPUTF8\r\n"
+	}
+	if _, err := domainToAscii(getAddressDomain(address)); err != nil {
+		return "553 5.1.2 Invalid domain\r\n"
+	}
+	return ""
+}
+
+func smtpReadEhloReply(conn *connStruct) (map[string]bool, error) { //读取EHLO的多行回复, 返回对方支持的扩展
+	extensionMap := make(map[string]bool)
+	for {
+		ret, err := ConnReadLine(conn)
+		if err != nil {
+			return nil, errors.New("network error")
+		}
+		if len(ret) < 5 || string(ret[:3]) != "250" {
+			return nil, errors.New("EHLO failed: " + strings.TrimRight(string(ret), "\r\n"))
+		}
+		if fields := strings.Fields(string(ret[4:])); len(fields) > 0 {
+			extensionMap[strings.ToUpper(fields[0])] = true
+		}
+		if ret[3] == ' ' {
+			return extensionMap, nil
+		}
+	}
+}
+
+func stmpSendHandshake(targetAddress []string, targetDomain string, envelope smtpEnvelopeStruct) (*connStruct, map[string]bool, error) { //连接邮件服务器, 返回连接和对方支持的扩展
+	asciiDomain, err := domainToAscii(targetDomain) //国际化域名要转成A-label再查询
 	if err != nil {
-		return nil, errors.New("cannot lookup MX records")
+		return nil, nil, newSmtpPermanentError("invalid domain: " + targetDomain)
+	}
+	mxRecords, err := net.LookupMX(asciiDomain) //查询mx记录
+	if err != nil {
+		if dnsError, ok := err.(*net.DNSError); ok && dnsError.IsNotFound { //域名不存在就不用重试了
+			return nil, nil, newSmtpPermanentError("cannot lookup MX records: domain not found")
+		}
+		return nil, nil, errors.New("cannot lookup MX records")
 	}
 	sort.Slice(mxRecords, func(i, j int) bool { return mxRecords[i].Pref < mxRecords[j].Pref }) //按照pref从小到大排序
 	conn := new(connStruct)
-	var supportStartTls bool = false
 	dialAddr, _ := net.ResolveTCPAddr("tcp", config.Smtp.Inbound.PlainListenAddress)
-	dialer := net.Dialer{LocalAddr: dialAddr, Timeout: time.Millisecond*time.Duration(config.Smtp.Outbound.RemoteConnectTimeoutMs)}
+	dialer := net.Dialer{LocalAddr: dialAddr, Timeout: time.Millisecond * time.Duration(config.Smtp.Outbound.RemoteConnectTimeoutMs)}
 	for _, mxRecord := range mxRecords { //尝试连接25端口
 		for i := 0; i < config.Smtp.Outbound.RemoteConnectRetryTimes; i++ {
 			plainConn, err := dialer.Dial("tcp", mxRecord.Host+":25")
@@ -36,91 +152,112 @@ func stmpSendHandshake(targetAddress []string, targetDomain string, internalAddr
 			}
 		}
 	}
-	return nil, errors.New("cannot connected to remote smtp server")
+	return nil, nil, errors.New("cannot connected to remote smtp server")
 connected: //下面是握手流程
+	conn.setTimeout(timeoutSeconds(config.Smtp.Timeout.CommandTimeoutS), timeoutSeconds(config.Smtp.Timeout.DataTimeoutS))
 	ret, err := ConnReadLine(conn)
 	if err != nil {
 		conn.Close()
-		return nil, errors.New("network error")
+		return nil, nil, errors.New("network error")
 	}
 	if string(ret[:3]) != "220" {
 		conn.Close()
-		return nil, errors.New("connect failed: " + string(ret[:len(ret)-2]))
+		return nil, nil, newSmtpReplyError("connect", ret)
 	}
 
 	conn.Write([]byte("EHLO " + config.General.ServerAddress + "\r\n"))
-	for {
-		ret, err = ConnReadLine(conn)
-		if err != nil {
-			conn.Close()
-			return nil, errors.New("network error")
-		}
-		if string(ret[:3]) != "250" {
-			conn.Close()
-			return nil, errors.New("EHLO failed: " + string(ret[:len(ret)-2]))
-		}
-		if len(ret) == 14 && string(ret)[4:12] == "STARTTLS" {
-			supportStartTls = true
-		}
-		if ret[3] == ' ' {
-			break
-		}
+	extensionMap, err := smtpReadEhloReply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
 	}
 
-	if conn.connType == 0x00 && supportStartTls {
+	if conn.connType == 0x00 && extensionMap["STARTTLS"] {
 		for i := 0; i < 5; i++ {
 			conn.Write([]byte("STARTTLS\r\n"))
 			ret, err = ConnReadLine(conn)
 			if err != nil {
 				conn.Close()
-				return nil, errors.New("network error")
+				return nil, nil, errors.New("network error")
 			}
 			if string(ret[:3]) == "454" {
 				time.Sleep(time.Millisecond * 10)
 				continue
 			}
+			conn.discardBuffered()
 			conn.tlsConn = tls.Client(conn.plainConn, &tls.Config{InsecureSkipVerify: true})
 			conn.connType = 0x01
 			conn.Write([]byte("EHLO " + config.General.ServerAddress + "\r\n"))
-			for {
-				ret, err = ConnReadLine(conn)
-				if err != nil {
-					conn.Close()
-					return nil, errors.New("network error")
-				}
-				if string(ret[:3]) != "250" {
-					conn.Close()
-					return nil, errors.New("EHLO failed: " + string(ret[:len(ret)-2]))
-				}
-				if ret[3] == ' ' {
-					break
-				}
+			extensionMap, err = smtpReadEhloReply(conn) //TLS之后的扩展列表以新的为准
+			if err != nil {
+				conn.Close()
+				return nil, nil, err
 			}
 			break
 		}
 	}
 
-	conn.Write([]byte("MAIL FROM:<" + internalAddress + ">\r\n"))
+	fromMail := envelope.fromMail
+	rcptAddress := append([]string{}, targetAddress...) //降级时不能改到调用者的列表
+	mailParams := ""
+	if envelope.smtpUtf8 {
+		if extensionMap["SMTPUTF8"] {
+			mailParams = " SMTPUTF8"
+		} else { //对方不支持SMTPUTF8就尝试降级: 域名转A-label, 本地部分有非ASCII字符就只能退信
+			if !isAscii(addressToAscii(fromMail)) {
+				conn.Close()
+				return nil, nil, newSmtpPermanentError("remote server does not support SMTPUTF8 and the sender address cannot be downgraded")
+			}
+			fromMail = addressToAscii(fromMail)
+			for i := range rcptAddress {
+				if !isAscii(addressToAscii(rcptAddress[i])) {
+					conn.Close()
+					return nil, nil, newSmtpPermanentError("remote server does not support SMTPUTF8 and the recipient address cannot be downgraded")
+				}
+				rcptAddress[i] = addressToAscii(rcptAddress[i])
+			}
+		}
+	}
+	if extensionMap["DSN"] { //对方支持DSN就把参数原样传过去, 通知由对方负责
+		if envelope.dsnRet != "" {
+			mailParams += " RET=" + envelope.dsnRet
+		}
+		if envelope.dsnEnvId != "" {
+			mailParams += " ENVID=" + envelope.dsnEnvId
+		}
+	}
+	conn.Write([]byte("MAIL FROM:<" + fromMail + ">" + mailParams + "\r\n"))
 	ret, err = ConnReadLine(conn)
 	if err != nil {
 		conn.Close()
-		return nil, errors.New("network error")
+		return nil, nil, errors.New("network error")
 	}
 	if string(ret[:3]) != "250" {
 		conn.Close()
-		return nil, errors.New("MAIL FROM failed: " + string(ret[:len(ret)-2]))
+		return nil, nil, newSmtpReplyError("MAIL FROM", ret)
 	}
 
-	for _, addr := range targetAddress {
-		conn.Write([]byte("RCPT TO:<" + addr + ">\r\n"))
+	for i, addr := range rcptAddress {
+		rcptParams := ""
+		if extensionMap["DSN"] {
+			if notify, ok := envelope.dsnNotify[targetAddress[i]]; ok {
+				rcptParams += " NOTIFY=" + notify
+			}
+			if orcpt, ok := envelope.dsnOrcpt[targetAddress[i]]; ok {
+				rcptParams += " ORCPT=" + orcpt
+			} else {
+				rcptParams += " ORCPT=rfc822;" + xtextEncode(targetAddress[i])
+			}
+		}
+		conn.Write([]byte("RCPT TO:<" + addr + ">" + rcptParams + "\r\n"))
 		ret, err = ConnReadLine(conn)
 		if err != nil {
 			conn.Close()
-			return nil, errors.New("network error")
+			return nil, nil, errors.New("network error")
 		}
 		if string(ret[:3]) != "250" {
 			conn.Close()
-			return nil, errors.New("RCPT TO failed: " + string(ret[:len(ret)-2]))
+			return nil, nil, newSmtpReplyError("RCPT TO", ret)
 		}
 	}
 
@@ -128,97 +265,110 @@ connected: //下面是握手流程
 	ret, err = ConnReadLine(conn)
 	if err != nil {
 		conn.Close()
-		return nil, errors.New("network error")
+		return nil, nil, errors.New("network error")
 	}
 	if string(ret[:3]) != "354" {
 		conn.Close()
-		return nil, errors.New("DATA failed: " + string(ret[:len(ret)-2]))
+		return nil, nil, newSmtpReplyError("DATA", ret)
 	}
 
-	return conn, nil
+	return conn, extensionMap, nil
 }
 
-func stmpEndBody(conn *connStruct) error { //结束邮件发送
-	conn.Write([]byte(".\r\n"))
-	ret, err := ConnReadLine(conn)
+func stmpEndBody(conn *connStruct, dotWriter *dotWriterStruct) error { //结束邮件发送
+	err := dotWriter.Close()
 	if err != nil {
+		conn.Close()
 		return errors.New("network error")
 	}
-	if string(ret[:3]) != "250" {
-		return errors.New("DATA failed: " + string(ret[:len(ret)-2]))
-	}
-
-	conn.Write([]byte("QUIT\r\n"))
-	ret, err = ConnReadLine(conn)
+	conn.setReadTimeout(timeoutSeconds(config.Smtp.Timeout.DataEndTimeoutS)) //对方收到结束行之后可能要处理比较久
+	ret, err := ConnReadLine(conn)
 	if err != nil {
+		conn.Close()
 		return errors.New("network error")
 	}
-	if string(ret[:3]) != "221" {
-		return errors.New("QUIT failed: " + string(ret[:len(ret)-2]))
+	if string(ret[:3]) != "250" {
+		conn.Close()
+		return newSmtpReplyError("DATA", ret)
 	}
 
+	conn.setReadTimeout(timeoutSeconds(config.Smtp.Timeout.CommandTimeoutS))
+	conn.Write([]byte("QUIT\r\n")) //邮件已经被接收了, QUIT失败也不影响投递结果
+	ConnReadLine(conn)
 	conn.Close()
 	return nil
 }
 
-func smtpHandleSendFalure(fromMail string, toMail []string, failureDomains map[string]error) { //退信通知
-	cacheFilePath := generateCacheFilePath()
-	f, err := os.OpenFile(cacheFilePath, os.O_CREATE|os.O_WRONLY, 0644)
+var smtpQueueWaitGroup sync.WaitGroup //命令行里生成的邮件要等发送完再退出
+
+func smtpQueueMail(envelope smtpEnvelopeStruct, cacheFilePath string) { //本机生成的邮件(退信/转发/自动回复)签名后交给发送程序
+	dkimHeader, err := generateDkimHeaderForFile(cacheFilePath)
 	if err != nil {
-		return
-	}
-	f.Write([]byte("Subject: Mail can't be delivered\r\nFrom: simpmailserv\r\nTo: " + fromMail + "\r\n\r\n"))
-	for k, v := range failureDomains {
-		f.Write([]byte(k + ": " + v.Error() + "\r\n"))
+		log.Println("Error: smtp DKIM sign error: " + err.Error())
 	}
-	f.Close()
-	os.Rename(cacheFilePath, getMailStoragePath(fromMail))
+	smtpQueueWaitGroup.Add(1)
+	go func() {
+		defer smtpQueueWaitGroup.Done()
+		smtpMailSendHandler(envelope, cacheFilePath, dkimHeader)
+	}()
 }
 
-func smtpMailSendHandler(fromMail string, toMail []string, cacheFilePath string, dkimHeader string) { //发送被缓存的邮件
-	cacheFile, _ := os.Open(cacheFilePath)
+func smtpMailSendHandler(envelope smtpEnvelopeStruct, cacheFilePath string, dkimHeader string) { //发送被缓存的邮件
 	domainAddressMap := make(map[string][]string)
 	connMap := make(map[string]*connStruct)
+	dotWriterMap := make(map[string]*dotWriterStruct)
+	dsnDomains := make(map[string]bool) //对方是否支持DSN
 	failureDomains := make(map[string]error)
+	failureAddress := make(map[string]error)
+	var resultList []dsnResultStruct
 	var err error
-	var readData []byte
-	var toInternalCachePathList []string
-	var toInternalStoragePathList []string
-	for _, targetAddress := range toMail { //获取每个邮箱地址对应的服务器地址(同时对回到本机的邮件做特判处理)
-		targetDomain := strings.Split(targetAddress, "@")[1]
-		if targetDomain == config.General.MailDomain {
-			if failureDomains[targetDomain] != nil {
-				continue
+	for _, targetAddress := range envelope.toMail { //获取每个邮箱地址对应的服务器地址(同时对回到本机的邮件做特判处理)
+		targetDomain := getAddressDomain(targetAddress)
+		if isLocalDomain(targetDomain) {
+			var targetList []string
+			var forwardList []string
+			targetList, err = aliasResolve(targetAddress)
+			if err == nil && len(targetList) == 0 {
+				err = errors.New("user not found")
 			}
-			toInternalCachePathList = append(toInternalCachePathList, generateCacheFilePath())
-			_, err = copyFile(cacheFilePath, toInternalCachePathList[len(toInternalCachePathList)-1])
-			if err != nil {
-				failureDomains[targetDomain] = errors.New("DATA failed: 431 The Recipient's Mail Server Is Experiencing a Disk Full Condition")
-				for _, cacheFilePath := range toInternalCachePathList {
-					os.Remove(cacheFilePath)
+			for i := 0; i < len(targetList) && err == nil; i++ {
+				if list, _ := listLookupAddress(targetList[i]); list != nil {
+					listDeliver(cacheFilePath, envelope, targetList[i])
+				} else if isLocalDomain(getAddressDomain(targetList[i])) {
+					err = localDeliver(cacheFilePath, envelope, targetList[i])
+				} else {
+					forwardList = append(forwardList, targetList[i])
 				}
-				toInternalStoragePathList = []string{}
 			}
-			toInternalStoragePathList = append(toInternalStoragePathList, getMailStoragePath(targetAddress))
+			if err != nil {
+				failureAddress[targetAddress] = errors.New("local delivery failed: " + err.Error())
+				continue
+			}
+			if len(forwardList) > 0 {
+				aliasForward(cacheFilePath, envelope, forwardList)
+			}
+			if len(targetList) == 1 && len(forwardList) == 0 {
+				resultList = append(resultList, dsnResultStruct{address: targetAddress, action: "delivered", status: "2.0.0"})
+			} else {
+				resultList = append(resultList, dsnResultStruct{address: targetAddress, action: "expanded", status: "2.0.0"})
+			}
 		} else {
 			domainAddressMap[targetDomain] = append(domainAddressMap[targetDomain], targetAddress)
 		}
 	}
-	for i := 0; i < len(toInternalStoragePathList); i++ { //照样是回到本机的特判
-		os.Rename(toInternalCachePathList[i], toInternalStoragePathList[i])
-	}
 	for targetDomain, targetAddress := range domainAddressMap { //连接每个邮件服务器并握手(获取conn)
-		targetConn, err := stmpSendHandshake(targetAddress, targetDomain, fromMail)
+		targetConn, extensionMap, err := stmpSendHandshake(targetAddress, targetDomain, envelope)
 		if err != nil {
 			failureDomains[targetDomain] = err
-			delete(connMap, targetDomain)
 			continue
 		}
 		connMap[targetDomain] = targetConn
+		dotWriterMap[targetDomain] = newDotWriter(targetConn)
+		dsnDomains[targetDomain] = extensionMap["DSN"]
 	}
-	if config.Smtp.Outbound.EnableDkim { //启用DKIM的话就先向每个服务器发送DKIM的头
+	if dkimHeader != "" { //需要DKIM签名的话就先向每个服务器发送DKIM的头
 		for targetDomain, targetConn := range connMap {
-			_, err = targetConn.Write([]byte(dkimHeader))
+			_, err = dotWriterMap[targetDomain].Write([]byte(dkimHeader))
 			if err != nil {
 				failureDomains[targetDomain] = err
 				targetConn.Close()
@@ -226,101 +376,257 @@ func smtpMailSendHandler(fromMail string, toMail []string, cacheFilePath string,
 			}
 		}
 	}
-	for { //读一行发一行
-		readData, err = FileReadLine(cacheFile)
-		if err != nil {
-			if err == io.EOF { //读到没
-				break
-			}
-			cacheFile.Close()
-			os.Remove(cacheFilePath)
-		}
+	cacheFile, err := os.Open(cacheFilePath)
+	if err != nil {
+		log.Println("Error: smtp open cache file error: " + err.Error())
 		for targetDomain, targetConn := range connMap {
-			_, err = targetConn.Write(readData)
+			failureDomains[targetDomain] = errors.New("local error: " + err.Error())
+			targetConn.Close()
+			delete(connMap, targetDomain)
+		}
+	} else {
+		buffer := make([]byte, 4096)
+		for { //读一块发一块(加上透明点)
+			n, err := cacheFile.Read(buffer)
+			if n > 0 {
+				for targetDomain, targetConn := range connMap {
+					_, err := dotWriterMap[targetDomain].Write(buffer[:n])
+					if err != nil {
+						failureDomains[targetDomain] = err
+						targetConn.Close()
+						delete(connMap, targetDomain)
+					}
+				}
+			}
 			if err != nil {
-				failureDomains[targetDomain] = err
-				targetConn.Close()
-				delete(connMap, targetDomain)
+				if err != io.EOF {
+					for targetDomain, targetConn := range connMap {
+						failureDomains[targetDomain] = errors.New("local error: " + err.Error())
+						targetConn.Close()
+						delete(connMap, targetDomain)
+					}
+				}
+				break
 			}
 		}
+		cacheFile.Close()
 	}
-	cacheFile.Close()
-	os.Remove(cacheFilePath)                        //删除cache文件
 	for targetDomain, targetConn := range connMap { //逐个服务器关闭连接
-		err = stmpEndBody(targetConn)
+		err = stmpEndBody(targetConn, dotWriterMap[targetDomain])
 		if err != nil {
 			failureDomains[targetDomain] = err
-			targetConn.Close()
-			delete(connMap, targetDomain)
+			continue
+		}
+		if !dsnDomains[targetDomain] { //对方支持DSN的话成功通知由对方发出
+			for _, targetAddress := range domainAddressMap[targetDomain] {
+				resultList = append(resultList, dsnResultStruct{address: targetAddress, action: "relayed", status: "2.0.0"})
+			}
 		}
 	}
-	if len(failureDomains) != 0 { //如果有发送失败的就进入发送失败处理流程
-		smtpHandleSendFalure(fromMail, toMail, failureDomains)
+	for targetDomain, err := range failureDomains {
+		for _, targetAddress := range domainAddressMap[targetDomain] {
+			failureAddress[targetAddress] = err
+		}
 	}
+
+	var deferredAddress []string
+	for _, targetAddress := range envelope.toMail { //临时错误就稍后重试, 否则退信
+		err, ok := failureAddress[targetAddress]
+		if !ok {
+			continue
+		}
+		status := dsnStatusFromError(err)
+		if isTemporarySendError(err) && envelope.retryTimes < config.Smtp.Outbound.DeferredRetryTimes {
+			deferredAddress = append(deferredAddress, targetAddress)
+			if envelope.retryTimes == 0 { //只在第一次推迟时通知
+				resultList = append(resultList, dsnResultStruct{address: targetAddress, action: "delayed", status: status, diagnostic: err.Error()})
+			}
+			continue
+		}
+		if status[0] == '4' { //重试用完了就是永久失败
+			status = "5" + status[1:]
+		}
+		log.Println("Warning: smtp delivery to " + targetAddress + " failed: " + err.Error())
+		resultList = append(resultList, dsnResultStruct{address: targetAddress, action: "failed", status: status, diagnostic: err.Error()})
+	}
+	if len(deferredAddress) != 0 {
+		retryCachePath := generateCacheFilePath()
+		_, err = copyFile(cacheFilePath, retryCachePath)
+		if err != nil {
+			log.Println("Error: smtp save deferred mail error: " + err.Error())
+		} else {
+			retryEnvelope := envelope
+			retryEnvelope.toMail = deferredAddress
+			retryEnvelope.retryTimes++
+			nextRetry := time.Now().Add(time.Second * time.Duration(config.Smtp.Outbound.DeferredRetryIntervalS))
+			if err = queueSave(retryCachePath, retryEnvelope, dkimHeader, nextRetry); err != nil { //没存下来的话重启后就不会重试了
+				log.Println("Error: smtp save deferred mail envelope error: " + err.Error())
+			}
+			log.Println("Warning: smtp delivery to " + strings.Join(deferredAddress, ", ") + " deferred, retry " + dsnFormatRetryTimes(retryEnvelope.retryTimes))
+			queueSchedule(retryEnvelope, retryCachePath, dkimHeader, nextRetry)
+		}
+	}
+	smtpSendDsn(envelope, resultList, cacheFilePath) //需要的话通知发件人
+	os.Remove(cacheFilePath)                         //删除cache文件
+	queueRemove(cacheFilePath)                       //是重试的邮件的话也删除信封文件
+}
+
+func smtpCloseConn(conn *connStruct, err error) { //读出错时关闭连接, 超时的话先回复421
+	if isTimeoutError(err) {
+		conn.Write([]byte("421 4.4.2 " + config.General.ServerAddress + " Error: timeout exceeded\r\n"))
+	}
+	conn.Close()
 }
 
-func smtpClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *tls.Config) { //处理客户端连接
-	conn := &connStruct{tlsConn: nil, plainConn: plainConn, connType: 0x00}
+func smtpClientHandler(plainConn net.Conn, option listenerOptionStruct) { //处理客户端连接
+	conn := newServerConn(plainConn)
+	conn.setTimeout(timeoutSeconds(config.Smtp.Timeout.IdleTimeoutS), timeoutSeconds(config.Smtp.Timeout.CommandTimeoutS))
+	remoteIp := getRemoteIp(plainConn.RemoteAddr())
+	if isIpBanned(remoteIp) { //被封禁的ip直接拒绝
+		conn.Write([]byte("421 4.7.0 " + config.General.ServerAddress + " Your address is temporarily banned\r\n"))
+		conn.Close()
+		return
+	}
+	var dnsblIpResult dnsblResultStruct
+	if option.smtpMode != smtpModeSubmission { //提交端口的用户可能在动态ip上, 不查黑名单
+		dnsblIpResult = dnsblCheckIp(remoteIp)
+		if dnsblIpResult.reject && option.smtpMode == smtpModeMx { //混用端口要等到MAIL FROM时看有没有鉴权再决定
+			conn.Write([]byte("554 5.7.1 Service unavailable; client host [" + remoteIp + "] blocked using " + strings.Join(dnsblIpResult.hits, ", ") + "\r\n"))
+			conn.Close()
+			return
+		}
+	}
+	var milterSession *milterSessionStruct //milter在每个阶段发生时就检查, 提交端口的邮件不检查
+	if config.Smtp.Milter.Enable && option.smtpMode != smtpModeSubmission {
+		var reply string
+		milterSession, reply = milterSessionOpen(remoteIp)
+		defer milterSession.close()
+		if reply != "" {
+			conn.Write([]byte(reply))
+			conn.Close()
+			return
+		}
+	}
 	conn.Write([]byte("220 " + config.General.ServerAddress + " simpmailserv\r\n"))
-	var hostName string
+	var state = smtpStateGreeting
+	var arrivalTime time.Time
+	var invalidRcptCount int //这次会话中被拒绝的收件人数量(用于tarpit)
 	var authenticatedUsername string
+	var heloName string
 	var fromMail string
 	var toMail []string
-	var isSend = false //默认接收模式
+	var isSend = false          //默认接收模式
+	var smtpUtf8 = false        //这次事务是否使用SMTPUTF8
+	var dsnRet, dsnEnvId string //DSN的MAIL参数
+	var dsnNotify, dsnOrcpt map[string]string
+	var dnsblResult dnsblResultStruct //这次事务的黑名单检查结果(ip和发件人域名)
+	resetTransaction := func() {      //结束/重置一次邮件事务
+		fromMail = ""
+		toMail = []string{}
+		isSend = false
+		smtpUtf8 = false
+		dsnRet = ""
+		dsnEnvId = ""
+		dsnNotify = make(map[string]string)
+		dsnOrcpt = make(map[string]string)
+		dnsblResult = dnsblResultStruct{}
+		milterSession.abort()
+		if state != smtpStateGreeting {
+			if authenticatedUsername != "" {
+				state = smtpStateAuth
+			} else {
+				state = smtpStateEhlo
+			}
+		}
+	}
 	for {
+		if state == smtpStateMail || state == smtpStateRcpt { //事务中和空闲时等待命令的超时不同
+			conn.setReadTimeout(timeoutSeconds(config.Smtp.Timeout.CommandTimeoutS))
+		} else {
+			conn.setReadTimeout(timeoutSeconds(config.Smtp.Timeout.IdleTimeoutS))
+		}
 		data, err := ConnReadLine(conn)
 		if err != nil {
-			conn.Close()
+			smtpCloseConn(conn, err)
 			return
 		}
 		data = data[:len(data)-2]
 		dataSplit := strings.Split(string(data), " ")
 		command := strings.ToLower(dataSplit[0])
+		if reply := smtpCheckTransition(state, command); reply != "" { //检查命令在当前状态下是否允许
+			conn.Write([]byte(reply))
+			continue
+		}
 		switch command {
-		case "helo": //获取对端客户端主机名
+		case "helo": //打招呼
 			if len(dataSplit) == 1 {
-				conn.Write([]byte("500 Error: bad syntax\r\n"))
+				conn.Write([]byte("501 5.5.4 Error: bad syntax\r\n"))
+				continue
+			}
+			if reply := milterSession.helo(dataSplit[1]); reply != "" {
+				conn.Write([]byte(reply))
 				continue
 			}
-			hostName = dataSplit[1]
-			conn.Write([]byte("250 OK\r\n"))
-		case "ehlo": //获取对端客户端主机名/返回功能列表
+			state = smtpStateEhlo
+			heloName = dataSplit[1]
+			resetTransaction()
+			conn.Write([]byte("250 " + config.General.ServerAddress + "\r\n")) //HELO/EHLO的回复不带增强状态码
+		case "ehlo": //打招呼/返回功能列表
 			if len(dataSplit) == 1 {
-				conn.Write([]byte("500 Error: bad syntax\r\n"))
+				conn.Write([]byte("501 5.5.4 Error: bad syntax\r\n"))
 				continue
 			}
-			hostName = dataSplit[1]
-			if enableStartTls {
-				conn.Write([]byte("250-mail\r\n250-AUTH LOGIN\r\n250-AUTH=LOGIN\r\n250-ID\r\n250-STARTTLS\r\n250 8BITMIME\r\n"))
-			} else {
-				conn.Write([]byte("250-mail\r\n250-AUTH LOGIN\r\n250-AUTH=LOGIN\r\n250-ID\r\n250 8BITMIME\r\n"))
+			if reply := milterSession.helo(dataSplit[1]); reply != "" {
+				conn.Write([]byte(reply))
+				continue
+			}
+			state = smtpStateEhlo
+			heloName = dataSplit[1]
+			resetTransaction()
+			ehloReply := "250-mail\r\n"
+			if option.smtpMode != smtpModeMx && (!option.requireTlsForAuth || conn.connType == 0x01) { //MX端口不显示AUTH, 要求TLS的话未加密时也不显示
+				ehloReply += "250-AUTH LOGIN\r\n250-AUTH=LOGIN\r\n"
 			}
+			ehloReply += "250-ID\r\n250-PIPELINING\r\n250-ENHANCEDSTATUSCODES\r\n"
+			if option.enableStartTls && conn.connType == 0x00 {
+				ehloReply += "250-STARTTLS\r\n"
+			}
+			ehloReply += "250-DSN\r\n250-SMTPUTF8\r\n250 8BITMIME\r\n"
+			conn.Write([]byte(ehloReply))
 		case "noop": //emmm就是啥也不干
-			conn.Write([]byte("250 OK\r\n"))
+			conn.Write([]byte("250 2.0.0 OK\r\n"))
 		case "rset": //重置发件邮箱和收件邮箱
-			conn.Write([]byte("250 OK\r\n"))
-			fromMail = ""
-			toMail = []string{}
+			resetTransaction()
+			conn.Write([]byte("250 2.0.0 OK\r\n"))
 		case "starttls": //升级到TLS
-			if !enableStartTls {
-				conn.Write([]byte("502 Error: command not implemented\r\n"))
+			if !option.enableStartTls || conn.connType == 0x01 {
+				conn.Write([]byte("502 5.5.1 Error: command not implemented\r\n"))
 				continue
 			}
-			conn.Write([]byte("220 Go ahead\r\n"))
-			tlsConn := tls.Server(conn.plainConn, startTlsConfig)
+			if conn.discardBuffered() > 0 { //STARTTLS后面不能跟着明文命令
+				log.Println("Warning: smtp client " + remoteIp + " sent plaintext after STARTTLS, discarded")
+			}
+			conn.Write([]byte("220 2.0.0 Go ahead\r\n"))
+			tlsConn := tls.Server(conn.plainConn, option.startTlsConfig)
 			conn.tlsConn = tlsConn
 			conn.connType = 0x01
+			state = smtpStateGreeting //升级后要重新EHLO
+			resetTransaction()
 		case "quit": //断开连接
-			conn.Write([]byte("221 Bye"))
+			conn.Write([]byte("221 2.0.0 Bye\r\n"))
 			conn.Close()
 			return
 		case "auth": //鉴权
-			if hostName == "" {
-				conn.Write([]byte("503 Error: send HELO/EHLO first\r\n"))
+			if option.smtpMode == smtpModeMx {
+				conn.Write([]byte("502 5.5.1 Error: AUTH not available on this port, use the submission port\r\n"))
+				continue
+			}
+			if option.requireTlsForAuth && conn.connType == 0x00 {
+				conn.Write([]byte("538 5.7.11 Encryption required for requested authentication mechanism\r\n"))
 				continue
 			}
 			if len(dataSplit) == 1 {
-				conn.Write([]byte("500 Error: bad syntax\r\n"))
+				conn.Write([]byte("501 5.5.4 Error: bad syntax\r\n"))
 				continue
 			}
 			switch strings.ToLower(dataSplit[1]) {
@@ -328,294 +634,390 @@ func smtpClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 				conn.Write([]byte("334 VXNlcm5hbWU6\r\n"))
 				usernameBase64, err := ConnReadLine(conn)
 				if err != nil {
-					conn.Close()
+					smtpCloseConn(conn, err)
 					return
 				}
 				usernameBase64 = usernameBase64[:len(usernameBase64)-2]
+				if string(usernameBase64) == "*" { //客户端取消鉴权
+					conn.Write([]byte("501 5.0.0 Authentication cancelled\r\n"))
+					continue
+				}
 
 				conn.Write([]byte("334 UGFzc3dvcmQ6\r\n"))
 				passwordBase64, err := ConnReadLine(conn)
 				if err != nil {
-					conn.Close()
+					smtpCloseConn(conn, err)
 					return
 				}
 				passwordBase64 = passwordBase64[:len(passwordBase64)-2]
+				if string(passwordBase64) == "*" {
+					conn.Write([]byte("501 5.0.0 Authentication cancelled\r\n"))
+					continue
+				}
 
 				usernameBytes, err := base64.StdEncoding.DecodeString(string(usernameBase64))
 				if err != nil {
-					conn.Write([]byte("535 Error: authentication failed\r\n"))
+					conn.Write([]byte("501 5.5.2 Error: cannot decode response\r\n"))
 					continue
 				}
 				username := string(usernameBytes)
 
 				passwordBytes, err := base64.StdEncoding.DecodeString(string(passwordBase64))
 				if err != nil {
-					conn.Write([]byte("535 Error: authentication failed\r\n"))
+					conn.Write([]byte("501 5.5.2 Error: cannot decode response\r\n"))
 					continue
 				}
 				password := string(passwordBytes)
 
-				if clientAuth(username, password) {
-					conn.Write([]byte("235 Authentication successful\r\n"))
-				} else {
-					conn.Write([]byte("535 Error: authentication failed\r\n"))
+				if !authAttempt(remoteIp, username, password, "smtp") { //失败的话不能记下用户名
+					conn.Write([]byte("535 5.7.8 Error: authentication failed\r\n"))
+					continue
 				}
 				authenticatedUsername = username
+				state = smtpStateAuth
+				conn.Write([]byte("235 2.7.0 Authentication successful\r\n"))
 			default:
-				conn.Write([]byte("504 Unrecognized authentication type\r\n"))
+				conn.Write([]byte("504 5.5.4 Unrecognized authentication type\r\n"))
 			}
 		case "mail": //来件地址
-			if hostName == "" {
-				conn.Write([]byte("503 Error: send HELO/EHLO first\r\n"))
+			mailAddress, mailParams, reply := smtpParseEnvelope(string(data), "from")
+			if reply != "" {
+				conn.Write([]byte(reply))
 				continue
 			}
-			if len(dataSplit) < 2 {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
+			_, mailSmtpUtf8 := mailParams["SMTPUTF8"]
+			if reply := dsnCheckMailParams(mailParams); reply != "" {
+				conn.Write([]byte(reply))
 				continue
 			}
-			from := strings.Join(dataSplit[1:], "")
-			fromSplit := strings.Split(from, ":")
-			if len(fromSplit) < 2 {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
+			if reply := smtpCheckAddressEncoding(mailAddress, mailSmtpUtf8); reply != "" {
+				conn.Write([]byte(reply))
 				continue
 			}
-			if strings.ToLower(fromSplit[0]) != "from" {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
+			if reply := smtpCheckSender(option.smtpMode, authenticatedUsername, remoteIp, mailAddress); reply != "" {
+				conn.Write([]byte(reply))
 				continue
 			}
-			mailSplitLeft := strings.Split(fromSplit[1], "<")
-			if len(mailSplitLeft) < 2 {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
-				continue
-			}
-			mailSplitRight := strings.Split(mailSplitLeft[1], ">")
-			mailSplit := strings.Split(mailSplitRight[0], "@")
-			if len(mailSplit) == 1 {
-				conn.Write([]byte("550 Invalid User\r\n"))
-				continue
+			var mailDnsblResult dnsblResultStruct
+			if authenticatedUsername == "" && option.smtpMode != smtpModeSubmission { //没有鉴权的客户端要检查黑名单
+				if dnsblIpResult.reject {
+					conn.Write([]byte("554 5.7.1 Client host [" + remoteIp + "] blocked using " + strings.Join(dnsblIpResult.hits, ", ") + "\r\n"))
+					continue
+				}
+				senderResult := dnsblCheckSender(mailAddress)
+				mailDnsblResult = dnsblResultStruct{score: dnsblIpResult.score + senderResult.score, reject: senderResult.reject, hits: append(append([]string{}, dnsblIpResult.hits...), senderResult.hits...)}
+				if config.Smtp.Dnsbl.RejectScore > 0 && mailDnsblResult.score >= config.Smtp.Dnsbl.RejectScore {
+					mailDnsblResult.reject = true
+				}
+				if mailDnsblResult.reject {
+					conn.Write([]byte("554 5.7.1 Sender address <" + mailAddress + "> rejected: blocked using " + strings.Join(mailDnsblResult.hits, ", ") + "\r\n"))
+					continue
+				}
 			}
-
-			if mailSplit[1] != config.General.MailDomain { //如果不是本机邮箱域名就设置为接收模式
-				isSend = false
-			} else { //如果是本机邮箱域名就设置为发送模式
-				if authenticatedUsername != "" { //没有鉴权过就拒绝
-					if !smtpAddressClientAuth(authenticatedUsername, mailSplitRight[0]) {
-						conn.Write([]byte("553 Mail from must equal authorized user\r\n"))
-						continue
-					}
-				} else {
-					conn.Write([]byte("553 authentication is required\r\n"))
+			mailIsSend := smtpIsRelayClient(option.smtpMode, authenticatedUsername, remoteIp) //可以转发的客户端就走发送模式
+			if !mailIsSend {
+				if reply := milterSession.mail(mailAddress); reply != "" {
+					conn.Write([]byte(reply))
 					continue
 				}
-				isSend = true
 			}
-			fromMail = mailSplitRight[0]
-			conn.Write([]byte("250 Mail OK\r\n"))
+			isSend = mailIsSend
+			dnsblResult = mailDnsblResult
+			smtpUtf8 = mailSmtpUtf8
+			dsnRet = strings.ToUpper(mailParams["RET"])
+			dsnEnvId = mailParams["ENVID"]
+			fromMail = mailAddress
+			state = smtpStateMail
+			conn.Write([]byte("250 2.1.0 Mail OK\r\n"))
 		case "rcpt": //接收地址
-			if hostName == "" {
-				conn.Write([]byte("503 Error: send HELO/EHLO first\r\n"))
-				continue
-			}
-			if len(dataSplit) < 2 {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
-				continue
-			}
-			to := strings.Join(dataSplit[1:], "")
-			toSplit := strings.Split(to, ":")
-			if len(toSplit) < 2 {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
+			smtpTarpit(invalidRcptCount) //之前无效收件人太多的话先拖一会
+			rcptAddress, rcptParams, reply := smtpParseEnvelope(string(data), "to")
+			if reply != "" {
+				invalidRcptCount++
+				conn.Write([]byte(reply))
 				continue
 			}
-			if strings.ToLower(toSplit[0]) != "to" {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
+			if reply := smtpCheckAddressEncoding(rcptAddress, smtpUtf8); reply != "" {
+				invalidRcptCount++
+				conn.Write([]byte(reply))
 				continue
 			}
-			mailSplitLeft := strings.Split(toSplit[1], "<")
-			if len(mailSplitLeft) < 2 {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
+			if reply := dsnCheckRcptParams(rcptParams); reply != "" {
+				invalidRcptCount++
+				conn.Write([]byte(reply))
 				continue
 			}
-			mailSplitRight := strings.Split(mailSplitLeft[1], ">")
-			mailSplit := strings.Split(mailSplitRight[0], "@")
-			if len(mailSplit) == 1 {
-				conn.Write([]byte("550 Invalid User\r\n"))
+			if isLocalDomain(getAddressDomain(rcptAddress)) { //如果是本机的域名的话就查找本地是否存在这个地址(包括别名)
+				targetList, err := aliasResolve(rcptAddress)
+				if err != nil {
+					log.Println("Warning: alias resolve " + rcptAddress + " error: " + err.Error())
+					conn.Write([]byte("550 5.4.6 Alias expansion failed: " + rcptAddress + "\r\n"))
+					continue
+				}
+				if len(targetList) == 0 {
+					invalidRcptCount++
+					conn.Write([]byte("550 5.1.1 User not found: " + rcptAddress + "\r\n"))
+					continue
+				}
+				if len(targetList) == 1 && isLocalDomain(getAddressDomain(targetList[0])) {
+					if list, kind := listLookupAddress(targetList[0]); list != nil {
+						if kind == listAddressPost {
+							if reply := listCheckSender(list, fromMail); reply != "" {
+								if reply[0] == '5' {
+									invalidRcptCount++
+								}
+								conn.Write([]byte(reply))
+								continue
+							}
+						}
+					} else if checkMailboxQuota(targetList[0], 0) == errorMailboxFull {
+						conn.Write([]byte("452 4.2.2 Mailbox full: " + rcptAddress + "\r\n"))
+						continue
+					}
+				}
+			} else if reply := smtpCheckRelay(option.smtpMode, authenticatedUsername, remoteIp, rcptAddress); reply != "" { //不是本机域名就要检查能不能转发
+				invalidRcptCount++
+				conn.Write([]byte(reply))
 				continue
 			}
-
-			if mailSplit[1] == config.General.MailDomain { //如果是本机的域名的话就查找本地是否存在这个地址
-				if !smtpCheckAddressExists(mailSplitRight[0]) {
-					conn.Write([]byte("550 User not found: " + mailSplitRight[0] + "\r\n"))
+			if !isSend { //只对其他服务器投递进来的邮件做灰名单
+				if reply := greylistCheck(remoteIp, fromMail, rcptAddress); reply != "" {
+					conn.Write([]byte(reply))
 					continue
 				}
-			} else { //不是本机域名且是不发送模式的话拒绝
-				if !isSend {
-					conn.Write([]byte("550 Invalid User\r\n"))
+				if reply := milterSession.rcpt(rcptAddress); reply != "" {
+					conn.Write([]byte(reply))
 					continue
 				}
 			}
-			toMail = append(toMail, mailSplitRight[0])
-			conn.Write([]byte("250 Mail OK\r\n"))
-		case "data": //开始处理邮件
-			if hostName == "" {
-				conn.Write([]byte("503 Error: send HELO/EHLO first\r\n"))
-				continue
+			toMail = append(toMail, rcptAddress)
+			if notify, ok := rcptParams["NOTIFY"]; ok {
+				dsnNotify[rcptAddress] = strings.ToUpper(notify)
 			}
-			if fromMail == "" || len(toMail) == 0 {
-				conn.Write([]byte("503 bad sequence of commands\r\n"))
-				continue
+			if orcpt, ok := rcptParams["ORCPT"]; ok {
+				dsnOrcpt[rcptAddress] = orcpt
+			}
+			state = smtpStateRcpt
+			conn.Write([]byte("250 2.1.5 Mail OK\r\n"))
+		case "data": //开始处理邮件
+			if !isSend {
+				if reply := milterSession.data(); reply != "" {
+					conn.Write([]byte(reply))
+					resetTransaction()
+					continue
+				}
 			}
 			conn.Write([]byte("354 End data with <CR><LF>.<CR><LF>\r\n"))
-			dkimBodyHash := sha256.New()
-			var headerList []string
-			var keepedHeaderList []string
-			var toKeepHeaders []string
-			if !isSend { //接收模式就写到对应的文件中就行
+			state = smtpStateData
+			arrivalTime = time.Now()
+			conn.setReadTimeout(timeoutSeconds(config.Smtp.Timeout.DataTimeoutS))
+			if !isSend { //接收模式先存到一个临时文件中, 经过内容过滤之后再复制给每个收件人
 				var recvData []byte
-				var storagePathList []string
-				var tempRecvPathList []string
-				var tempRecvFileList []*os.File
 				var err error
 				var endHead bool = false
+				var skipHeader bool = false //正在跳过的头部(包括折叠的续行)
 				var writeError bool = false
-				for i := 0; i < len(toMail); i++ {
-					storagePathList = append(storagePathList, getMailStoragePath(toMail[i]))
-				}
-				for i := 0; i < len(toMail); i++ {
-					tempRecvPathList = append(tempRecvPathList, generateCacheFilePath())
-				}
-				for i := 0; i < len(tempRecvPathList); i++ {
-					f, err := os.OpenFile(tempRecvPathList[i], os.O_CREATE|os.O_WRONLY, 0644)
-					if err != nil {
-						conn.Write([]byte("431 The Recipient's Mail Server Is Experiencing a Disk Full Condition\r\n"))
-						writeError = true
-						goto endInternalSave
-					}
-					tempRecvFileList = append(tempRecvFileList, f)
+				var dataEnd bool = false
+				tempRecvPath := generateCacheFilePath()
+				tempRecvFile, err := os.OpenFile(tempRecvPath, os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					writeError = true
+					goto endInternalSave
 				}
 				for {
-					recvData, err = ConnReadLine(conn)
+					recvData, dataEnd, err = DotReadLine(conn)
 					if err != nil {
-						conn.Close()
+						tempRecvFile.Close()
+						os.Remove(tempRecvPath) //连接断开的话临时文件就没用了
+						smtpCloseConn(conn, err)
 						return
 					}
-					if string(recvData) == ".\r\n" {
+					if dataEnd {
 						break
 					}
 					if string(recvData) == "\r\n" && !endHead {
 						endHead = true
 						t := time.Now().UTC()
-						for i := 0; i < len(tempRecvFileList); i++ {
-							_, err = tempRecvFileList[i].Write([]byte("Date: " + t.Weekday().String()[:3] + ", " + strconv.Itoa(t.Day()) + " " + t.Month().String()[:3] + " " + strconv.Itoa(t.Year()) + " " + strconv.Itoa(t.Hour()) + ":" + strconv.Itoa(t.Minute()) + ":" + strconv.Itoa(t.Second()) + " +0000 (CST)\r\nSender: " + fromMail + "\r\n\r\n"))
-							if err != nil {
-								conn.Write([]byte("431 The Recipient's Mail Server Is Experiencing a Disk Full Condition\r\n"))
-								writeError = true
-								goto endInternalSave
-							}
+						appendHeader := "Date: " + t.Weekday().String()[:3] + ", " + strconv.Itoa(t.Day()) + " " + t.Month().String()[:3] + " " + strconv.Itoa(t.Year()) + " " + strconv.Itoa(t.Hour()) + ":" + strconv.Itoa(t.Minute()) + ":" + strconv.Itoa(t.Second()) + " +0000 (CST)\r\n"
+						if fromMail != "" { //退信的发件人是空的
+							appendHeader += "Sender: " + fromMail + "\r\n"
 						}
-						continue
-					}
-					for i := 0; i < len(tempRecvFileList); i++ {
-						_, err := tempRecvFileList[i].Write(recvData)
+						if dnsblResult.score > 0 { //被计分的黑名单命中记录在头部里
+							appendHeader += "X-DNSBL: score=" + strconv.Itoa(dnsblResult.score) + "; listed=" + strings.Join(dnsblResult.hits, ", ") + "\r\n"
+						}
+						_, err = tempRecvFile.Write([]byte(appendHeader + "\r\n"))
 						if err != nil {
-							conn.Write([]byte("431 The Recipient's Mail Server Is Experiencing a Disk Full Condition\r\n"))
 							writeError = true
 							goto endInternalSave
 						}
+						continue
+					}
+					if !endHead { //客户端自己带的X-DNSBL和X-Spam-*头部不可信, 去掉
+						if recvData[0] != ' ' && recvData[0] != '\t' {
+							headerName := getHeaderName(string(recvData))
+							skipHeader = headerName == "x-dnsbl" || (config.Spam.Enable && strings.HasPrefix(headerName, "x-spam-"))
+						}
+						if skipHeader {
+							continue
+						}
+					}
+					_, err = tempRecvFile.Write(recvData)
+					if err != nil {
+						writeError = true
+						goto endInternalSave
 					}
 				}
 			endInternalSave:
-				for i := 0; i < len(tempRecvFileList); i++ {
-					tempRecvFileList[i].Close()
+				tempRecvFile.Close()
+				if writeError {
+					os.Remove(tempRecvPath)
+					if !dataEnd { //出错时也要把剩下的数据读完, 不然会被当成命令
+						if err := dotDiscardData(conn); err != nil {
+							smtpCloseConn(conn, err)
+							return
+						}
+					}
+					conn.Write([]byte("452 4.3.1 Insufficient system storage\r\n"))
+					resetTransaction()
+					continue
+				}
+				envelope := smtpEnvelopeStruct{fromMail: fromMail, toMail: toMail, smtpUtf8: smtpUtf8, dsnRet: dsnRet, dsnEnvId: dsnEnvId, dsnNotify: dsnNotify, dsnOrcpt: dsnOrcpt, arrivalTime: arrivalTime, clientIp: remoteIp, heloName: heloName}
+				filterResult := smtpContentFilter(tempRecvPath, envelope, milterSession) //交给milter和过滤命令检查
+				if filterResult.reply != "" || filterResult.discard {
+					os.Remove(tempRecvPath)
+					if filterResult.reply != "" {
+						conn.Write([]byte(filterResult.reply))
+					} else {
+						conn.Write([]byte("250 2.0.0 Mail OK\r\n")) //丢弃的邮件也要假装收下了
+					}
+					resetTransaction()
+					continue
+				}
+				if filterResult.quarantine != "" { //隔离的邮件不投递给收件人
+					quarantinePath := getQuarantinePath()
+					if err := os.Rename(tempRecvPath, quarantinePath); err != nil {
+						log.Println("Error: move mail to quarantine error: " + err.Error())
+						os.Remove(tempRecvPath)
+						conn.Write([]byte("452 4.3.1 Insufficient system storage\r\n"))
+						resetTransaction()
+						continue
+					}
+					log.Println("Info: mail from " + fromMail + " quarantined to " + quarantinePath + ": " + filterResult.quarantine)
+					conn.Write([]byte("250 2.0.0 Mail OK\r\n"))
+					resetTransaction()
+					continue
+				}
+				var spamTokenList []string
+				if config.Spam.Enable { //垃圾邮件分类器对每个收件人分别打分, 先分好词
+					spamTokenList, err = spamTokenizeFile(tempRecvPath)
+					if err != nil {
+						log.Println("Error: spam tokenize error: " + err.Error())
+					}
+				}
+				var deliveryList []*localDeliveryStruct
+				var forwardList []string                          //别名指向的外部地址
+				rcptTargetList := make([][]string, len(toMail))   //每个收件人展开别名之后的地址
+				prepared := make(map[string]bool)                 //几个收件人指向同一个邮箱时只投递一次
+				mailboxFull := make(map[string]bool)              //超过容量限制的邮箱(单独退信)
+				listTargets := make(map[string]bool)              //邮件列表的地址(投递之后再发给成员)
+				for i := 0; i < len(toMail) && !writeError; i++ { //先给每个收件人准备好, 全部成功了再存进邮箱, 避免只投递给一部分收件人
+					rcptTargetList[i], err = aliasResolve(toMail[i])
+					if err != nil {
+						log.Println("Error: alias resolve " + toMail[i] + " error: " + err.Error())
+						writeError = true
+						break
+					}
+					for _, target := range rcptTargetList[i] {
+						if prepared[strings.ToLower(target)] {
+							continue
+						}
+						prepared[strings.ToLower(target)] = true
+						if !isLocalDomain(getAddressDomain(target)) {
+							forwardList = append(forwardList, target)
+							continue
+						}
+						if list, _ := listLookupAddress(target); list != nil {
+							listTargets[strings.ToLower(target)] = true
+							continue
+						}
+						delivery, err := localDeliveryPrepare(tempRecvPath, envelope, target, spamTokenList)
+						if err == errorMailboxFull {
+							log.Println("Warning: local delivery to " + target + " failed: mailbox full")
+							mailboxFull[strings.ToLower(target)] = true
+							continue
+						}
+						if err != nil {
+							log.Println("Error: local delivery to " + target + " error: " + err.Error())
+							writeError = true
+							break
+						}
+						deliveryList = append(deliveryList, delivery)
+					}
 				}
 				if writeError {
-					for i := 0; i < len(tempRecvFileList); i++ {
-						os.Remove(tempRecvPathList[i])
+					for _, delivery := range deliveryList {
+						delivery.abort()
 					}
+					os.Remove(tempRecvPath)
+					conn.Write([]byte("452 4.3.1 Insufficient system storage\r\n"))
+					resetTransaction()
 					continue
 				}
-				for i := 0; i < len(tempRecvFileList); i++ {
-					os.Rename(tempRecvPathList[i], storagePathList[i])
+				rejected := make(map[string]bool)
+				for _, delivery := range deliveryList {
+					delivery.commit()
+					if delivery.result.reject != "" {
+						rejected[strings.ToLower(delivery.address)] = true
+					}
+				}
+				if len(forwardList) > 0 {
+					aliasForward(tempRecvPath, envelope, forwardList)
 				}
-				conn.Write([]byte("250 Mail OK\r\n"))
-			} else { //发送模式先把邮件存到一个临时文件中(如果启用了DKIM就同时计算hash)然后转交给发送程序处理
+				for target := range listTargets {
+					listDeliver(tempRecvPath, envelope, target)
+				}
+				var resultList []dsnResultStruct
+				for i := 0; i < len(toMail); i++ {
+					targetList := rcptTargetList[i]
+					if len(targetList) == 1 && isLocalDomain(getAddressDomain(targetList[0])) && !listTargets[strings.ToLower(targetList[0])] { //只对应一个本机邮箱
+						if mailboxFull[strings.ToLower(targetList[0])] {
+							resultList = append(resultList, dsnResultStruct{address: toMail[i], action: "failed", status: "5.2.2", diagnostic: "552 5.2.2 Mailbox full"})
+						} else if !rejected[strings.ToLower(targetList[0])] { //被sieve拒绝的已经单独退信了
+							resultList = append(resultList, dsnResultStruct{address: toMail[i], action: "delivered", status: "2.0.0"})
+						}
+					} else { //展开成了多个地址或者转发到外部(RFC 3464 2.3.3)
+						resultList = append(resultList, dsnResultStruct{address: toMail[i], action: "expanded", status: "2.0.0"})
+					}
+				}
+				conn.Write([]byte("250 2.0.0 Mail OK\r\n"))
+				if len(resultList) > 0 { //要求了SUCCESS通知的话就发送投递成功的通知
+					smtpSendDsn(envelope, resultList, tempRecvPath)
+				}
+				os.Remove(tempRecvPath)
+			} else { //发送模式先把邮件存到一个临时文件中, 处理完之后(提交修正/DKIM)转交给发送程序处理
 				var recvData []byte
-				var hashBuffer string
 				var err error
-				var endHead bool = false
 				var writeError bool = false
-				var startBody bool = false
-				rxReduceWS := regexp.MustCompile(`[ \t]+`)
+				var dataEnd bool = false
 				tempRecvPath := generateCacheFilePath()
 				tempRecvFile, err := os.OpenFile(tempRecvPath, os.O_CREATE|os.O_WRONLY, 0644)
 				if err != nil {
-					conn.Write([]byte("431 The Recipient's Mail Server Is Experiencing a Disk Full Condition\r\n"))
 					writeError = true
 					goto endSendSave
 				}
 				for {
-					recvData, err = ConnReadLine(conn)
+					recvData, dataEnd, err = DotReadLine(conn)
 					if err != nil {
-						conn.Close()
+						tempRecvFile.Close()
+						os.Remove(tempRecvPath) //连接断开的话临时文件就没用了
+						smtpCloseConn(conn, err)
 						return
 					}
-					if string(recvData) == ".\r\n" {
-						if config.Smtp.Outbound.EnableDkim {
-							if !startBody {
-								dkimBodyHash.Write([]byte("\r\n"))
-							}
-						}
+					if dataEnd {
 						break
 					}
-					if string(recvData) == "\r\n" && !endHead { //结束头部就把头部列表给规范化了
-						endHead = true
-						_, err := tempRecvFile.Write(recvData)
-						if err != nil {
-							conn.Write([]byte("431 The Recipient's Mail Server Is Experiencing a Disk Full Condition\r\n"))
-							writeError = true
-							goto endSendSave
-						}
-						if config.Smtp.Outbound.EnableDkim {
-							headerList[len(headerList)-1] = strings.TrimRight(headerList[len(headerList)-1], "\r\n")
-							for _, header := range headerList {
-								headerSplit := strings.Split(header, ":")
-								if len(headerSplit) < 2 {
-									continue
-								}
-								toKeepHeaders = append(toKeepHeaders, strings.ToLower(headerSplit[0]))
-								keepedHeaderList = append(keepedHeaderList, header)
-							}
-							keepedHeaderList = canonicalizeHeaderList(keepedHeaderList)
-						}
-						continue
-					}
-					if config.Smtp.Outbound.EnableDkim { //结束了头部就规范化然后加入hash, 没结束就加入头部列表
-						if !endHead {
-							if recvData[0] == 32 || recvData[0] == 9 {
-								headerList[len(headerList)-1] += string(recvData)
-							} else {
-								if len(headerList) >= 1 {
-									headerList[len(headerList)-1] = strings.TrimRight(headerList[len(headerList)-1], "\r\n")
-								}
-								headerList = append(headerList, string(recvData))
-							}
-						} else {
-							line := strings.TrimRight(string(recvData), "\r\n")
-							line += "\r\n"
-							line = rxReduceWS.ReplaceAllString(line, " ")
-							if line == "\r\n" {
-								hashBuffer += "\r\n"
-							} else {
-								dkimBodyHash.Write([]byte(line + hashBuffer))
-								hashBuffer = ""
-							}
-						}
-					}
-					if endHead && !startBody {
-						startBody = true
-					}
-					_, err := tempRecvFile.Write(recvData)
+					_, err = tempRecvFile.Write(recvData)
 					if err != nil {
-						conn.Write([]byte("431 The Recipient's Mail Server Is Experiencing a Disk Full Condition\r\n"))
 						writeError = true
 						goto endSendSave
 					}
@@ -624,31 +1026,77 @@ func smtpClientHandler(plainConn net.Conn, enableStartTls bool, startTlsConfig *
 				tempRecvFile.Close()
 				if writeError {
 					os.Remove(tempRecvPath)
+					if !dataEnd { //出错时也要把剩下的数据读完, 不然会被当成命令
+						if err := dotDiscardData(conn); err != nil {
+							smtpCloseConn(conn, err)
+							return
+						}
+					}
+					conn.Write([]byte("452 4.3.1 Insufficient system storage\r\n"))
+					resetTransaction()
 					continue
 				}
-				var dkimHeader string
-				if config.Smtp.Outbound.EnableDkim { //计算DKIM头部
-					dkimBaseHeader := generateDkimBaseHeader(base64.StdEncoding.EncodeToString(dkimBodyHash.Sum(nil)), config.Smtp.Outbound.DkimDomain, config.Smtp.Outbound.DkimSelector, toKeepHeaders, smtpDkimPrivateKey)
-					dkimHeader = generateDkimFullHeaderWithSign(keepedHeaderList, dkimBaseHeader, smtpDkimPrivateKey)
+				if scanResult := clamavCheck(tempRecvPath, smtpEnvelopeStruct{fromMail: fromMail, toMail: toMail}); scanResult.reply != "" { //病毒扫描要在提交处理(会存发件人副本)和DKIM签名之前
+					conn.Write([]byte(scanResult.reply))
+					os.Remove(tempRecvPath)
+					resetTransaction()
+					continue
 				}
-				conn.Write([]byte("250 Mail OK\r\n"))
-				go smtpMailSendHandler(fromMail, toMail, tempRecvPath, dkimHeader) //发送~
+				var sentCopyCachePath string     //发件人副本, 邮件被接受之后才存进邮箱
+				if authenticatedUsername != "" { //已鉴权用户提交的邮件要做处理
+					var reply string
+					reply, sentCopyCachePath, err = smtpSubmissionProcess(tempRecvPath, authenticatedUsername, fromMail)
+					if err != nil {
+						log.Println("Error: smtp submission process error: " + err.Error())
+						conn.Write([]byte("451 4.3.0 Requested action aborted: local error in processing\r\n"))
+						os.Remove(tempRecvPath)
+						resetTransaction()
+						continue
+					}
+					if reply != "" {
+						conn.Write([]byte(reply))
+						os.Remove(tempRecvPath)
+						resetTransaction()
+						continue
+					}
+				}
+				dkimHeader, err := generateDkimHeaderForFile(tempRecvPath) //计算DKIM头部(按发件域名选择签名身份)
+				if err != nil {
+					log.Println("Error: smtp DKIM sign error: " + err.Error())
+					conn.Write([]byte("451 4.3.0 Requested action aborted: local error in processing\r\n"))
+					os.Remove(tempRecvPath)
+					os.Remove(sentCopyCachePath)
+					resetTransaction()
+					continue
+				}
+				smtpSaveSentCopy(sentCopyCachePath, fromMail) //后面不会再拒绝了
+				conn.Write([]byte("250 2.0.0 Mail OK\r\n"))
+				envelope := smtpEnvelopeStruct{fromMail: fromMail, toMail: toMail, smtpUtf8: smtpUtf8, dsnRet: dsnRet, dsnEnvId: dsnEnvId, dsnNotify: dsnNotify, dsnOrcpt: dsnOrcpt, arrivalTime: arrivalTime}
+				go smtpMailSendHandler(envelope, tempRecvPath, dkimHeader) //发送~
 			}
-			fromMail = ""
-			toMail = []string{}
+			resetTransaction()
 		default:
-			conn.Write([]byte("502 Error: command not implemented\r\n"))
+			conn.Write([]byte("502 5.5.1 Error: command not implemented\r\n"))
 		}
 	}
 }
 
-func smtpClientListenHandler(listener net.Listener, enableStartTls bool, startTlsConfig *tls.Config) { //监听
+func smtpClientListenHandler(listener net.Listener, option listenerOptionStruct) { //监听
 	for !serverStop {
 		conn, err := listener.Accept()
 		if err != nil {
 			log.Println("Error: smtp listen error: " + err.Error())
+			continue
+		}
+		remoteIp := getRemoteIp(conn.RemoteAddr())
+		if !acquireConnection(remoteIp) { //超过连接数限制
+			go rejectConnection(conn, "421 4.7.0 "+config.General.ServerAddress+" Too many connections\r\n")
+			continue
 		}
-		go smtpClientHandler(conn, enableStartTls, startTlsConfig)
+		go func() {
+			smtpClientHandler(conn, option)
+			releaseConnection(remoteIp)
+		}()
 	}
 }
 
@@ -660,24 +1108,48 @@ func smtpServer() { //启用smtp服务
 			goto next
 		}
 		log.Println("Info: start smtp server at: " + listener.Addr().String())
+		option := listenerOptionStruct{requireTlsForAuth: config.Smtp.Inbound.PlainRequireTlsForAuth}
 		if config.Smtp.Inbound.PlainEnableStartTls {
 			log.Println("Info: smtp STARTTLS enabled")
-			go smtpClientListenHandler(listener, true, &tls.Config{Certificates: []tls.Certificate{smtpStartTlsCert}})
-		} else {
-			go smtpClientListenHandler(listener, false, nil)
+			option.enableStartTls = true
+			option.startTlsConfig = &tls.Config{Certificates: []tls.Certificate{smtpStartTlsCert}}
+		}
+		if config.Smtp.Submission.Enable { //启用了提交端口的话25端口就只做MX
+			option.smtpMode = smtpModeMx
 		}
+		go smtpClientListenHandler(listener, option)
 	}
 next:
 	if config.Smtp.Inbound.EnableTls {
 		listener, err := tls.Listen("tcp", config.Smtp.Inbound.TlsListenAddress+":"+strconv.Itoa(config.Smtp.Inbound.TlsListenPort), &tls.Config{Certificates: []tls.Certificate{smtpTlsCert}})
 		if err != nil {
 			log.Println("Error: start smtp tls server error: " + err.Error())
-			return
+			goto submission
 		}
 		log.Println("Info: start smtp tls server at: " + listener.Addr().String())
-		go smtpClientListenHandler(listener, false, nil)
+		option := listenerOptionStruct{}
+		if config.Smtp.Submission.Enable { //启用了提交端口的话465端口也按提交端口处理(RFC 8314)
+			option.smtpMode = smtpModeSubmission
+		}
+		go smtpClientListenHandler(listener, option)
+	}
+submission:
+	if config.Smtp.Submission.Enable {
+		listener, err := net.Listen("tcp", config.Smtp.Submission.ListenAddress+":"+strconv.Itoa(config.Smtp.Submission.ListenPort))
+		if err != nil {
+			log.Println("Error: start smtp submission server error: " + err.Error())
+			return
+		}
+		log.Println("Info: start smtp submission server at: " + listener.Addr().String())
+		option := listenerOptionStruct{requireTlsForAuth: config.Smtp.Submission.RequireTlsForAuth, smtpMode: smtpModeSubmission}
+		if config.Smtp.Submission.EnableStartTls {
+			log.Println("Info: smtp submission STARTTLS enabled")
+			option.enableStartTls = true
+			option.startTlsConfig = &tls.Config{Certificates: []tls.Certificate{smtpSubmissionStartTlsCert}}
+		}
+		go smtpClientListenHandler(listener, option)
 	}
-	if (config.Smtp.Inbound.EnablePlain || config.Smtp.Inbound.EnableTls) && config.Smtp.Outbound.EnableDkim {
+	if (config.Smtp.Inbound.EnablePlain || config.Smtp.Inbound.EnableTls || config.Smtp.Submission.Enable) && config.Smtp.Outbound.EnableDkim {
 		log.Println("Info: smtp DKIM enabled")
 	}
 }
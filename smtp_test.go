@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSmtpClient struct { //通过net.Pipe和smtpClientHandler对话的测试客户端
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestSmtpClient(t *testing.T, option listenerOptionStruct) *testSmtpClient {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	handlerDone := make(chan struct{})
+	go func() {
+		smtpClientHandler(serverConn, option)
+		close(handlerDone)
+	}()
+	client := &testSmtpClient{t: t, conn: clientConn, reader: bufio.NewReader(clientConn)}
+	t.Cleanup(func() { //等会话结束, 下一个测试才能换配置
+		clientConn.Close()
+		<-handlerDone
+	})
+	if reply := client.readReply(); !strings.HasPrefix(reply, "220 ") {
+		t.Fatalf("greeting = %q", reply)
+	}
+	return client
+}
+
+func (client *testSmtpClient) readReply() string { //读取一个(可能是多行的)回复, 只返回最后一行
+	client.t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for {
+		line, err := client.reader.ReadString('\n')
+		if err != nil {
+			client.t.Fatalf("read reply error: %v", err)
+		}
+		if len(line) < 4 || line[3] != '-' {
+			return strings.TrimRight(line, "\r\n")
+		}
+	}
+}
+
+func (client *testSmtpClient) command(line string, wantCode string) string { //发送一条命令并检查回复码
+	client.t.Helper()
+	client.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err := client.conn.Write([]byte(line + "\r\n")); err != nil {
+		client.t.Fatalf("write %q error: %v", line, err)
+	}
+	reply := client.readReply()
+	if !strings.HasPrefix(reply, wantCode+" ") {
+		client.t.Fatalf("%s: got %q, want %s", line, reply, wantCode)
+	}
+	return reply
+}
+
+func TestSmtpStateMachine(t *testing.T) {
+	testLoadConfig(t, "")
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMixed})
+	client.command("MAIL FROM:<a@other.net>", "503")
+	client.command("RCPT TO:<b@other.org>", "503")
+	client.command("DATA", "503")
+	client.command("EHLO client.test", "250")
+	if reply := client.command("RCPT TO:<b@other.org>", "503"); !strings.Contains(reply, "need MAIL") {
+		t.Errorf("RCPT before MAIL: %q", reply)
+	}
+	if reply := client.command("DATA", "503"); !strings.Contains(reply, "need MAIL") {
+		t.Errorf("DATA before MAIL: %q", reply)
+	}
+	client.command("MAIL FROM:<a@other.net>", "250")
+	if reply := client.command("DATA", "503"); !strings.Contains(reply, "need RCPT") {
+		t.Errorf("DATA before RCPT: %q", reply)
+	}
+	if reply := client.command("MAIL FROM:<a@other.net>", "503"); !strings.Contains(reply, "nested MAIL") {
+		t.Errorf("MAIL inside transaction: %q", reply)
+	}
+	client.command("AUTH LOGIN", "503")
+	client.command("STARTTLS", "503")
+
+	client.command("RSET", "250") //RSET之后回到EHLO之后的状态
+	client.command("RCPT TO:<b@other.org>", "503")
+	client.command("MAIL FROM:<a@other.net>", "250")
+
+	client.command("HELO client.test", "250") //HELO也会重置事务
+	client.command("DATA", "503")
+	client.command("MAIL FROM:<a@other.net>", "250")
+	client.command("NOOP", "250")
+	client.command("QUIT", "221")
+}
+
+func TestSmtpAuth(t *testing.T) { //鉴权失败不能被当成已经登录
+	testLoadConfig(t, "")
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMixed})
+	client.command("EHLO client.test", "250")
+	client.command("AUTH LOGIN", "334")
+	client.command(base64.StdEncoding.EncodeToString([]byte("alice")), "334")
+	client.command(base64.StdEncoding.EncodeToString([]byte("wrong")), "535")
+	client.command("MAIL FROM:<alice@example.com>", "530") //本机发件人还是要求鉴权
+	client.command("MAIL FROM:<someone@other.net>", "250")
+	client.command("RCPT TO:<victim@other.org>", "554") //也不能转发
+	client.command("RSET", "250")
+
+	client.command("AUTH LOGIN", "334")
+	client.command(base64.StdEncoding.EncodeToString([]byte("alice")), "334")
+	client.command(base64.StdEncoding.EncodeToString([]byte("pw")), "235")
+	client.command("AUTH LOGIN", "503") //已经鉴权过了
+	client.command("MAIL FROM:<alice@example.com>", "250")
+	client.command("QUIT", "221")
+}
+
+func (client *testSmtpClient) pipeline(lineList []string, wantCodeList []string) { //一次写入多条命令, 按顺序检查每条的回复
+	client.t.Helper()
+	client.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err := client.conn.Write([]byte(strings.Join(lineList, "\r\n") + "\r\n")); err != nil {
+		client.t.Fatalf("write error: %v", err)
+	}
+	for i, wantCode := range wantCodeList {
+		if reply := client.readReply(); !strings.HasPrefix(reply, wantCode+" ") {
+			client.t.Errorf("%s: got %q, want %s", lineList[i], reply, wantCode)
+		}
+	}
+}
+
+func TestSmtpPipelining(t *testing.T) { //一次写入的多条命令都要按顺序回复
+	testLoadConfig(t, "")
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMx})
+	client.command("EHLO client.test", "250")
+	client.pipeline([]string{"MAIL FROM:<someone@other.net>", "RCPT TO:<alice@example.com>", "DATA"}, []string{"250", "250", "354"})
+	client.command("Subject: one\r\n\r\nbody\r\n.", "250")
+	client.pipeline([]string{"MAIL FROM:<someone@other.net>", "RCPT TO:<nobody@example.com>", "RCPT TO:<alice@example.com>", "DATA"}, []string{"250", "550", "250", "354"})
+	client.pipeline([]string{"Subject: two", "", "body", ".", "NOOP", "QUIT"}, []string{"250", "250", "221"}) //正文结束之后跟着的命令也要处理
+	if mailInfoList, err := getMailAllInfo("alice@example.com"); err != nil || len(mailInfoList) != 2 {
+		t.Errorf("mailbox has %d mails, %v", len(mailInfoList), err)
+	}
+}
+
+func testTlsConfig(t *testing.T) *tls.Config { //测试用的自签名证书
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "mail.example.com"}, DNSNames: []string{"mail.example.com"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSmtpStartTlsInjection(t *testing.T) { //和STARTTLS一起发过来的明文命令不能在TLS之后执行
+	testLoadConfig(t, "")
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMx, enableStartTls: true, startTlsConfig: testTlsConfig(t)})
+	client.command("EHLO client.test", "250")
+	client.pipeline([]string{"STARTTLS", "RSET"}, []string{"220"})
+	if client.reader.Buffered() != 0 {
+		t.Fatalf("reply after 220 in plaintext")
+	}
+	tlsConn := tls.Client(client.conn, &tls.Config{InsecureSkipVerify: true})
+	tlsConn.SetDeadline(time.Now().Add(time.Second * 5))
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	client.conn = tlsConn
+	client.reader = bufio.NewReader(tlsConn)
+	client.conn.Write([]byte("EHLO client.test\r\n"))
+	client.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if line, err := client.reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "250-") { //第一条回复要是EHLO的多行回复, 不是RSET的
+		t.Fatalf("first reply after TLS = %q, %v", line, err)
+	}
+	client.readReply()
+	client.command("RSET", "250")
+	client.command("QUIT", "221")
+}
+
+func TestSmtpCheckTransition(t *testing.T) {
+	testList := []struct {
+		state   byte
+		command string
+		allowed bool
+	}{
+		{smtpStateGreeting, "ehlo", true},
+		{smtpStateGreeting, "mail", false},
+		{smtpStateGreeting, "auth", false},
+		{smtpStateEhlo, "auth", true},
+		{smtpStateEhlo, "mail", true},
+		{smtpStateEhlo, "rcpt", false},
+		{smtpStateAuth, "auth", false},
+		{smtpStateAuth, "starttls", false},
+		{smtpStateMail, "mail", false},
+		{smtpStateMail, "rcpt", true},
+		{smtpStateMail, "data", false},
+		{smtpStateMail, "starttls", false},
+		{smtpStateRcpt, "rcpt", true},
+		{smtpStateRcpt, "data", true},
+		{smtpStateRcpt, "auth", false},
+		{smtpStateRcpt, "rset", true},
+	}
+	for _, test := range testList {
+		reply := smtpCheckTransition(test.state, test.command)
+		if (reply == "") != test.allowed {
+			t.Errorf("state %d command %s: reply %q, want allowed=%v", test.state, test.command, reply, test.allowed)
+		}
+	}
+}
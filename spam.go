@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	spamTotalToken        = ""         //记录训练过的邮件数量的特殊token(正常的token不会是空的)
+	spamMaxScanBytes      = 512 * 1024 //每封邮件最多分析这么多正文
+	spamMaxMimeDepth      = 8
+	spamMinTokenLength    = 3
+	spamMaxTokenLength    = 40
+	spamUnknownWordProb   = 0.5  //没见过的token的概率
+	spamUnknownWordWeight = 0.45 //Robinson的s参数
+	spamMinProbDistance   = 0.1  //离0.5太近的token不参与计算
+	spamQueryBatchSize    = 500
+)
+
+type spamCountStruct struct {
+	spam int64
+	ham  int64
+}
+
+type spamTokenizerStruct struct {
+	tokens    map[string]bool
+	scanBytes int
+}
+
+func (tokenizer *spamTokenizerStruct) add(token string) {
+	tokenizer.tokens[token] = true
+}
+
+func (tokenizer *spamTokenizerStruct) addWord(prefix string, word string) { //处理一个词(太长的只记录长度)
+	length := utf8.RuneCountInString(word)
+	if length < spamMinTokenLength && !isHanWord(word) {
+		return
+	}
+	if length > spamMaxTokenLength {
+		tokenizer.add(prefix + "skip:" + string([]rune(word)[0]) + " " + strconv.Itoa(length/10*10))
+		return
+	}
+	tokenizer.add(prefix + word)
+}
+
+func isHanWord(word string) bool {
+	r, _ := utf8.DecodeRuneInString(word)
+	return unicode.Is(unicode.Han, r)
+}
+
+func (tokenizer *spamTokenizerStruct) addText(prefix string, text string) { //把一段文字拆成token, 汉字没有空格分隔, 按相邻两个字组成token
+	text = strings.ToLower(text)
+	var word []rune
+	var hanRun []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			tokenizer.addWord(prefix, strings.Trim(string(word), ".-'!$"))
+			word = word[:0]
+		}
+	}
+	flushHan := func() {
+		if len(hanRun) == 1 {
+			tokenizer.add(prefix + string(hanRun))
+		}
+		for i := 0; i+1 < len(hanRun); i++ {
+			tokenizer.add(prefix + string(hanRun[i:i+2]))
+		}
+		hanRun = hanRun[:0]
+	}
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flushWord()
+			hanRun = append(hanRun, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(".-'!$", r):
+			flushHan()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushHan()
+		}
+	}
+	flushWord()
+	flushHan()
+}
+
+func (tokenizer *spamTokenizerStruct) addBody(text string) { //正文, 网址额外记录域名
+	for _, field := range strings.Fields(text) {
+		lower := strings.ToLower(field)
+		for _, scheme := range []string{"http://", "https://"} {
+			if index := strings.Index(lower, scheme); index != -1 {
+				host := lower[index+len(scheme):]
+				if end := strings.IndexAny(host, "/?#\"'<>)"); end != -1 {
+					host = host[:end]
+				}
+				if host != "" {
+					tokenizer.add("url:" + host)
+				}
+			}
+		}
+	}
+	tokenizer.addText("", text)
+}
+
+func spamStripHtml(html string) string { //去掉html标签(粗略的, 只是用来分词)
+	var text strings.Builder
+	inTag := false
+	for i := 0; i < len(html); i++ {
+		switch {
+		case html[i] == '<':
+			inTag = true
+			text.WriteByte(' ')
+		case html[i] == '>':
+			inTag = false
+		case !inTag:
+			text.WriteByte(html[i])
+		default:
+			if strings.HasPrefix(html[i:], "href=") { //链接的地址也要留着
+				end := strings.IndexAny(html[i:], " >")
+				if end == -1 {
+					end = len(html) - i
+				}
+				text.WriteString(" " + strings.Trim(html[i+5:i+end], "\"'") + " ")
+				i += end - 1
+			}
+		}
+	}
+	return text.String()
+}
+
+func spamDecodeTransfer(reader io.Reader, encoding string) io.Reader { //解码Content-Transfer-Encoding
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &spamBase64Cleaner{reader: reader})
+	case "quoted-printable":
+		return quotedprintable.NewReader(reader)
+	}
+	return reader
+}
+
+type spamBase64Cleaner struct { //去掉base64中的换行和空白
+	reader io.Reader
+}
+
+func (cleaner *spamBase64Cleaner) Read(data []byte) (int, error) {
+	for {
+		n, err := cleaner.reader.Read(data)
+		j := 0
+		for i := 0; i < n; i++ {
+			c := data[i]
+			if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+				continue
+			}
+			data[j] = c
+			j++
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+func (tokenizer *spamTokenizerStruct) addPart(contentType string, encoding string, disposition string, body io.Reader, depth int) { //处理一个MIME部分
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	tokenizer.add("content-type:" + mediaType)
+	if _, dispositionParams, err := mime.ParseMediaType(disposition); err == nil && dispositionParams["filename"] != "" {
+		tokenizer.addText("filename:", dispositionParams["filename"])
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= spamMaxMimeDepth || params["boundary"] == "" {
+			return
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				return
+			}
+			tokenizer.addPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Disposition"), part, depth+1)
+		}
+	}
+	if mediaType == "message/rfc822" && depth < spamMaxMimeDepth {
+		message, err := mail.ReadMessage(bufio.NewReader(spamDecodeTransfer(body, encoding)))
+		if err == nil {
+			tokenizer.addHeader(message.Header)
+			tokenizer.addPart(message.Header.Get("Content-Type"), message.Header.Get("Content-Transfer-Encoding"), message.Header.Get("Content-Disposition"), message.Body, depth+1)
+		}
+		return
+	}
+	if !strings.HasPrefix(mediaType, "text/") || tokenizer.scanBytes >= spamMaxScanBytes {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(spamDecodeTransfer(body, encoding), int64(spamMaxScanBytes-tokenizer.scanBytes)))
+	if len(data) == 0 && err != nil {
+		return
+	}
+	tokenizer.scanBytes += len(data)
+	text := string(data)
+	if mediaType == "text/html" {
+		text = spamStripHtml(text)
+	}
+	tokenizer.addBody(text)
+}
+
+func (tokenizer *spamTokenizerStruct) addHeader(header mail.Header) { //一部分头部的内容带上前缀分词
+	decoder := mime.WordDecoder{}
+	for _, name := range []string{"Subject", "From", "Reply-To", "To"} {
+		value := header.Get(name)
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		if value != "" {
+			tokenizer.addText(strings.ToLower(name)+":", value)
+		}
+	}
+	if addressList, err := header.AddressList("From"); err == nil {
+		for _, address := range addressList {
+			tokenizer.add("from-domain:" + getAddressDomain(address.Address))
+		}
+	}
+	if value := header.Get("X-Mailer"); value != "" {
+		tokenizer.add("x-mailer:" + strings.ToLower(value))
+	}
+}
+
+func spamTokenizeFile(filePath string) ([]string, error) { //把一封邮件拆成token(不重复)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	message, err := mail.ReadMessage(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	tokenizer := &spamTokenizerStruct{tokens: make(map[string]bool)}
+	tokenizer.addHeader(message.Header)
+	tokenizer.addPart(message.Header.Get("Content-Type"), message.Header.Get("Content-Transfer-Encoding"), message.Header.Get("Content-Disposition"), message.Body, 0)
+	tokenList := make([]string, 0, len(tokenizer.tokens))
+	for token := range tokenizer.tokens {
+		tokenList = append(tokenList, token)
+	}
+	return tokenList, nil
+}
+
+func spamOwner(address string) string { //每个邮箱的分类器用邮箱地址区分, 空为全局
+	return strings.ToLower(addressToAscii(address))
+}
+
+func spamLoadCounts(owner string, tokenList []string) (map[string]spamCountStruct, error) { //从数据库读取token的计数
+	countMap := make(map[string]spamCountStruct)
+	tokenList = append([]string{spamTotalToken}, tokenList...)
+	for start := 0; start < len(tokenList); start += spamQueryBatchSize {
+		end := start + spamQueryBatchSize
+		if end > len(tokenList) {
+			end = len(tokenList)
+		}
+		args := []interface{}{owner}
+		for _, token := range tokenList[start:end] {
+			args = append(args, token)
+		}
+		row, err := authDatabase.Query("SELECT token, spam_count, ham_count FROM "+config.Auth.Sqlite.SpamTokenTableName+" WHERE owner=? AND token IN (?"+strings.Repeat(", ?", end-start-1)+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		for row.Next() {
+			var token string
+			var count spamCountStruct
+			if err = row.Scan(&token, &count.spam, &count.ham); err != nil {
+				row.Close()
+				return nil, err
+			}
+			countMap[token] = count
+		}
+		row.Close()
+	}
+	return countMap, nil
+}
+
+func spamTrain(owner string, tokenList []string, isSpam bool) error { //用一封邮件训练分类器
+	column := "ham_count"
+	spamCount, hamCount := 0, 1
+	if isSpam {
+		column = "spam_count"
+		spamCount, hamCount = 1, 0
+	}
+	tx, err := authDatabase.Begin()
+	if err != nil {
+		return err
+	}
+	for _, token := range append([]string{spamTotalToken}, tokenList...) {
+		result, err := tx.Exec("UPDATE "+config.Auth.Sqlite.SpamTokenTableName+" SET "+column+"="+column+"+1 WHERE owner=? AND token=?", owner, token)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			_, err = tx.Exec("INSERT INTO "+config.Auth.Sqlite.SpamTokenTableName+"(owner, token, spam_count, ham_count) VALUES(?, ?, ?, ?)", owner, token, spamCount, hamCount)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func spamChi2Q(x2 float64, freedom int) float64 { //卡方分布的上尾概率(自由度为偶数)
+	m := x2 / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < freedom/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	return math.Min(sum, 1)
+}
+
+func spamClassify(owner string, tokenList []string) (float64, bool, error) { //计算垃圾邮件的概率(Robinson-Fisher), 训练得不够时返回false
+	countMap, err := spamLoadCounts(owner, tokenList)
+	if err != nil {
+		return 0, false, err
+	}
+	total := countMap[spamTotalToken]
+	if total.spam < int64(config.Spam.MinTrained) || total.ham < int64(config.Spam.MinTrained) || total.spam == 0 || total.ham == 0 {
+		return 0, false, nil
+	}
+	var probList []float64
+	for _, token := range tokenList {
+		count, ok := countMap[token]
+		if !ok || token == spamTotalToken {
+			continue
+		}
+		spamRatio := float64(count.spam) / float64(total.spam)
+		hamRatio := float64(count.ham) / float64(total.ham)
+		if spamRatio+hamRatio == 0 {
+			continue
+		}
+		n := float64(count.spam + count.ham)
+		prob := (spamUnknownWordWeight*spamUnknownWordProb + n*spamRatio/(spamRatio+hamRatio)) / (spamUnknownWordWeight + n)
+		if math.Abs(prob-0.5) < spamMinProbDistance {
+			continue
+		}
+		probList = append(probList, math.Min(math.Max(prob, 0.001), 0.999))
+	}
+	if len(probList) == 0 {
+		return 0.5, true, nil
+	}
+	sort.Slice(probList, func(i, j int) bool { return math.Abs(probList[i]-0.5) > math.Abs(probList[j]-0.5) }) //只用最有区分度的token
+	if len(probList) > config.Spam.MaxTokens {
+		probList = probList[:config.Spam.MaxTokens]
+	}
+	var hamSum, spamSum float64
+	for _, prob := range probList {
+		hamSum += math.Log(prob)
+		spamSum += math.Log(1 - prob)
+	}
+	hamScore := 1 - spamChi2Q(-2*hamSum, 2*len(probList))
+	spamScore := 1 - spamChi2Q(-2*spamSum, 2*len(probList))
+	return (spamScore - hamScore + 1) / 2, true, nil
+}
+
+func spamCheck(filePath string, address string, tokenList []string) string { //给投递给一个邮箱的邮件打分并加上头部, 返回要放进的文件夹(空为收件箱)
+	if !config.Spam.Enable {
+		return ""
+	}
+	score, ok, err := 0.0, false, error(nil)
+	if config.Spam.PerUser { //自己训练得足够的话用自己的分类器, 不然用全局的
+		score, ok, err = spamClassify(spamOwner(address), tokenList)
+	}
+	if err == nil && !ok {
+		score, ok, err = spamClassify("", tokenList)
+	}
+	if err != nil {
+		log.Println("Error: spam classify error: " + err.Error())
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+	isSpam := score >= config.Spam.SpamThreshold
+	status := "No"
+	if isSpam {
+		status = "Yes"
+	}
+	scoreString := strconv.FormatFloat(score, 'f', 3, 64)
+	err = rewriteMailHeader(filePath, func(headerList []string) []string {
+		newHeaderList := []string{"X-Spam-Score: " + scoreString + "\r\n", "X-Spam-Status: " + status + ", score=" + scoreString + " threshold=" + strconv.FormatFloat(config.Spam.SpamThreshold, 'f', 3, 64) + "\r\n"}
+		for _, header := range headerList { //去掉外面带进来的同名头部
+			if name := getHeaderName(header); name != "x-spam-score" && name != "x-spam-status" {
+				newHeaderList = append(newHeaderList, header)
+			}
+		}
+		return newHeaderList
+	})
+	if err != nil {
+		log.Println("Error: add spam header error: " + err.Error())
+	}
+	if config.Spam.FolderThreshold > 0 && score >= config.Spam.FolderThreshold {
+		log.Println("Info: mail to " + address + " moved to " + config.Spam.SpamFolder + " score=" + scoreString)
+		return config.Spam.SpamFolder
+	}
+	return ""
+}
+
+func spamTrainCommand(kind string, target string) (int, error) { //spam train命令, target为邮件文件/文件夹(训练全局分类器)或者邮箱地址[/文件夹](训练这个邮箱的分类器)
+	if kind != "ham" && kind != "spam" {
+		return 0, errors.New("type must be ham or spam")
+	}
+	owner := ""
+	var fileList []string
+	if info, err := os.Stat(target); err == nil {
+		if info.IsDir() {
+			entryList, err := os.ReadDir(target)
+			if err != nil {
+				return 0, err
+			}
+			for _, entry := range entryList {
+				if !entry.IsDir() {
+					fileList = append(fileList, filepath.Join(target, entry.Name()))
+				}
+			}
+		} else {
+			fileList = append(fileList, target)
+		}
+	} else if strings.Contains(target, "@") {
+		address, folder, _ := strings.Cut(target, "/")
+		if !smtpCheckAddressExists(address) {
+			return 0, errors.New("mail address does not exists")
+		}
+		owner = spamOwner(address)
+		folderPath := getMailSubFolder(address, folder)
+		entryList, err := os.ReadDir(folderPath)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entryList {
+			if !entry.IsDir() {
+				fileList = append(fileList, filepath.Join(folderPath, entry.Name()))
+			}
+		}
+	} else {
+		return 0, errors.New("file or mail address does not exists")
+	}
+	trained := 0
+	for _, filePath := range fileList {
+		tokenList, err := spamTokenizeFile(filePath)
+		if err != nil {
+			log.Println("Warning: skip " + filePath + ": " + err.Error())
+			continue
+		}
+		if err = spamTrain(owner, tokenList, kind == "spam"); err != nil {
+			return trained, err
+		}
+		trained++
+	}
+	return trained, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testSpamConfig = `
+[spam]
+enable = true
+per_user = false
+min_trained = 3
+max_tokens = 150
+spam_threshold = 0.9
+folder_threshold = 0
+spam_folder = "Spam"
+`
+
+func testSpamTrain(t *testing.T, kind string, body string) { //用几封一样内容的邮件训练全局分类器
+	t.Helper()
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(filepath.Join(dir, strconv.Itoa(i)), []byte("Subject: "+body+"\r\n\r\n"+body+"\r\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := spamTrainCommand(kind, dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testSpamDeliver(t *testing.T, content string) string { //从外部投递一封邮件给alice, 返回存下来的内容
+	t.Helper()
+	client := newTestSmtpClient(t, listenerOptionStruct{smtpMode: smtpModeMx})
+	client.command("EHLO client.test", "250")
+	client.command("MAIL FROM:<someone@other.net>", "250")
+	client.command("RCPT TO:<alice@example.com>", "250")
+	client.command("DATA", "354")
+	client.command(content+"\r\n.", "250")
+	client.command("QUIT", "221")
+	mailInfoList, err := getMailAllInfo("alice@example.com")
+	if err != nil || len(mailInfoList) == 0 {
+		t.Fatalf("mailbox has %d mails, %v", len(mailInfoList), err)
+	}
+	data, err := os.ReadFile(mailInfoList[len(mailInfoList)-1].filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(mailInfoList[len(mailInfoList)-1].filePath)
+	return string(data)
+}
+
+func TestSpamHeaderNotForgeable(t *testing.T) { //客户端自己带的X-Spam-*头部要被去掉, 分类器还没训练好的时候也一样
+	testLoadConfig(t, testSpamConfig)
+	testAddUser(t, "alice", "alice@example.com", "pw")
+	forged := "X-Spam-Status: No, score=0.000\r\n threshold=0.900\r\nx-spam-score: 0.000\r\nX-Spam-Flag: NO\r\nX-Other: kept\r\n"
+
+	mail := testSpamDeliver(t, forged+"Subject: cheap pills\r\n\r\ncheap pills\r\n") //没训练的时候不打分
+	if strings.Contains(strings.ToLower(mail), "x-spam-") || strings.Contains(mail, "threshold") {
+		t.Errorf("forged spam headers kept without a classifier:\n%s", mail)
+	}
+	if !strings.Contains(mail, "X-Other: kept\r\n") || !strings.Contains(mail, "\r\n\r\ncheap pills\r\n") {
+		t.Errorf("mail content wrong:\n%s", mail)
+	}
+
+	testSpamTrain(t, "spam", "cheap pills viagra casino")
+	testSpamTrain(t, "ham", "meeting agenda project report")
+	mail = testSpamDeliver(t, forged+"Subject: cheap pills\r\n\r\ncheap pills viagra casino\r\n")
+	if strings.Count(strings.ToLower(mail), "x-spam-status:") != 1 || !strings.Contains(mail, "X-Spam-Status: Yes, score=") {
+		t.Errorf("spam headers wrong:\n%s", mail)
+	}
+	if strings.Count(strings.ToLower(mail), "x-spam-score:") != 1 || strings.Contains(mail, "X-Spam-Flag") {
+		t.Errorf("forged spam headers kept:\n%s", mail)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"io"
 	"io/fs"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
@@ -23,8 +26,117 @@ type mailInfo struct {
 	filePath  string
 }
 
+func getMailFolderName(address string) string { //把邮箱地址转换成安全的文件夹名(域名转A-label, 本地部分的特殊字符和非ASCII字节用%XX转义)
+	address = addressToAscii(address)
+	index := strings.LastIndex(address, "@")
+	localPart := address
+	domain := ""
+	if index != -1 {
+		localPart = address[:index]
+		domain = address[index:]
+	}
+	var folderName strings.Builder
+	for i := 0; i < len(localPart); i++ {
+		c := localPart[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("!#$&'*+-=?^_`{|}~", c) != -1 || (c == '.' && i != 0) {
+			folderName.WriteByte(c)
+		} else {
+			folderName.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	folderName.WriteString(strings.ReplaceAll(domain, "/", "%2F"))
+	return folderName.String()
+}
+
+const mailFolderMigratedFile = ".migrated" //邮件存储目录里的标记文件, 存在说明文件夹都已经是现在的名字(没有的话会把所有文件夹当成旧版本的名字)
+
+func migrateMailFolders() { //把旧版本直接用地址命名的文件夹(大小写不同/U-label域名/特殊字符)改成现在的名字, 名字冲突时合并, 只做一次
+	markPath := path.Join(config.General.MailStoragePath, mailFolderMigratedFile)
+	if _, err := os.Stat(markPath); err == nil {
+		return
+	}
+	defer func() { //出错的文件夹也不再重试, 不然已经改好的名字会被再转义一次
+		if err := os.WriteFile(markPath, nil, 0644); err != nil {
+			log.Println("Error: write mail folder migration mark error: " + err.Error())
+		}
+	}()
+	entryList, err := os.ReadDir(config.General.MailStoragePath)
+	if err != nil {
+		log.Println("Error: read mail storage error: " + err.Error())
+		return
+	}
+	for _, entry := range entryList {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if getMailFolderName(name) == name { //旧名字和现在的名字一样(按原来的地址比较, 不看里面有没有%XX)
+			continue
+		}
+		oldPath := path.Join(config.General.MailStoragePath, name)
+		newPath := path.Join(config.General.MailStoragePath, getMailFolderName(name))
+		if _, err = os.Stat(newPath); os.IsNotExist(err) {
+			err = os.Rename(oldPath, newPath)
+		} else {
+			err = mergeMailFolder(oldPath, newPath)
+		}
+		if err != nil {
+			log.Println("Error: migrate mail folder " + name + " error: " + err.Error())
+			continue
+		}
+		log.Println("Info: migrated mail folder " + name + " to " + getMailFolderName(name))
+	}
+}
+
+func mergeMailFolder(oldPath string, newPath string) error { //把旧文件夹里的邮件移到新文件夹(文件名带随机部分, 不会重名), 然后删除旧文件夹
+	entryList, err := os.ReadDir(oldPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entryList {
+		oldEntryPath := path.Join(oldPath, entry.Name())
+		newEntryPath := path.Join(newPath, entry.Name())
+		if _, err = os.Stat(newEntryPath); err == nil {
+			if !entry.IsDir() {
+				return errors.New("error: " + newEntryPath + " already exists")
+			}
+			err = mergeMailFolder(oldEntryPath, newEntryPath)
+		} else {
+			err = os.Rename(oldEntryPath, newEntryPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(oldPath)
+}
+
 func getMailFolder(address string) string { //获取一个邮箱地址对应的文件夹
-	storagePath := path.Join(config.General.MailStoragePath, address)
+	storagePath := path.Join(config.General.MailStoragePath, getMailFolderName(address))
+	if _, err := os.Stat(storagePath); os.IsNotExist(err) {
+		os.MkdirAll(storagePath, 0644)
+	}
+	return storagePath
+}
+
+func getMailSubFolderName(folder string) string { //把文件夹名转换成安全的子文件夹名
+	var folderName strings.Builder
+	for i := 0; i < len(folder); i++ {
+		c := folder[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("!#$&'+-=^_`{}~ ", c) != -1 || (c == '.' && i != 0) {
+			folderName.WriteByte(c)
+		} else {
+			folderName.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return folderName.String()
+}
+
+func getMailSubFolder(address string, folder string) string { //获取一个邮箱地址下的子文件夹(比如垃圾邮件), 空为收件箱
+	if folder == "" || strings.EqualFold(folder, "INBOX") {
+		return getMailFolder(address)
+	}
+	storagePath := path.Join(getMailFolder(address), getMailSubFolderName(folder))
 	if _, err := os.Stat(storagePath); os.IsNotExist(err) {
 		os.MkdirAll(storagePath, 0644)
 	}
@@ -32,7 +144,11 @@ func getMailFolder(address string) string { //获取一个邮箱地址对应的
 }
 
 func getMailStoragePath(address string) string { //获取一个邮件应该储存的位置
-	storagePath := getMailFolder(address)
+	return getMailStoragePathInFolder(address, "")
+}
+
+func getMailStoragePathInFolder(address string, folder string) string { //获取一个邮件储存在某个文件夹中的位置
+	storagePath := getMailSubFolder(address, folder)
 	randByte := make([]byte, 16)
 	rand.Read(randByte)
 	idHash := sha1.Sum(append([]byte(strconv.FormatInt(time.Now().UnixNano(), 10)+"-hash-salt-"+storagePath), randByte...))
@@ -42,11 +158,15 @@ func getMailStoragePath(address string) string { //获取一个邮件应该储
 
 func getMailAllInfo(address string) ([]mailInfo, error) { //获取全部邮件信息
 	var mailInfoList []mailInfo
-	err := filepath.Walk(getMailFolder(address), func(path string, info fs.FileInfo, err error) error {
+	root := getMailFolder(address)
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if info.IsDir() {
+			if path != root { //子文件夹(比如垃圾邮件)不算在收件箱里
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		var newErr error
@@ -76,6 +196,20 @@ func getMailAllInfo(address string) ([]mailInfo, error) { //获取全部邮件
 	return mailInfoList, nil
 }
 
+func getMailUsage(address string) (int64, error) { //获取一个邮箱占用的总大小(包括子文件夹)
+	var usage int64
+	err := filepath.Walk(getMailFolder(address), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			usage += info.Size()
+		}
+		return nil
+	})
+	return usage, err
+}
+
 func getMailAllInfoList(addressList []string) ([]mailInfo, error) { //获取一个邮件地址列表的邮件信息
 	var mailInfoList []mailInfo
 	for _, address := range addressList {
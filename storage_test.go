@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMigrateMailFolders(t *testing.T) {
+	testLoadConfig(t, "")
+	writeMail := func(folder string, name string) {
+		t.Helper()
+		if err := os.MkdirAll(path.Join(config.General.MailStoragePath, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(config.General.MailStoragePath, folder, name), []byte("Subject: "+name+"\r\n\r\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(path.Join(config.General.MailStoragePath, mailFolderMigratedFile)) //testLoadConfig已经在空目录上迁移过了, 模拟旧版本的存储目录
+	writeMail("alice@EXAMPLE.com", "1-old")                                      //旧版本按原样的地址命名
+	writeMail("bob@münchen.de", "1-old")                                         //U-label域名
+	writeMail("bob@xn--mnchen-3ya.de", "2-new")                                  //新名字已经存在, 要合并
+	writeMail("carol smith@example.com", "1-old")                                //本地部分有特殊字符
+	writeMail("dave@example.com", "1-current")                                   //已经是现在的名字
+	writeMail("eve%20x@example.com", "1-old")                                    //本地部分里本来就有%XX, 也要迁移
+	writeMail("fay%25y@example.com", "1-old")
+	migrateMailFolders()
+	for _, expected := range []string{"alice@example.com/1-old", "bob@xn--mnchen-3ya.de/1-old", "bob@xn--mnchen-3ya.de/2-new", "carol%20smith@example.com/1-old", "dave@example.com/1-current", "eve%2520x@example.com/1-old", "fay%2525y@example.com/1-old"} {
+		if _, err := os.Stat(path.Join(config.General.MailStoragePath, expected)); err != nil {
+			t.Errorf("%s: %v", expected, err)
+		}
+	}
+	for _, removed := range []string{"alice@EXAMPLE.com", "bob@münchen.de", "carol smith@example.com", "eve%20x@example.com", "fay%25y@example.com"} {
+		if _, err := os.Stat(path.Join(config.General.MailStoragePath, removed)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", removed, err)
+		}
+	}
+	if mailInfoList, err := getMailAllInfo("eve%20x@example.com"); err != nil || len(mailInfoList) != 1 {
+		t.Errorf("getMailAllInfo(eve%%20x) = %d mails, %v, want 1", len(mailInfoList), err)
+	}
+	migrateMailFolders() //迁移只做一次, 现在的名字不能再转义
+	for _, expected := range []string{"carol%20smith@example.com/1-old", "eve%2520x@example.com/1-old"} {
+		if _, err := os.Stat(path.Join(config.General.MailStoragePath, expected)); err != nil {
+			t.Errorf("after second run %s: %v", expected, err)
+		}
+	}
+	if mailInfoList, err := getMailAllInfo("bob@MÜNCHEN.de"); err != nil || len(mailInfoList) != 2 {
+		t.Errorf("getMailAllInfo = %d mails, %v, want 2", len(mailInfoList), err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/mail"
+	"os"
+	"strconv"
+	"time"
+)
+
+func generateMessageId() string { //生成一个Message-ID
+	randBytes := make([]byte, 8)
+	rand.Read(randBytes)
+	return "<" + strconv.FormatInt(time.Now().UnixNano(), 36) + "." + hex.EncodeToString(randBytes) + "@" + config.General.ServerAddress + ">"
+}
+
+func smtpCheckFromHeader(headerList []string, username string) bool { //检查From头部的地址是否都属于这个账号
+	for _, header := range headerList {
+		if getHeaderName(header) != "from" {
+			continue
+		}
+		addressList, err := mail.ParseAddressList(getHeaderValue(header))
+		if err != nil || len(addressList) == 0 {
+			return false
+		}
+		for _, address := range addressList {
+			if !smtpAddressClientAuth(username, address.Address) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func smtpSubmissionProcess(filePath string, username string, fromMail string) (string, string, error) { //处理已鉴权用户提交的邮件(RFC 6409 8), 返回要拒绝时回复的内容和发件人副本的缓存文件(没有就为空)
+	var rejectReply string
+	err := rewriteMailHeader(filePath, func(headerList []string) []string { //补上缺少的From/Date/Message-ID
+		if !smtpCheckFromHeader(headerList, username) {
+			rejectReply = "550 5.7.1 From header must belong to authorized user\r\n"
+			return headerList
+		}
+		if findHeader(headerList, "from") == -1 {
+			headerList = append([]string{"From: <" + fromMail + ">\r\n"}, headerList...)
+		}
+		if findHeader(headerList, "message-id") == -1 {
+			headerList = append([]string{"Message-ID: " + generateMessageId() + "\r\n"}, headerList...)
+		}
+		if findHeader(headerList, "date") == -1 {
+			headerList = append([]string{"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n"}, headerList...)
+		}
+		return headerList
+	})
+	if err != nil || rejectReply != "" {
+		return rejectReply, "", err
+	}
+	var sentCopyCachePath string
+	if config.Smtp.Submission.SaveSentCopy { //给发件人自己准备一份(保留Bcc), 邮件被接受之后才存进去
+		sentCopyCachePath = generateCacheFilePath()
+		_, err = copyFile(filePath, sentCopyCachePath)
+		if err != nil {
+			os.Remove(sentCopyCachePath)
+			return "", "", err
+		}
+	}
+	err = rewriteMailHeader(filePath, func(headerList []string) []string { //转发前去掉Bcc
+		var keepedHeaderList []string
+		for _, header := range headerList {
+			if getHeaderName(header) != "bcc" {
+				keepedHeaderList = append(keepedHeaderList, header)
+			}
+		}
+		return keepedHeaderList
+	})
+	if err != nil && sentCopyCachePath != "" {
+		os.Remove(sentCopyCachePath)
+		sentCopyCachePath = ""
+	}
+	return "", sentCopyCachePath, err
+}
+
+func smtpSaveSentCopy(sentCopyCachePath string, fromMail string) { //把发件人副本存进发件人邮箱的已发送文件夹
+	if sentCopyCachePath == "" {
+		return
+	}
+	if err := os.Rename(sentCopyCachePath, getMailStoragePathInFolder(fromMail, config.Smtp.Submission.SentFolder)); err != nil {
+		log.Println("Error: smtp save sent copy error: " + err.Error())
+		os.Remove(sentCopyCachePath)
+	}
+}